@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// allowRule lets the clients in a subnet, or meeting another clientCond,
+// transfer the files matching a pattern, optionally only downloading or
+// uploading them, and only in a time window
+type allowRule struct {
+	client  clientCond
+	pattern string
+	op      tftp.OpCode // 0 for both
+	window  *timeWindow // nil for any time
+}
+
+// matches reports whether the rule lets clientAddr transfer filename now.
+// Patterns are path.Match globs, matched against the last element of the
+// name if they have no /, like the patterns of a tftp.ServeMux. Where the
+// file system ignores case, so do the patterns.
+func (r allowRule) matches(ip net.IP, filename string, op tftp.OpCode) bool {
+	if r.op != 0 && r.op != op || r.window != nil && !r.window.contains(time.Now()) || !r.client.matches(ip) {
+		return false
+	}
+
+	name := tftp.FSPath(filename)
+	if !strings.Contains(r.pattern, "/") {
+		name = path.Base(name)
+	}
+
+	ok, _ := path.Match(fileKey(r.pattern), fileKey(name))
+
+	return ok
+}
+
+// parseAllowRule parses a rule given as client=pattern, the client a
+// subnet or another clientCond, followed by get or put, days and hours,
+// each of them optional, e.g. country:NL=*.efi or
+// '10.9.0.0/16=backups/* put mon-sat 01:00-03:00'
+func parseAllowRule(def string, geo *geoIP) (allowRule, error) {
+	fields := strings.Fields(def)
+	if len(fields) == 0 {
+		return allowRule{}, fmt.Errorf("%q is not subnet=pattern", def)
+	}
+
+	cond, pattern, ok := strings.Cut(fields[0], "=")
+	if !ok || pattern == "" {
+		return allowRule{}, fmt.Errorf("%q is not subnet=pattern", def)
+	}
+
+	client, err := parseClientCond(cond, geo)
+	if err != nil {
+		return allowRule{}, err
+	}
+
+	if _, err = path.Match(pattern, ""); err != nil {
+		return allowRule{}, fmt.Errorf("%q: %w", pattern, err)
+	}
+
+	var (
+		r           = allowRule{client: client, pattern: pattern}
+		days, hours string
+	)
+
+	for _, field := range fields[1:] {
+		isOp := field == "get" || field == "put"
+
+		switch {
+		case isOp && r.op == 0 && days == "" && hours == "":
+			r.op = tftp.OpRRQ
+			if field == "put" {
+				r.op = tftp.OpWRQ
+			}
+		case !isOp && strings.Contains(field, ":") && hours == "":
+			hours = field
+		case !isOp && days == "" && hours == "":
+			days = field
+		default:
+			return allowRule{}, fmt.Errorf("%q: unexpected %q, rules are subnet=pattern [get|put] [days] [HH:MM-HH:MM]", def, field)
+		}
+	}
+
+	if days == "" && hours == "" {
+		return r, nil
+	}
+
+	r.window = &timeWindow{days: 0x7f}
+
+	if days != "" {
+		r.window.days = 0
+		err = r.window.parseDays(days)
+	}
+
+	if err == nil && hours != "" {
+		err = r.window.parseHours(hours)
+	}
+
+	if err != nil {
+		return allowRule{}, err
+	}
+
+	return r, nil
+}
+
+// authorizeFor returns the server's Authorize hook dropping the requests
+// of clients meeting a -drop condition without an answer, and refusing
+// transfers no -allow rule, given as subnet=pattern, lets through if there
+// are any, or nil if there are no rules at all
+func authorizeFor(defs, dropDefs []string, geo *geoIP) (func(string, string, tftp.OpCode) error, error) {
+	if len(defs) == 0 && len(dropDefs) == 0 {
+		return nil, nil
+	}
+
+	var (
+		rules []allowRule
+		drops []clientCond
+	)
+
+	for _, def := range defs {
+		r, err := parseAllowRule(def, geo)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %w", err)
+		}
+
+		rules = append(rules, r)
+	}
+
+	for _, def := range dropDefs {
+		c, err := parseClientCond(def, geo)
+		if err != nil {
+			return nil, fmt.Errorf("drop: %w", err)
+		}
+
+		drops = append(drops, c)
+	}
+
+	return func(clientAddr, filename string, op tftp.OpCode) error {
+		ip := net.ParseIP(clientIP(clientAddr))
+		for _, c := range drops {
+			if c.matches(ip) {
+				return fmt.Errorf("%w by -drop %s, client at %s", tftp.ErrDropped, c.def, geo.tags(ip))
+			}
+		}
+
+		if len(rules) == 0 {
+			return nil
+		}
+
+		for _, r := range rules {
+			if r.matches(ip, filename, op) {
+				return nil
+			}
+		}
+
+		return errors.New("access denied")
+	}, nil
+}
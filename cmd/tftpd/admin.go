@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// adminAPI serves a JSON API over HTTP to operate a running server without
+// a shell on its host:
+//
+//	GET    /sessions                transfers in progress
+//	DELETE /sessions/{id}           cancel a transfer, sending its client an ERROR
+//	GET    /counters                transfers completed, failed and reaped, bytes sent
+//	GET    /maintenance             whether maintenance mode is on
+//	PUT    /maintenance             turn it on or off with {"enabled": true}
+//	GET    /versions/{name}         versions kept of a file, with -keep-versions
+//	DELETE /versions/{name}?keep=N  remove all but its last N versions
+//	GET    /campaigns               rollout progress of every -campaign file
+//	GET    /campaigns/{name}        clients updated and outdated, devices pending
+//	GET    /ready                   200 while serving, 503 while a -standby
+//
+// In maintenance mode new requests are refused with an ERROR packet while
+// the transfers in progress carry on. Maintenance mode and campaign records
+// are kept in the server's state, shared by the servers sharing a Redis
+// -state, whichever of them is asked. With a token set, requests must carry
+// it as a bearer token in their Authorization header. Without one the API
+// only listens on loopback addresses, as anyone reaching it could stop the
+// server from serving.
+type adminAPI struct {
+	s         *tftp.Server
+	state     *sharedState // holds maintenance mode
+	stats     *transferStats
+	versions  *versionStore
+	campaigns *campaignTracker
+	lease     *leaderLease // nil unless -standby
+	token     string
+}
+
+type adminSession struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Filename string    `json:"filename"`
+	Mode     string    `json:"mode"`
+	Upload   bool      `json:"upload"`
+	Blocks   uint64    `json:"blocks"`
+	Bytes    int64     `json:"bytes"`
+	Start    time.Time `json:"start"`
+}
+
+type adminCounters struct {
+	transferCounts
+	Active int `json:"active"`
+}
+
+type adminMaintenance struct {
+	Enabled bool `json:"enabled"`
+}
+
+// errAdminExposed refuses an API without a token on a non-loopback address
+var errAdminExposed = errors.New("listening on a non-loopback address needs -admin-token")
+
+// listen starts serving the API on addr in the background
+func (a *adminAPI) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if tcp, ok := ln.Addr().(*net.TCPAddr); a.token == "" && (!ok || !tcp.IP.IsLoopback()) {
+		_ = ln.Close()
+		return errAdminExposed
+	}
+
+	log.Printf("Admin API listening on http://%s ...\n", ln.Addr())
+
+	srv := &http.Server{Handler: a.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		log.Printf("admin: %v", srv.Serve(ln))
+	}()
+
+	return nil
+}
+
+// handler routes the API's requests, once authenticated
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", a.sessions)
+	mux.HandleFunc("/sessions/", a.session)
+	mux.HandleFunc("/counters", a.counters)
+	mux.HandleFunc("/maintenance", a.maintenanceMode)
+	mux.HandleFunc("/versions/", a.fileVersions)
+	mux.HandleFunc("/campaigns", a.campaignSummaries)
+	mux.HandleFunc("/campaigns/", a.campaignProgress)
+	mux.HandleFunc("/ready", a.ready)
+
+	return a.authenticate(mux)
+}
+
+func (a *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+				adminError(w, http.StatusUnauthorized, "missing or wrong token")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminAPI) sessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	sessions := []adminSession{}
+	for _, sess := range a.s.Sessions() {
+		sessions = append(sessions, adminSession(sess))
+	}
+
+	adminJSON(w, http.StatusOK, sessions)
+}
+
+func (a *adminAPI) session(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, "use DELETE")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid session ID")
+		return
+	}
+
+	if !a.s.Cancel(id) {
+		adminError(w, http.StatusNotFound, "no such session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) counters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	adminJSON(w, http.StatusOK, adminCounters{
+		transferCounts: a.stats.counts(),
+		Active:         len(a.s.Sessions()),
+	})
+}
+
+func (a *adminAPI) maintenanceMode(w http.ResponseWriter, r *http.Request) {
+	on, err := a.state.maintenance(r.Context())
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var m adminMaintenance
+		if err = json.NewDecoder(r.Body).Decode(&m); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+
+		if err = a.state.setMaintenance(r.Context(), m.Enabled); err != nil {
+			adminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if on != m.Enabled {
+			log.Printf("admin: maintenance mode set to %t by %s", m.Enabled, r.RemoteAddr)
+		}
+
+		on = m.Enabled
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		return
+	}
+
+	adminJSON(w, http.StatusOK, adminMaintenance{Enabled: on})
+}
+
+func (a *adminAPI) fileVersions(w http.ResponseWriter, r *http.Request) {
+	if a.versions == nil {
+		adminError(w, http.StatusNotFound, "versions aren't kept, see -keep-versions")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/versions/")
+	if name == "" || !fs.ValidPath(name) || !tftp.LocalName(name) {
+		adminError(w, http.StatusBadRequest, "invalid file name")
+		return
+	}
+
+	var (
+		versions []fileVersion
+		err      error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		versions, err = a.versions.list(name)
+	case http.MethodDelete:
+		keep, convErr := strconv.Atoi(r.URL.Query().Get("keep"))
+		if convErr != nil || keep < 1 {
+			adminError(w, http.StatusBadRequest, "keep must be 1 or more")
+			return
+		}
+
+		if versions, err = a.versions.prune(name, keep); err == nil {
+			log.Printf("admin: versions of %s pruned to %d by %s", name, len(versions), r.RemoteAddr)
+		}
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "use GET or DELETE")
+		return
+	}
+
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if len(versions) == 0 {
+		adminError(w, http.StatusNotFound, "no versions of "+name)
+		return
+	}
+
+	adminJSON(w, http.StatusOK, versions)
+}
+
+func (a *adminAPI) campaignSummaries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	if a.campaigns == nil {
+		adminJSON(w, http.StatusOK, []campaignSummary{})
+		return
+	}
+
+	summaries, err := a.campaigns.summaries(r.Context())
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusOK, summaries)
+}
+
+func (a *adminAPI) campaignProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/campaigns/")
+	if a.campaigns == nil || !a.campaigns.tracks(name) {
+		adminError(w, http.StatusNotFound, "no campaign of "+name)
+		return
+	}
+
+	p, err := a.campaigns.progress(r.Context(), name)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	adminJSON(w, http.StatusOK, p)
+}
+
+// adminReady is the body of GET /ready
+type adminReady struct {
+	Ready    bool   `json:"ready"`
+	Instance string `json:"instance,omitempty"`
+}
+
+func (a *adminAPI) ready(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	if a.lease == nil {
+		adminJSON(w, http.StatusOK, adminReady{Ready: true})
+		return
+	}
+
+	status := http.StatusOK
+	if !a.lease.leader() {
+		status = http.StatusServiceUnavailable
+	}
+
+	adminJSON(w, status, adminReady{Ready: status == http.StatusOK, Instance: a.state.instance})
+}
+
+// authorize returns the server's Authorize hook refusing every request in
+// maintenance mode, and consulting next, if set, otherwise. Requests are
+// served if the state can't be read, rather than no request.
+func (a *adminAPI) authorize(next func(string, string, tftp.OpCode) error) func(string, string, tftp.OpCode) error {
+	return func(clientAddr, filename string, op tftp.OpCode) error {
+		on, err := a.state.maintenance(context.Background())
+		if err != nil {
+			log.Printf("admin: %v", err)
+		}
+
+		if on {
+			return &tftp.Error{Code: tftp.ErrUnknown, Message: "server under maintenance"}
+		}
+
+		if next != nil {
+			return next(clientAddr, filename, op)
+		}
+
+		return nil
+	}
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestAdminAPI(t *testing.T) {
+	s := &tftp.Server{Payload: make([]byte, 10*512), Timeout: 5 * time.Second, Logger: log.New(io.Discard, "", 0)}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _ = s.Serve(conn) }()
+	t.Cleanup(func() { _ = s.Close() })
+
+	stats := &transferStats{}
+	stats.transfer(tftp.Transfer{Client: "10.0.0.1:2000", Filename: "f", Bytes: 42})
+
+	a := &adminAPI{s: s, state: &sharedState{store: &memoryState{}, prefix: "t:"}, stats: stats, token: "secret"}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+
+	call := func(method, path, token, body string, v interface{}) int {
+		t.Helper()
+
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() { _ = resp.Body.Close() }()
+
+		if v != nil && resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+
+		return resp.StatusCode
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if got := call(http.MethodGet, "/counters", token, "", nil); got != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, want %d", token, got, http.StatusUnauthorized)
+		}
+	}
+
+	// a client fetching the payload, stalled after its first block
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = client.Close() }()
+
+	if _, err = client.WriteTo(append([]byte{0, byte(tftp.OpRRQ)}, "pxelinux.0\x00octet\x00"...), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if _, _, err = client.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []adminSession
+	if got := call(http.MethodGet, "/sessions", "secret", "", &sessions); got != http.StatusOK || len(sessions) != 1 || sessions[0].Filename != "pxelinux.0" {
+		t.Fatalf("GET /sessions: got status %d, %+v", got, sessions)
+	}
+
+	var counters adminCounters
+	if got := call(http.MethodGet, "/counters", "secret", "", &counters); got != http.StatusOK || counters.Completed != 1 || counters.Bytes != 42 || counters.Active != 1 {
+		t.Errorf("GET /counters: got status %d, %+v", got, counters)
+	}
+
+	id := "/sessions/" + strconv.FormatUint(sessions[0].ID, 10)
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/sessions", http.StatusMethodNotAllowed},
+		{http.MethodGet, id, http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/sessions/x", http.StatusBadRequest},
+		{http.MethodDelete, id, http.StatusNoContent},
+		{http.MethodDelete, id, http.StatusNotFound},
+	} {
+		if got := call(tt.method, tt.path, "secret", "", nil); got != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, got, tt.status)
+		}
+	}
+
+	// the cancelled client is told so
+	for {
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no ERROR after cancelling the session: %v", err)
+		}
+
+		if n >= 2 && tftp.OpCode(buf[1]) == tftp.OpErr {
+			break
+		}
+	}
+
+	authorize := a.authorize(nil)
+
+	var m adminMaintenance
+	for _, tt := range []struct {
+		method, body string
+		status       int
+		enabled      bool
+	}{
+		{http.MethodGet, "", http.StatusOK, false},
+		{http.MethodPut, `{"enabled": true}`, http.StatusOK, true},
+		{http.MethodGet, "", http.StatusOK, true},
+		{http.MethodPut, `{"enabled":`, http.StatusBadRequest, true},
+		{http.MethodPost, "", http.StatusMethodNotAllowed, true},
+	} {
+		if got := call(tt.method, "/maintenance", "secret", tt.body, &m); got != tt.status || (got == http.StatusOK && m.Enabled != tt.enabled) {
+			t.Errorf("%s /maintenance %s: got status %d, %+v", tt.method, tt.body, got, m)
+		}
+
+		if err := authorize("10.0.0.1:2000", "f", tftp.OpRRQ); (err != nil) != tt.enabled {
+			t.Errorf("%s /maintenance %s: authorize returned %v", tt.method, tt.body, err)
+		}
+	}
+
+	var ready adminReady
+	if got := call(http.MethodGet, "/ready", "secret", "", &ready); got != http.StatusOK || !ready.Ready {
+		t.Errorf("GET /ready without -standby: got status %d, %+v", got, ready)
+	}
+}
+
+func TestAdminAPIExposed(t *testing.T) {
+	if err := (&adminAPI{}).listen("0.0.0.0:0"); err != errAdminExposed {
+		t.Errorf("got %v, want %v", err, errAdminExposed)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+const (
+	// maxAuditField bounds the strings clients choose, like file names, in a
+	// record, so requests of up to 64 KB, or names that JSON escapes to six
+	// times their size, don't make records longer than maxAuditRecord
+	maxAuditField = 1024
+
+	// maxAuditRecord is the longest line the audit log is read with
+	maxAuditRecord = 1 << 20
+)
+
+// auditRecord is one line of the audit log. Hash is the SHA-256 of the
+// record encoded with Hash and MAC left empty, which includes Prev, the hash
+// of the record before it, chaining every record to all earlier ones. MAC,
+// if a key is configured, is the HMAC-SHA256 of Hash.
+type auditRecord struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // request, upload, transfer.completed or transfer.failed
+	Client   string    `json:"client"`
+	Name     string    `json:"client_name,omitempty"`
+	Filename string    `json:"filename"`
+	Mode     string    `json:"mode"`
+	Variant  string    `json:"variant,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash,omitempty"`
+	MAC      string    `json:"mac,omitempty"`
+}
+
+// auditLog appends a hash-chained record of every request and transfer
+// outcome to a file, so any later edit, insertion or removal of a record is
+// detected by 'tftpd audit-verify'. An existing log is continued.
+type auditLog struct {
+	key []byte
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  uint64
+	prev string
+}
+
+func newAuditLog(name string, key []byte) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditLog{f: f, key: key, prev: zeroHash}
+
+	// continue the chain from the last record
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, maxAuditRecord)
+	for sc.Scan() {
+		var rec auditRecord
+		if err = json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("audit log %s: record %d: %w", name, a.seq+1, err)
+		}
+
+		a.seq, a.prev = rec.Seq, rec.Hash
+	}
+
+	if err = sc.Err(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// zeroHash is the Prev of the first record
+var zeroHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+func (a *auditLog) request(t tftp.Transfer) {
+	event := "request"
+	if t.Upload {
+		event = "upload"
+	}
+
+	a.append(auditRecord{
+		Time:     t.Start.UTC(),
+		Event:    event,
+		Client:   t.Client,
+		Name:     clientName(t.Client),
+		Filename: auditField(t.Filename),
+		Mode:     auditField(t.Mode),
+		Variant:  t.Variant,
+	})
+}
+
+func (a *auditLog) transfer(t tftp.Transfer) {
+	rec := auditRecord{
+		Time:     t.Start.Add(t.Duration).UTC(),
+		Event:    "transfer.completed",
+		Client:   t.Client,
+		Name:     clientName(t.Client),
+		Filename: auditField(t.Filename),
+		Mode:     auditField(t.Mode),
+		Variant:  t.Variant,
+		Bytes:    t.Bytes,
+	}
+
+	if t.Err != nil {
+		rec.Event, rec.Error = "transfer.failed", auditField(t.Err.Error())
+	}
+
+	a.append(rec)
+}
+
+// auditField cuts s to maxAuditField bytes, marking it cut with ...
+func auditField(s string) string {
+	if len(s) <= maxAuditField {
+		return s
+	}
+
+	s = s[:maxAuditField-3]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+
+	return s + "..."
+}
+
+func (a *auditLog) append(rec auditRecord) {
+	a.mu.Lock()
+
+	a.seq++
+	rec.Seq, rec.Prev = a.seq, a.prev
+	rec.Hash, rec.MAC = sealRecord(rec, a.key)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		a.mu.Unlock()
+		log.Printf("audit: %v", err)
+
+		return
+	}
+
+	_, err = a.f.Write(append(line, '\n'))
+	a.prev = rec.Hash
+	a.mu.Unlock()
+
+	// records must reach the disk, a log that loses its tail on a crash
+	// can't prove what was served. Syncing outside the lock lets concurrent
+	// transfers share a sync rather than wait for one each.
+	if err == nil {
+		err = a.f.Sync()
+	}
+
+	if err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+func (a *auditLog) Close() error {
+	return a.f.Close()
+}
+
+// sealRecord returns the hash and, given a key, the MAC of rec
+func sealRecord(rec auditRecord, key []byte) (hash, mac string) {
+	rec.Hash, rec.MAC = "", ""
+
+	b, _ := json.Marshal(rec)
+	sum := sha256.Sum256(b)
+	hash = hex.EncodeToString(sum[:])
+
+	if len(key) > 0 {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(hash))
+		mac = hex.EncodeToString(m.Sum(nil))
+	}
+
+	return hash, mac
+}
+
+// verifyAudit checks the chain of the audit log read from r, returning the
+// number of valid records
+func verifyAudit(r io.Reader, key []byte) (uint64, error) {
+	var (
+		n    uint64
+		prev = zeroHash
+		sc   = bufio.NewScanner(r)
+	)
+
+	sc.Buffer(nil, maxAuditRecord)
+
+	for sc.Scan() {
+		n++
+
+		var rec auditRecord
+
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&rec); err != nil {
+			return n - 1, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		hash, mac := sealRecord(rec, key)
+
+		switch {
+		case rec.Seq != n:
+			return n - 1, fmt.Errorf("line %d: sequence number %d, expected %d", n, rec.Seq, n)
+		case rec.Prev != prev:
+			return n - 1, fmt.Errorf("line %d: chain broken, the previous record was changed or removed", n)
+		case rec.Hash != hash:
+			return n - 1, fmt.Errorf("line %d: hash mismatch, the record was changed", n)
+		case len(key) > 0 && !hmac.Equal([]byte(rec.MAC), []byte(mac)):
+			return n - 1, fmt.Errorf("line %d: MAC mismatch, the record was not written with this key", n)
+		}
+
+		prev = rec.Hash
+	}
+
+	return n, sc.Err()
+}
+
+func auditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd audit-verify [flags] audit-log")
+		fmt.Fprintln(fs.Output(), "\nChecks that no record of an audit log written by 'serve -audit-log' was changed,")
+		fmt.Fprintln(fs.Output(), "inserted or removed. Records cut from the end of the log can only be noticed by")
+		fmt.Fprintln(fs.Output(), "comparing the record count with an earlier run.")
+		fs.PrintDefaults()
+	}
+
+	key := fs.String("key", "", "key the records were signed with by -audit-key")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	n, err := verifyAudit(f, []byte(*key))
+	if err != nil {
+		return fmt.Errorf("%s: %w (%d valid records before it)", fs.Arg(0), err, n)
+	}
+
+	if n == 0 {
+		return errors.New("audit log is empty")
+	}
+
+	fmt.Printf("%s: %d records, chain intact\n", fs.Arg(0), n)
+
+	return nil
+}
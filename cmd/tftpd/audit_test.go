@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// writeAudit writes an audit log of three records, appended by two runs,
+// and returns its lines
+func writeAudit(t *testing.T, key []byte) [][]byte {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "audit.log")
+	tr := tftp.Transfer{Client: "192.0.2.1:1024", Filename: "pxelinux.0", Mode: "octet", Start: time.Unix(1700000000, 0)}
+
+	a, err := newAuditLog(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.request(tr)
+
+	tr.Bytes, tr.Duration = 26579, time.Second
+	a.transfer(tr)
+	_ = a.Close()
+
+	// a restarted server continues the chain
+	if a, err = newAuditLog(name, key); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.Err = errors.New("timed out")
+	a.transfer(tr)
+	_ = a.Close()
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.SplitAfter(b, []byte("\n"))[:3]
+}
+
+func TestVerifyAudit(t *testing.T) {
+	key := []byte("secret")
+
+	lines := writeAudit(t, key)
+
+	n, err := verifyAudit(bytes.NewReader(bytes.Join(lines, nil)), key)
+	if n != 3 || err != nil {
+		t.Fatalf("verified %d records with %v, want 3", n, err)
+	}
+
+	// edit replaces the first occurrence of old in line i
+	edit := func(i int, old, new string) [][]byte {
+		out := append([][]byte(nil), lines...)
+		out[i] = bytes.Replace(out[i], []byte(old), []byte(new), 1)
+
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		lines [][]byte
+		key   []byte
+		valid uint64
+		err   string
+	}{
+		{name: "edited", lines: edit(1, "26579", "26578"), key: key, valid: 1, err: "hash mismatch"},
+		{name: "removed", lines: [][]byte{lines[0], lines[2]}, key: key, valid: 1, err: "sequence number"},
+		{name: "reordered", lines: [][]byte{lines[1], lines[0], lines[2]}, key: key, valid: 0, err: "sequence number"},
+		{name: "removed first", lines: lines[1:], key: key, valid: 0, err: "sequence number"},
+		{name: "inserted", lines: [][]byte{lines[0], lines[0], lines[1], lines[2]}, key: key, valid: 1, err: "sequence number"},
+		{name: "chain broken", lines: edit(2, `"prev":"`, `"prev":"0`), key: key, valid: 2, err: "chain broken"},
+		{name: "wrong key", lines: lines, key: []byte("guess"), valid: 0, err: "MAC mismatch"},
+		{name: "unknown field", lines: edit(0, `"mac":`, `"signature":`), key: key, valid: 0, err: "unknown field"},
+		{name: "truncated", lines: [][]byte{lines[0], lines[1][:len(lines[1])/2]}, key: key, valid: 1, err: "line 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := verifyAudit(bytes.NewReader(bytes.Join(tt.lines, nil)), tt.key)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error about %q", err, tt.err)
+			}
+
+			if n != tt.valid {
+				t.Errorf("%d valid records, want %d", n, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSealRecord(t *testing.T) {
+	rec := auditRecord{Seq: 1, Event: "request", Client: "192.0.2.1:1024", Filename: "f", Prev: zeroHash}
+
+	hash, mac := sealRecord(rec, nil)
+	if mac != "" {
+		t.Errorf("MAC %q without a key", mac)
+	}
+
+	// the hash and MAC a record carries aren't part of what's hashed
+	rec.Hash, rec.MAC = hash, "something"
+	if again, _ := sealRecord(rec, nil); again != hash {
+		t.Errorf("sealing a sealed record gave hash %s, want %s", again, hash)
+	}
+
+	rec.Filename = "g"
+	if other, _ := sealRecord(rec, nil); other == hash {
+		t.Error("records differing in a field have the same hash")
+	}
+
+	_, mac1 := sealRecord(rec, []byte("a"))
+	_, mac2 := sealRecord(rec, []byte("b"))
+	if mac1 == "" || mac1 == mac2 {
+		t.Errorf("keys a and b gave MACs %q and %q", mac1, mac2)
+	}
+}
+
+func TestAuditField(t *testing.T) {
+	long := strings.Repeat("é", maxAuditField)
+
+	got := auditField(long)
+	if len(got) > maxAuditField || !strings.HasSuffix(got, "...") || !strings.HasPrefix(long, strings.TrimSuffix(got, "...")) {
+		t.Errorf("cut to %d bytes ending %q", len(got), got[len(got)-5:])
+	}
+
+	if got := auditField("short"); got != "short" {
+		t.Errorf("short field changed to %q", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+func bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd bench [flags] host[:port] remote-file")
+		fmt.Fprintln(fs.Output(), "\nDownloads remote-file repeatedly and reports the achieved throughput.")
+		fs.PrintDefaults()
+	}
+
+	var (
+		common      commonFlags
+		count       = fs.Int("n", 100, "total number of downloads")
+		concurrency = fs.Int("c", 10, "number of concurrent downloads")
+	)
+
+	common.register(fs)
+	common.registerClient(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := common.validate(); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	if *count < 1 || *concurrency < 1 {
+		return fmt.Errorf("-n and -c must be at least 1")
+	}
+
+	trace, _, closeTrace, err := common.hooks()
+	if err != nil {
+		return err
+	}
+
+	defer closeTrace()
+
+	var (
+		addr, remote = withDefaultPort(fs.Arg(0)), fs.Arg(1)
+		client       = common.client(trace)
+		jobs         = make(chan struct{})
+		wg           sync.WaitGroup
+
+		mu       sync.Mutex
+		bytes    int64
+		failed   int
+		lastErr  error
+		duration time.Duration
+	)
+
+	start := time.Now()
+
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range jobs {
+				t := time.Now()
+				n, err := client.Get(addr, remote, ioutil.Discard)
+
+				mu.Lock()
+				bytes += n
+				duration += time.Since(t)
+				if err != nil {
+					failed++
+					lastErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < *count; i++ {
+		jobs <- struct{}{}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d downloads (%d failed) of %s from %s\n", *count, failed, remote, addr)
+	fmt.Printf("%d bytes in %s, %.2f MB/s, %s average per download\n",
+		bytes, elapsed.Round(time.Millisecond), float64(bytes)/elapsed.Seconds()/1e6,
+		(duration / time.Duration(*count)).Round(time.Microsecond))
+
+	if failed > 0 {
+		return fmt.Errorf("%d download(s) failed, last error: %w", failed, lastErr)
+	}
+
+	return nil
+}
+
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd check [flags] host[:port] remote-file")
+		fmt.Fprintln(fs.Output(), "\nDownloads remote-file once and exits non-zero if the download fails.")
+		fs.PrintDefaults()
+	}
+
+	var (
+		common  commonFlags
+		minSize = fs.Int64("min-size", 0, "minimum size in bytes the file must have")
+	)
+
+	common.register(fs)
+	common.registerClient(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := common.validate(); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	trace, _, closeTrace, err := common.hooks()
+	if err != nil {
+		return err
+	}
+
+	defer closeTrace()
+
+	addr, remote := withDefaultPort(fs.Arg(0)), fs.Arg(1)
+
+	start := time.Now()
+
+	n, err := common.client(trace).Get(addr, remote, ioutil.Discard)
+	if err == nil && n < *minSize {
+		err = fmt.Errorf("got %d bytes, expected at least %d", n, *minSize)
+	}
+
+	if err != nil {
+		fmt.Printf("FAIL %s from %s: %v\n", remote, addr, err)
+		os.Exit(exitFailure)
+	}
+
+	fmt.Printf("OK %s from %s: %d bytes in %s\n", remote, addr, n, time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// bundles answers requests for a bundle name with a tar archive of the
+// bundle's files, so a client fetches e.g. kernel, initrd and config in one
+// transfer and unpacks them with 'get -untar'. Archives are built when the
+// server starts, like the payload, and served as variant bundle:<name>.
+type bundles struct {
+	archives map[string][]byte
+	next     func(clientAddr string, rrq tftp.ReadReq) ([]byte, string)
+}
+
+func (b *bundles) payloadFor(clientAddr string, rrq tftp.ReadReq) ([]byte, string) {
+	if archive, ok := b.archives[rrq.Filename]; ok {
+		return archive, "bundle:" + rrq.Filename
+	}
+
+	return b.next(clientAddr, rrq)
+}
+
+// add builds the archive of the bundle defined as name=file,file,...
+func (b *bundles) add(def string) error {
+	name, files, ok := strings.Cut(def, "=")
+	if !ok || name == "" || files == "" {
+		return fmt.Errorf("bundle %q: expected name=file,file", def)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, file := range strings.Split(files, ",") {
+		if err := addToTar(tw, file); err != nil {
+			return fmt.Errorf("bundle %s: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	b.archives[name] = buf.Bytes()
+
+	return nil
+}
+
+func addToTar(tw *tar.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+
+	hdr := &tar.Header{
+		Name:    filepath.Base(file),
+		Mode:    0o644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+
+	return err
+}
+
+// untar extracts the regular files and directories of the archive read from
+// r into dir, refusing entries that would land outside of it
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(filepath.Clean(name), ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to extract %q outside of %s", hdr.Name, dir)
+		}
+
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0o755)
+		case tar.TypeReg:
+			err = extractFile(tr, target)
+		default:
+			err = errors.New("unsupported entry type")
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func extractFile(r io.Reader, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
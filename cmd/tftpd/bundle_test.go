@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestBundles(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{"vmlinuz": "kernel", "initrd.img": "initrd", "boot.cfg": "config"}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stable := func(string, tftp.ReadReq) ([]byte, string) { return []byte("stable"), "stable" }
+	b := &bundles{archives: make(map[string][]byte), next: stable}
+
+	def := "netboot=" + filepath.Join(src, "vmlinuz") + "," + filepath.Join(src, "initrd.img") + "," + filepath.Join(src, "boot.cfg")
+	if err := b.add(def); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, variant := b.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "netboot"})
+	if variant != "bundle:netboot" {
+		t.Errorf("got variant %q, want bundle:netboot", variant)
+	}
+
+	if p, variant := b.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "other"}); string(p) != "stable" || variant != "stable" {
+		t.Errorf("other file: served %q as %s", p, variant)
+	}
+
+	dst := t.TempDir()
+	if err := untar(bytes.NewReader(archive), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q (%v), want %q", name, got, err, want)
+		}
+	}
+
+	for _, def := range []string{"netboot", "=" + src, "netboot=", "netboot=" + src, "netboot=" + filepath.Join(src, "missing")} {
+		if err := b.add(def); err == nil {
+			t.Errorf("%q: expected an error", def)
+		}
+	}
+}
+
+func TestUntarRefusesEscapes(t *testing.T) {
+	for _, name := range []string{"../evil", "a/../../evil", "/etc/evil"} {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = tw.Write([]byte("evil"))
+		_ = tw.Close()
+
+		dir := t.TempDir()
+		if err := untar(buf, filepath.Join(dir, "out")); err == nil || !strings.Contains(err.Error(), "refusing") {
+			t.Errorf("%s: got %v, want it refused", name, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "evil")); err == nil {
+			t.Errorf("%s: extracted outside of the directory", name)
+		}
+	}
+}
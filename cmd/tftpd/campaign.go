@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// campaignTracker tracks firmware rollouts: it records which client
+// completed a download of which version, by SHA-256 digest, of the files of
+// its campaigns, including the earlier versions requested as <name>@..., to
+// report the clients updated to the current version of a file, those still
+// on an earlier one, and the devices of the inventory yet to download it.
+// Records are kept in the server's state, by file and client IP, so in
+// memory they start over with the server.
+type campaignTracker struct {
+	files   []string      // campaign files, as FS paths
+	fsys    fs.FS         // the files are read from
+	devices []tftp.Device // inventory, nil if it can't be listed
+	state   *sharedState
+
+	mu      sync.Mutex
+	digests map[string]fileDigestEntry // by name read from fsys
+}
+
+// campaignRecord is the last download of a campaign file by a client
+type campaignRecord struct {
+	IP       string    `json:"ip"`
+	MAC      string    `json:"mac,omitempty"` // if the requested name held one
+	Filename string    `json:"filename"`      // as requested
+	SHA256   string    `json:"sha256"`
+	Time     time.Time `json:"time"`
+}
+
+// campaignProgress is how far the rollout of a file got
+type campaignProgress struct {
+	File     string           `json:"file"`
+	SHA256   string           `json:"sha256"` // of the current version
+	Updated  []campaignRecord `json:"updated"`
+	Outdated []campaignRecord `json:"outdated"`
+	Pending  []tftp.Device    `json:"pending"` // devices of the inventory not updated yet
+}
+
+// campaignSummary counts the clients and devices of a campaignProgress
+type campaignSummary struct {
+	File     string `json:"file"`
+	SHA256   string `json:"sha256"`
+	Updated  int    `json:"updated"`
+	Outdated int    `json:"outdated"`
+	Pending  int    `json:"pending"`
+}
+
+// fileDigestEntry is a file's digest, valid while its size and modification
+// time are unchanged
+type fileDigestEntry struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+func newCampaignTracker(files []string, fsys fs.FS, inventory tftp.DeviceResolver, state *sharedState) *campaignTracker {
+	c := &campaignTracker{
+		fsys:    fsys,
+		state:   state,
+		digests: make(map[string]fileDigestEntry),
+	}
+
+	for _, f := range files {
+		c.files = append(c.files, tftp.FSPath(f))
+	}
+
+	if table, ok := inventory.(interface{ Devices() []tftp.Device }); ok {
+		c.devices = table.Devices()
+	}
+
+	return c
+}
+
+// transfer records the completed downloads of the campaign files
+func (c *campaignTracker) transfer(t tftp.Transfer) {
+	if t.Upload || t.Err != nil {
+		return
+	}
+
+	// a file chosen by Resolve is the one served
+	served := tftp.FSPath(t.Filename)
+	if t.Variant != "" {
+		served = tftp.FSPath(t.Variant)
+	}
+
+	file := served
+	if i := strings.LastIndexByte(served, '@'); i >= 0 && !strings.Contains(served[i:], "/") {
+		file = served[:i]
+	}
+
+	if !c.tracks(file) {
+		return
+	}
+
+	digest, err := c.digest(served)
+	if err != nil {
+		log.Printf("campaign: %s: %v", served, err)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(t.Client)
+	if err != nil {
+		ip = t.Client
+	}
+
+	r := campaignRecord{IP: ip, Filename: t.Filename, SHA256: digest, Time: t.Start.Add(t.Duration)}
+	if mac := tftp.MACFromFilename(t.Filename); mac != nil {
+		r.MAC = mac.String()
+	}
+
+	b, _ := json.Marshal(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = c.state.store.hset(ctx, c.state.prefix+"campaign:"+file, ip, string(b)); err != nil {
+		log.Printf("campaign: %s: %v", file, err)
+	}
+}
+
+func (c *campaignTracker) tracks(file string) bool {
+	for _, f := range c.files {
+		if f == file {
+			return true
+		}
+	}
+
+	return false
+}
+
+// digest returns the SHA-256 digest of the file name of fsys, hashing it
+// again only once it changed
+func (c *campaignTracker) digest(name string) (string, error) {
+	f, err := c.fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	e, ok := c.digests[name]
+	c.mu.Unlock()
+
+	if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		return e.digest, nil
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	e = fileDigestEntry{size: fi.Size(), modTime: fi.ModTime(), digest: hex.EncodeToString(h.Sum(nil))}
+
+	c.mu.Lock()
+	c.digests[name] = e
+	c.mu.Unlock()
+
+	return e.digest, nil
+}
+
+// progress returns how far the rollout of the current version of file got
+func (c *campaignTracker) progress(ctx context.Context, file string) (campaignProgress, error) {
+	digest, err := c.digest(file)
+	if err != nil {
+		return campaignProgress{}, err
+	}
+
+	records, err := c.state.store.hgetall(ctx, c.state.prefix+"campaign:"+file)
+	if err != nil {
+		return campaignProgress{}, err
+	}
+
+	p := campaignProgress{File: file, SHA256: digest, Updated: []campaignRecord{}, Outdated: []campaignRecord{}, Pending: []tftp.Device{}}
+
+	for _, v := range records {
+		var r campaignRecord
+		if json.Unmarshal([]byte(v), &r) != nil {
+			continue
+		}
+
+		if r.SHA256 == digest {
+			p.Updated = append(p.Updated, r)
+		} else {
+			p.Outdated = append(p.Outdated, r)
+		}
+	}
+
+	for _, recs := range [][]campaignRecord{p.Updated, p.Outdated} {
+		sort.Slice(recs, func(i, j int) bool { return recs[i].Time.Before(recs[j].Time) })
+	}
+
+	for _, d := range c.devices {
+		if !updated(d, p.Updated) {
+			p.Pending = append(p.Pending, d)
+		}
+	}
+
+	return p, nil
+}
+
+// updated reports whether one of the records is a download by device d,
+// going by its IP or MAC address
+func updated(d tftp.Device, records []campaignRecord) bool {
+	ip := net.ParseIP(d["ip"])
+	mac, _ := net.ParseMAC(d["mac"])
+
+	for _, r := range records {
+		if ip != nil && ip.Equal(net.ParseIP(r.IP)) || mac != nil && mac.String() == r.MAC {
+			return true
+		}
+	}
+
+	return false
+}
+
+// summaries returns the progress of every campaign, counted
+func (c *campaignTracker) summaries(ctx context.Context) ([]campaignSummary, error) {
+	summaries := []campaignSummary{}
+
+	for _, f := range c.files {
+		p, err := c.progress(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, campaignSummary{
+			File:     p.File,
+			SHA256:   p.SHA256,
+			Updated:  len(p.Updated),
+			Outdated: len(p.Outdated),
+			Pending:  len(p.Pending),
+		})
+	}
+
+	return summaries, nil
+}
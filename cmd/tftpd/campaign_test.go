@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestCampaignTracker(t *testing.T) {
+	fsys := fstest.MapFS{
+		"images/fw.bin":   {Data: []byte("v2"), ModTime: time.Now()},
+		"images/fw.bin@1": {Data: []byte("v1"), ModTime: time.Now()},
+	}
+
+	inventory, err := tftp.NewDeviceTable([]tftp.Device{
+		{"ip": "10.0.0.1", "name": "sw1"},
+		{"mac": "00:50:56:01:02:03", "name": "sw2"},
+		{"ip": "10.0.0.3", "name": "sw3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newCampaignTracker([]string{"images/fw.bin"}, fsys, inventory, &sharedState{store: &memoryState{}})
+
+	for _, tr := range []tftp.Transfer{
+		{Client: "10.0.0.1:2001", Filename: "images/fw.bin"},
+		{Client: "10.0.0.2:2002", Filename: "images/fw.bin"},
+		{Client: "10.0.0.9:2009", Filename: "pxelinux.cfg/01-00-50-56-01-02-03", Variant: "images/fw.bin"},
+		{Client: "10.0.0.3:2003", Filename: "images/fw.bin@1"},
+		{Client: "10.0.0.4:2004", Filename: "images/fw.bin", Err: errors.New("timeout")},
+		{Client: "10.0.0.5:2005", Filename: "images/other.bin"},
+		{Client: "10.0.0.6:2006", Filename: "images/fw.bin", Upload: true},
+	} {
+		c.transfer(tr)
+	}
+
+	p, err := c.progress(context.Background(), "images/fw.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := func(records []campaignRecord) map[string]bool {
+		m := make(map[string]bool)
+		for _, r := range records {
+			m[r.IP] = true
+		}
+
+		return m
+	}
+
+	if got := ips(p.Updated); len(got) != 3 || !got["10.0.0.1"] || !got["10.0.0.2"] || !got["10.0.0.9"] {
+		t.Errorf("updated %v, want 10.0.0.1, 10.0.0.2 and 10.0.0.9", got)
+	}
+
+	if got := ips(p.Outdated); len(got) != 1 || !got["10.0.0.3"] {
+		t.Errorf("outdated %v, want 10.0.0.3", got)
+	}
+
+	// sw2 is found by the MAC address its request named, sw3 got version 1
+	if len(p.Pending) != 1 || p.Pending[0]["name"] != "sw3" {
+		t.Errorf("pending %v, want sw3", p.Pending)
+	}
+
+	// a new version leaves every client outdated
+	fsys["images/fw.bin"] = &fstest.MapFile{Data: []byte("v3"), ModTime: time.Now().Add(time.Second)}
+
+	admin := &adminAPI{campaigns: c}
+
+	w := httptest.NewRecorder()
+	admin.campaignSummaries(w, httptest.NewRequest(http.MethodGet, "/campaigns", nil))
+
+	var summaries []campaignSummary
+	if err = json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+
+	want := campaignSummary{File: "images/fw.bin", Updated: 0, Outdated: 4, Pending: 3}
+	if len(summaries) != 1 {
+		t.Fatalf("got %d campaigns, want 1", len(summaries))
+	}
+
+	if got := summaries[0]; got.File != want.File || got.Updated != want.Updated || got.Outdated != want.Outdated || got.Pending != want.Pending {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	admin.campaignProgress(w, httptest.NewRequest(http.MethodGet, "/campaigns/images/other.bin", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a file without a campaign, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"hash/fnv"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// canary serves a new payload to a fixed percentage of clients while the
+// rest keep getting the stable one. Clients are bucketed by a hash of their
+// IP address, so a device gets the same variant on every request and raising
+// the percentage only ever moves more devices onto the canary.
+type canary struct {
+	stable  []byte
+	canary  []byte
+	percent uint32
+}
+
+func (c *canary) payloadFor(clientAddr string, _ tftp.ReadReq) ([]byte, string) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(clientIP(clientAddr)))
+
+	if h.Sum32()%100 < c.percent {
+		return c.canary, "canary"
+	}
+
+	return c.stable, "stable"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestCanary(t *testing.T) {
+	clients := make([]string, 10000)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff)
+	}
+
+	variants := func(percent uint32) map[string]string {
+		c := &canary{stable: []byte("stable"), canary: []byte("canary"), percent: percent}
+		got := make(map[string]string, len(clients))
+
+		for _, ip := range clients {
+			p, variant := c.payloadFor(ip+":2000", tftp.ReadReq{Filename: "f"})
+			if string(p) != variant {
+				t.Fatalf("%s: served %q as %s", ip, p, variant)
+			}
+
+			// the same variant whatever the client's port
+			if _, again := c.payloadFor(ip+":3000", tftp.ReadReq{Filename: "f"}); again != variant {
+				t.Fatalf("%s: got %s, then %s from another port", ip, variant, again)
+			}
+
+			got[ip] = variant
+		}
+
+		return got
+	}
+
+	count := func(got map[string]string) (n int) {
+		for _, variant := range got {
+			if variant == "canary" {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	if n := count(variants(0)); n != 0 {
+		t.Errorf("0%%: %d clients on the canary", n)
+	}
+
+	if n := count(variants(100)); n != len(clients) {
+		t.Errorf("100%%: %d of %d clients on the canary", n, len(clients))
+	}
+
+	low, high := variants(10), variants(30)
+
+	if n := count(low); n < 800 || n > 1200 {
+		t.Errorf("10%%: %d of %d clients on the canary", n, len(clients))
+	}
+
+	if n := count(high); n < 2700 || n > 3300 {
+		t.Errorf("30%%: %d of %d clients on the canary", n, len(clients))
+	}
+
+	// raising the percentage only moves clients onto the canary
+	for ip, variant := range low {
+		if variant == "canary" && high[ip] != "canary" {
+			t.Fatalf("%s left the canary going from 10%% to 30%%", ip)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd get [flags] host[:port] remote-file [local-file]")
+		fmt.Fprintln(fs.Output(), "\nDownloads remote-file to local-file, or to stdout if local-file is -.")
+		fmt.Fprintln(fs.Output(), "With -untar, remote-file is a bundle whose files are unpacked into a directory.")
+		fs.PrintDefaults()
+		fmt.Fprint(fs.Output(), exitCodes)
+	}
+
+	var common commonFlags
+	common.register(fs)
+	common.registerClient(fs)
+	untarDir := fs.String("untar", "", "unpack the downloaded tar bundle into this directory instead of saving it")
+	compress := fs.Bool("compress", false, "ask the server to send the file gzip compressed (experimental, needs serve -compress)")
+	checksum := fs.String("sha256", "", "hex `digest` the SHA-256 checksum of the file received must match")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 || *untarDir != "" && fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := common.validate(); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	want, err := hex.DecodeString(*checksum)
+	if err != nil || len(want) != 0 && len(want) != sha256.Size {
+		return &exitError{code: exitUsage, err: fmt.Errorf("invalid -sha256 digest %q", *checksum)}
+	}
+
+	addr, remote := withDefaultPort(fs.Arg(0)), fs.Arg(1)
+
+	local := path.Base(remote)
+	if fs.NArg() == 3 {
+		local = fs.Arg(2)
+	}
+
+	if local == "-" && *untarDir == "" && common.report != "" && common.reportFD == 1 {
+		return &exitError{code: exitUsage, err: errors.New("the file and -report would both be written to stdout, move the reports with -report-fd 2")}
+	}
+
+	trace, report, closeTrace, err := common.hooks()
+	if err != nil {
+		return err
+	}
+
+	defer closeTrace()
+
+	client := common.client(trace)
+	client.Compress = *compress
+
+	if *untarDir != "" {
+		return getBundle(client, report, addr, remote, *untarDir, want)
+	}
+
+	var w io.Writer = os.Stdout
+	if local != "-" {
+		f, err := os.Create(local)
+		if err != nil {
+			return exitWith(localIO(err))
+		}
+
+		defer func() { _ = f.Close() }()
+		w = f
+	}
+
+	sum := sha256.New()
+
+	t := record(client)
+	if _, err = client.Get(addr, remote, io.MultiWriter(localWriter{w}, sum)); err == nil {
+		t.Err = verify(sum, want)
+	}
+
+	if t.Err != nil && local != "-" {
+		_ = os.Remove(local)
+	}
+
+	return finish(*t, report, "received")
+}
+
+// verify checks the checksum of a download against the expected one, if any
+func verify(sum hash.Hash, want []byte) error {
+	if got := sum.Sum(nil); len(want) > 0 && !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: got sha256 %x, expected %x", errChecksum, got, want)
+	}
+
+	return nil
+}
+
+// getBundle downloads the bundle remote and unpacks it into dir as it
+// arrives, checking it against the SHA-256 checksum want if given
+func getBundle(client *tftp.Client, report func(tftp.Transfer), addr, remote, dir string, want []byte) error {
+	pr, pw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		err := untar(pr, dir)
+		if err != nil {
+			err = localIO(fmt.Errorf("unpacking: %w", err))
+		}
+
+		_ = pr.CloseWithError(err) // stop the download if unpacking failed
+		done <- err
+	}()
+
+	sum := sha256.New()
+
+	t := record(client)
+	_, err := client.Get(addr, remote, io.MultiWriter(pw, sum))
+	_ = pw.CloseWithError(err)
+
+	if err := <-done; err != nil && t.Err == nil {
+		t.Err = err
+	}
+
+	if t.Err == nil {
+		t.Err = verify(sum, want)
+	}
+
+	return finish(*t, report, "received")
+}
+
+func put(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd put [flags] host[:port] local-file [remote-file]")
+		fmt.Fprintln(fs.Output(), "\nUploads local-file, or stdin if local-file is -, as remote-file.")
+		fs.PrintDefaults()
+		fmt.Fprint(fs.Output(), exitCodes)
+	}
+
+	var common commonFlags
+	common.register(fs)
+	common.registerClient(fs)
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if err := common.validate(); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	addr, local := withDefaultPort(fs.Arg(0)), fs.Arg(1)
+
+	remote := path.Base(local)
+	if fs.NArg() == 3 {
+		remote = fs.Arg(2)
+	} else if local == "-" {
+		return &exitError{code: exitUsage, err: fmt.Errorf("remote-file is required when uploading from stdin")}
+	}
+
+	trace, report, closeTrace, err := common.hooks()
+	if err != nil {
+		return err
+	}
+
+	defer closeTrace()
+
+	var r io.Reader = os.Stdin
+	if local != "-" {
+		f, err := os.Open(local)
+		if err != nil {
+			return exitWith(localIO(err))
+		}
+
+		defer func() { _ = f.Close() }()
+		r = f
+	}
+
+	client := common.client(trace)
+	t := record(client)
+	_, _ = client.Put(addr, remote, localReader{r})
+
+	return finish(*t, report, "sent")
+}
+
+// record makes client store the summary of the transfers it finishes, with
+// the blocks counted and the parameters negotiated, in the returned Transfer
+func record(client *tftp.Client) *tftp.Transfer {
+	t := new(tftp.Transfer)
+	client.OnFinish = func(done tftp.Transfer) { *t = done }
+
+	return t
+}
+
+// finish logs and reports the outcome of a client transfer
+func finish(t tftp.Transfer, report func(tftp.Transfer), verb string) error {
+	if report != nil {
+		report(t)
+	}
+
+	if t.Err != nil {
+		return exitWith(fmt.Errorf("[%s] %s: %w", t.Client, t.Filename, t.Err))
+	}
+
+	log.Printf("[%s] %s %d bytes of %s in %s", t.Client, verb, t.Bytes, t.Filename, t.Duration.Round(time.Millisecond))
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/josephwoodward/tftp-server/tftp/wire"
+)
+
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tftpd decode [flags] [hex-packet | file ...]")
+		fmt.Fprintln(fs.Output(), "\nDecodes TFTP packets given as hex strings, files holding hex encoded packets (one")
+		fmt.Fprintln(fs.Output(), "per line), raw packet files or pcap captures. Reads stdin when no arguments are")
+		fmt.Fprintln(fs.Output(), "given. Transfers found in captures are reassembled and summarised.")
+		fs.PrintDefaults()
+	}
+
+	port := fs.Int("port", 69, "server port requests are sent to in captures")
+	_ = fs.Parse(args)
+
+	d := decoder{sessions: newSessions(*port)}
+
+	if fs.NArg() == 0 {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		d.input(b)
+	}
+
+	for _, arg := range fs.Args() {
+		b, err := ioutil.ReadFile(arg)
+		if err != nil {
+			// not a file, treat the argument as a hex encoded packet
+			d.hex(arg)
+			continue
+		}
+
+		d.input(b)
+	}
+
+	d.sessions.summarise()
+
+	if d.failed > 0 {
+		return fmt.Errorf("%d packet(s) could not be decoded", d.failed)
+	}
+
+	return nil
+}
+
+type decoder struct {
+	sessions *sessions
+	failed   int
+}
+
+// input decodes the contents of a file or stdin, detecting whether it holds
+// a pcap capture, hex encoded packets or a single raw packet
+func (d *decoder) input(b []byte) {
+	if isPcap(b) {
+		pkts, err := readPcap(b)
+		for _, p := range pkts {
+			d.captured(p)
+		}
+
+		if err != nil {
+			d.failed++
+			fmt.Printf("error: reading capture: %v\n", err)
+		}
+
+		return
+	}
+
+	if isHexText(b) {
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			if strings.TrimSpace(sc.Text()) != "" {
+				d.hex(sc.Text())
+			}
+		}
+
+		return
+	}
+
+	d.raw(b)
+}
+
+func (d *decoder) hex(s string) {
+	p, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		d.failed++
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+
+	d.raw(p)
+}
+
+func (d *decoder) raw(p []byte) {
+	pkt, err := wire.ParsePacket(p)
+	if err != nil {
+		d.failed++
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+
+	fmt.Println(pkt)
+}
+
+func (d *decoder) captured(p capturedPacket) {
+	pkt, err := wire.ParsePacket(p.payload)
+	if err != nil {
+		// captures usually hold other UDP traffic, only complain about
+		// packets belonging to a known transfer
+		if s := d.sessions.lookup(p); s != nil {
+			d.failed++
+			fmt.Printf("%s [%d] error: %v\n", p, s.id, err)
+		}
+
+		return
+	}
+
+	if s := d.sessions.track(p, pkt); s != nil {
+		fmt.Printf("%s [%d] %s\n", p, s.id, pkt)
+	} else {
+		fmt.Printf("%s %s\n", p, pkt)
+	}
+}
+
+func isHexText(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		case c == ' ', c == '\t', c == '\r', c == '\n':
+		default:
+			return false
+		}
+	}
+
+	return len(b) > 0
+}
+
+// session is a transfer reassembled from a capture
+type session struct {
+	id             int
+	op             wire.OpCode
+	filename, mode string
+	client, server string // the server address is its transfer ID once known
+
+	block       uint16 // last new DATA block seen
+	lastSize    int    // payload size of the last new DATA block
+	blockSize   int    // negotiated with blksize, wire.BlockSize by default
+	bytes       int64
+	retransmits int
+	complete    bool
+	err         string
+}
+
+// sessions reassembles transfers by following a request from a client to the
+// server port and then the packets exchanged between the client and the
+// transfer ID the server answers from
+type sessions struct {
+	port    int
+	list    []*session
+	byPair  map[string]*session
+	pending map[string]*session // requests awaiting the server's first reply, by client
+}
+
+func newSessions(port int) *sessions {
+	return &sessions{
+		port:    port,
+		byPair:  make(map[string]*session),
+		pending: make(map[string]*session),
+	}
+}
+
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return a + " " + b
+}
+
+func (t *sessions) lookup(p capturedPacket) *session {
+	src, dst := p.src.String(), p.dst.String()
+
+	if s, ok := t.byPair[pairKey(src, dst)]; ok {
+		return s
+	}
+
+	// first reply from the server's transfer ID
+	if s, ok := t.pending[dst]; ok {
+		delete(t.pending, dst)
+		s.server = src
+		t.byPair[pairKey(src, dst)] = s
+
+		return s
+	}
+
+	return nil
+}
+
+func (t *sessions) track(p capturedPacket, pkt wire.Packet) *session {
+	src := p.src.String()
+
+	switch pkt := pkt.(type) {
+	case *wire.ReadReq:
+		return t.request(p, wire.OpRRQ, pkt.Filename, pkt.Mode)
+	case *wire.WriteReq:
+		return t.request(p, wire.OpWRQ, pkt.Filename, pkt.Mode)
+	}
+
+	s := t.lookup(p)
+	if s == nil {
+		return nil
+	}
+
+	switch pkt := pkt.(type) {
+	case *wire.Data:
+		size := len(p.payload) - 4
+		if pkt.Block != s.block+1 {
+			s.retransmits++
+			break
+		}
+
+		s.block, s.lastSize = pkt.Block, size
+		s.bytes += int64(size)
+	case *wire.Ack:
+		if uint16(*pkt) == s.block && s.block > 0 && s.lastSize < s.blockSize {
+			s.complete = true
+		}
+	case *wire.OAck:
+		for _, o := range *pkt {
+			if n, err := strconv.Atoi(o.Value); err == nil && strings.EqualFold(o.Name, "blksize") {
+				s.blockSize = n
+			}
+		}
+	case *wire.Err:
+		s.err = fmt.Sprintf("%s: %s", pkt.Error, pkt.Message)
+		if src == s.server {
+			s.err = "server sent " + s.err
+		} else {
+			s.err = "client sent " + s.err
+		}
+	}
+
+	return s
+}
+
+func (t *sessions) request(p capturedPacket, op wire.OpCode, filename, mode string) *session {
+	if p.dst.Port != t.port {
+		return nil
+	}
+
+	src := p.src.String()
+
+	// a retransmitted request belongs to the same transfer
+	if s, ok := t.pending[src]; ok && s.op == op && s.filename == filename {
+		return s
+	}
+
+	s := &session{
+		id:        len(t.list) + 1,
+		op:        op,
+		filename:  filename,
+		mode:      mode,
+		client:    src,
+		server:    p.dst.String(),
+		blockSize: wire.BlockSize,
+	}
+
+	t.list = append(t.list, s)
+	t.pending[src] = s
+	t.byPair[pairKey(src, s.server)] = s
+
+	return s
+}
+
+func (t *sessions) summarise() {
+	if len(t.list) == 0 {
+		return
+	}
+
+	fmt.Printf("\n%d transfer(s):\n", len(t.list))
+
+	for _, s := range t.list {
+		result := "incomplete"
+		switch {
+		case s.err != "":
+			result = "failed, " + s.err
+		case s.complete:
+			result = "complete"
+		}
+
+		fmt.Printf("[%d] %s %q (%s) %s <-> %s\n", s.id, s.op, s.filename, s.mode, s.client, s.server)
+		fmt.Printf("    %d blocks, %d bytes, %d retransmitted, %s\n", s.block, s.bytes, s.retransmits, result)
+	}
+}
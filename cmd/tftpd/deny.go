@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// denyHook hands the clients -allow and -drop turn away to an enforcement
+// point, e.g. a firewall blocking them upstream: a shell command run with
+// TFTP_CLIENT, TFTP_FILENAME, TFTP_UPLOAD and TFTP_REASON set, or, given a
+// URL, a JSON notice posted to it, signed like webhook notifications.
+// Denials are handed over one at a time in the background and dropped when
+// the queue is full, and a client is handed over at most once an interval,
+// so a client retrying its request doesn't run the command every time.
+type denyHook struct {
+	target   string
+	secret   []byte
+	interval time.Duration
+	client   *http.Client
+	queue    *sendQueue
+
+	mu   sync.Mutex
+	last map[string]time.Time // when each client IP was last handed over
+}
+
+// denial is the notice posted to a -deny-hook URL
+type denial struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Filename string    `json:"filename"`
+	Upload   bool      `json:"upload,omitempty"`
+	Reason   string    `json:"reason"`
+	Dropped  bool      `json:"dropped,omitempty"`
+}
+
+// maxDenyClients bounds the clients remembered for the interval, the ones
+// whose interval is over are forgotten once it's reached
+const maxDenyClients = 4096
+
+func newDenyHook(target string, secret []byte, interval, timeout time.Duration, queue int) *denyHook {
+	return &denyHook{
+		target:   target,
+		secret:   secret,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		queue:    newSendQueue("deny hook", queue),
+		last:     make(map[string]time.Time),
+	}
+}
+
+// authorize returns the server's Authorize hook handing the clients next
+// denies over
+func (h *denyHook) authorize(next func(string, string, tftp.OpCode) error) func(string, string, tftp.OpCode) error {
+	if next == nil {
+		return nil
+	}
+
+	return func(clientAddr, filename string, op tftp.OpCode) error {
+		err := next(clientAddr, filename, op)
+		if err != nil {
+			h.deny(clientAddr, filename, op, err)
+		}
+
+		return err
+	}
+}
+
+func (h *denyHook) deny(clientAddr, filename string, op tftp.OpCode, err error) {
+	d := denial{
+		Time:     time.Now(),
+		Client:   clientIP(clientAddr),
+		Filename: filename,
+		Upload:   op == tftp.OpWRQ,
+		Reason:   err.Error(),
+		Dropped:  errors.Is(err, tftp.ErrDropped),
+	}
+
+	if !h.due(d.Client, d.Time) {
+		return
+	}
+
+	h.queue.push("denial of "+d.Client, func() {
+		if err := h.deliver(d); err != nil {
+			log.Printf("deny hook: %s: %v", d.Client, err)
+		}
+	})
+}
+
+// due reports whether ip wasn't handed over within the interval, noting
+// it's handed over now if so
+func (h *denyHook) due(ip string, now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if last, ok := h.last[ip]; ok && now.Sub(last) < h.interval {
+		return false
+	}
+
+	if len(h.last) >= maxDenyClients {
+		for client, last := range h.last {
+			if now.Sub(last) >= h.interval {
+				delete(h.last, client)
+			}
+		}
+	}
+
+	h.last[ip] = now
+
+	return true
+}
+
+func (h *denyHook) deliver(d denial) error {
+	if !strings.HasPrefix(h.target, "http://") && !strings.HasPrefix(h.target, "https://") {
+		cmd := shell(h.target)
+		cmd.Env = append(os.Environ(),
+			"TFTP_CLIENT="+d.Client,
+			"TFTP_FILENAME="+d.Filename,
+			"TFTP_UPLOAD="+strconv.FormatBool(d.Upload),
+			"TFTP_REASON="+d.Reason,
+		)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+		return cmd.Run()
+	}
+
+	body, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tftp-server")
+
+	if len(h.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-TFTP-Timestamp", timestamp)
+		req.Header.Set("X-TFTP-Signature", "sha256="+signWebhook(h.secret, timestamp, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestDenyHook(t *testing.T) {
+	delivered := make(chan denial, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d denial
+		_ = json.NewDecoder(r.Body).Decode(&d)
+		delivered <- d
+	}))
+	defer srv.Close()
+
+	acl, err := authorizeFor([]string{"10.1.0.0/16=*"}, []string{"10.9.0.0/16"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := newDenyHook(srv.URL, nil, time.Hour, time.Second, 10)
+	authorize := hook.authorize(acl)
+
+	requests := []struct {
+		client string
+		op     tftp.OpCode
+		denied bool
+	}{
+		{"10.1.0.1:2000", tftp.OpRRQ, false},
+		{"10.2.0.1:2000", tftp.OpWRQ, true},
+		{"10.2.0.1:2001", tftp.OpRRQ, true}, // within the interval
+		{"10.9.0.1:2000", tftp.OpRRQ, true},
+	}
+
+	for _, r := range requests {
+		if err := authorize(r.client, "f", r.op); (err != nil) != r.denied {
+			t.Errorf("%s: got %v, denied %t", r.client, err, r.denied)
+		}
+	}
+
+	want := []denial{
+		{Client: "10.2.0.1", Filename: "f", Upload: true, Reason: "access denied"},
+		{Client: "10.9.0.1", Filename: "f", Dropped: true},
+	}
+
+	for _, w := range want {
+		var d denial
+		select {
+		case d = <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("denial of %s wasn't handed over", w.Client)
+		}
+
+		if w.Reason == "" {
+			w.Reason = d.Reason
+		}
+
+		d.Time = time.Time{}
+		if d != w {
+			t.Errorf("got %+v, want %+v", d, w)
+		}
+	}
+
+	select {
+	case d := <-delivered:
+		t.Errorf("got %+v handed over again within the interval", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDenyHookForgets(t *testing.T) {
+	hook := newDenyHook("true", nil, time.Minute, time.Second, 1)
+	now := time.Now()
+
+	for i := 0; i < maxDenyClients; i++ {
+		hook.due(fmt.Sprintf("10.0.%d.%d", i/256, i%256), now.Add(-time.Hour))
+	}
+
+	if !hook.due("10.99.0.1", now) || len(hook.last) != 1 {
+		t.Errorf("remembering %d clients, want the ones past the interval forgotten", len(hook.last))
+	}
+
+	if hook.due("10.99.0.1", now.Add(time.Second)) {
+		t.Error("a client was handed over twice within the interval")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// publisher delivers a single JSON encoded transfer event to a message
+// broker. Implementations are only ever called from one goroutine.
+type publisher interface {
+	publish(key string, body []byte) error
+}
+
+// eventStream queues the event of every finished transfer and hands them to
+// a publisher in the background, so a slow or unreachable broker never holds
+// up the server. Events are dropped when the queue is full.
+type eventStream struct {
+	pub   publisher
+	queue *sendQueue
+}
+
+// newEventStream returns a stream publishing to the broker at rawURL, which
+// is one of
+//
+//	nats://[user:pass@]host[:port]/subject
+//	kafka-rest://host[:port]/topic  (a Kafka REST proxy, https+kafka-rest for TLS)
+func newEventStream(rawURL string, queue int) (*eventStream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		return nil, fmt.Errorf("%s: missing subject or topic", rawURL)
+	}
+
+	var pub publisher
+
+	switch u.Scheme {
+	case "nats":
+		pub = &natsPublisher{addr: withPort(u.Host, "4222"), subject: name, user: u.User}
+	case "kafka-rest", "https+kafka-rest":
+		scheme := "http"
+		if u.Scheme == "https+kafka-rest" {
+			scheme = "https"
+		}
+
+		pub = &kafkaRestPublisher{
+			url:    scheme + "://" + withPort(u.Host, "8082") + "/topics/" + url.PathEscape(name),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported event broker %q", u.Scheme)
+	}
+
+	return &eventStream{pub: pub, queue: newSendQueue("events "+u.Redacted(), queue)}, nil
+}
+
+func (s *eventStream) transfer(t tftp.Transfer) {
+	body, err := json.Marshal(newTransferEvent(t))
+	if err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+
+	s.queue.push("event for "+t.Client, func() {
+		if err := s.pub.publish(t.Client, body); err != nil {
+			log.Printf("events: %v", err)
+		}
+	})
+}
+
+// natsPublisher publishes events to a NATS subject using the core NATS text
+// protocol. The connection is made on first use and re-established after
+// any error.
+type natsPublisher struct {
+	addr    string
+	subject string
+	user    *url.Userinfo
+
+	mu   sync.Mutex // guards writes to conn, which the PING handler shares
+	conn net.Conn
+}
+
+func (p *natsPublisher) publish(_ string, body []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return fmt.Errorf("nats %s: %w", p.addr, err)
+		}
+	}
+
+	_ = p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", p.subject, len(body), body); err != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+
+		return fmt.Errorf("nats %s: %w", p.addr, err)
+	}
+
+	return nil
+}
+
+// connect dials the server, reads its INFO banner and sends CONNECT. The
+// caller must hold p.mu.
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		_ = conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "tftp-server"}
+	if p.user != nil {
+		opts["user"] = p.user.Username()
+		opts["pass"], _ = p.user.Password()
+	}
+
+	connect, _ := json.Marshal(opts)
+
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+	p.conn = conn
+
+	go p.read(conn, r)
+
+	return nil
+}
+
+// read answers the server's keep-alive PINGs and logs protocol errors until
+// the connection fails
+func (p *natsPublisher) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			p.mu.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("nats %s: %s", p.addr, line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_ = conn.Close()
+	if p.conn == conn {
+		p.conn = nil
+	}
+}
+
+// kafkaRestPublisher produces events to a Kafka topic through a Kafka REST
+// proxy, keyed by the client address so the events of one client land on
+// the same partition
+type kafkaRestPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *kafkaRestPublisher) publish(key string, body []byte) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+
+	records, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{[]record{{Key: key, Value: body}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Post(p.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(records))
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka %s: unexpected status %s", p.url, resp.Status)
+	}
+
+	return nil
+}
+
+// withPort appends port to host if it has none
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, port)
+	}
+
+	return host
+}
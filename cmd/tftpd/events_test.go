@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestNATSEvents(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	type published struct {
+		connect, pub, body, pong string
+	}
+
+	done := make(chan published, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\"}\r\n")
+
+		var p published
+		r := bufio.NewReader(conn)
+		p.connect, _ = r.ReadString('\n')
+		p.pub, _ = r.ReadString('\n')
+		p.body, _ = r.ReadString('\n')
+
+		// keep-alive PINGs are answered
+		_, _ = io.WriteString(conn, "PING\r\n")
+		p.pong, _ = r.ReadString('\n')
+
+		done <- p
+	}()
+
+	stream, err := newEventStream("nats://tftp:s3cret@"+ln.Addr().String()+"/tftp.transfers", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.transfer(tftp.Transfer{Client: "10.0.0.1:2000", Filename: "f", Bytes: 42})
+
+	var p published
+	select {
+	case p = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't published")
+	}
+
+	var connect struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+	}
+
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(p.connect, "CONNECT ")), &connect); err != nil || connect.User != "tftp" || connect.Pass != "s3cret" {
+		t.Errorf("got %q, want CONNECT with the URL's user and password", p.connect)
+	}
+
+	body := strings.TrimSuffix(p.body, "\r\n")
+	if want := "PUB tftp.transfers " + strconv.Itoa(len(body)) + "\r\n"; p.pub != want {
+		t.Errorf("got %q, want %q", p.pub, want)
+	}
+
+	var ev transferEvent
+	if err = json.Unmarshal([]byte(body), &ev); err != nil || ev.Event != "transfer.completed" || ev.Client != "10.0.0.1:2000" || ev.Bytes != 42 {
+		t.Errorf("published %q, want the completed transfer", body)
+	}
+
+	if p.pong != "PONG\r\n" {
+		t.Errorf("got %q, want PONG", p.pong)
+	}
+}
+
+func TestKafkaRestEvents(t *testing.T) {
+	type request struct {
+		path, contentType string
+		body              []byte
+	}
+
+	received := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{r.URL.Path, r.Header.Get("Content-Type"), body}
+	}))
+	defer srv.Close()
+
+	stream, err := newEventStream("kafka-rest://"+strings.TrimPrefix(srv.URL, "http://")+"/tftp-transfers", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.transfer(tftp.Transfer{Client: "10.0.0.1:2000", Filename: "f", Err: tftp.ErrIdle})
+
+	var r request
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event wasn't produced")
+	}
+
+	if r.path != "/topics/tftp-transfers" || r.contentType != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("produced to %s as %s, want /topics/tftp-transfers as application/vnd.kafka.json.v2+json", r.path, r.contentType)
+	}
+
+	var records struct {
+		Records []struct {
+			Key   string        `json:"key"`
+			Value transferEvent `json:"value"`
+		} `json:"records"`
+	}
+
+	if err = json.Unmarshal(r.body, &records); err != nil || len(records.Records) != 1 {
+		t.Fatalf("got %q, want a single record", r.body)
+	}
+
+	// keyed by client, so the events of one client stay in order
+	if rec := records.Records[0]; rec.Key != "10.0.0.1:2000" || rec.Value.Event != "transfer.failed" || rec.Value.Error == "" {
+		t.Errorf("got %+v, want the failed transfer keyed by its client", rec)
+	}
+}
+
+func TestNewEventStreamRejects(t *testing.T) {
+	for _, rawURL := range []string{
+		"nats://broker",         // no subject
+		"amqp://broker/queue",   // unsupported broker
+		"kafka-rest://broker/%", // malformed
+	} {
+		if _, err := newEventStream(rawURL, 1); err == nil {
+			t.Errorf("%s: no error", rawURL)
+		}
+	}
+}
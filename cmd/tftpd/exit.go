@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// Exit codes of the get and put commands, for scripts to tell the causes of
+// a failure apart
+const (
+	exitFailure  = 1 // any other failure
+	exitUsage    = 2 // invalid flags or arguments
+	exitNotFound = 3 // the server has no such file
+	exitDenied   = 4 // the server refused access to the file
+	exitTimeout  = 5 // the server stopped answering, or the transfer took too long
+	exitVerify   = 6 // the file received doesn't match its -sha256 checksum
+	exitLocalIO  = 7 // reading or writing the local file failed
+)
+
+// exitCodes documents the exit codes in the usage of get and put
+const exitCodes = `
+Exit codes:
+  0  success
+  1  any other failure
+  2  invalid flags or arguments
+  3  file not found on the server
+  4  access denied by the server
+  5  timed out waiting for the server, or past -max-transfer-duration
+  6  checksum verification failed (get -sha256)
+  7  reading or writing a local file failed
+`
+
+// errChecksum is the error of a download not matching its expected checksum
+var errChecksum = errors.New("checksum mismatch")
+
+// exitError is the error of a command exiting with a code other than 1
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitWith returns err along with the exit code of its cause, nil if err is
+func exitWith(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &exitError{code: exitCode(err), err: err}
+}
+
+// exitCode returns the code a get or put failing with err exits with
+func exitCode(err error) int {
+	var (
+		local   *localError
+		tftpErr *tftp.Error
+	)
+
+	switch {
+	case errors.As(err, &local):
+		return exitLocalIO
+	case errors.Is(err, errChecksum):
+		return exitVerify
+	case errors.Is(err, tftp.ErrRetriesExhausted), errors.Is(err, tftp.ErrTransferTimeout):
+		return exitTimeout
+	case errors.As(err, &tftpErr) && tftpErr.Code == tftp.ErrNotFound:
+		return exitNotFound
+	case errors.As(err, &tftpErr) && tftpErr.Code == tftp.ErrAccessViolation:
+		return exitDenied
+	default:
+		return exitFailure
+	}
+}
+
+// localError marks an error reading or writing a local file, which the
+// client returns like the errors of the transfer itself
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string { return e.err.Error() }
+func (e *localError) Unwrap() error { return e.err }
+
+// localIO marks err, if any, as a local I/O error
+func localIO(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &localError{err}
+}
+
+// localReader marks the errors reading r as local I/O errors
+type localReader struct {
+	r io.Reader
+}
+
+func (l localReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if err == io.EOF {
+		return n, err
+	}
+
+	return n, localIO(err)
+}
+
+// localWriter marks the errors writing to w as local I/O errors
+type localWriter struct {
+	w io.Writer
+}
+
+func (l localWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	return n, localIO(err)
+}
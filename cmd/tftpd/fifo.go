@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// fifoPayload serves what a script writes to a named pipe given as -p,
+// read anew for every request until the script closes it, so every client
+// is served a freshly generated payload. One request reads the pipe at a
+// time, the ones arriving meanwhile are refused as busy, and a request
+// whose transfer ends before the script writes gives up on the pipe.
+type fifoPayload struct {
+	name string
+
+	mu sync.Mutex // held by the request reading the pipe
+}
+
+// isFIFO reports whether name is a named pipe
+func isFIFO(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+func (p *fifoPayload) generate(r *tftp.Request) (io.Reader, int64, error) {
+	if !p.mu.TryLock() {
+		return nil, -1, tftp.Errorf(tftp.ErrUnknown, "busy")
+	}
+
+	defer p.mu.Unlock()
+
+	ctx := r.Context()
+
+	// opening a pipe blocks until the script opens it for writing
+	type opened struct {
+		f   *os.File
+		err error
+	}
+
+	ch := make(chan opened, 1)
+	go func() {
+		f, err := os.Open(p.name)
+		ch <- opened{f, err}
+	}()
+
+	var f *os.File
+
+	select {
+	case o := <-ch:
+		if o.err != nil {
+			return nil, -1, o.err
+		}
+
+		f = o.f
+	case <-ctx.Done():
+		go func() {
+			if o := <-ch; o.f != nil {
+				_ = o.f.Close()
+			}
+		}()
+
+		return nil, -1, ctx.Err()
+	}
+
+	// closing the pipe unblocks the read once the transfer ended. It's
+	// closed before the next request opens it, or the script's next
+	// payload could be written to this request's end.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+		case <-done:
+		}
+	}()
+
+	b, err := io.ReadAll(f)
+	close(done)
+	_ = f.Close()
+
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return bytes.NewReader(b), int64(len(b)), nil
+}
@@ -0,0 +1,89 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestFIFOPayload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "payload")
+	if err := syscall.Mkfifo(name, 0o600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+
+	if !isFIFO(name) {
+		t.Fatal("didn't detect the named pipe")
+	}
+
+	p := &fifoPayload{name: name}
+
+	// write is the script, generating a payload per request
+	write := func(content string) {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, _ = f.WriteString(content)
+		_ = f.Close()
+	}
+
+	type generated struct {
+		content string
+		size    int64
+		err     error
+	}
+
+	generate := func() chan generated {
+		ch := make(chan generated, 1)
+		go func() {
+			r, size, err := p.generate(&tftp.Request{Filename: "boot"})
+
+			var b []byte
+			if err == nil {
+				b, _ = io.ReadAll(r)
+			}
+
+			ch <- generated{string(b), size, err}
+		}()
+
+		return ch
+	}
+
+	for _, content := range []string{"first payload", "second"} {
+		pending := generate()
+		go write(content)
+
+		select {
+		case g := <-pending:
+			if g.err != nil || g.content != content || g.size != int64(len(content)) {
+				t.Errorf("got %q of size %d, %v, want %q", g.content, g.size, g.err, content)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("payload wasn't read")
+		}
+	}
+
+	// a request arriving while another waits for the script is refused
+	pending := generate()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, _, err := p.generate(&tftp.Request{Filename: "boot"}); err == nil || tftp.ErrorPacket(err).Message != "busy" {
+		t.Errorf("got %v, want busy", err)
+	}
+
+	go write("third")
+
+	if g := <-pending; g.content != "third" {
+		t.Errorf("got %q, want the third payload", g.content)
+	}
+}
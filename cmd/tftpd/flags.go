@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// commonFlags are the protocol and diagnostic flags shared by the server and
+// the client commands
+type commonFlags struct {
+	timeout     time.Duration
+	retries     uint
+	report      string
+	reportFD    uint
+	verbose     bool
+	veryVerbose bool
+	traceFile   string
+
+	// set by the client commands only, see registerClient
+	forClient   bool
+	blockSize   int
+	windowSize  int
+	maxDuration time.Duration
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "time to wait for a reply before retransmitting a packet")
+	fs.UintVar(&c.retries, "retries", 10, "number of times a packet is retransmitted before the transfer is abandoned")
+	fs.StringVar(&c.report, "report", "", "emit a summary of every finished transfer in the given format (jsonl)")
+	fs.UintVar(&c.reportFD, "report-fd", 1, "file descriptor the transfer summaries are written to")
+	fs.BoolVar(&c.verbose, "v", false, "log every packet sent and received")
+	fs.BoolVar(&c.veryVerbose, "vv", false, "log every packet sent and received along with a hex dump of its contents")
+	fs.StringVar(&c.traceFile, "trace-file", "", "write every packet sent and received to a pcap file")
+}
+
+// registerClient registers the flags tuning the transfers of the client
+// commands, which serve has as aliases of its limits
+func (c *commonFlags) registerClient(fs *flag.FlagSet) {
+	c.forClient = true
+	fs.IntVar(&c.blockSize, "blocksize", 0, "ask the server for blocks of this size with the blksize option, 0 for plain 512 byte blocks")
+	fs.IntVar(&c.windowSize, "windowsize", 1, "ask the server to send this many blocks before waiting for an ACK with the windowsize option")
+	fs.DurationVar(&c.maxDuration, "max-transfer-duration", 0, "end transfers still running after this long, however often the server answers, 0 for no limit")
+}
+
+func (c *commonFlags) validate() error {
+	if c.retries == 0 || c.retries > math.MaxUint8 {
+		return fmt.Errorf("retries must be between 1 and %d", math.MaxUint8)
+	}
+
+	if c.timeout <= 0 {
+		return errors.New("timeout must be greater than zero")
+	}
+
+	if c.blockSize != 0 && (c.blockSize < tftp.MinBlockSize || c.blockSize > tftp.MaxBlockSize) {
+		return fmt.Errorf("blocksize must be 0 or between %d and %d", tftp.MinBlockSize, tftp.MaxBlockSize)
+	}
+
+	if c.forClient && (c.windowSize < 1 || c.windowSize > math.MaxUint16) {
+		return fmt.Errorf("windowsize must be between 1 and %d", math.MaxUint16)
+	}
+
+	if c.maxDuration < 0 {
+		return errors.New("max-transfer-duration can't be negative")
+	}
+
+	if c.report != "" {
+		if err := checkFD(uintptr(c.reportFD)); err != nil {
+			return fmt.Errorf("report-fd: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// hooks builds the packet tracer and transfer reporter asked for by the
+// flags, either of which may be nil. The returned close function releases
+// the trace file, if any.
+func (c *commonFlags) hooks() (trace func(tftp.TraceDir, net.Addr, net.Addr, []byte), report func(tftp.Transfer), closeFn func(), err error) {
+	closeFn = func() {}
+
+	if report, err = newReporter(c.report, uintptr(c.reportFD)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if c.verbose || c.veryVerbose || c.traceFile != "" {
+		t, err := newTracer(c.veryVerbose, c.traceFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		trace, closeFn = t.trace, func() { _ = t.Close() }
+	}
+
+	return trace, report, closeFn, nil
+}
+
+// client builds a TFTP client configured by the flags
+func (c *commonFlags) client(trace func(tftp.TraceDir, net.Addr, net.Addr, []byte)) *tftp.Client {
+	return &tftp.Client{
+		Retries:     uint8(c.retries),
+		Timeout:     c.timeout,
+		BlockSize:   c.blockSize,
+		WindowSize:  c.windowSize,
+		MaxDuration: c.maxDuration,
+		Trace:       trace,
+	}
+}
+
+// withDefaultPort appends the well-known TFTP port to addr if it has none
+func withDefaultPort(addr string) string {
+	return withPort(addr, "69")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestCommonFlagsWindowSize(t *testing.T) {
+	tests := []struct {
+		args   []string
+		client bool
+		valid  bool
+	}{
+		{nil, true, true},
+		{[]string{"-windowsize", "16"}, true, true},
+		{[]string{"-windowsize", "65535"}, true, true},
+		{[]string{"-windowsize", "0"}, true, false},
+		{[]string{"-windowsize", "-1"}, true, false},
+		{[]string{"-windowsize", "65536"}, true, false},
+		{nil, false, true}, // serve has no window size of its own
+	}
+
+	for _, tt := range tests {
+		var c commonFlags
+
+		fs := flag.NewFlagSet("get", flag.ContinueOnError)
+		c.register(fs)
+		if tt.client {
+			c.registerClient(fs)
+		}
+
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.validate(); (err == nil) != tt.valid {
+			t.Errorf("%q: got %v, valid %t", tt.args, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// geoIP looks up the country and autonomous system of clients in MaxMind DB
+// files, e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb, each consulted for
+// what the others don't know
+type geoIP struct {
+	dbs []*mmdb
+}
+
+func openGeoIP(names []string) (*geoIP, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	g := &geoIP{}
+
+	for _, name := range names {
+		db, err := openMMDB(name)
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+
+		g.dbs = append(g.dbs, db)
+	}
+
+	return g, nil
+}
+
+// geoTags are the country and autonomous system of a client, empty for
+// private addresses and those the databases don't know
+type geoTags struct {
+	country string // ISO 3166-1 code, e.g. NL
+	asn     uint64
+}
+
+func (t geoTags) String() string {
+	var s []string
+	if t.country != "" {
+		s = append(s, "country:"+t.country)
+	}
+
+	if t.asn != 0 {
+		s = append(s, "asn:"+strconv.FormatUint(t.asn, 10))
+	}
+
+	if s == nil {
+		return "unknown location"
+	}
+
+	return strings.Join(s, " ")
+}
+
+// tags looks up ip, a corrupt record counting as unknown
+func (g *geoIP) tags(ip net.IP) geoTags {
+	var t geoTags
+
+	if g == nil || ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return t
+	}
+
+	for _, db := range g.dbs {
+		v, err := db.lookup(ip)
+		if err != nil {
+			continue
+		}
+
+		record, _ := v.(map[string]interface{})
+
+		if t.country == "" {
+			t.country = isoCode(record, "country")
+		}
+
+		if t.country == "" {
+			t.country = isoCode(record, "registered_country")
+		}
+
+		if t.asn == 0 {
+			t.asn, _ = record["autonomous_system_number"].(uint64)
+		}
+	}
+
+	return t
+}
+
+// isoCode returns the iso_code of the country record under key
+func isoCode(record map[string]interface{}, key string) string {
+	country, _ := record[key].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+
+	return code
+}
+
+// clientCond matches clients by subnet, or by the country or autonomous
+// system the -geoip databases place them in, given as 10.0.0.0/8,
+// country:NL or asn:64512, negated with a leading !. Clients of unknown
+// location match no country or asn condition, negated or not, so private
+// networks aren't caught by a rule like !country:NL.
+type clientCond struct {
+	def     string
+	not     bool
+	subnet  *net.IPNet
+	country string
+	asn     uint64
+	geo     *geoIP
+}
+
+func parseClientCond(def string, geo *geoIP) (clientCond, error) {
+	c := clientCond{def: def, geo: geo}
+
+	cond := def
+	if strings.HasPrefix(cond, "!") {
+		c.not, cond = true, cond[1:]
+	}
+
+	kind, value, _ := strings.Cut(cond, ":")
+
+	switch kind {
+	case "country", "asn":
+		if geo == nil {
+			return clientCond{}, fmt.Errorf("%q needs -geoip", def)
+		}
+	}
+
+	var err error
+
+	switch kind {
+	case "country":
+		if len(value) != 2 {
+			return clientCond{}, fmt.Errorf("%q: country must be a two letter code", def)
+		}
+
+		c.country = strings.ToUpper(value)
+	case "asn":
+		if c.asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32); err != nil || c.asn == 0 {
+			return clientCond{}, fmt.Errorf("%q: invalid AS number", def)
+		}
+	default:
+		if _, c.subnet, err = net.ParseCIDR(cond); err != nil {
+			return clientCond{}, err
+		}
+	}
+
+	return c, nil
+}
+
+// matches reports whether the client ip meets the condition
+func (c clientCond) matches(ip net.IP) bool {
+	if c.subnet != nil {
+		return c.subnet.Contains(ip) != c.not
+	}
+
+	t := c.geo.tags(ip)
+
+	switch {
+	case c.country != "" && t.country != "":
+		return (t.country == c.country) != c.not
+	case c.asn != 0 && t.asn != 0:
+		return (t.asn == c.asn) != c.not
+	default:
+		return false
+	}
+}
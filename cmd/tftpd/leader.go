@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// leaderLease elects the server serving among those sharing a -state, for
+// active/passive failover: the one holding the lease serves, refreshing it
+// every third of its ttl, while standbys, their content and config loaded,
+// drop every request unanswered and try to take the lease as often, so a
+// leader lost is replaced within the ttl. Readiness, as GET /ready of the
+// admin API reports it, follows the lease, for load balancers or keepalived
+// to move the service address to the leader.
+type leaderLease struct {
+	state *sharedState
+	ttl   time.Duration
+
+	leading uint32 // 1 while holding the lease
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newLeaderLease(state *sharedState, ttl time.Duration) *leaderLease {
+	return &leaderLease{state: state, ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run tries to take the lease, or keep it, until stopped, giving it up then
+// so a standby takes over at once
+func (l *leaderLease) run() {
+	defer close(l.done)
+
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	for {
+		l.renew()
+
+		select {
+		case <-l.stop:
+			if l.leader() {
+				ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+				_ = l.state.store.delIf(ctx, l.key(), l.state.instance)
+				cancel()
+			}
+
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (l *leaderLease) key() string {
+	return l.state.prefix + "leader"
+}
+
+// renew refreshes the lease held, or tries to take it. Failing to reach the
+// store, a leader steps down, as a standby might have taken over.
+func (l *leaderLease) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+	defer cancel()
+
+	var (
+		ok  bool
+		err error
+	)
+
+	if l.leader() {
+		ok, err = l.state.store.expireIf(ctx, l.key(), l.state.instance, l.ttl)
+	} else {
+		ok, err = l.state.store.setNX(ctx, l.key(), l.state.instance, l.ttl)
+	}
+
+	if err != nil {
+		log.Printf("leader: %v", err)
+	}
+
+	l.set(ok && err == nil)
+}
+
+func (l *leaderLease) set(leading bool) {
+	var v uint32
+	if leading {
+		v = 1
+	}
+
+	if atomic.SwapUint32(&l.leading, v) != v {
+		if leading {
+			log.Printf("leader: %s took the lease, serving", l.state.instance)
+		} else {
+			log.Printf("leader: %s lost the lease, standing by", l.state.instance)
+		}
+	}
+}
+
+func (l *leaderLease) leader() bool {
+	return atomic.LoadUint32(&l.leading) == 1
+}
+
+// close stops renewing the lease, giving it up
+func (l *leaderLease) close() {
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+// authorize returns the server's Authorize hook dropping every request
+// while standing by, and consulting next, if set, otherwise
+func (l *leaderLease) authorize(next func(string, string, tftp.OpCode) error) func(string, string, tftp.OpCode) error {
+	return func(clientAddr, filename string, op tftp.OpCode) error {
+		if !l.leader() {
+			return tftp.ErrDropped
+		}
+
+		if next != nil {
+			return next(clientAddr, filename, op)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestLeaderLease(t *testing.T) {
+	store := &memoryState{}
+	a := newLeaderLease(&sharedState{store: store, prefix: "t:", instance: "a"}, 150*time.Millisecond)
+	b := newLeaderLease(&sharedState{store: store, prefix: "t:", instance: "b"}, 150*time.Millisecond)
+
+	ready := func(l *leaderLease) int {
+		w := httptest.NewRecorder()
+		(&adminAPI{state: l.state, lease: l}).ready(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+
+		return w.Code
+	}
+
+	a.renew()
+	b.renew()
+
+	if !a.leader() || b.leader() {
+		t.Fatalf("a leading %t, b leading %t, want only a", a.leader(), b.leader())
+	}
+
+	if err := a.authorize(nil)("10.0.0.1:2000", "f", tftp.OpRRQ); err != nil {
+		t.Errorf("the leader refused a request: %v", err)
+	}
+
+	if err := b.authorize(nil)("10.0.0.1:2000", "f", tftp.OpRRQ); !errors.Is(err, tftp.ErrDropped) {
+		t.Errorf("the standby answered a request with %v, want ErrDropped", err)
+	}
+
+	if got, want := ready(a), http.StatusOK; got != want {
+		t.Errorf("leader ready with %d, want %d", got, want)
+	}
+
+	if got, want := ready(b), http.StatusServiceUnavailable; got != want {
+		t.Errorf("standby ready with %d, want %d", got, want)
+	}
+
+	// a keeps the lease while running, beyond its ttl
+	go a.run()
+	time.Sleep(400 * time.Millisecond)
+
+	if b.renew(); b.leader() {
+		t.Fatal("b took the lease a holds")
+	}
+
+	// a stopping gives the lease up at once
+	a.close()
+
+	if b.renew(); !b.leader() {
+		t.Fatal("b didn't take the lease a gave up")
+	}
+
+	// b failing without giving it up, a takes over once it expired
+	a = newLeaderLease(a.state, a.ttl)
+
+	if a.renew(); a.leader() {
+		t.Fatal("a took the lease b holds")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if a.renew(); !a.leader() {
+		t.Error("a didn't take the lease of the failed b")
+	}
+
+	if b.renew(); b.leader() {
+		t.Error("b kept leading after a took over")
+	}
+}
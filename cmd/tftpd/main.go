@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: tftpd <command> [flags] [arguments]
+
+Commands:
+  serve    serve a file to TFTP clients (the default command)
+  get      download a file from a TFTP server
+  put      upload a file to a TFTP server
+  decode   decode TFTP packets given in hex, raw packet files or pcap captures
+  bench    measure the download throughput of a TFTP server
+  check    check that a TFTP server is serving a file
+  audit-verify
+           check the hash chain of a serve -audit-log file
+
+Run 'tftpd <command> -h' to list the flags of a command.
+`
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+
+	switch cmd {
+	case "serve":
+		err = serve(args)
+	case "get":
+		err = get(args)
+	case "put":
+		err = put(args)
+	case "decode":
+		err = decode(args)
+	case "bench":
+		err = bench(args)
+	case "check":
+		err = check(args)
+	case "audit-verify":
+		err = auditVerify(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
+	}
+
+	if err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			log.Print(err)
+			os.Exit(exit.code)
+		}
+
+		log.Fatal(err)
+	}
+}
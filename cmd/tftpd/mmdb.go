@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdb is a MaxMind DB file, the format of the GeoIP2 and GeoLite2
+// databases, e.g. GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, read into
+// memory. Records are decoded into maps, slices, strings, float64s, uint64s,
+// int64s and bools.
+type mmdb struct {
+	tree       []byte // the binary search tree of the networks
+	data       []byte // the data section holding the records
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node of ::/96, where IPv4 addresses start in an IPv6 tree
+}
+
+var (
+	mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+	errMMDBCorrupt    = errors.New("corrupt MaxMind DB file")
+)
+
+// mmdbMaxDepth bounds the nesting of maps, arrays and pointers decoded, so
+// a corrupt file can't recurse forever
+const mmdbMaxDepth = 32
+
+func openMMDB(name string) (*mmdb, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataStart)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", name)
+	}
+
+	v, _, err := mmdbDecoder(buf[i+len(mmdbMetadataStart):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", name, err)
+	}
+
+	meta, _ := v.(map[string]interface{})
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 || ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported record size %d or IP version %d", name, recordSize, ipVersion)
+	}
+
+	treeSize := recordSize * 2 / 8 * nodeCount
+	if nodeCount > math.MaxUint32 || treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%s: %w", name, errMMDBCorrupt)
+	}
+
+	db := &mmdb{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+16 : i], // after 16 zero bytes
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// lookup returns the record of the network ip is in, nil if there is none
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	var node uint
+
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+
+		bits = ip4
+	} else if db.ipVersion == 4 || bits == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+
+	v, _, err := mmdbDecoder(db.data).decode(node-db.nodeCount-16, 0)
+
+	return v, err
+}
+
+// record returns the left (bit 0) or right record of a node of the tree
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.tree
+
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[node*8+bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes the values of a data section
+type mmdbDecoder []byte
+
+// decode returns the value at offset and the offset following it
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth || offset >= uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	ctrl := d[offset]
+	offset++
+
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		v, _, err := d.decode(ptr, depth+1)
+
+		return v, next, err
+	}
+
+	if typ == 0 { // extended type
+		if offset >= uint(len(d)) {
+			return nil, 0, errMMDBCorrupt
+		}
+
+		typ = 7 + uint(d[offset])
+		offset++
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{})
+
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+
+			if k, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+
+			m[key] = v
+		}
+
+		return m, offset, nil
+	case 11: // array
+		var a []interface{}
+
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+		}
+
+		return a, offset, nil
+	case 14: // boolean, its value being the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d)) {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	b, next := d[offset:offset+size], offset+size
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), next, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), next, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case 5, 6, 8, 9: // uint16, uint32, int32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+
+		if typ == 8 {
+			return int64(int32(uint32(n))), next, nil
+		}
+
+		return n, next, nil
+	case 10: // uint128, kept as its bytes
+		return append([]byte(nil), b...), next, nil
+	default:
+		return nil, 0, errMMDBCorrupt
+	}
+}
+
+// pointer returns the offset a pointer at offset points to, and the offset
+// following it
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	if offset+n > uint(len(d)) {
+		return 0, 0, errMMDBCorrupt
+	}
+
+	p := uint(ctrl & 7)
+	if n == 4 {
+		p = 0
+	}
+
+	for _, c := range d[offset : offset+n] {
+		p = p<<8 | uint(c)
+	}
+
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+
+	return p, offset + n, nil
+}
+
+// size returns the size in the control byte ctrl, and the offset following
+// the bytes extending it
+func (d mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	n := size - 28
+	if offset+n > uint(len(d)) {
+		return 0, 0, errMMDBCorrupt
+	}
+
+	var ext uint
+	for _, c := range d[offset : offset+n] {
+		ext = ext<<8 | uint(c)
+	}
+
+	switch n {
+	case 1:
+		size = 29 + ext
+	case 2:
+		size = 285 + ext
+	default:
+		size = 65821 + ext
+	}
+
+	return size, offset + n, nil
+}
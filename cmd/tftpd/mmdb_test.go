@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mmdbControl encodes the control byte, extended type and size of a value
+func mmdbControl(typ, size int) []byte {
+	var b []byte
+	if typ < 8 {
+		b = []byte{byte(typ << 5)}
+	} else {
+		b = []byte{0, byte(typ - 7)}
+	}
+
+	switch {
+	case size < 29:
+		b[0] |= byte(size)
+	case size < 285:
+		b[0] |= 29
+		b = append(b, byte(size-29))
+	case size < 65821:
+		b[0] |= 30
+		b = append(b, byte((size-285)>>8), byte(size-285))
+	default:
+		b[0] |= 31
+		b = append(b, byte((size-65821)>>16), byte((size-65821)>>8), byte(size-65821))
+	}
+
+	return b
+}
+
+// mmdbEncode encodes a value of the data section
+func mmdbEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbControl(2, len(v)), v...)
+	case uint64:
+		var b []byte
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+
+		return append(mmdbControl(9, len(b)), b...)
+	case bool:
+		if v {
+			return mmdbControl(14, 1)
+		}
+
+		return mmdbControl(14, 0)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+
+		return append(mmdbControl(3, 8), b...)
+	case []interface{}:
+		b := mmdbControl(11, len(v))
+		for _, e := range v {
+			b = append(b, mmdbEncode(e)...)
+		}
+
+		return b
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		b := mmdbControl(7, len(v))
+		for _, k := range keys {
+			b = append(append(b, mmdbEncode(k)...), mmdbEncode(v[k])...)
+		}
+
+		return b
+	default:
+		panic("can't encode a " + reflect.TypeOf(v).String())
+	}
+}
+
+// writeMMDB writes a MaxMind DB file mapping the networks to their records
+// and returns its name
+func writeMMDB(t *testing.T, ipVersion, recordSize int, networks map[string]interface{}) string {
+	t.Helper()
+
+	const empty = -1
+
+	var (
+		data  []byte
+		nodes = [][2]int{{empty, empty}}
+		leafs = map[[2]int]int{} // the data offset of records pointing to data
+	)
+
+	for cidr, record := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bits, _ := n.Mask.Size()
+		ip := []byte(n.IP)
+		if ipVersion == 6 && len(ip) == net.IPv4len {
+			ip, bits = append(make([]byte, 12), ip...), bits+96
+		}
+
+		node := 0
+		for i := 0; i < bits; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == bits-1 {
+				leafs[[2]int{node, bit}] = len(data)
+				break
+			}
+
+			if nodes[node][bit] == empty {
+				nodes[node][bit] = len(nodes)
+				nodes = append(nodes, [2]int{empty, empty})
+			}
+
+			node = nodes[node][bit]
+		}
+
+		data = append(data, mmdbEncode(record)...)
+	}
+
+	count := len(nodes)
+	tree := make([]byte, recordSize*2/8*count)
+
+	for node := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			v := nodes[node][bit]
+			if off, ok := leafs[[2]int{node, bit}]; ok {
+				v = count + 16 + off
+			} else if v == empty {
+				v = count
+			}
+
+			switch recordSize {
+			case 24:
+				off := node*6 + bit*3
+				tree[off], tree[off+1], tree[off+2] = byte(v>>16), byte(v>>8), byte(v)
+			case 28:
+				off := node*7 + bit*4
+				if bit == 0 {
+					tree[off+3] |= byte(v>>24) << 4
+				} else {
+					tree[off-1] |= byte(v>>24) & 0x0f
+				}
+
+				tree[off], tree[off+1], tree[off+2] = byte(v>>16), byte(v>>8), byte(v)
+			case 32:
+				binary.BigEndian.PutUint32(tree[node*8+bit*4:], uint32(v))
+			}
+		}
+	}
+
+	meta := mmdbEncode(map[string]interface{}{
+		"node_count":  uint64(count),
+		"record_size": uint64(recordSize),
+		"ip_version":  uint64(ipVersion),
+	})
+
+	var b []byte
+	b = append(append(b, tree...), make([]byte, 16)...)
+	b = append(append(b, data...), mmdbMetadataStart...)
+	b = append(b, meta...)
+
+	name := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestMMDBLookup(t *testing.T) {
+	nl := map[string]interface{}{"country": map[string]interface{}{"iso_code": "NL"}}
+	de := map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}
+	as := map[string]interface{}{"autonomous_system_number": uint64(64500)}
+
+	networks := map[string]interface{}{
+		"192.0.2.0/24":      nl,
+		"198.51.100.128/25": as,
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		if ipVersion == 6 {
+			networks["2001:db8::/32"] = de
+		}
+
+		for _, recordSize := range []int{24, 28, 32} {
+			db, err := openMMDB(writeMMDB(t, ipVersion, recordSize, networks))
+			if err != nil {
+				t.Fatalf("IPv%d with %d bit records: %v", ipVersion, recordSize, err)
+			}
+
+			tests := []struct {
+				ip   string
+				want interface{}
+			}{
+				{"192.0.2.1", nl},
+				{"192.0.2.255", nl},
+				{"198.51.100.200", as},
+				{"198.51.100.1", nil},
+				{"203.0.113.1", nil},
+				{"2001:db8::1", map[int]interface{}{4: nil, 6: de}[ipVersion]},
+				{"2001:db9::1", nil},
+			}
+
+			for _, tt := range tests {
+				got, err := db.lookup(net.ParseIP(tt.ip))
+				if err != nil {
+					t.Errorf("IPv%d with %d bit records: %s: %v", ipVersion, recordSize, tt.ip, err)
+				}
+
+				if tt.want == nil && got != nil || tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("IPv%d with %d bit records: %s is %v, want %v", ipVersion, recordSize, tt.ip, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenMMDBRejects(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(b []byte) string {
+		name := filepath.Join(dir, "db.mmdb")
+		if err := os.WriteFile(name, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		return name
+	}
+
+	meta := func(m map[string]interface{}) string {
+		return write(append(append(make([]byte, 64), mmdbMetadataStart...), mmdbEncode(m)...))
+	}
+
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"missing", filepath.Join(dir, "missing.mmdb")},
+		{"not a database", write([]byte("GIF89a"))},
+		{"malformed metadata", write(append(append(make([]byte, 64), mmdbMetadataStart...), 0xe5, 'x'))},
+		{"record size", meta(map[string]interface{}{"node_count": uint64(1), "record_size": uint64(16), "ip_version": uint64(4)})},
+		{"IP version", meta(map[string]interface{}{"node_count": uint64(1), "record_size": uint64(24), "ip_version": uint64(5)})},
+		{"tree too large", meta(map[string]interface{}{"node_count": uint64(100), "record_size": uint64(24), "ip_version": uint64(4)})},
+		{"node count overflowing", meta(map[string]interface{}{"node_count": uint64(1 << 62), "record_size": uint64(32), "ip_version": uint64(4)})},
+	}
+
+	for _, tt := range tests {
+		if _, err := openMMDB(tt.file); err == nil {
+			t.Errorf("%s: opened without error", tt.name)
+		}
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	values := []interface{}{
+		"",
+		"short",
+		strings.Repeat("x", 28),
+		strings.Repeat("x", 300),
+		strings.Repeat("x", 70000),
+		uint64(0),
+		uint64(1 << 40),
+		true,
+		false,
+		1.5,
+		[]interface{}{"a", uint64(1), []interface{}{true}},
+		map[string]interface{}{"names": map[string]interface{}{"en": "Netherlands"}, "geoname_id": uint64(2750405)},
+	}
+
+	for _, v := range values {
+		b := mmdbEncode(v)
+
+		got, next, err := mmdbDecoder(b).decode(0, 0)
+		if err != nil || next != uint(len(b)) || !reflect.DeepEqual(got, v) {
+			t.Errorf("%.20v decoded as %.20v, %d of %d bytes, %v", v, got, next, len(b), err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"int32", []byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{"float", []byte{0x04, 0x08, 0x3f, 0xc0, 0, 0}, 1.5},
+		{"uint16", []byte{0xa2, 0x01, 0x00}, uint64(256)},
+		{"pointer", []byte{0x20, 0x02, 0x43, 'a', 'b', 'c'}, "abc"},
+	}
+
+	for _, tt := range tests {
+		if got, _, err := mmdbDecoder(tt.in).decode(0, 0); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decoded as %v with %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMMDBDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"pointer to itself", []byte{0x20, 0x00}},
+		{"pointers to each other", []byte{0x20, 0x02, 0x20, 0x00}},
+		{"pointer out of range", []byte{0x20, 0x10}},
+		{"truncated pointer", []byte{0x28, 0x00}},
+		{"truncated extended type", []byte{0x00}},
+		{"truncated size", []byte{0x5e, 0x01}},
+		{"non-string key", append([]byte{0xe1}, mmdbEncode(true)...)},
+		{"short double", []byte{0x64, 0, 0, 0, 0}},
+		{"short float", []byte{0x02, 0x08, 0, 0}},
+		{"long integer", append([]byte{0x09, 0x02}, make([]byte, 9)...)},
+		{"unknown type", []byte{0x00, 0x05}},
+		{"deeply nested", []byte(strings.Repeat("\x01\x04", mmdbMaxDepth+2) + "\x40")},
+	}
+
+	// every truncation of a valid value
+	valid := mmdbEncode(map[string]interface{}{"country": map[string]interface{}{"iso_code": "NL"}, "list": []interface{}{uint64(1), 1.5}})
+	for i := 0; i < len(valid); i++ {
+		tests = append(tests, struct {
+			name string
+			in   []byte
+		}{"truncated", valid[:i]})
+	}
+
+	for _, tt := range tests {
+		if v, _, err := mmdbDecoder(tt.in).decode(0, 0); !errors.Is(err, errMMDBCorrupt) {
+			t.Errorf("%s: % x decoded as %v with %v", tt.name, tt.in, v, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// optionRule turns off or caps an option for every client, or for the
+// clients and files matching an -allow style rule
+type optionRule struct {
+	scope *allowRule // nil for every request
+	name  string     // lower case
+	off   bool
+	max   int64
+}
+
+// optionPolicyFor returns the server's OptionPolicy applying the -option
+// rules, given as [subnet=pattern ]name=off|max, the scope taking the words
+// of an -allow rule too, e.g. '10.0.0.0/8=*.img mon-fri 08:00-18:00
+// windowsize=off' for office hours, or nil if there are none.
+// Every rule matching a request applies, so an option is ignored if any of
+// them turns it off and capped at the lowest of their maximums.
+func optionPolicyFor(defs []string, geo *geoIP) (tftp.OptionPolicy, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+
+	var rules []optionRule
+
+	for _, def := range defs {
+		var r optionRule
+
+		option := strings.TrimSpace(def)
+		if i := strings.LastIndexByte(option, ' '); i >= 0 {
+			a, err := parseAllowRule(option[:i], geo)
+			if err != nil {
+				return nil, fmt.Errorf("option: %w", err)
+			}
+
+			r.scope, option = &a, option[i+1:]
+		}
+
+		name, value, ok := strings.Cut(option, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("option: %q is not [subnet=pattern ]name=off|max", def)
+		}
+
+		r.name = strings.ToLower(name)
+
+		max, err := strconv.ParseInt(value, 10, 64)
+
+		switch {
+		case value == "off":
+			r.off = true
+		case err == nil && max > 0:
+			r.max = max
+		default:
+			return nil, fmt.Errorf("option: %q: value must be off or a positive maximum", def)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return func(req tftp.OptionRequest) (int64, bool) {
+		var (
+			ip  = net.ParseIP(clientIP(req.RemoteAddr))
+			op  = tftp.OpRRQ
+			max int64
+		)
+
+		if req.Upload {
+			op = tftp.OpWRQ
+		}
+
+		for _, r := range rules {
+			if r.name != strings.ToLower(req.Name) || r.scope != nil && !r.scope.matches(ip, req.Filename, op) {
+				continue
+			}
+
+			if r.off {
+				return 0, false
+			}
+
+			if max == 0 || r.max < max {
+				max = r.max
+			}
+		}
+
+		return max, true
+	}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// capturedPacket is a UDP datagram read from a packet capture
+type capturedPacket struct {
+	time     time.Time
+	src, dst *net.UDPAddr
+	payload  []byte
+}
+
+// pcap link types understood by readPcap
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// isPcap reports whether b starts with a pcap file header
+func isPcap(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+
+	switch binary.LittleEndian.Uint32(b) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	}
+
+	return false
+}
+
+// readPcap returns the UDP datagrams in a classic pcap capture, skipping
+// anything that isn't UDP over IPv4 or IPv6
+func readPcap(b []byte) ([]capturedPacket, error) {
+	if len(b) < 24 || !isPcap(b) {
+		return nil, errors.New("not a pcap file")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(b)
+	if magic == 0xd4c3b2a1 || magic == 0x4d3cb2a1 {
+		order = binary.BigEndian
+		magic = order.Uint32(b)
+	}
+
+	nano := magic == 0xa1b23c4d
+	link := order.Uint32(b[20:])
+
+	var pkts []capturedPacket
+
+	for r := b[24:]; len(r) > 0; {
+		if len(r) < 16 {
+			return pkts, io.ErrUnexpectedEOF
+		}
+
+		sec, frac, n := order.Uint32(r), order.Uint32(r[4:]), order.Uint32(r[8:])
+		if uint32(len(r)-16) < n {
+			return pkts, io.ErrUnexpectedEOF
+		}
+
+		if !nano {
+			frac *= 1000
+		}
+
+		frame := r[16 : 16+n]
+		r = r[16+n:]
+
+		ip, ok := linkPayload(link, frame)
+		if !ok {
+			continue
+		}
+
+		if pkt, ok := parseUDP(ip); ok {
+			pkt.time = time.Unix(int64(sec), int64(frac))
+			pkts = append(pkts, pkt)
+		}
+	}
+
+	return pkts, nil
+}
+
+// linkPayload strips the link layer header from a captured frame
+func linkPayload(link uint32, frame []byte) ([]byte, bool) {
+	switch link {
+	case linkRaw:
+		return frame, true
+	case linkNull:
+		if len(frame) < 4 {
+			return nil, false
+		}
+
+		return frame[4:], true
+	case linkLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+
+		return frame[16:], true
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+
+		etherType, off := binary.BigEndian.Uint16(frame[12:]), 14
+		for etherType == 0x8100 || etherType == 0x88a8 { // VLAN tags
+			if len(frame) < off+4 {
+				return nil, false
+			}
+
+			etherType, off = binary.BigEndian.Uint16(frame[off+2:]), off+4
+		}
+
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+
+		return frame[off:], true
+	default:
+		return nil, false
+	}
+}
+
+// parseUDP extracts the addresses and payload of a UDP datagram from an
+// IPv4 or IPv6 packet
+func parseUDP(ip []byte) (capturedPacket, bool) {
+	var (
+		pkt capturedPacket
+		udp []byte
+	)
+
+	if len(ip) < 1 {
+		return pkt, false
+	}
+
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 || ip[9] != 17 {
+			return pkt, false
+		}
+
+		// skip fragments other than the first
+		if binary.BigEndian.Uint16(ip[6:])&0x1fff != 0 {
+			return pkt, false
+		}
+
+		hl := int(ip[0]&0x0f) * 4
+		if len(ip) < hl {
+			return pkt, false
+		}
+
+		pkt.src = &net.UDPAddr{IP: net.IP(append([]byte(nil), ip[12:16]...))}
+		pkt.dst = &net.UDPAddr{IP: net.IP(append([]byte(nil), ip[16:20]...))}
+		udp = ip[hl:]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 {
+			return pkt, false
+		}
+
+		pkt.src = &net.UDPAddr{IP: net.IP(append([]byte(nil), ip[8:24]...))}
+		pkt.dst = &net.UDPAddr{IP: net.IP(append([]byte(nil), ip[24:40]...))}
+		udp = ip[40:]
+	default:
+		return pkt, false
+	}
+
+	if len(udp) < 8 {
+		return pkt, false
+	}
+
+	pkt.src.Port = int(binary.BigEndian.Uint16(udp))
+	pkt.dst.Port = int(binary.BigEndian.Uint16(udp[2:]))
+
+	end := int(binary.BigEndian.Uint16(udp[4:]))
+	if end < 8 || end > len(udp) {
+		end = len(udp)
+	}
+
+	pkt.payload = udp[8:end]
+
+	return pkt, true
+}
+
+func (p capturedPacket) String() string {
+	return fmt.Sprintf("%s %s > %s", p.time.Format("15:04:05.000000"), p.src, p.dst)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pcapFile encodes a capture of the frames, with the byte order and time
+// resolution of the magic number
+func pcapFile(order binary.ByteOrder, magic, link uint32, frames ...[]byte) []byte {
+	b := make([]byte, 24)
+	order.PutUint32(b, magic)
+	order.PutUint16(b[4:], 2)
+	order.PutUint16(b[6:], 4)
+	order.PutUint32(b[16:], 65535)
+	order.PutUint32(b[20:], link)
+
+	for i, f := range frames {
+		hdr := make([]byte, 16)
+		order.PutUint32(hdr, 1700000000)
+		order.PutUint32(hdr[4:], uint32(i+1))
+		order.PutUint32(hdr[8:], uint32(len(f)))
+		order.PutUint32(hdr[12:], uint32(len(f)))
+		b = append(append(b, hdr...), f...)
+	}
+
+	return b
+}
+
+// udpPacket encodes an IPv4 or IPv6 packet carrying a UDP datagram
+func udpPacket(src, dst string, sport, dport uint16, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp, sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if s := net.ParseIP(src).To4(); s != nil {
+		ip := make([]byte, 20)
+		ip[0], ip[9] = 0x45, 17
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		copy(ip[12:], s)
+		copy(ip[16:], net.ParseIP(dst).To4())
+
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40)
+	ip[0], ip[6] = 0x60, 17
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	copy(ip[8:], net.ParseIP(src))
+	copy(ip[24:], net.ParseIP(dst))
+
+	return append(ip, udp...)
+}
+
+// ethernet frames an IP packet, behind the VLAN tags
+func ethernet(ip []byte, vlans ...uint16) []byte {
+	f := make([]byte, 12)
+	for range vlans {
+		f = append(f, 0x81, 0x00, 0x00, 0x01)
+	}
+
+	etherType := []byte{0x08, 0x00}
+	if ip[0]>>4 == 6 {
+		etherType = []byte{0x86, 0xdd}
+	}
+
+	return append(append(f, etherType...), ip...)
+}
+
+func TestReadPcap(t *testing.T) {
+	rrq := []byte("\x00\x01pxelinux.0\x00octet\x00")
+	v4 := udpPacket("192.0.2.1", "192.0.2.2", 2000, 69, rrq)
+	v6 := udpPacket("2001:db8::1", "2001:db8::2", 2000, 69, rrq)
+
+	tcp := append([]byte(nil), v4...)
+	tcp[9] = 6
+
+	fragment := append([]byte(nil), v4...)
+	fragment[7] = 1
+
+	tests := []struct {
+		name   string
+		file   []byte
+		want   int
+		second time.Duration // of the first packet
+	}{
+		{"raw", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkRaw, v4, v6), 2, time.Microsecond},
+		{"big endian", pcapFile(binary.BigEndian, 0xa1b2c3d4, linkRaw, v4), 1, time.Microsecond},
+		{"nanosecond", pcapFile(binary.LittleEndian, 0xa1b23c4d, linkRaw, v4), 1, time.Nanosecond},
+		{"ethernet", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkEthernet, ethernet(v4), ethernet(v6)), 2, time.Microsecond},
+		{"VLAN tagged", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkEthernet, ethernet(v4, 1, 2)), 1, time.Microsecond},
+		{"loopback", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkNull, append([]byte{2, 0, 0, 0}, v4...)), 1, time.Microsecond},
+		{"Linux cooked", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkLinuxSLL, append(make([]byte, 16), v6...)), 1, time.Microsecond},
+		{"not UDP", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkRaw, tcp, v4), 1, 2 * time.Microsecond},
+		{"fragment", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkRaw, fragment), 0, 0},
+		{"unknown link type", pcapFile(binary.LittleEndian, 0xa1b2c3d4, 42, v4), 0, 0},
+		{"short frames", pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkEthernet, nil, ethernet(v4)[:13], ethernet(v4, 1)[:15], v4[:1]), 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts, err := readPcap(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pkts) != tt.want {
+				t.Fatalf("read %d packets, want %d", len(pkts), tt.want)
+			}
+
+			for _, p := range pkts {
+				if string(p.payload) != string(rrq) || p.src.Port != 2000 || p.dst.Port != 69 {
+					t.Errorf("read %s carrying %q", p, p.payload)
+				}
+			}
+
+			if len(pkts) > 0 && !pkts[0].time.Equal(time.Unix(1700000000, 0).Add(tt.second)) {
+				t.Errorf("first packet captured at %v", pkts[0].time)
+			}
+		})
+	}
+}
+
+func TestReadPcapMalformed(t *testing.T) {
+	valid := pcapFile(binary.LittleEndian, 0xa1b2c3d4, linkRaw, udpPacket("192.0.2.1", "192.0.2.2", 2000, 69, []byte("x")))
+
+	for _, b := range [][]byte{nil, []byte("\xd4\xc3\xb2"), make([]byte, 24), []byte("GIF89a" + string(make([]byte, 30)))} {
+		if _, err := readPcap(b); err == nil {
+			t.Errorf("% x read without error", b)
+		}
+	}
+
+	for i := 25; i < len(valid); i++ {
+		if pkts, err := readPcap(valid[:i]); !errors.Is(err, io.ErrUnexpectedEOF) || len(pkts) != 0 {
+			t.Errorf("truncated to %d bytes: read %d packets with %v", i, len(pkts), err)
+		}
+	}
+
+	// a UDP length beyond the packet is cut to what was captured
+	ip := udpPacket("192.0.2.1", "192.0.2.2", 2000, 69, []byte("abc"))
+	binary.BigEndian.PutUint16(ip[24:], 100)
+
+	if p, ok := parseUDP(ip); !ok || string(p.payload) != "abc" {
+		t.Errorf("got payload %q, want the captured abc", p.payload)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// DHCP message types and options used by the ProxyDHCP responder
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+
+	optVendorSpecific = 43
+	optMessageType    = 53
+	optServerID       = 54
+	optVendorClass    = 60
+	optClientArch     = 93
+	optClientGUID     = 97
+	optEnd            = 255
+)
+
+// dhcpCookie separates the fixed BOOTP header from the DHCP options
+var dhcpCookie = []byte{99, 130, 83, 99}
+
+// proxyDHCP answers the DHCP requests of PXE clients with the address of
+// this server and the name of the boot file, leaving IP address assignment
+// to the network's regular DHCP server (PXE specification 2.1, section 2.2).
+// DHCPDISCOVERs are answered with a broadcast offer from port 67, boot
+// server requests to port 4011 with a unicast ack.
+type proxyDHCP struct {
+	server   net.IP // next-server handed to clients
+	bootfile string
+}
+
+func newProxyDHCP(server, bootfile string) (*proxyDHCP, error) {
+	ip := net.ParseIP(server).To4()
+	if ip == nil || ip.IsUnspecified() {
+		return nil, fmt.Errorf("proxydhcp: next server %q is not an IPv4 address, set it with -next-server", server)
+	}
+
+	return &proxyDHCP{server: ip, bootfile: bootfile}, nil
+}
+
+// listen starts answering requests on ports 67 and 4011 in the background
+func (p *proxyDHCP) listen() error {
+	lc := net.ListenConfig{Control: broadcastControl}
+
+	dhcp, err := lc.ListenPacket(context.Background(), "udp4", ":67")
+	if err != nil {
+		return fmt.Errorf("proxydhcp: %w", err)
+	}
+
+	pxe, err := net.ListenPacket("udp4", net.JoinHostPort(p.server.String(), "4011"))
+	if err != nil {
+		_ = dhcp.Close()
+		return fmt.Errorf("proxydhcp: %w", err)
+	}
+
+	log.Printf("ProxyDHCP offering %s from %s ...\n", p.bootfile, p.server)
+
+	go p.serve(dhcp, dhcpDiscover, dhcpOffer)
+	go p.serve(pxe, dhcpRequest, dhcpAck)
+
+	return nil
+}
+
+// serve answers every PXE request of type want on conn with a reply of type
+// reply. Offers go to the broadcast address as the client has no address
+// yet, acks straight back to the client.
+func (p *proxyDHCP) serve(conn net.PacketConn, want, reply byte) {
+	buf := make([]byte, 1500)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("proxydhcp: %v", err)
+			return
+		}
+
+		req, err := parseDHCP(buf[:n])
+		if err != nil || req.msgType() != want || !req.isPXE() {
+			continue
+		}
+
+		to := addr
+		if reply == dhcpOffer {
+			to = &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+		}
+
+		if _, err = conn.WriteTo(p.reply(req, reply), to); err != nil {
+			log.Printf("proxydhcp: %v", err)
+			continue
+		}
+
+		log.Printf("[%s] proxydhcp: sent %s to %s (arch %d)", req.mac(), p.bootfile, to, req.arch())
+	}
+}
+
+// reply builds the offer or ack for req. PXE discovery control 8 tells the
+// client to skip boot server discovery and download the boot file directly.
+func (p *proxyDHCP) reply(req *dhcpPacket, msgType byte) []byte {
+	b := make([]byte, 236, 300)
+	b[0] = 2                          // BOOTREPLY
+	copy(b[1:3], req.header[1:3])     // hardware type and address length
+	copy(b[4:8], req.header[4:8])     // transaction ID
+	copy(b[10:12], req.header[10:12]) // flags
+	copy(b[20:24], p.server)          // siaddr, the next server
+	copy(b[24:28], req.header[24:28]) // giaddr
+	copy(b[28:44], req.header[28:44]) // client hardware address
+	copy(b[44:107], p.server.String())
+	copy(b[108:235], p.bootfile) // both names are null terminated
+
+	b = append(b, dhcpCookie...)
+	b = append(b, optMessageType, 1, msgType)
+	b = append(b, optServerID, 4)
+	b = append(b, p.server...)
+	b = append(b, optVendorClass, 9)
+	b = append(b, "PXEClient"...)
+	b = append(b, optVendorSpecific, 4, 6, 1, 8, optEnd) // PXE sub-options end with their own end marker
+
+	if guid, ok := req.options[optClientGUID]; ok {
+		b = append(b, optClientGUID, byte(len(guid)))
+		b = append(b, guid...)
+	}
+
+	return append(b, optEnd)
+}
+
+// dhcpPacket is a decoded DHCP message
+type dhcpPacket struct {
+	header  []byte // fixed 236 byte BOOTP header
+	options map[byte][]byte
+}
+
+func parseDHCP(b []byte) (*dhcpPacket, error) {
+	if len(b) < 240 || b[0] != 1 || string(b[236:240]) != string(dhcpCookie) {
+		return nil, errors.New("not a DHCP request")
+	}
+
+	p := &dhcpPacket{header: b[:236], options: make(map[byte][]byte)}
+
+	for opts := b[240:]; len(opts) > 0; {
+		code := opts[0]
+
+		switch code {
+		case 0: // pad
+			opts = opts[1:]
+			continue
+		case optEnd:
+			return p, nil
+		}
+
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, errors.New("truncated DHCP option")
+		}
+
+		p.options[code] = opts[2 : 2+opts[1]]
+		opts = opts[2+opts[1]:]
+	}
+
+	return p, nil
+}
+
+func (p *dhcpPacket) msgType() byte {
+	if t := p.options[optMessageType]; len(t) == 1 {
+		return t[0]
+	}
+
+	return 0
+}
+
+func (p *dhcpPacket) isPXE() bool {
+	return strings.HasPrefix(string(p.options[optVendorClass]), "PXEClient")
+}
+
+// arch returns the client system architecture (RFC 4578), 0 being x86 BIOS
+func (p *dhcpPacket) arch() uint16 {
+	if a := p.options[optClientArch]; len(a) == 2 {
+		return binary.BigEndian.Uint16(a)
+	}
+
+	return 0
+}
+
+func (p *dhcpPacket) mac() net.HardwareAddr {
+	n := int(p.header[2])
+	if n > 16 {
+		n = 16
+	}
+
+	return net.HardwareAddr(p.header[28 : 28+n])
+}
+
+// broadcastControl enables SO_BROADCAST so offers can be sent to clients
+// that have no address yet
+func broadcastControl(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+
+	if err := c.Control(func(fd uintptr) { sockErr = setBroadcast(fd) }); err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// pxeRequest returns a DHCP request of msgType from a PXE client with the
+// MAC address 00:50:56:01:02:03
+func pxeRequest(msgType byte) []byte {
+	b := make([]byte, 236)
+	b[0], b[1], b[2] = 1, 1, 6                                 // BOOTREQUEST, Ethernet
+	copy(b[4:8], []byte{0xde, 0xad, 0xbe, 0xef})               // transaction ID
+	copy(b[10:12], []byte{0x80, 0})                            // broadcast flag
+	copy(b[28:34], []byte{0x00, 0x50, 0x56, 0x01, 0x02, 0x03}) // client hardware address
+
+	b = append(b, dhcpCookie...)
+	b = append(b, optMessageType, 1, msgType)
+	b = append(b, 0) // pad
+	b = append(b, optVendorClass, 32)
+	b = append(b, "PXEClient:Arch:00007:UNDI:003016"...)
+	b = append(b, optClientArch, 2, 0, 7)
+	b = append(b, optClientGUID, 17, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16)
+
+	return append(b, optEnd)
+}
+
+func TestParseDHCP(t *testing.T) {
+	req, err := parseDHCP(pxeRequest(dhcpDiscover))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.msgType() != dhcpDiscover || !req.isPXE() || req.arch() != 7 || req.mac().String() != "00:50:56:01:02:03" {
+		t.Errorf("got type %d, PXE %t, arch %d, MAC %s, want a DHCPDISCOVER of an EFI x64 PXE client", req.msgType(), req.isPXE(), req.arch(), req.mac())
+	}
+
+	truncated := pxeRequest(dhcpDiscover)
+	truncated = truncated[:len(truncated)-5]
+
+	for name, b := range map[string][]byte{
+		"short":     make([]byte, 239),
+		"reply":     append([]byte{2}, pxeRequest(dhcpDiscover)[1:]...),
+		"no cookie": append(pxeRequest(dhcpDiscover)[:236], 0, 0, 0, 0),
+		"truncated": truncated,
+	} {
+		if _, err := parseDHCP(b); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestProxyDHCPOffer(t *testing.T) {
+	p, err := newProxyDHCP("10.0.0.5", "undionly.kpxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := parseDHCP(pxeRequest(dhcpDiscover))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := p.reply(req, dhcpOffer)
+
+	if b[0] != 2 {
+		t.Fatalf("got op %d, want BOOTREPLY", b[0])
+	}
+
+	// the offer decodes like a request apart from its op
+	offer, err := parseDHCP(append([]byte{1}, b[1:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := []struct {
+		name      string
+		got, want []byte
+	}{
+		{"transaction ID", offer.header[4:8], []byte{0xde, 0xad, 0xbe, 0xef}},
+		{"flags", offer.header[10:12], []byte{0x80, 0}},
+		{"next server", offer.header[20:24], []byte{10, 0, 0, 5}},
+		{"client hardware address", offer.header[28:34], []byte{0x00, 0x50, 0x56, 0x01, 0x02, 0x03}},
+		{"server name", bytes.TrimRight(offer.header[44:108], "\x00"), []byte("10.0.0.5")},
+		{"boot file", bytes.TrimRight(offer.header[108:236], "\x00"), []byte("undionly.kpxe")},
+	}
+
+	for _, h := range header {
+		if !bytes.Equal(h.got, h.want) {
+			t.Errorf("%s: got %v, want %v", h.name, h.got, h.want)
+		}
+	}
+
+	options := []struct {
+		code byte
+		want []byte
+	}{
+		{optMessageType, []byte{dhcpOffer}},
+		{optServerID, []byte{10, 0, 0, 5}},
+		{optVendorClass, []byte("PXEClient")},
+		{optVendorSpecific, []byte{6, 1, 8, optEnd}}, // skip boot server discovery
+		{optClientGUID, req.options[optClientGUID]},
+	}
+
+	for _, o := range options {
+		if got := offer.options[o.code]; !bytes.Equal(got, o.want) {
+			t.Errorf("option %d: got %v, want %v", o.code, got, o.want)
+		}
+	}
+
+	if _, err = newProxyDHCP("::1", "f"); err == nil {
+		t.Error("took an IPv6 next server")
+	}
+}
+
+func TestProxyDHCPServe(t *testing.T) {
+	p, err := newProxyDHCP("127.0.0.1", "ipxe.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	go p.serve(conn, dhcpRequest, dhcpAck)
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// requests of other types and of other clients than PXE ones are
+	// ignored
+	notPXE := pxeRequest(dhcpRequest)
+	copy(notPXE[bytes.Index(notPXE, []byte("PXEClient")):], "MSFT 5.0")
+
+	for _, b := range [][]byte{pxeRequest(dhcpDiscover), notPXE, pxeRequest(dhcpRequest)} {
+		if _, err = client.WriteTo(b, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 1500)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := parseDHCP(append([]byte{1}, buf[1:n]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack.msgType() != dhcpAck || !bytes.HasPrefix(ack.header[108:], []byte("ipxe.efi\x00")) {
+		t.Errorf("got type %d for %q, want a DHCPACK for ipxe.efi", ack.msgType(), bytes.TrimRight(ack.header[108:], "\x00"))
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	if _, _, err = client.ReadFrom(buf); err == nil {
+		t.Error("answered more than the PXE request")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// sendQueue runs deliveries one at a time in the background, so a slow or
+// unreachable receiver never holds up the server, dropping the ones queued
+// while it's full. It's flushed on exit, waiting a bounded time for the
+// deliveries of the last transfers.
+type sendQueue struct {
+	name string
+
+	mu        sync.Mutex // guards closing items
+	closed    bool
+	items     chan func()
+	done      chan struct{} // closed once every delivery ran
+	abandoned chan struct{} // closed once flushing gave up, skipping the deliveries left
+}
+
+func newSendQueue(name string, size int) *sendQueue {
+	q := &sendQueue{
+		name:      name,
+		items:     make(chan func(), size),
+		done:      make(chan struct{}),
+		abandoned: make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// push queues deliver, logging what's dropped if the queue is full or
+// already flushed
+func (q *sendQueue) push(what string, deliver func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		log.Printf("%s: exiting, dropping %s", q.name, what)
+		return
+	}
+
+	select {
+	case q.items <- deliver:
+	default:
+		log.Printf("%s: queue full, dropping %s", q.name, what)
+	}
+}
+
+func (q *sendQueue) run() {
+	defer close(q.done)
+
+	for deliver := range q.items {
+		select {
+		case <-q.abandoned:
+			continue
+		default:
+		}
+
+		deliver()
+	}
+}
+
+// sleep waits d between attempts of a delivery, reporting false if
+// flushing gave up on the queue meanwhile
+func (q *sendQueue) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-q.abandoned:
+		return false
+	}
+}
+
+// flush stops queueing deliveries and waits for the queued ones to run,
+// giving up on those left once ctx is done
+func (q *sendQueue) flush(ctx context.Context) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		close(q.abandoned)
+		log.Printf("%s: %d queued deliveries left undone on exit", q.name, len(q.items))
+	}
+}
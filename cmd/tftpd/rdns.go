@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// rdns, if set, names clients in reports, events and the audit log
+var rdns *resolver
+
+// resolver looks up the names of client addresses in the background so DNS
+// never slows down a transfer. Results, including failures, are cached for
+// ttl, at most max of them, and no more than workers lookups run at once;
+// clients arriving while all workers are busy simply go unnamed.
+type resolver struct {
+	ttl     time.Duration
+	max     int
+	workers chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]*rdnsEntry
+}
+
+type rdnsEntry struct {
+	name    string // empty while pending or if the lookup failed
+	expires time.Time
+}
+
+func newResolver(ttl time.Duration, max, workers int) *resolver {
+	return &resolver{
+		ttl:     ttl,
+		max:     max,
+		workers: make(chan struct{}, workers),
+		cache:   make(map[string]*rdnsEntry),
+	}
+}
+
+// start begins looking up the name of the client of t, it is used as the
+// server's OnStart hook
+func (r *resolver) start(t tftp.Transfer) {
+	ip := clientIP(t.Client)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.cache[ip]; ok && time.Now().Before(e.expires) {
+		return
+	}
+
+	select {
+	case r.workers <- struct{}{}:
+	default:
+		return
+	}
+
+	if len(r.cache) >= r.max {
+		r.evict()
+	}
+
+	e := &rdnsEntry{expires: time.Now().Add(r.ttl)}
+	r.cache[ip] = e
+
+	go func() {
+		defer func() { <-r.workers }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		if err != nil || len(names) == 0 {
+			return
+		}
+
+		name := strings.TrimSuffix(names[0], ".")
+		log.Printf("[%s] resolved to %s", t.Client, name)
+
+		r.mu.Lock()
+		e.name = name
+		r.mu.Unlock()
+	}()
+}
+
+// name returns the cached name of the client at addr, or "" if it isn't
+// known (yet)
+func (r *resolver) name(addr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.cache[clientIP(addr)]; ok {
+		return e.name
+	}
+
+	return ""
+}
+
+// evict drops expired entries, or an arbitrary one if none has expired. The
+// caller must hold r.mu.
+func (r *resolver) evict() {
+	now := time.Now()
+
+	for ip, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, ip)
+		}
+	}
+
+	for ip := range r.cache {
+		if len(r.cache) < r.max {
+			break
+		}
+
+		delete(r.cache, ip)
+	}
+}
+
+// clientName returns the resolved name of the client at addr, or "" when
+// reverse DNS is disabled or found no name
+func clientName(addr string) string {
+	if rdns == nil {
+		return ""
+	}
+
+	return rdns.name(addr)
+}
+
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestResolver(t *testing.T) {
+	r := newResolver(time.Hour, 2, 1)
+
+	// a client is looked up once a ttl, whatever its port
+	r.start(tftp.Transfer{Client: "192.0.2.1:1024"})
+	r.start(tftp.Transfer{Client: "192.0.2.1:2048"})
+
+	if len(r.cache) != 1 {
+		t.Fatalf("got %d cached clients, want 1", len(r.cache))
+	}
+
+	// clients arriving while every worker is busy go unnamed
+	r.workers <- struct{}{}
+	r.start(tftp.Transfer{Client: "192.0.2.2:1024"})
+	<-r.workers
+
+	r.mu.Lock()
+	if _, ok := r.cache["192.0.2.2"]; ok {
+		t.Error("192.0.2.2 looked up with no worker free")
+	}
+	r.mu.Unlock()
+
+	// expired entries make room for new ones, or else an arbitrary one goes
+	r.mu.Lock()
+	r.cache["192.0.2.3"] = &rdnsEntry{name: "old.example.com", expires: time.Now().Add(-time.Second)}
+	r.mu.Unlock()
+
+	for len(r.workers) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r.start(tftp.Transfer{Client: "192.0.2.4:1024"})
+
+	r.mu.Lock()
+	_, expired := r.cache["192.0.2.3"]
+	_, added := r.cache["192.0.2.4"]
+	n := len(r.cache)
+	r.mu.Unlock()
+
+	if expired || !added || n > 2 {
+		t.Errorf("after eviction: expired entry kept %v, new entry added %v, %d cached", expired, added, n)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	t.Cleanup(func() { rdns = nil })
+
+	tr := tftp.Transfer{Client: "192.0.2.1:1024", Filename: "pxelinux.0"}
+
+	rdns = nil
+	if got := newReportLine(tr).ClientName; got != "" {
+		t.Errorf("without -rdns: got name %q", got)
+	}
+
+	rdns = newResolver(time.Hour, 16, 1)
+	rdns.cache["192.0.2.1"] = &rdnsEntry{name: "pxe1.example.com", expires: time.Now().Add(time.Hour)}
+
+	if got := newReportLine(tr).ClientName; got != "pxe1.example.com" {
+		t.Errorf("got name %q, want pxe1.example.com", got)
+	}
+
+	if got := clientName("192.0.2.2:1024"); got != "" {
+		t.Errorf("unknown client: got name %q", got)
+	}
+}
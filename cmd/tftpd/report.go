@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// reportLine is the JSON object written for every finished transfer when
+// running with -report=jsonl
+type reportLine struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientName string    `json:"client_name,omitempty"`
+	Filename   string    `json:"filename"`
+	Mode       string    `json:"mode"`
+	Upload     bool      `json:"upload,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
+	Signature  string    `json:"client_signature"`
+	Family     string    `json:"client_family"`
+	Acks       string    `json:"acks,omitempty"`
+	Blocks     uint64    `json:"blocks"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// jsonlReporter writes one JSON object per line for every finished transfer.
+// Transfers finish concurrently so writes are serialised.
+type jsonlReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newReporter returns a function reporting transfers in the given format to
+// the file descriptor fd, or nil if format is empty
+func newReporter(format string, fd uintptr) (func(tftp.Transfer), error) {
+	switch format {
+	case "":
+		return nil, nil
+	case "jsonl":
+	default:
+		return nil, fmt.Errorf("unsupported report format %q", format)
+	}
+
+	// reuse the standard streams rather than wrapping their descriptors in
+	// another *os.File, which would close them once garbage collected
+	var w io.Writer
+	switch fd {
+	case 1:
+		w = os.Stdout
+	case 2:
+		w = os.Stderr
+	default:
+		w = os.NewFile(fd, "report")
+	}
+
+	r := &jsonlReporter{enc: json.NewEncoder(w)}
+
+	return r.report, nil
+}
+
+func newReportLine(t tftp.Transfer) reportLine {
+	line := reportLine{
+		Time:       t.Start.Add(t.Duration).UTC(),
+		Client:     t.Client,
+		ClientName: clientName(t.Client),
+		Filename:   t.Filename,
+		Mode:       t.Mode,
+		Upload:     t.Upload,
+		Variant:    t.Variant,
+		Signature:  clientSignature(t),
+		Family:     clientFamily(t),
+		Acks:       string(t.Acks),
+		Blocks:     t.Blocks,
+		Bytes:      t.Bytes,
+		DurationMS: t.Duration.Milliseconds(),
+		Result:     "ok",
+	}
+
+	if t.Err != nil {
+		line.Result = "error"
+		line.Error = t.Err.Error()
+	}
+
+	return line
+}
+
+// clientSignature summarises the request quirks that tell client
+// implementations apart: the mode exactly as sent (octet, OCTET, Octet) and
+// the names of the options requested, in order, e.g. "octet+tsize+blksize".
+// Characters other than letters, digits, - and _ are replaced. Clients
+// choose it freely, so it's reported but never used as a metric tag.
+func clientSignature(t tftp.Transfer) string {
+	parts := []string{t.Mode}
+	for _, o := range t.Options {
+		parts = append(parts, o.Name)
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '+' || r == '-' || r == '_' || r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+
+		return '_'
+	}, strings.Join(parts, "+"))
+}
+
+// Client families told apart by clientFamily
+const (
+	familyIPXE   = "ipxe"
+	familyUBoot  = "u-boot"
+	familyPXEROM = "pxe-rom"
+	familyOther  = "other"
+)
+
+// clientFamily guesses the implementation of the client from the options it
+// requested, going by the defaults of the common network boot clients:
+// U-Boot asks for timeout first, iPXE for blksize 1432 then tsize, and PXE
+// option ROMs for tsize alone, probing the size, or blksize 1456. Any other
+// request is "other", so metrics tagged with it stay bounded.
+func clientFamily(t tftp.Transfer) string {
+	var names []string
+	values := make(map[string]string)
+
+	for _, o := range t.Options {
+		name := strings.ToLower(o.Name)
+		names = append(names, name)
+		values[name] = o.Value
+	}
+
+	switch {
+	case len(names) > 0 && names[0] == "timeout":
+		return familyUBoot
+	case len(names) >= 2 && names[0] == "blksize" && names[1] == "tsize" && values["blksize"] == "1432":
+		return familyIPXE
+	case len(names) == 1 && names[0] == "tsize", values["blksize"] == "1456":
+		return familyPXEROM
+	default:
+		return familyOther
+	}
+}
+
+// transferEvent is the JSON body of webhook notifications and of events
+// published to a message broker
+type transferEvent struct {
+	Event string `json:"event"` // transfer.completed or transfer.failed
+	reportLine
+}
+
+func newTransferEvent(t tftp.Transfer) transferEvent {
+	ev := transferEvent{Event: "transfer.completed", reportLine: newReportLine(t)}
+	if t.Err != nil {
+		ev.Event = "transfer.failed"
+	}
+
+	return ev
+}
+
+func (r *jsonlReporter) report(t tftp.Transfer) {
+	line := newReportLine(t)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_ = r.enc.Encode(line)
+}
+
+// fanOut returns a function passing every transfer to each non-nil fn
+func fanOut(fns ...func(tftp.Transfer)) func(tftp.Transfer) {
+	var set []func(tftp.Transfer)
+	for _, fn := range fns {
+		if fn != nil {
+			set = append(set, fn)
+		}
+	}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	return func(t tftp.Transfer) {
+		for _, fn := range set {
+			fn(t)
+		}
+	}
+}
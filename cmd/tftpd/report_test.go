@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestClientFamily(t *testing.T) {
+	options := func(kv ...string) []tftp.Option {
+		var opts []tftp.Option
+		for i := 0; i+1 < len(kv); i += 2 {
+			opts = append(opts, tftp.Option{Name: kv[i], Value: kv[i+1]})
+		}
+
+		return opts
+	}
+
+	tests := []struct {
+		name    string
+		options []tftp.Option
+		want    string
+	}{
+		{name: "u-boot", options: options("timeout", "5", "tsize", "0", "blksize", "1468"), want: familyUBoot},
+		{name: "ipxe", options: options("blksize", "1432", "tsize", "0"), want: familyIPXE},
+		{name: "pxe rom size probe", options: options("tsize", "0"), want: familyPXEROM},
+		{name: "pxe rom", options: options("BLKSIZE", "1456"), want: familyPXEROM},
+		{name: "no options", want: familyOther},
+		{name: "made up options", options: options("x-vendor", "42", "blksize", "1432"), want: familyOther},
+	}
+
+	for _, tt := range tests {
+		if got := clientFamily(tftp.Transfer{Mode: "octet", Options: tt.options}); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package main
+
+// checkFD can't tell open file descriptors apart on this platform, so a
+// closed one fails once the first report is written
+func checkFD(uintptr) error {
+	return nil
+}
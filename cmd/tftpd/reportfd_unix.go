@@ -0,0 +1,18 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// checkFD reports an error if fd isn't an open file descriptor
+func checkFD(fd uintptr) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); err != nil {
+		return fmt.Errorf("file descriptor %d: %w", fd, err)
+	}
+
+	return nil
+}
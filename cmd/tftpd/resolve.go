@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// resolveFor returns the server's Resolve hook trying the files of the
+// -resolve rules, given as space separated conditions, any of net:subnet,
+// mac:prefix, file:pattern and device:attribute:value, followed by
+// =file,file..., or nil if there are none
+func resolveFor(defs []string, devices tftp.DeviceResolver) (func(context.Context, string, tftp.ReadReq) []string, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+
+	r := tftp.Resolver{Devices: devices}
+
+	for _, def := range defs {
+		conds, files, ok := strings.Cut(def, "=")
+		if !ok || files == "" {
+			return nil, fmt.Errorf("resolve: %q is not conditions=file,...", def)
+		}
+
+		rule := tftp.ResolveRule{Files: strings.Split(files, ",")}
+
+		for _, cond := range strings.Fields(conds) {
+			kind, value, _ := strings.Cut(cond, ":")
+
+			switch kind {
+			case "net":
+				_, subnet, err := net.ParseCIDR(value)
+				if err != nil {
+					return nil, fmt.Errorf("resolve: %w", err)
+				}
+
+				rule.Subnet = subnet
+			case "mac":
+				rule.MAC = value
+			case "file":
+				if _, err := path.Match(value, ""); err != nil {
+					return nil, fmt.Errorf("resolve: %q: %w", value, err)
+				}
+
+				rule.Pattern = value
+			case "device":
+				attr, want, ok := strings.Cut(value, ":")
+				if !ok || devices == nil {
+					return nil, fmt.Errorf("resolve: %q needs -devices and the form device:attribute:value", cond)
+				}
+
+				if rule.Device == nil {
+					rule.Device = make(tftp.Device)
+				}
+
+				rule.Device[attr] = want
+			default:
+				return nil, fmt.Errorf("resolve: unknown condition %q, expected net:, mac:, file: or device:", cond)
+			}
+		}
+
+		r.Rules = append(r.Rules, rule)
+	}
+
+	return r.Resolve, nil
+}
+
+// devicesFor returns the inventory of -devices, a .json or .csv file or the
+// URL of an HTTP inventory API sent the given headers, whose answers are
+// remembered for ttl, or nil if there is none
+func devicesFor(source string, headers []string, ttl time.Duration) (tftp.DeviceResolver, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return tftp.LoadDevices(source)
+	}
+
+	api := &tftp.DeviceAPI{URL: source, Header: make(http.Header), Client: &http.Client{Timeout: 5 * time.Second}}
+
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("devices-header: %q is not name: value", h)
+		}
+
+		api.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if ttl <= 0 {
+		return api, nil
+	}
+
+	return &tftp.DeviceCache{Resolver: api, TTL: ttl}, nil
+}
+
+// secretsFor returns the secrets provider of -secrets, or nil if there is
+// none
+func secretsFor(source string) (tftp.SecretProvider, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	kind, value, _ := strings.Cut(source, ":")
+
+	switch kind {
+	case "env":
+		return tftp.EnvSecrets{Prefix: value}, nil
+	case "file":
+		return tftp.FileSecrets{Dir: value}, nil
+	case "vault":
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, errors.New("secrets: vault needs a token in VAULT_TOKEN")
+		}
+
+		return &tftp.VaultSecrets{URL: value, Token: token, Client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("secrets: unknown provider %q, expected env:, file: or vault:", kind)
+	}
+}
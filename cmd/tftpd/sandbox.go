@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandbox returns the paths serve still opens once it's running, with the
+// unveil(2) permissions it needs on them, and the pledge(2) promises of what
+// it does, which OpenBSD holds it to unless -no-pledge is set. Files read
+// while starting up, like the -p file, are left out, the ones opened for
+// every request in.
+func (f *serveFlags) sandbox() (paths map[string]string, promises []string) {
+	paths = map[string]string{
+		// name resolution, TLS for Redis, webhooks, brokers and Vault, and
+		// times of the local zone
+		"/etc/hosts":          "r",
+		"/etc/resolv.conf":    "r",
+		"/etc/services":       "r",
+		"/etc/ssl/cert.pem":   "r",
+		"/usr/share/zoneinfo": "r",
+	}
+	promises = []string{"stdio", "rpath", "inet", "dns"}
+
+	if f.multicast != "" || f.mtftpAddr != "" {
+		promises = append(promises, "mcast")
+	}
+
+	unveil := func(name, perm string) {
+		if name == "" {
+			return
+		}
+
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+
+		if paths[name] != "rwc" {
+			paths[name] = perm
+		}
+	}
+
+	if f.root == "" && isFIFO(f.payload) {
+		unveil(f.payload, "r")
+	}
+
+	unveil(f.root, "r")
+	unveil(f.templateDir, "r")
+	unveil(f.cloudDir, "r")
+
+	if kind, dir, _ := strings.Cut(f.secrets, ":"); kind == "file" {
+		unveil(dir, "r")
+	}
+
+	// snapshots and uploads are written to temporary files, renamed once
+	// complete
+	writes := false
+
+	if f.snapshot {
+		unveil(os.TempDir(), "rwc")
+		writes = true
+	}
+
+	if f.writable && f.uploadCmd == "" {
+		dir := f.uploads
+		if dir == "" {
+			dir = f.root
+		}
+
+		unveil(dir, "rwc")
+		writes = true
+	}
+
+	if writes {
+		promises = append(promises, "wpath", "cpath", "fattr")
+	}
+
+	// -upload-pipe and -deny-hook commands run in a shell, which neither
+	// unveil nor these promises follow into
+	if f.uploadCmd != "" && f.uploadCmd != "-" || f.denyHookTo != "" && !strings.Contains(f.denyHookTo, "://") {
+		unveil("/bin/sh", "x")
+		promises = append(promises, "proc", "exec")
+	}
+
+	return paths, promises
+}
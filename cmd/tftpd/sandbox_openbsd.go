@@ -0,0 +1,33 @@
+//go:build openbsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// restrict unveils only paths to the process, with their permissions, and
+// pledges it to promises
+func restrict(paths map[string]string, promises []string) error {
+	for name, perm := range paths {
+		// optional files, like /etc/ssl/cert.pem, may not exist
+		if err := unix.Unveil(name, perm); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unveil %s: %w", name, err)
+		}
+	}
+
+	if err := unix.UnveilBlock(); err != nil {
+		return fmt.Errorf("unveil: %w", err)
+	}
+
+	if err := unix.PledgePromises(strings.Join(promises, " ")); err != nil {
+		return fmt.Errorf("pledge: %w", err)
+	}
+
+	return nil
+}
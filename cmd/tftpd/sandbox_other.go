@@ -0,0 +1,8 @@
+//go:build !openbsd
+
+package main
+
+// restrict does nothing where there's no unveil(2) and pledge(2)
+func restrict(map[string]string, []string) error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	tests := []struct {
+		args     []string
+		paths    map[string]string
+		promises []string
+	}{
+		{
+			args:     []string{"-root", "/srv/tftp"},
+			paths:    map[string]string{"/srv/tftp": "r"},
+			promises: []string{"dns", "inet", "rpath", "stdio"},
+		},
+		{
+			args:     []string{"-root", "/srv/tftp", "-writable", "-templates", "/srv/tmpl", "-secrets", "file:/etc/tftp/secrets"},
+			paths:    map[string]string{"/srv/tftp": "rwc", "/srv/tmpl": "r", "/etc/tftp/secrets": "r"},
+			promises: []string{"cpath", "dns", "fattr", "inet", "rpath", "stdio", "wpath"},
+		},
+		{
+			args:     []string{"-root", "/srv/tftp", "-writable", "-upload-dir", "/srv/in", "-multicast", "239.255.0.1:1758"},
+			paths:    map[string]string{"/srv/tftp": "r", "/srv/in": "rwc"},
+			promises: []string{"cpath", "dns", "fattr", "inet", "mcast", "rpath", "stdio", "wpath"},
+		},
+		{
+			args:     []string{"-root", "/srv/tftp", "-writable", "-upload-pipe", "gzip > /tmp/x", "-allow", "10.0.0.0/8=*", "-deny-hook", "https://fw/block"},
+			paths:    map[string]string{"/srv/tftp": "r", "/bin/sh": "x"},
+			promises: []string{"dns", "exec", "inet", "proc", "rpath", "stdio"},
+		},
+	}
+
+	for _, tt := range tests {
+		var f serveFlags
+
+		flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+		f.register(flags)
+
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		paths, promises := f.sandbox()
+		sort.Strings(promises)
+
+		for name, perm := range tt.paths {
+			if paths[name] != perm {
+				t.Errorf("%q: unveiled %s with %q, want %q", tt.args, name, paths[name], perm)
+			}
+		}
+
+		if !reflect.DeepEqual(promises, tt.promises) {
+			t.Errorf("%q: pledged %q, want %q", tt.args, promises, tt.promises)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// schedule serves a staged payload from a given time on, and optionally only
+// until the end of a maintenance window, falling back to the payload chosen
+// by next outside of it
+type schedule struct {
+	staged []byte
+	from   time.Time
+	until  time.Time // zero if the staged payload stays active
+	next   func(clientAddr string, rrq tftp.ReadReq) ([]byte, string)
+}
+
+func (s *schedule) payloadFor(clientAddr string, rrq tftp.ReadReq) ([]byte, string) {
+	if now := time.Now(); !now.Before(s.from) && (s.until.IsZero() || now.Before(s.until)) {
+		return s.staged, "staged"
+	}
+
+	return s.next(clientAddr, rrq)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestSchedule(t *testing.T) {
+	now := time.Now()
+	stable := func(string, tftp.ReadReq) ([]byte, string) {
+		return []byte("stable"), "stable"
+	}
+
+	tests := []struct {
+		name        string
+		from, until time.Time
+		want        string
+	}{
+		{"before the window", now.Add(time.Hour), now.Add(2 * time.Hour), "stable"},
+		{"within the window", now.Add(-time.Hour), now.Add(time.Hour), "staged"},
+		{"after the window", now.Add(-2 * time.Hour), now.Add(-time.Hour), "stable"},
+		{"from on", now.Add(-time.Hour), time.Time{}, "staged"},
+		{"not yet", now.Add(time.Hour), time.Time{}, "stable"},
+	}
+
+	for _, tt := range tests {
+		s := &schedule{staged: []byte("staged"), from: tt.from, until: tt.until, next: stable}
+
+		p, variant := s.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "f"})
+		if variant != tt.want || string(p) != tt.want {
+			t.Errorf("%s: served %q as %s, want %s", tt.name, p, variant, tt.want)
+		}
+	}
+}
@@ -0,0 +1,912 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// serveFlags are the flags of the serve command
+type serveFlags struct {
+	common commonFlags
+
+	webhooks    stringList
+	bundleDefs  stringList
+	events      stringList
+	strictNets  stringList
+	allowRules  stringList
+	optionRules stringList
+	dropRules   stringList
+	geoipDBs    stringList
+	resolveDefs stringList
+	deviceHdrs  stringList
+	campaigns   stringList
+
+	address     string
+	payload     string
+	simLoss     float64
+	simDelay    time.Duration
+	simDup      float64
+	simOrder    float64
+	statsd      string
+	prefix      string
+	dogstats    bool
+	tags        string
+	hookSecret  string
+	hookRetries int
+	hookTimeout time.Duration
+	hookQueue   int
+	denyHookTo  string
+	denyEvery   time.Duration
+	proxyDHCP   bool
+	nextServer  string
+	bootfile    string
+	snmpAddr    string
+	community   string
+	snmpOID     string
+	minAge      time.Duration
+	canaryFile  string
+	canaryPct   uint
+	stagedFile  string
+	activateAt  string
+	revertAfter time.Duration
+	auditFile   string
+	auditKey    string
+	checksums   bool
+	reverseDNS  bool
+	netascii    string
+	modes       string
+	root        string
+	snapshot    bool
+	fallback    string
+	templateDir string
+	cloudDir    string
+	secrets     string
+	devices     string
+	devicesTTL  time.Duration
+	writable    bool
+	uploads     string
+	uploadCmd   string
+	clobber     string
+	keep        int
+	minTimeout  time.Duration
+	maxTimeout  time.Duration
+	minBlksize  int
+	maxBlksize  int
+	retryPolicy string
+	graceful    time.Duration
+	maxWindow   int
+	multicast   string
+	mtftpAddr   string
+	mtftpGroup  string
+	compress    bool
+	resume      bool
+	singlePort  bool
+	strict      bool
+	maxDuration time.Duration
+	idleTimeout time.Duration
+	maxAge      time.Duration
+	maxXfers    int
+	backlog     int
+	rejectBusy  bool
+	maxUpload   int64
+	adminAddr   string
+	adminToken  string
+	stateURL    string
+	standby     bool
+	leaseTTL    time.Duration
+	statePrefix string
+	eventQueue  int
+	flushWait   time.Duration
+	noPledge    bool
+
+	activation time.Time // -activate-at, parsed by validate
+}
+
+func serve(args []string) error {
+	var f serveFlags
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	f.register(flags)
+	_ = flags.Parse(args)
+
+	if err := f.validate(flags); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	return f.run()
+}
+
+func (f *serveFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.address, "a", "127.0.0.1:69", "listen address, or comma separated addresses to serve several interfaces, e.g. 10.1.0.1:69,10.2.0.1:69")
+	flags.StringVar(&f.payload, "p", "payload.jpeg", "file to serve to clients, or - to read it from stdin once, or a named pipe read anew for every request")
+	flags.Float64Var(&f.simLoss, "sim-loss", 0, "simulate a lossy network by dropping packets on the listening socket and every transfer's with the given probability (0-1)")
+	flags.DurationVar(&f.simDelay, "sim-delay", 0, "simulate network latency by delaying packets on the listening socket and every transfer's")
+	flags.Float64Var(&f.simDup, "sim-dup", 0, "simulate duplicated packets on the listening socket and every transfer's with the given probability (0-1)")
+	flags.Float64Var(&f.simOrder, "sim-reorder", 0, "simulate reordered packets on the listening socket and every transfer's with the given probability (0-1)")
+	flags.StringVar(&f.statsd, "statsd", "", "send transfer metrics to the StatsD endpoint at this address")
+	flags.StringVar(&f.prefix, "statsd-prefix", "tftp.", "prefix added to the name of every StatsD metric")
+	flags.BoolVar(&f.dogstats, "dogstatsd", false, "tag StatsD metrics using the DogStatsD extension instead of encoding the result in the metric name")
+	flags.StringVar(&f.tags, "statsd-tags", "", "comma separated DogStatsD tags added to every metric, e.g. env:lab,site:ams")
+	flags.StringVar(&f.hookSecret, "webhook-secret", "", "sign webhook bodies with HMAC-SHA256 using this secret")
+	flags.IntVar(&f.hookRetries, "webhook-retries", 3, "number of times a failed webhook delivery is retried")
+	flags.DurationVar(&f.hookTimeout, "webhook-timeout", 10*time.Second, "timeout of a single webhook delivery")
+	flags.IntVar(&f.hookQueue, "webhook-queue", 1024, "number of notifications buffered per webhook before new ones are dropped")
+	flags.StringVar(&f.denyHookTo, "deny-hook", "", "hand the clients -allow and -drop turn away to a firewall or another enforcement point: run this shell command with TFTP_CLIENT, TFTP_FILENAME, TFTP_UPLOAD and TFTP_REASON set, or post a JSON notice to this URL, signed with -webhook-secret")
+	flags.DurationVar(&f.denyEvery, "deny-hook-interval", time.Minute, "hand a client denied again and again over to -deny-hook at most once in this time")
+	flags.BoolVar(&f.proxyDHCP, "proxydhcp", false, "answer PXE clients' DHCP requests with this server and the boot file, alongside the network's own DHCP server")
+	flags.StringVar(&f.nextServer, "next-server", "", "IPv4 address of this server handed to PXE clients, defaults to the -a address")
+	flags.StringVar(&f.bootfile, "bootfile", "", "boot file name handed to PXE clients, defaults to the name of the -p file")
+	flags.StringVar(&f.snmpAddr, "snmp", "", "serve transfer counters to SNMPv2c managers on this address, e.g. :161")
+	flags.StringVar(&f.community, "snmp-community", "public", "SNMP community accepted by the agent")
+	flags.StringVar(&f.snmpOID, "snmp-oid", "1.3.6.1.3.6969", "OID below which the agent exposes the transfer counters")
+	flags.DurationVar(&f.minAge, "min-age", 0, "wait until the -p file has not been modified for this long before serving it, or with -root refuse the requests of files modified less than this long ago, so half-copied images are never served")
+	flags.StringVar(&f.canaryFile, "canary", "", "file served instead of the -p file to -canary-percent of clients")
+	flags.UintVar(&f.canaryPct, "canary-percent", 0, "percentage of clients, chosen by a hash of their IP address, served the -canary file")
+	flags.StringVar(&f.stagedFile, "staged", "", "file served instead of the -p file from -activate-at on")
+	flags.StringVar(&f.activateAt, "activate-at", "", "time the -staged file starts being served, in RFC 3339 format, e.g. 2026-03-01T02:00:00+01:00")
+	flags.DurationVar(&f.revertAfter, "revert-after", 0, "go back to serving the -p file this long after -activate-at, 0 keeps the -staged file")
+	flags.StringVar(&f.auditFile, "audit-log", "", "append a hash-chained record of every request and transfer to this file")
+	flags.StringVar(&f.auditKey, "audit-key", "", "sign audit records with HMAC-SHA256 using this key")
+	flags.BoolVar(&f.checksums, "checksums", false, "answer requests for <name>.sha256 and <name>.md5 with the checksum of the payload")
+	flags.BoolVar(&f.reverseDNS, "rdns", false, "resolve client addresses to names for reports, events and the audit log")
+	flags.StringVar(&f.netascii, "netascii", "convert", "how netascii requests are answered: convert line endings, reject, or octet to serve the payload unchanged")
+	flags.StringVar(&f.modes, "modes", "netascii", "transfer modes served: octet only, netascii for octet and netascii, or all to serve any other mode the payload unchanged")
+	flags.StringVar(&f.root, "root", "", "serve the files below this directory by their requested name instead of the -p file")
+	flags.BoolVar(&f.snapshot, "snapshot", false, "copy every -root file before sending it, so files overwritten in place mid-transfer are still served whole as they were when requested")
+	flags.StringVar(&f.fallback, "fallback", "", "serve this -root file for requests of files that don't exist instead of a not found ERROR, e.g. pxelinux.cfg/default")
+	flags.StringVar(&f.templateDir, "templates", "", "render the Go template <name>.tmpl below this directory for requests of <name>, with the client's {{.IP}}, {{.Port}}, {{.Path}}, {{.MAC}} and -devices attributes, e.g. {{.Device.role}}")
+	flags.StringVar(&f.cloudDir, "cloud-init", "", "render the cloud-init user-data or Ignition config <name>.tmpl below this directory for requests of <name>, like -templates, with {{json}}, {{base64}} and {{dataurl}} functions, refusing configs that aren't valid JSON for *.ign and *.json or lack a cloud-init header like #cloud-config otherwise")
+	flags.StringVar(&f.secrets, "secrets", "", "where -templates and -cloud-init look up the secrets they insert with {{secret \"name\"}}: env:PREFIX for environment variables, file:DIR for a file per secret, or vault:URL of a Vault KV v2 engine, e.g. vault:https://vault:8200/v1/secret, with the token in VAULT_TOKEN")
+	flags.StringVar(&f.devices, "devices", "", "look up the attributes of clients' devices, by the MAC address in the requested name or their IP address, in this .json or .csv inventory file or HTTP API URL with {mac} and {ip}, for -templates, -cloud-init and -resolve")
+	flags.DurationVar(&f.devicesTTL, "devices-ttl", time.Minute, "remember what a -devices API answered about a device for this long, 0 to ask it on every request")
+	flags.BoolVar(&f.writable, "writable", false, "accept uploads, stored below -upload-dir, or -root if not set, or streamed to -upload-pipe; without it every write request is refused")
+	flags.StringVar(&f.uploads, "upload-dir", "", "directory -writable stores uploads below")
+	flags.StringVar(&f.uploadCmd, "upload-pipe", "", "stream -writable uploads to stdout with -, or to the stdin of this shell command, run once per upload with TFTP_FILENAME and TFTP_CLIENT set")
+	flags.StringVar(&f.clobber, "upload-policy", uploadOverwrite, "what an upload does to an existing file of the same name: overwrite it, create new files only, refusing the upload, or rename the upload to <name>.1, <name>.2, ...")
+	flags.IntVar(&f.keep, "keep-versions", 0, "keep the last this many versions of every file -writable stores below -upload-dir or -root, below its .versions directory, served by -root as <name>@<version> or <name>@sha256:<digest> and listed and pruned through -admin")
+	flags.DurationVar(&f.minTimeout, "min-timeout", time.Second, "shortest retransmission timeout clients may ask for with the timeout option")
+	flags.DurationVar(&f.maxTimeout, "max-timeout", 255*time.Second, "longest retransmission timeout clients may ask for with the timeout option")
+	flags.IntVar(&f.minBlksize, "min-blksize", tftp.MinBlockSize, "smallest block size clients may ask for with the blksize option")
+	flags.IntVar(&f.maxBlksize, "max-blksize", tftp.MaxBlockSize, "largest block size clients may ask for with the blksize option, larger ones are lowered to it")
+	flags.StringVar(&f.retryPolicy, "retry", "fixed", "retransmission timeout: fixed at -timeout, exponential doubling from -min-timeout up to -timeout, or adaptive to each client's round trip time up to -timeout")
+	flags.DurationVar(&f.graceful, "shutdown-timeout", 30*time.Second, "time to wait for transfers in progress to end when stopped by SIGINT or SIGTERM")
+	flags.IntVar(&f.maxWindow, "max-windowsize", 64, "largest window size clients may ask for with the windowsize option, larger ones are lowered to it")
+	flags.StringVar(&f.multicast, "multicast", "", "let clients share a transfer sent to this multicast group and port (RFC 2090), e.g. 239.255.0.1:1758")
+	flags.StringVar(&f.mtftpAddr, "mtftp", "", "also answer Intel MTFTP requests of legacy PXE ROMs on this address, e.g. :1759")
+	flags.StringVar(&f.mtftpGroup, "mtftp-group", "", "multicast address and client port MTFTP transfers are sent to, as configured in the PXE ROMs, e.g. 224.1.1.0:1758")
+	flags.BoolVar(&f.compress, "compress", false, "send files gzip compressed to clients asking for it with the experimental xcompress option, e.g. get -compress")
+	flags.BoolVar(&f.resume, "resume", false, "let clients complete interrupted downloads by asking for the rest of a file with the custom offset option")
+	flags.BoolVar(&f.singlePort, "single-port", false, "send every transfer from the listen address's port instead of a port of its own, for firewalls and NATs dropping other replies")
+	flags.BoolVar(&f.strict, "strict", false, "ignore every option clients send, behaving as a plain RFC 1350 server")
+	flags.DurationVar(&f.maxDuration, "transfer-timeout", 0, "end transfers still running after this long, however often the client answers, 0 for no limit")
+	flags.DurationVar(&f.idleTimeout, "idle-timeout", 0, "end transfers whose client sent nothing for this long, counted as reaped in metrics, 0 to rely on -retries alone")
+	flags.DurationVar(&f.maxAge, "max-session-age", 24*time.Hour, "abort any transfer still running after this long, whatever it is waiting for, so stuck sessions never pile up, negative for no cap")
+	flags.IntVar(&f.maxXfers, "max-transfers", 0, "serve at most this many transfers at once, queueing further requests in the -backlog, 0 for no limit")
+	flags.IntVar(&f.backlog, "backlog", 64, "requests waiting for a transfer to end with -max-transfers running, further ones are dropped")
+	flags.BoolVar(&f.rejectBusy, "reject-busy", false, "answer requests overflowing the -backlog with a server busy ERROR instead of dropping them")
+	flags.Int64Var(&f.maxUpload, "max-upload", 0, "reject uploads larger than this many bytes, 0 for no limit")
+	flags.StringVar(&f.adminAddr, "admin", "", "serve a JSON HTTP API listing and canceling transfers, with counters and maintenance mode, on this address, e.g. 127.0.0.1:8069")
+	flags.StringVar(&f.adminToken, "admin-token", "", "require this bearer token on every admin API request, needed unless -admin listens on a loopback address")
+	flags.StringVar(&f.stateURL, "state", "", "share maintenance mode, -campaign records and, with -single-port, which server serves a client with the other servers behind the same address through the Redis server at this redis:// or rediss:// URL, e.g. redis://:password@redis:6379/0, instead of keeping them in memory")
+	flags.BoolVar(&f.standby, "standby", false, "serve only while holding the leader lease of the -state, standing by otherwise with requests dropped and -admin /ready answering 503, so a second server takes over within -lease-ttl of the first one failing")
+	flags.DurationVar(&f.leaseTTL, "lease-ttl", 3*time.Second, "how long the -standby leader lease outlives a failed leader")
+	flags.StringVar(&f.statePrefix, "state-prefix", "tftpd:", "start the keys of the -state with this prefix, telling the servers sharing it apart from other users of the Redis server")
+	flags.IntVar(&f.eventQueue, "publish-queue", 1024, "number of transfer events buffered per broker before new events are dropped")
+	flags.DurationVar(&f.flushWait, "flush-timeout", 10*time.Second, "time to wait on exit for the queued webhook notifications and events of the last transfers to be delivered")
+	flags.BoolVar(&f.noPledge, "no-pledge", false, "on OpenBSD, don't unveil only the directories served and written or pledge the promises serving needs once started, for debugging")
+
+	flags.Var(&f.bundleDefs, "bundle", "serve a tar archive of files under a name, as name=file,file,... (may be repeated)")
+	flags.Var(&f.events, "publish", "publish transfer events to a nats://host/subject or kafka-rest://host/topic broker URL (may be repeated)")
+	flags.Var(&f.allowRules, "allow", "only let clients in a subnet, or a -geoip country:CC or asn:N, optionally negated with !, transfer the files matching a pattern, optionally followed by get or put, days and hours of server time, e.g. 10.1.0.0/16=images/*.efi, country:NL=*.kpxe or '10.9.0.0/16=backups/* put mon-sat 01:00-03:00' (may be repeated)")
+	flags.Var(&f.dropRules, "drop", "drop the requests of clients in a subnet, or a -geoip country:CC or asn:N, optionally negated with !, without an answer, e.g. asn:64512 or !country:NL, which spares private and unknown addresses (may be repeated)")
+	flags.Var(&f.geoipDBs, "geoip", "look up the country and autonomous system of clients for -allow, -drop and -option rules in this MaxMind DB file, e.g. GeoLite2-Country.mmdb (may be repeated)")
+	flags.Var(&f.campaigns, "campaign", "track which clients downloaded which version of this -root file, e.g. images/fw.bin, reporting through -admin the clients updated to its current version, those on an earlier one and the devices of a -devices file still pending (may be repeated)")
+	flags.Var(&f.resolveDefs, "resolve", "try other -root files first for the requests matching conditions, e.g. 'mac:00:50:56 file:pxelinux.cfg/*=pxelinux.cfg/vmware', 'net:10.2.0.0/16=lab/{name}' or 'device:role:spine=images/{device.image}' (may be repeated)")
+	flags.Var(&f.optionRules, "option", "turn off or cap an option clients may ask for, everywhere or for the clients and files of an -allow style rule, e.g. windowsize=off, blksize=1024 or '10.1.0.0/16=*.kpxe blksize=1024' (may be repeated)")
+	flags.Var(&f.deviceHdrs, "devices-header", "send this header to a -devices API, e.g. 'Authorization: Token abc' (may be repeated)")
+	flags.Var(&f.strictNets, "strict-net", "ignore the options sent by clients in this subnet, e.g. 10.1.0.0/16 (may be repeated)")
+	flags.IntVar(&f.maxBlksize, "blocksize", tftp.MaxBlockSize, "alias of -max-blksize")
+	flags.IntVar(&f.maxWindow, "windowsize", 64, "alias of -max-windowsize")
+	flags.DurationVar(&f.maxDuration, "max-transfer-duration", 0, "alias of -transfer-timeout")
+	flags.Var(&f.webhooks, "webhook", "post a JSON notification to this URL when a transfer completes or fails (may be repeated)")
+
+	f.common.register(flags)
+}
+
+// validate checks the flags and how they're combined, before serve reads a
+// file or starts a listener
+func (f *serveFlags) validate(flags *flag.FlagSet) (err error) {
+	if err = f.common.validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case f.minTimeout > f.maxTimeout:
+		return errors.New("-min-timeout can't be longer than -max-timeout")
+	case f.maxWindow < 1:
+		return errors.New("-max-windowsize must be at least 1")
+	case f.hookQueue < 0:
+		return errors.New("-webhook-queue can't be negative")
+	case f.eventQueue < 0:
+		return errors.New("-publish-queue can't be negative")
+	case f.keep > 0 && (!f.writable || f.uploadCmd != "" || f.uploads == "" && f.root == ""):
+		return errors.New("-keep-versions needs -writable with -upload-dir or -root")
+	case f.standby && (f.stateURL == "" || f.leaseTTL <= 0):
+		return errors.New("-standby needs -state and a positive -lease-ttl")
+	case f.root != "" && (isSet(flags, "p") || f.canaryFile != "" || f.stagedFile != ""):
+		return errors.New("-p, -canary and -staged can't be combined with -root")
+	case f.root == "" && isFIFO(f.payload) && (f.canaryFile != "" || f.stagedFile != "" || len(f.bundleDefs) > 0 || f.checksums):
+		return errors.New("-p naming a FIFO can't be combined with -canary, -staged, -bundle or -checksums")
+	case f.proxyDHCP && f.root != "" && f.bootfile == "":
+		return errors.New("-proxydhcp with -root needs the -bootfile handed to clients")
+	case f.snapshot && f.root == "":
+		return errors.New("-snapshot needs -root")
+	case len(f.campaigns) > 0 && (f.root == "" || f.adminAddr == ""):
+		return errors.New("-campaign needs -root and -admin")
+	case f.denyHookTo != "" && len(f.allowRules) == 0 && len(f.dropRules) == 0:
+		return errors.New("-deny-hook needs -allow or -drop rules")
+	case f.canaryPct > 100:
+		return errors.New("canary-percent must be between 0 and 100")
+	case f.mtftpAddr != "" && f.mtftpGroup == "":
+		return errors.New("-mtftp needs -mtftp-group")
+	case f.impaired() && strings.Contains(f.address, ","):
+		return errors.New("simulated impairments need a single listen address")
+	}
+
+	switch f.clobber {
+	case uploadOverwrite, uploadCreate, uploadRename:
+	default:
+		return fmt.Errorf("unsupported upload policy %q", f.clobber)
+	}
+
+	switch {
+	case !f.writable:
+		if f.uploads != "" || f.uploadCmd != "" {
+			return errors.New("-upload-dir and -upload-pipe need -writable")
+		}
+	case f.uploads != "" && f.uploadCmd != "":
+		return errors.New("-upload-dir can't be combined with -upload-pipe")
+	case f.uploadCmd == "-" && f.common.report != "" && f.common.reportFD == 1:
+		return errors.New("-upload-pipe - and -report would both write to stdout, move the reports with -report-fd 2")
+	case f.uploads == "" && f.uploadCmd == "" && f.root == "":
+		return errors.New("-writable needs -upload-dir, -upload-pipe or -root")
+	}
+
+	switch f.netascii {
+	case "convert", "reject", "octet":
+	default:
+		return fmt.Errorf("unsupported netascii policy %q", f.netascii)
+	}
+
+	switch f.modes {
+	case "octet":
+		// serving octet only rejects netascii requests, which only agrees
+		// with -netascii reject
+		if isSet(flags, "netascii") && f.netascii != "reject" {
+			return fmt.Errorf("-modes octet can't be combined with -netascii %s", f.netascii)
+		}
+	case "netascii", "all":
+	default:
+		return fmt.Errorf("unsupported mode policy %q", f.modes)
+	}
+
+	switch f.retryPolicy {
+	case "fixed", "exponential", "adaptive":
+	default:
+		return fmt.Errorf("unsupported retry policy %q", f.retryPolicy)
+	}
+
+	if f.stagedFile != "" {
+		if f.activation, err = time.Parse(time.RFC3339, f.activateAt); err != nil {
+			return fmt.Errorf("activate-at: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// impaired reports whether any simulated network impairment is set
+func (f *serveFlags) impaired() bool {
+	return f.simLoss != 0 || f.simDelay != 0 || f.simDup != 0 || f.simOrder != 0
+}
+
+// run serves as the flags validate checked say, setting everything up
+// before starting the first listener, so a rule or file failing to load
+// never leaves a half started server behind
+func (f *serveFlags) run() error {
+	trace, report, closeTrace, err := f.common.hooks()
+	if err != nil {
+		return err
+	}
+
+	defer closeTrace()
+
+	if f.statsd != "" {
+		sink, err := newStatsdSink(f.statsd, f.prefix, f.tags, f.dogstats)
+		if err != nil {
+			return err
+		}
+
+		report = fanOut(report, sink.transfer)
+	}
+
+	// the notifications and events queued are delivered before exiting
+	var queues []*sendQueue
+
+	for _, url := range f.webhooks {
+		hook := newWebhook(url, []byte(f.hookSecret), f.hookRetries, f.hookQueue, f.hookTimeout)
+		report = fanOut(report, hook.transfer)
+		queues = append(queues, hook.queue)
+	}
+
+	for _, url := range f.events {
+		stream, err := newEventStream(url, f.eventQueue)
+		if err != nil {
+			return &exitError{code: exitUsage, err: err}
+		}
+
+		report = fanOut(report, stream.transfer)
+		queues = append(queues, stream.queue)
+	}
+
+	// the SNMP agent and the admin API share the transfer counters
+	stats := &transferStats{}
+	if f.snmpAddr != "" || f.adminAddr != "" {
+		report = fanOut(report, stats.transfer)
+	}
+
+	var agent *snmpAgent
+	if f.snmpAddr != "" {
+		if agent, err = newSNMPAgent(f.community, f.snmpOID, stats); err != nil {
+			return &exitError{code: exitUsage, err: err}
+		}
+	}
+
+	var versions *versionStore
+	if f.keep > 0 {
+		dir := f.uploads
+		if dir == "" {
+			dir = f.root
+		}
+
+		versions = &versionStore{dir: dir, keep: f.keep}
+	}
+
+	state, err := stateFor(f.stateURL, f.statePrefix)
+	if err != nil {
+		return err
+	}
+
+	var lease *leaderLease
+	if f.standby {
+		lease = newLeaderLease(state, f.leaseTTL)
+	}
+
+	var admin *adminAPI
+	if f.adminAddr != "" {
+		admin = &adminAPI{state: state, stats: stats, token: f.adminToken, versions: versions, lease: lease}
+	}
+
+	var audit *auditLog
+	if f.auditFile != "" {
+		if audit, err = newAuditLog(f.auditFile, []byte(f.auditKey)); err != nil {
+			return err
+		}
+
+		defer func() { _ = audit.Close() }()
+
+		report = fanOut(report, audit.transfer)
+	}
+
+	inventory, err := devicesFor(f.devices, f.deviceHdrs, f.devicesTTL)
+	if err != nil {
+		return err
+	}
+
+	s, err := f.server(trace, report, versions, state, inventory)
+	if err != nil {
+		return err
+	}
+
+	if audit != nil {
+		s.OnStart = fanOut(s.OnStart, audit.request)
+	}
+
+	if len(f.campaigns) > 0 {
+		admin.campaigns = newCampaignTracker(f.campaigns, s.FS, inventory, state)
+		s.OnFinish = fanOut(s.OnFinish, admin.campaigns.transfer)
+	}
+
+	geo, err := openGeoIP(f.geoipDBs)
+	if err != nil {
+		return err
+	}
+
+	if s.OptionPolicy, err = optionPolicyFor(f.optionRules, geo); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	if s.Authorize, err = authorizeFor(f.allowRules, f.dropRules, geo); err != nil {
+		return &exitError{code: exitUsage, err: err}
+	}
+
+	if f.denyHookTo != "" {
+		hook := newDenyHook(f.denyHookTo, []byte(f.hookSecret), f.denyEvery, f.hookTimeout, f.hookQueue)
+		s.Authorize = hook.authorize(s.Authorize)
+		queues = append(queues, hook.queue)
+	}
+
+	if lease != nil {
+		s.Authorize = lease.authorize(s.Authorize)
+	}
+
+	if admin != nil {
+		admin.s = s
+		s.Authorize = admin.authorize(s.Authorize)
+	}
+
+	// everything is set up, start standing by and listening
+	if lease != nil {
+		lease.renew()
+
+		go lease.run()
+		defer lease.close()
+	}
+
+	if agent != nil {
+		if err = agent.listen(f.snmpAddr); err != nil {
+			return err
+		}
+	}
+
+	if admin != nil {
+		if err = admin.listen(f.adminAddr); err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+	}
+
+	addrs := strings.Split(f.address, ",")
+
+	if f.proxyDHCP {
+		payload := f.payload
+		if f.root != "" {
+			payload = ""
+		}
+
+		if err := startProxyDHCP(addrs[0], f.nextServer, f.bootfile, payload); err != nil {
+			return err
+		}
+	}
+
+	if f.mtftpAddr != "" {
+		conn, err := net.ListenPacket("udp", f.mtftpAddr)
+		if err != nil {
+			return fmt.Errorf("mtftp: %w", err)
+		}
+
+		log.Printf("MTFTP listening on %s, sending to %s ...\n", conn.LocalAddr(), f.mtftpGroup)
+
+		go func() {
+			log.Printf("mtftp: %v", s.ServeMTFTP(conn, f.mtftpGroup))
+		}()
+	}
+
+	// on OpenBSD, give up what serving doesn't need once started
+	if !f.noPledge {
+		if err = restrict(f.sandbox()); err != nil {
+			return err
+		}
+	}
+
+	go shutdownOnSignal(s, f.graceful)
+
+	if !f.impaired() {
+		err = s.ListenAndServeAll(addrs)
+	} else {
+		conn, lErr := net.ListenPacket("udp", f.address)
+		if lErr != nil {
+			return lErr
+		}
+
+		log.Printf("Listening on %s with simulated impairments (loss %.2f, delay %s, dup %.2f, reorder %.2f) ...\n",
+			conn.LocalAddr(), f.simLoss, f.simDelay, f.simDup, f.simOrder)
+
+		sim := impairment{loss: f.simLoss, delay: f.simDelay, dup: f.simDup, reorder: f.simOrder}
+		s.Transport = sim.transport
+
+		err = s.Serve(newSimConn(conn, sim))
+	}
+
+	flush(queues, f.flushWait)
+
+	if errors.Is(err, tftp.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// server returns the server the flags describe, its Authorize hook left to
+// run
+func (f *serveFlags) server(trace func(tftp.TraceDir, net.Addr, net.Addr, []byte), report func(tftp.Transfer), versions *versionStore, state *sharedState, inventory tftp.DeviceResolver) (*tftp.Server, error) {
+	var (
+		p    []byte
+		fifo *fifoPayload
+		err  error
+	)
+
+	switch {
+	case f.root == "" && isFIFO(f.payload):
+		fifo = &fifoPayload{name: f.payload}
+	case f.root == "":
+		if p, err = readPayload(f.payload, f.minAge); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &tftp.Server{
+		Payload: p,
+		Retries: uint8(f.common.retries),
+		Timeout: f.common.timeout,
+
+		MinTimeout: f.minTimeout,
+		MaxTimeout: f.maxTimeout,
+
+		MinBlockSize:  f.minBlksize,
+		MaxBlockSize:  f.maxBlksize,
+		MaxWindowSize: f.maxWindow,
+
+		TransferTimeout: f.maxDuration,
+		IdleTimeout:     f.idleTimeout,
+		MaxSessionAge:   f.maxAge,
+
+		MaxTransfers: f.maxXfers,
+		Backlog:      f.backlog,
+		RejectBusy:   f.rejectBusy,
+
+		MulticastAddr: f.multicast,
+		Compress:      f.compress,
+		Resume:        f.resume,
+		SinglePort:    f.singlePort,
+
+		Trace:    trace,
+		OnFinish: report,
+	}
+
+	if f.singlePort && f.stateURL != "" {
+		s.Owners = state
+	}
+
+	if f.root != "" {
+		s.FS = tftp.DirFS(f.root)
+		if versions != nil {
+			s.FS = versionedFS{FS: s.FS, versions: versions}
+		}
+		if f.minAge > 0 {
+			s.FS = settledFS{FS: s.FS, minAge: f.minAge}
+		}
+		s.Fallback = f.fallback
+		s.Snapshot = f.snapshot
+	}
+
+	secretStore, err := secretsFor(f.secrets)
+	if err != nil {
+		return nil, &exitError{code: exitUsage, err: err}
+	}
+
+	if f.templateDir != "" {
+		s.Generate = (&tftp.Templates{FS: tftp.DirFS(f.templateDir), Devices: inventory, Secrets: secretStore}).Generate
+	}
+
+	if f.cloudDir != "" {
+		cloud := &tftp.CloudConfig{Templates: tftp.Templates{FS: tftp.DirFS(f.cloudDir), Devices: inventory, Secrets: secretStore}}
+		s.Generate = generateFirst(s.Generate, cloud.Generate)
+	}
+
+	if fifo != nil {
+		s.Generate = generateFirst(s.Generate, fifo.generate)
+	}
+
+	if s.Resolve, err = resolveFor(f.resolveDefs, inventory); err != nil {
+		return nil, &exitError{code: exitUsage, err: err}
+	}
+
+	if s.Strict, err = strictFor(f.strict, f.strictNets); err != nil {
+		return nil, &exitError{code: exitUsage, err: err}
+	}
+
+	switch {
+	case !f.writable:
+	case f.uploadCmd != "":
+		s.Upload = (&uploadPipe{command: f.uploadCmd}).upload
+	case f.uploads != "":
+		s.Upload = (&uploadDir{dir: f.uploads, policy: f.clobber, versions: versions}).upload
+	default:
+		s.Upload = (&uploadDir{dir: f.root, policy: f.clobber, versions: versions}).upload
+	}
+
+	s.MaxUploadSize = f.maxUpload
+
+	switch f.netascii {
+	case "reject":
+		s.ModePolicy = tftp.OctetOnly
+	case "octet":
+		s.ModePolicy = tftp.NetasciiAsOctet
+	}
+
+	switch f.modes {
+	case "octet":
+		s.ModePolicy = tftp.OctetOnly
+	case "all":
+		s.AnyMode = true
+
+		// a policy for netascii requests decides every other mode too, so
+		// it's limited to them
+		if policy := s.ModePolicy; policy != nil {
+			s.ModePolicy = func(rrq tftp.ReadReq) *tftp.Err {
+				if strings.EqualFold(rrq.Mode, "netascii") {
+					return policy(rrq)
+				}
+
+				return nil
+			}
+		}
+	}
+
+	switch f.retryPolicy {
+	case "exponential":
+		s.Retry = tftp.ExponentialRetry{Initial: f.minTimeout, Max: f.common.timeout}
+	case "adaptive":
+		s.Retry = tftp.AdaptiveRetry{Initial: f.common.timeout, Min: 10 * time.Millisecond, Max: f.common.timeout}
+	}
+
+	if f.reverseDNS {
+		rdns = newResolver(10*time.Minute, 4096, 8)
+		s.OnStart = rdns.start
+	}
+
+	return s, f.payloads(s, p)
+}
+
+// payloads sets the server's PayloadFor hook serving the -canary, -staged,
+// -bundle and -checksums files in place of, or alongside, the payload p
+func (f *serveFlags) payloads(s *tftp.Server, p []byte) error {
+	if f.canaryFile != "" {
+		c, err := readPayload(f.canaryFile, f.minAge)
+		if err != nil {
+			return err
+		}
+
+		s.PayloadFor = (&canary{stable: p, canary: c, percent: uint32(f.canaryPct)}).payloadFor
+	}
+
+	if f.stagedFile != "" {
+		staged, err := readPayload(f.stagedFile, f.minAge)
+		if err != nil {
+			return err
+		}
+
+		sched := &schedule{staged: staged, from: f.activation, next: payloadFor(s)}
+		if f.revertAfter > 0 {
+			sched.until = f.activation.Add(f.revertAfter)
+		}
+
+		s.PayloadFor = sched.payloadFor
+		log.Printf("Serving %s from %s", f.stagedFile, f.activation.Local())
+	}
+
+	if len(f.bundleDefs) > 0 {
+		b := &bundles{archives: make(map[string][]byte), next: payloadFor(s)}
+		for _, def := range f.bundleDefs {
+			if err := b.add(def); err != nil {
+				return err
+			}
+		}
+
+		s.PayloadFor = b.payloadFor
+	}
+
+	if f.checksums {
+		s.PayloadFor = (&sidecars{next: payloadFor(s), fsys: s.FS, cache: make(map[string][]byte)}).payloadFor
+	}
+
+	return nil
+}
+
+// isSet reports whether the flag name was given on the command line
+func isSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(fl *flag.Flag) { set = set || fl.Name == name })
+
+	return set
+}
+
+// shutdownOnSignal shuts s down on SIGINT or SIGTERM, waiting up to wait for
+// the transfers in progress to end before closing the ones left, whose
+// clients are sent an ERROR. A second signal exits right away.
+func shutdownOnSignal(s *tftp.Server, wait time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	log.Printf("received %s, waiting up to %s for transfers to end", <-sig, wait)
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v, closing the transfers left", err)
+		_ = s.Close()
+	}
+}
+
+// flush delivers what's left in the queues, giving up after wait
+func flush(queues []*sendQueue, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	for _, q := range queues {
+		q.flush(ctx)
+	}
+}
+
+// generateFirst returns a Generate hook trying first, if set, then next for
+// the requests first generates nothing for
+func generateFirst(first, next func(*tftp.Request) (io.Reader, int64, error)) func(*tftp.Request) (io.Reader, int64, error) {
+	if first == nil {
+		return next
+	}
+
+	return func(r *tftp.Request) (io.Reader, int64, error) {
+		if content, size, err := first(r); content != nil || err != nil {
+			return content, size, err
+		}
+
+		return next(r)
+	}
+}
+
+// payloadFor returns the server's PayloadFor hook, or one choosing its
+// Payload for every request if none is set yet, which is nil when serving
+// a Root
+func payloadFor(s *tftp.Server) func(string, tftp.ReadReq) ([]byte, string) {
+	if s.PayloadFor != nil {
+		return s.PayloadFor
+	}
+
+	p := s.Payload
+
+	return func(string, tftp.ReadReq) ([]byte, string) { return p, "" }
+}
+
+// strictFor returns the server's Strict hook, matching every client if all
+// is set or the clients in one of the subnets, or nil if neither is given
+func strictFor(all bool, subnets []string) (func(string) bool, error) {
+	if all {
+		return func(string) bool { return true }, nil
+	}
+
+	if len(subnets) == 0 {
+		return nil, nil
+	}
+
+	var nets []*net.IPNet
+
+	for _, cidr := range subnets {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("strict-net: %w", err)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return func(clientAddr string) bool {
+		ip := net.ParseIP(clientIP(clientAddr))
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// startProxyDHCP starts the ProxyDHCP responder, defaulting the next server
+// to the listen address and the boot file to the payload's name
+func startProxyDHCP(address, server, bootfile, payload string) error {
+	if server == "" {
+		server, _, _ = net.SplitHostPort(address)
+	}
+
+	if bootfile == "" {
+		switch payload {
+		case "":
+			return errors.New("proxydhcp: set the boot file handed to clients with -bootfile")
+		case "-":
+			bootfile = "boot"
+		default:
+			bootfile = filepath.Base(payload)
+		}
+	}
+
+	p, err := newProxyDHCP(server, bootfile)
+	if err != nil {
+		return err
+	}
+
+	return p.listen()
+}
+
+// readPayload reads the file served to clients, where a name of "-" reads
+// the payload from stdin until EOF. A file modified less than minAge ago is
+// read once it has stopped changing for that long.
+func readPayload(name string, minAge time.Duration) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	for {
+		fi, err := os.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("File '%s' does not exist", name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		wait := minAge - time.Since(fi.ModTime())
+		if wait <= 0 {
+			break
+		}
+
+		log.Printf("%s was modified %s ago, waiting %s for it to settle ...", name, time.Since(fi.ModTime()).Round(time.Second), wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+
+	return ioutil.ReadFile(name)
+}
+
+// settledFS refuses to open the files modified less than minAge ago, so
+// half-copied images are never served, telling clients to try again later
+type settledFS struct {
+	fs.FS
+	minAge time.Duration
+}
+
+func (s settledFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if age := time.Since(fi.ModTime()); fi.Mode().IsRegular() && age < s.minAge {
+		_ = f.Close()
+		return nil, tftp.Errorf(tftp.ErrUnknown, "%s was modified %s ago, try again in %s", name, age.Round(time.Second), (s.minAge - age).Round(time.Second))
+	}
+
+	return f, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestSettledFS(t *testing.T) {
+	fsys := settledFS{
+		FS: fstest.MapFS{
+			"settled.bin": {Data: []byte("old"), ModTime: time.Now().Add(-time.Hour)},
+			"copying.bin": {Data: []byte("half"), ModTime: time.Now().Add(-time.Second)},
+			"dir":         {Mode: fs.ModeDir, ModTime: time.Now()},
+		},
+		minAge: time.Minute,
+	}
+
+	for _, name := range []string{"settled.bin", "dir"} {
+		f, err := fsys.Open(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		_ = f.Close()
+	}
+
+	_, err := fsys.Open("copying.bin")
+
+	var tftpErr *tftp.Error
+	if !errors.As(err, &tftpErr) || tftpErr.Code != tftp.ErrUnknown {
+		t.Errorf("copying.bin: got %v, want an ERROR telling the client to try again", err)
+	}
+
+	if _, err = fsys.Open("missing.bin"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing.bin: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestServeFlagsValidate(t *testing.T) {
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{}, true},
+		{[]string{"-root", "/srv/tftp", "-writable", "-keep-versions", "3"}, true},
+		{[]string{"-min-timeout", "10s", "-max-timeout", "5s"}, false},
+		{[]string{"-windowsize", "0"}, false},
+		{[]string{"-retry", "bogus", "-snmp", ":161", "-admin", "127.0.0.1:8069"}, false},
+		{[]string{"-keep-versions", "3"}, false},
+		{[]string{"-standby"}, false},
+		{[]string{"-root", "/srv/tftp", "-p", "boot.efi"}, false},
+		{[]string{"-root", "/srv/tftp", "-proxydhcp"}, false},
+		{[]string{"-root", "/srv/tftp", "-proxydhcp", "-bootfile", "boot.efi"}, true},
+		{[]string{"-campaign", "fw.bin", "-root", "/srv/tftp"}, false},
+		{[]string{"-deny-hook", "true"}, false},
+		{[]string{"-mtftp", ":1759"}, false},
+		{[]string{"-a", "127.0.0.1:69,127.0.0.2:69", "-sim-loss", "0.1"}, false},
+		{[]string{"-writable"}, false},
+		{[]string{"-modes", "octet", "-netascii", "convert"}, false},
+		{[]string{"-modes", "octet"}, true},
+		{[]string{"-staged", "next.bin", "-activate-at", "tomorrow"}, false},
+		{[]string{"-staged", "next.bin", "-activate-at", "2026-03-01T02:00:00+01:00"}, true},
+	}
+
+	for _, tt := range tests {
+		var f serveFlags
+
+		flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+		f.register(flags)
+
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.validate(flags); (err == nil) != tt.valid {
+			t.Errorf("%q: got %v, valid %t", tt.args, err, tt.valid)
+		}
+	}
+}
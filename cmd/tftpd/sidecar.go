@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// sidecarHashes are the checksum files served for the payload, by suffix
+var sidecarHashes = map[string]func() hash.Hash{
+	".sha256": sha256.New,
+	".md5":    md5.New,
+}
+
+// sidecars answers requests for <name>.sha256 and <name>.md5 with the
+// checksum of the payload the client would get for <name>, in the format
+// read by sha256sum -c and md5sum -c. Checksums are computed on first use
+// and cached per payload variant, or per file version when serving a root.
+// A checksum file that exists below the root is served as is.
+type sidecars struct {
+	next func(clientAddr string, rrq tftp.ReadReq) ([]byte, string)
+	fsys fs.FS // files served besides the payload, if any
+
+	mu    sync.Mutex
+	cache map[string][]byte // keyed by suffix and variant or file version
+}
+
+func (s *sidecars) payloadFor(clientAddr string, rrq tftp.ReadReq) ([]byte, string) {
+	ext := path.Ext(rrq.Filename)
+
+	newHash, ok := sidecarHashes[strings.ToLower(ext)]
+	if !ok {
+		return s.next(clientAddr, rrq)
+	}
+
+	if s.fsys != nil {
+		if _, err := fs.Stat(s.fsys, tftp.FSPath(rrq.Filename)); err == nil {
+			return s.next(clientAddr, rrq)
+		}
+	}
+
+	rrq.Filename = strings.TrimSuffix(rrq.Filename, ext)
+	payload, variant := s.next(clientAddr, rrq)
+
+	var (
+		key  = ext + "/" + variant
+		data io.Reader
+	)
+
+	switch {
+	case payload != nil:
+		data = bytes.NewReader(payload)
+	case s.fsys != nil:
+		name := tftp.FSPath(rrq.Filename)
+
+		f, err := s.fsys.Open(name)
+		if err != nil {
+			return nil, "" // let the server answer file not found
+		}
+
+		defer func() { _ = f.Close() }()
+
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, ""
+		}
+
+		key = fmt.Sprintf("%s/%s/%d/%d", ext, name, fi.Size(), fi.ModTime().UnixNano())
+		data = f
+	default:
+		return nil, ""
+	}
+
+	s.mu.Lock()
+	sum, ok := s.cache[key]
+	s.mu.Unlock()
+
+	// hash without holding the lock, so a large file doesn't hold up the
+	// checksums of others; racing requests for the same one both compute it
+	if !ok {
+		h := newHash()
+		if _, err := io.Copy(h, data); err != nil {
+			return nil, ""
+		}
+
+		sum = []byte(hex.EncodeToString(h.Sum(nil)))
+
+		s.mu.Lock()
+		s.cache[key] = sum
+		s.mu.Unlock()
+	}
+
+	return []byte(fmt.Sprintf("%s  %s\n", sum, path.Base(rrq.Filename))), variant
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestSidecarsPayload(t *testing.T) {
+	c := &canary{stable: []byte("stable"), canary: []byte("canary"), percent: 50}
+	s := &sidecars{next: c.payloadFor, cache: make(map[string][]byte)}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		payload, variant := c.payloadFor(ip+":2000", tftp.ReadReq{Filename: "boot/pxelinux.0"})
+
+		sha := sha256.Sum256(payload)
+		got, gotVariant := s.payloadFor(ip+":2000", tftp.ReadReq{Filename: "boot/pxelinux.0.sha256"})
+		if want := hex.EncodeToString(sha[:]) + "  pxelinux.0\n"; string(got) != want || gotVariant != variant {
+			t.Errorf("%s: got %q (%s), want %q (%s)", ip, got, gotVariant, want, variant)
+		}
+
+		sum := md5.Sum(payload)
+		got, _ = s.payloadFor(ip+":2000", tftp.ReadReq{Filename: "boot/pxelinux.0.MD5"})
+		if want := hex.EncodeToString(sum[:]) + "  pxelinux.0\n"; string(got) != want {
+			t.Errorf("%s: got %q, want %q", ip, got, want)
+		}
+	}
+
+	if got, _ := s.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "pxelinux.0"}); string(got) != "stable" && string(got) != "canary" {
+		t.Errorf("the payload itself: got %q", got)
+	}
+}
+
+func TestSidecarsRoot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"kernel":        {Data: []byte("v1"), ModTime: time.Unix(1, 0)},
+		"initrd.sha256": {Data: []byte("from disk\n")},
+		"boot":          {Mode: fs.ModeDir | 0o755},
+	}
+	none := func(string, tftp.ReadReq) ([]byte, string) { return nil, "" }
+	s := &sidecars{next: none, fsys: fsys, cache: make(map[string][]byte)}
+
+	sum := func(data string) string {
+		h := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(h[:]) + "  kernel\n"
+	}
+
+	if got, _ := s.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "kernel.sha256"}); string(got) != sum("v1") {
+		t.Errorf("got %q, want %q", got, sum("v1"))
+	}
+
+	// a new version of the file gets a new checksum
+	fsys["kernel"] = &fstest.MapFile{Data: []byte("v2"), ModTime: time.Unix(2, 0)}
+
+	if got, _ := s.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: "kernel.sha256"}); string(got) != sum("v2") {
+		t.Errorf("after a change: got %q, want %q", got, sum("v2"))
+	}
+
+	// checksum files below the root, missing files and directories are left
+	// to the server
+	for _, name := range []string{"initrd.sha256", "missing.sha256", "boot.sha256"} {
+		if got, _ := s.payloadFor("10.0.0.1:2000", tftp.ReadReq{Filename: name}); got != nil {
+			t.Errorf("%s: got %q, want it left to the server", name, got)
+		}
+	}
+}
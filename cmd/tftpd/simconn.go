@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// reorderDelay is the extra latency given to a packet chosen for reordering
+// so packets sent after it overtake it
+const reorderDelay = 20 * time.Millisecond
+
+// impairment are the faults a simConn injects
+type impairment struct {
+	loss    float64       // probability a packet is dropped
+	delay   time.Duration // latency added to every packet
+	dup     float64       // probability a packet is delivered twice
+	reorder float64       // probability a packet is held back behind later ones
+}
+
+// transport is the server's Transport, impairing the socket of every
+// transfer like the listening one, on an ephemeral port of the IP address
+// the request was read from unless that's a wildcard
+func (sim impairment) transport(ctx context.Context, local, _ net.Addr) (net.PacketConn, error) {
+	address := ":0"
+	if addr, ok := local.(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+		address = net.JoinHostPort(addr.IP.String(), "0")
+	}
+
+	var lc net.ListenConfig
+
+	conn, err := lc.ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSimConn(conn, sim), nil
+}
+
+// simConn wraps a PacketConn and injects packet loss, delay, duplication and
+// reordering in both directions, emulating a bad network for lab testing
+type simConn struct {
+	net.PacketConn
+	impairment
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	err      error         // error that stopped the receiver
+	deadline time.Time     // of reads, none if zero
+	wake     chan struct{} // closed when the read deadline changes
+
+	once sync.Once
+	in   chan simPacket
+	done chan struct{}
+}
+
+type simPacket struct {
+	p    []byte
+	addr net.Addr
+}
+
+func newSimConn(conn net.PacketConn, sim impairment) *simConn {
+	return &simConn{
+		PacketConn: conn,
+		impairment: sim,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:       make(chan struct{}),
+		in:         make(chan simPacket, 64),
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *simConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.once.Do(func() { go c.receive() })
+
+	for {
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+
+		timeout := make(<-chan time.Time)
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.in:
+			stopTimer(timer)
+			return copy(p, pkt.p), pkt.addr, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			// wait again for the new deadline
+			stopTimer(timer)
+		case <-c.done:
+			stopTimer(timer)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			return 0, nil, c.err
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// SetDeadline only sets the read deadline, as writes never block
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline applies to the impaired packets ReadFrom returns, rather
+// than to the underlying connection, which the receiver keeps reading
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+
+	close(c.wake)
+	c.wake = make(chan struct{})
+
+	return nil
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.impair(simPacket{p: append([]byte(nil), p...), addr: addr}, func(pkt simPacket) {
+		_, _ = c.PacketConn.WriteTo(pkt.p, pkt.addr)
+	})
+
+	return len(p), nil
+}
+
+// receive reads from the underlying connection and queues impaired packets
+// for ReadFrom until the connection fails
+func (c *simConn) receive() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+
+			close(c.done)
+			return
+		}
+
+		c.impair(simPacket{p: append([]byte(nil), buf[:n]...), addr: addr}, func(pkt simPacket) {
+			select {
+			case c.in <- pkt:
+			case <-c.done:
+			}
+		})
+	}
+}
+
+// impair drops, duplicates or delays pkt before passing it to deliver
+func (c *simConn) impair(pkt simPacket, deliver func(simPacket)) {
+	c.mu.Lock()
+	drop := c.rnd.Float64() < c.loss
+	copies := 1
+	if c.rnd.Float64() < c.dup {
+		copies = 2
+	}
+	delay := c.delay
+	if c.rnd.Float64() < c.reorder {
+		delay += reorderDelay
+	}
+	c.mu.Unlock()
+
+	if drop {
+		return
+	}
+
+	for i := 0; i < copies; i++ {
+		if delay == 0 {
+			deliver(pkt)
+			continue
+		}
+
+		time.AfterFunc(delay, func() { deliver(pkt) })
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BER tags of the SNMPv2c messages handled by the agent (RFC 3416)
+const (
+	berInteger   = 0x02
+	berOctets    = 0x04
+	berOID       = 0x06
+	berSequence  = 0x30
+	berTimeTicks = 0x43
+	berCounter32 = 0x41
+	berCounter64 = 0x46
+
+	pduGet     = 0xa0
+	pduGetNext = 0xa1
+	pduResp    = 0xa2
+	pduGetBulk = 0xa5
+
+	noSuchObject = 0x80
+	endOfMibView = 0x82
+
+	errTooBig = 1 // error-status of a response that wouldn't fit
+
+	maxRepetitions = 64   // upper bound of GetBulk repetitions answered
+	maxMessageSize = 1472 // largest response, fitting an Ethernet frame in an IPv4 datagram
+)
+
+// snmpAgent is a read-only SNMPv2c agent exposing the server's transfer
+// counters below a configurable base OID, alongside sysDescr and sysUpTime:
+//
+//	<base>.1.0  transfers completed (Counter32)
+//	<base>.2.0  transfers failed    (Counter32)
+//	<base>.3.0  payload bytes sent  (Counter64)
+//	<base>.4.0  transfers reaped    (Counter32), idle for -idle-timeout
+//
+// Get, GetNext and GetBulk are supported, so the counters can be walked.
+// Responses are kept within maxMessageSize bytes, so a GetBulk can't turn a
+// small spoofed request into a flood of varbinds.
+// SNMPv1 and v3 requests are ignored.
+type snmpAgent struct {
+	stats     *transferStats
+	community string
+	base      []uint32
+	start     time.Time
+}
+
+type snmpObject struct {
+	oid   []uint32
+	value []byte // BER encoded
+}
+
+func newSNMPAgent(community, base string, stats *transferStats) (*snmpAgent, error) {
+	oid, err := parseOID(base)
+	if err != nil {
+		return nil, fmt.Errorf("snmp: base OID: %w", err)
+	}
+
+	return &snmpAgent{stats: stats, community: community, base: oid, start: time.Now()}, nil
+}
+
+// listen starts answering requests on addr in the background
+func (a *snmpAgent) listen(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("snmp: %w", err)
+	}
+
+	log.Printf("SNMP agent listening on %s ...\n", conn.LocalAddr())
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("snmp: %v", err)
+				return
+			}
+
+			resp, err := a.handle(buf[:n])
+			if err != nil {
+				log.Printf("[%s] snmp: %v", addr, err)
+				continue
+			}
+
+			if _, err = conn.WriteTo(resp, addr); err != nil {
+				log.Printf("[%s] snmp: %v", addr, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// objects returns a snapshot of the agent's objects in lexicographic order
+func (a *snmpAgent) objects() []snmpObject {
+	counter := func(n uint32) []uint32 { return append(append([]uint32(nil), a.base...), n, 0) }
+	counts := a.stats.counts()
+
+	objs := []snmpObject{
+		{[]uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}, berTLV(berOctets, []byte("tftp-server"))},
+		{[]uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}, berTLV(berTimeTicks, berUint(uint64(time.Since(a.start)/(10*time.Millisecond))))},
+		{counter(1), berTLV(berCounter32, berUint(uint64(uint32(counts.Completed))))},
+		{counter(2), berTLV(berCounter32, berUint(uint64(uint32(counts.Failed))))},
+		{counter(3), berTLV(berCounter64, berUint(counts.Bytes))},
+		{counter(4), berTLV(berCounter32, berUint(uint64(uint32(counts.Reaped))))},
+	}
+
+	sort.Slice(objs, func(i, j int) bool { return compareOID(objs[i].oid, objs[j].oid) < 0 })
+
+	return objs
+}
+
+// handle decodes a request and returns the encoded response
+func (a *snmpAgent) handle(req []byte) ([]byte, error) {
+	tag, msg, _, err := berNext(req)
+	if err != nil || tag != berSequence {
+		return nil, errors.New("malformed message")
+	}
+
+	var version, community, pdu []byte
+	var pduType byte
+
+	if _, version, msg, err = berNext(msg); err != nil {
+		return nil, err
+	}
+
+	if len(version) != 1 || version[0] != 1 {
+		return nil, errors.New("only SNMPv2c is supported")
+	}
+
+	if _, community, msg, err = berNext(msg); err != nil {
+		return nil, err
+	}
+
+	if string(community) != a.community {
+		return nil, errors.New("unknown community")
+	}
+
+	if pduType, pdu, _, err = berNext(msg); err != nil {
+		return nil, err
+	}
+
+	var reqID, nonRep, maxRep, varbinds []byte
+
+	for _, field := range []*[]byte{&reqID, &nonRep, &maxRep, &varbinds} {
+		if _, *field, pdu, err = berNext(pdu); err != nil {
+			return nil, err
+		}
+	}
+
+	var oids [][]uint32
+
+	for len(varbinds) > 0 {
+		var vb, name []byte
+
+		if _, vb, varbinds, err = berNext(varbinds); err != nil {
+			return nil, err
+		}
+
+		if _, name, _, err = berNext(vb); err != nil {
+			return nil, err
+		}
+
+		oids = append(oids, decodeOID(name))
+	}
+
+	objs := a.objects()
+
+	// varbinds are added while the response stays within maxMessageSize,
+	// allowing up front for the length fields enclosing them growing
+	header := len(response(version, community, reqID, 0, nil))
+	budget := maxMessageSize - header - 3*4
+
+	var (
+		out    []byte
+		tooBig bool
+		add    = func(vb []byte) bool {
+			if len(out)+len(vb) > budget {
+				return false
+			}
+
+			out = append(out, vb...)
+
+			return true
+		}
+	)
+
+	switch pduType {
+	case pduGet:
+		for _, oid := range oids {
+			tooBig = tooBig || !add(getObject(objs, oid))
+		}
+	case pduGetNext:
+		for _, oid := range oids {
+			_, vb := nextObject(objs, oid)
+			tooBig = tooBig || !add(vb)
+		}
+	case pduGetBulk:
+		n, reps := int(berInt(nonRep)), int(berInt(maxRep))
+		if n < 0 || n > len(oids) {
+			n = len(oids)
+		}
+
+		if reps > maxRepetitions {
+			reps = maxRepetitions
+		}
+
+		// varbinds that don't fit are left off the end (RFC 3416 section
+		// 4.2.3), so the response never outgrows the limit however many
+		// repetitions of however many names are asked for
+		full := false
+		for _, oid := range oids[:n] {
+			_, vb := nextObject(objs, oid)
+			if full = !add(vb); full {
+				break
+			}
+		}
+
+		repeat := oids[n:]
+		for r := 0; r < reps && len(repeat) > 0 && !full; r++ {
+			for i, oid := range repeat {
+				var vb []byte
+				repeat[i], vb = nextObject(objs, oid)
+
+				if full = !add(vb); full {
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU type %#x", pduType)
+	}
+
+	// a Get or GetNext that doesn't fit is answered with no varbinds at all
+	// (RFC 3416 section 4.2.1)
+	if tooBig {
+		return response(version, community, reqID, errTooBig, nil), nil
+	}
+
+	return response(version, community, reqID, 0, out), nil
+}
+
+// response encodes a response message carrying the encoded varbinds
+func response(version, community, reqID []byte, status byte, varbinds []byte) []byte {
+	pdu := berTLV(pduResp, concat(berTLV(berInteger, reqID), berTLV(berInteger, []byte{status}), berTLV(berInteger, []byte{0}), berTLV(berSequence, varbinds)))
+
+	return berTLV(berSequence, concat(berTLV(berInteger, version), berTLV(berOctets, community), pdu))
+}
+
+// getObject returns the varbind of the object named oid
+func getObject(objs []snmpObject, oid []uint32) []byte {
+	for _, o := range objs {
+		if compareOID(o.oid, oid) == 0 {
+			return varbind(o.oid, o.value)
+		}
+	}
+
+	return varbind(oid, []byte{noSuchObject, 0})
+}
+
+// nextObject returns the name and varbind of the first object following oid
+func nextObject(objs []snmpObject, oid []uint32) ([]uint32, []byte) {
+	for _, o := range objs {
+		if compareOID(o.oid, oid) > 0 {
+			return o.oid, varbind(o.oid, o.value)
+		}
+	}
+
+	return oid, varbind(oid, []byte{endOfMibView, 0})
+}
+
+func varbind(oid []uint32, value []byte) []byte {
+	return berTLV(berSequence, concat(berTLV(berOID, encodeOID(oid)), value))
+}
+
+// berNext splits the first TLV off b, returning its tag, value and the
+// bytes following it
+func berNext(b []byte) (tag byte, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated BER value")
+	}
+
+	tag, n, b := b[0], int(b[1]), b[2:]
+
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, errors.New("unsupported BER length")
+		}
+
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+
+		b = b[size:]
+	}
+
+	if len(b) < n {
+		return 0, nil, nil, errors.New("truncated BER value")
+	}
+
+	return tag, b[:n], b[n:], nil
+}
+
+// berTLV encodes a value with its tag and length, in the short form below
+// 128 bytes and the long form with as few length bytes as needed above
+func berTLV(tag byte, value []byte) []byte {
+	n := len(value)
+
+	b := []byte{tag}
+
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var size []byte
+		for ; n > 0; n >>= 8 {
+			size = append([]byte{byte(n)}, size...)
+		}
+
+		b = append(append(b, 0x80|byte(len(size))), size...)
+	}
+
+	return append(b, value...)
+}
+
+func berInt(b []byte) int64 {
+	var n int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			n = -1
+		}
+
+		n = n<<8 | int64(c)
+	}
+
+	return n
+}
+
+// berUint encodes an unsigned value, adding a leading zero byte when the
+// high bit is set so it isn't read back as negative
+func berUint(n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+
+	return b
+}
+
+func parseOID(s string) ([]uint32, error) {
+	var oid []uint32
+
+	for _, part := range strings.Split(strings.Trim(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		oid = append(oid, uint32(n))
+	}
+
+	if len(oid) < 2 || oid[0] > 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	return oid, nil
+}
+
+func encodeOID(oid []uint32) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+
+	var b []byte
+
+	for _, n := range append([]uint32{oid[0]*40 + oid[1]}, oid[2:]...) {
+		enc := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			enc = append([]byte{byte(n&0x7f) | 0x80}, enc...)
+		}
+
+		b = append(b, enc...)
+	}
+
+	return b
+}
+
+func decodeOID(b []byte) []uint32 {
+	var (
+		oid []uint32
+		n   uint32
+	)
+
+	for _, c := range b {
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			continue
+		}
+
+		if oid == nil {
+			oid = []uint32{n / 40, n % 40}
+			if n >= 80 {
+				oid = []uint32{2, n - 80}
+			}
+		} else {
+			oid = append(oid, n)
+		}
+
+		n = 0
+	}
+
+	return oid
+}
+
+func compareOID(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+
+	return b
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBERLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 65536, 70000} {
+		value := bytes.Repeat([]byte{'x'}, n)
+		enc := berTLV(berOctets, value)
+
+		tag, got, rest, err := berNext(enc)
+		if err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+			continue
+		}
+
+		if tag != berOctets || !bytes.Equal(got, value) || len(rest) != 0 {
+			t.Errorf("%d bytes: decoded tag %#x with %d bytes and %d left", n, tag, len(got), len(rest))
+		}
+	}
+
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{127, []byte{berOctets, 0x7f}},
+		{128, []byte{berOctets, 0x81, 0x80}},
+		{256, []byte{berOctets, 0x82, 0x01, 0x00}},
+		{65536, []byte{berOctets, 0x83, 0x01, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		if got := berTLV(berOctets, make([]byte, tt.n))[:len(tt.want)]; !bytes.Equal(got, tt.want) {
+			t.Errorf("length %d encoded as % x, want % x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBERNextMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"tag only", []byte{berSequence}},
+		{"short value", []byte{berSequence, 3, 1, 2}},
+		{"indefinite length", []byte{berSequence, 0x80, 1}},
+		{"long length", []byte{berSequence, 0x84, 0, 0, 0, 1, 1}},
+		{"truncated length", []byte{berSequence, 0x82, 1}},
+		{"short long form value", []byte{berSequence, 0x81, 0x80, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := berNext(tt.in); err == nil {
+				t.Errorf("% x decoded without error", tt.in)
+			}
+		})
+	}
+}
+
+func TestBERIntegers(t *testing.T) {
+	for _, n := range []uint64{0, 1, 127, 128, 255, 256, 1 << 31, 1<<63 + 5} {
+		enc := berUint(n)
+		if enc[0]&0x80 != 0 {
+			t.Errorf("%d encoded as negative % x", n, enc)
+		}
+
+		if n < 1<<62 && uint64(berInt(enc)) != n {
+			t.Errorf("%d decoded as %d", n, berInt(enc))
+		}
+	}
+
+	if got := berInt([]byte{0xff}); got != -1 {
+		t.Errorf("ff decoded as %d, want -1", got)
+	}
+}
+
+func TestOID(t *testing.T) {
+	for _, s := range []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.3.6969", "2.999.1", "1.3.268435455"} {
+		oid, err := parseOID(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+
+		if got := decodeOID(encodeOID(oid)); compareOID(got, oid) != 0 {
+			t.Errorf("%s came back as %v", s, got)
+		}
+	}
+
+	for _, s := range []string{"", "1", "3.1", "1.x", "1.3.4294967296"} {
+		if _, err := parseOID(s); err == nil {
+			t.Errorf("%q parsed without error", s)
+		}
+	}
+}
+
+// snmpRequest encodes an SNMPv2c request of the PDU type for the OIDs
+func snmpRequest(community string, pduType byte, nonRep, maxRep byte, oids ...string) []byte {
+	var varbinds []byte
+	for _, s := range oids {
+		oid, _ := parseOID(s)
+		varbinds = append(varbinds, berTLV(berSequence, concat(berTLV(berOID, encodeOID(oid)), []byte{0x05, 0}))...)
+	}
+
+	pdu := berTLV(pduType, concat(berTLV(berInteger, []byte{42}), berTLV(berInteger, []byte{nonRep}), berTLV(berInteger, []byte{maxRep}), berTLV(berSequence, varbinds)))
+
+	return berTLV(berSequence, concat(berTLV(berInteger, []byte{1}), berTLV(berOctets, []byte(community)), pdu))
+}
+
+// snmpResponse decodes a response into its error-status and the OIDs and
+// encoded values of its varbinds
+func snmpResponse(t *testing.T, msg []byte) (status int64, oids [][]uint32, values [][]byte) {
+	t.Helper()
+
+	_, msg, _, err := berNext(msg)
+	if err == nil {
+		_, _, msg, err = berNext(msg) // version
+	}
+
+	if err == nil {
+		_, _, msg, err = berNext(msg) // community
+	}
+
+	var pdu, field, varbinds []byte
+	if err == nil {
+		_, pdu, _, err = berNext(msg)
+	}
+
+	if err == nil {
+		_, _, pdu, err = berNext(pdu) // request-id
+	}
+
+	if err == nil {
+		_, field, pdu, err = berNext(pdu)
+		status = berInt(field)
+	}
+
+	if err == nil {
+		_, _, pdu, err = berNext(pdu) // error-index
+	}
+
+	if err == nil {
+		_, varbinds, _, err = berNext(pdu)
+	}
+
+	for err == nil && len(varbinds) > 0 {
+		var vb, name []byte
+		if _, vb, varbinds, err = berNext(varbinds); err == nil {
+			_, name, vb, err = berNext(vb)
+			oids, values = append(oids, decodeOID(name)), append(values, vb)
+		}
+	}
+
+	if err != nil {
+		t.Fatalf("malformed response: %v", err)
+	}
+
+	return status, oids, values
+}
+
+func TestSNMPAgent(t *testing.T) {
+	stats := &transferStats{completed: 3, bytes: 1 << 40}
+
+	a, err := newSNMPAgent("public", "1.3.6.1.3.6969", stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		req      []byte
+		wantOIDs []string
+		wantErr  int64
+	}{
+		{
+			name:     "get",
+			req:      snmpRequest("public", pduGet, 0, 0, "1.3.6.1.3.6969.1.0", "1.3.6.1.3.6969.3.0"),
+			wantOIDs: []string{"1.3.6.1.3.6969.1.0", "1.3.6.1.3.6969.3.0"},
+		},
+		{
+			name:     "get unknown",
+			req:      snmpRequest("public", pduGet, 0, 0, "1.3.6.1.3.6969.9.0"),
+			wantOIDs: []string{"1.3.6.1.3.6969.9.0"},
+		},
+		{
+			name:     "get next",
+			req:      snmpRequest("public", pduGetNext, 0, 0, "1.3.6.1.3.6969"),
+			wantOIDs: []string{"1.3.6.1.3.6969.1.0"},
+		},
+		{
+			name:     "get next past the end",
+			req:      snmpRequest("public", pduGetNext, 0, 0, "1.3.6.1.3.6969.4.0"),
+			wantOIDs: []string{"1.3.6.1.3.6969.4.0"},
+		},
+		{
+			name:     "get bulk",
+			req:      snmpRequest("public", pduGetBulk, 1, 3, "1.3.6.1.2.1.1.1", "1.3.6.1.3.6969"),
+			wantOIDs: []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.3.6969.1.0", "1.3.6.1.3.6969.2.0", "1.3.6.1.3.6969.3.0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := a.handle(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			status, oids, _ := snmpResponse(t, resp)
+			if status != tt.wantErr {
+				t.Errorf("error-status %d, want %d", status, tt.wantErr)
+			}
+
+			if len(oids) != len(tt.wantOIDs) {
+				t.Fatalf("got %d varbinds, want %d", len(oids), len(tt.wantOIDs))
+			}
+
+			for i, s := range tt.wantOIDs {
+				want, _ := parseOID(s)
+				if compareOID(oids[i], want) != 0 {
+					t.Errorf("varbind %d is %v, want %s", i, oids[i], s)
+				}
+			}
+		})
+	}
+}
+
+func TestSNMPAgentBulkBounded(t *testing.T) {
+	a, err := newSNMPAgent("public", "1.3.6.1.3.6969", &transferStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a hundred names, each repeated as often as allowed
+	var oids []string
+	for i := 0; i < 100; i++ {
+		oids = append(oids, "1.3")
+	}
+
+	resp, err := a.handle(snmpRequest("public", pduGetBulk, 0, maxRepetitions, oids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp) > maxMessageSize {
+		t.Errorf("response of %d bytes, want at most %d", len(resp), maxMessageSize)
+	}
+
+	status, got, _ := snmpResponse(t, resp)
+	if status != 0 || len(got) == 0 {
+		t.Errorf("got error-status %d and %d varbinds, want the ones fitting", status, len(got))
+	}
+
+	// a Get that doesn't fit is refused as a whole
+	long := "1.3.6.1.3.6969" + strings.Repeat(".1", 50)
+	for i := range oids {
+		oids[i] = long
+	}
+
+	resp, err = a.handle(snmpRequest("public", pduGet, 0, 0, oids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, got, _ = snmpResponse(t, resp); status != errTooBig || len(got) != 0 {
+		t.Errorf("got error-status %d and %d varbinds, want tooBig and none", status, len(got))
+	}
+}
+
+func TestSNMPAgentRejects(t *testing.T) {
+	a, err := newSNMPAgent("public", "1.3.6.1.3.6969", &transferStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := snmpRequest("public", pduGetBulk, 0, 2, "1.3.6.1.3.6969")
+
+	tests := []struct {
+		name string
+		req  []byte
+	}{
+		{"wrong community", snmpRequest("private", pduGet, 0, 0, "1.3.6.1.3.6969.1.0")},
+		{"set", snmpRequest("public", 0xa3, 0, 0, "1.3.6.1.3.6969.1.0")},
+		{"SNMPv1", append([]byte{berSequence, byte(len(valid) - 2), berInteger, 1, 0}, valid[5:]...)},
+		{"not a sequence", append([]byte{berOctets}, valid[1:]...)},
+	}
+
+	// every truncation of a valid request
+	for i := 0; i < len(valid); i++ {
+		tests = append(tests, struct {
+			name string
+			req  []byte
+		}{"truncated", valid[:i]})
+	}
+
+	for _, tt := range tests {
+		if resp, err := a.handle(tt.req); err == nil {
+			t.Errorf("%s: % x answered with % x", tt.name, tt.req, resp)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+
+package main
+
+import "errors"
+
+func setBroadcast(uintptr) error {
+	return errors.New("broadcast sockets are not supported on this platform")
+}
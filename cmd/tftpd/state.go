@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateStore holds the state servers behind one address share, so they
+// behave as one: maintenance mode, campaign records and, in single-port
+// mode, which server owns a client's session. Values expire after their
+// ttl, if not 0.
+type stateStore interface {
+	get(ctx context.Context, key string) (value string, ok bool, err error)
+	set(ctx context.Context, key, value string, ttl time.Duration) error
+	// setNX sets key unless it's set already, reporting whether it did
+	setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	del(ctx context.Context, key string) error
+	// delIf deletes key if it's set to value
+	delIf(ctx context.Context, key, value string) error
+	// expireIf sets the ttl of key if it's set to value, reporting whether
+	// it is
+	expireIf(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	hset(ctx context.Context, key, field, value string) error
+	hgetall(ctx context.Context, key string) (map[string]string, error)
+}
+
+// sharedState is the state of a server, under keys starting with a prefix
+// telling its servers apart from others sharing the store
+type sharedState struct {
+	store    stateStore
+	prefix   string
+	instance string        // tells the server apart from the others sharing the state
+	claimTTL time.Duration // claims expire after unless refreshed, in case their server died
+
+	mu     sync.Mutex
+	claims map[string]chan struct{} // closed to stop refreshing a claim, by client
+}
+
+// claimTTL is how long the claim of a session outlives its server, whose
+// clients the other servers sharing the state ignore until then. Claims are
+// refreshed three times as often while their transfer runs.
+const claimTTL = 30 * time.Second
+
+// stateFor returns the state kept by source: empty for memory, only the
+// server's own, or the redis:// or rediss:// URL of a Redis server, e.g.
+// redis://:password@redis:6379/2, shared with the other servers using it
+func stateFor(source, prefix string) (*sharedState, error) {
+	s := &sharedState{prefix: prefix, instance: instanceID(), claimTTL: claimTTL}
+
+	if source == "" {
+		s.store = &memoryState{}
+		return s, nil
+	}
+
+	r, err := newRedisState(source)
+	if err != nil {
+		return nil, err
+	}
+
+	s.store = r
+
+	return s, nil
+}
+
+// instanceID returns a name for the server, unique among those sharing the
+// state
+func instanceID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "tftpd"
+	}
+
+	return host + "-" + hex.EncodeToString(b)
+}
+
+func (s *sharedState) maintenance(ctx context.Context) (bool, error) {
+	v, _, err := s.store.get(ctx, s.prefix+"maintenance")
+	return v == "1", err
+}
+
+func (s *sharedState) setMaintenance(ctx context.Context, on bool) error {
+	if !on {
+		return s.store.del(ctx, s.prefix+"maintenance")
+	}
+
+	return s.store.set(ctx, s.prefix+"maintenance", "1", 0)
+}
+
+// Claim, Release and OwnedElsewhere make the state the tftp.SessionOwners
+// of the servers sharing it. A claim is refreshed until released.
+func (s *sharedState) Claim(ctx context.Context, clientAddr string) (bool, error) {
+	key := s.prefix + "session:" + clientAddr
+
+	ok, err := s.store.setNX(ctx, key, s.instance, s.claimTTL)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		owner, _, err := s.store.get(ctx, key)
+		if err != nil || owner != s.instance {
+			return false, err
+		}
+	}
+
+	s.refresh(key, clientAddr)
+
+	return true, nil
+}
+
+// refresh extends the claim of key until clientAddr's session is released
+// or the claim found lost
+func (s *sharedState) refresh(key, clientAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.claims[clientAddr]; ok {
+		return
+	}
+
+	if s.claims == nil {
+		s.claims = make(map[string]chan struct{})
+	}
+
+	stop := make(chan struct{})
+	s.claims[clientAddr] = stop
+
+	go func() {
+		t := time.NewTicker(s.claimTTL / 3)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), s.claimTTL/3)
+			ok, err := s.store.expireIf(ctx, key, s.instance, s.claimTTL)
+			cancel()
+
+			if err == nil && !ok {
+				log.Printf("state: lost the claim of %s", clientAddr)
+				return
+			}
+		}
+	}()
+}
+
+// Release deletes the claim only if it's still the server's, keeping one
+// another server made after it expired
+func (s *sharedState) Release(clientAddr string) error {
+	s.mu.Lock()
+	if stop, ok := s.claims[clientAddr]; ok {
+		close(stop)
+		delete(s.claims, clientAddr)
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.store.delIf(ctx, s.prefix+"session:"+clientAddr, s.instance)
+}
+
+func (s *sharedState) OwnedElsewhere(ctx context.Context, clientAddr string) (bool, error) {
+	owner, ok, err := s.store.get(ctx, s.prefix+"session:"+clientAddr)
+	return ok && owner != s.instance, err
+}
+
+// memoryState is a stateStore of a single server
+type memoryState struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   string
+	hash    map[string]string
+	expires time.Time // zero for never
+}
+
+// entry returns the entry of key unless it expired, with mu held
+func (m *memoryState) entry(key string) (memoryEntry, bool) {
+	e, ok := m.entries[key]
+	if ok && !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+
+	return e, ok
+}
+
+func (m *memoryState) put(key string, e memoryEntry, ttl time.Duration) {
+	if m.entries == nil {
+		m.entries = make(map[string]memoryEntry)
+	}
+
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+
+	m.entries[key] = e
+}
+
+func (m *memoryState) get(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(key)
+
+	return e.value, ok, nil
+}
+
+func (m *memoryState) set(_ context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(key, memoryEntry{value: value}, ttl)
+
+	return nil
+}
+
+func (m *memoryState) setNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entry(key); ok {
+		return false, nil
+	}
+
+	m.put(key, memoryEntry{value: value}, ttl)
+
+	return true, nil
+}
+
+func (m *memoryState) del(_ context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *memoryState) delIf(_ context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entry(key); ok && e.hash == nil && e.value == value {
+		delete(m.entries, key)
+	}
+
+	return nil
+}
+
+func (m *memoryState) expireIf(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(key)
+	if !ok || e.hash != nil || e.value != value {
+		return false, nil
+	}
+
+	e.expires = time.Time{}
+	m.put(key, e, ttl)
+
+	return true, nil
+}
+
+func (m *memoryState) hset(_ context.Context, key, field, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entry(key)
+	if !ok || e.hash == nil {
+		e = memoryEntry{hash: make(map[string]string)}
+		m.put(key, e, 0)
+	}
+
+	e.hash[field] = value
+
+	return nil
+}
+
+func (m *memoryState) hgetall(_ context.Context, key string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, _ := m.entry(key)
+
+	hash := make(map[string]string, len(e.hash))
+	for field, value := range e.hash {
+		hash[field] = value
+	}
+
+	return hash, nil
+}
+
+// redisState is a stateStore kept by a Redis server, over a connection
+// dialed again after failing. Commands are sent one at a time.
+type redisState struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+
+	mu   sync.Mutex // serializes the commands on the connection
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is the reply of a missing key
+var errRedisNil = errors.New("redis: nil")
+
+func newRedisState(rawURL string) (*redisState, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("%s: state is kept in memory or by a redis:// or rediss:// URL", u.Redacted())
+	}
+
+	r := &redisState{addr: u.Host, tls: u.Scheme == "rediss"}
+
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("%s: invalid database %q", u.Redacted(), db)
+		}
+	}
+
+	return r, nil
+}
+
+// connect dials the server, authenticating and selecting the database,
+// with mu held
+func (r *redisState) connect(ctx context.Context) error {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+
+	conn, err := d.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return err
+	}
+
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+
+	r.conn, r.r = conn, bufio.NewReader(conn)
+
+	if r.password != "" {
+		if _, err = r.roundTrip(ctx, "AUTH", r.password); err != nil {
+			return err
+		}
+	}
+
+	if r.db != 0 {
+		if _, err = r.roundTrip(ctx, "SELECT", strconv.Itoa(r.db)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// do sends a command and returns its reply: a string, an int64, a slice of
+// replies, or errRedisNil
+func (r *redisState) do(ctx context.Context, args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			r.close()
+			return nil, fmt.Errorf("redis %s: %w", r.addr, err)
+		}
+	}
+
+	reply, err := r.roundTrip(ctx, args...)
+
+	// errors the server replied with leave the connection usable
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) && !errors.Is(err, errRedisNil) {
+		r.close()
+		return nil, fmt.Errorf("redis %s: %w", r.addr, err)
+	}
+
+	return reply, err
+}
+
+func (r *redisState) close() {
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+
+	r.conn, r.r = nil, nil
+}
+
+func (r *redisState) roundTrip(ctx context.Context, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+
+	_ = r.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+
+	if _, err := io.WriteString(r.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRESP(r.r)
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRESP reads a reply in the Redis serialization protocol
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch kind, rest := line[0], line[1:]; kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, errRedisNil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, errRedisNil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply %q", line)
+	}
+}
+
+func (r *redisState) get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := r.do(ctx, "GET", key)
+	if errors.Is(err, errRedisNil) {
+		return "", false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	v, _ := reply.(string)
+
+	return v, true, nil
+}
+
+func (r *redisState) set(ctx context.Context, key, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+
+	_, err := r.do(ctx, args...)
+
+	return err
+}
+
+func (r *redisState) setNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	args := []string{"SET", key, value, "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+
+	_, err := r.do(ctx, args...)
+	if errors.Is(err, errRedisNil) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (r *redisState) del(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", key)
+	return err
+}
+
+// Scripts comparing a key's value before deleting it or setting its ttl, in
+// one step so another server's value set in between is left alone
+const (
+	redisDelIf    = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+	redisExpireIf = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+func (r *redisState) delIf(ctx context.Context, key, value string) error {
+	_, err := r.do(ctx, "EVAL", redisDelIf, "1", key, value)
+	return err
+}
+
+func (r *redisState) expireIf(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	reply, err := r.do(ctx, "EVAL", redisExpireIf, "1", key, value, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := reply.(int64)
+
+	return n == 1, nil
+}
+
+func (r *redisState) hset(ctx context.Context, key, field, value string) error {
+	_, err := r.do(ctx, "HSET", key, field, value)
+	return err
+}
+
+func (r *redisState) hgetall(ctx context.Context, key string) (map[string]string, error) {
+	reply, err := r.do(ctx, "HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := reply.([]interface{})
+
+	hash := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		field, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		hash[field] = value
+	}
+
+	return hash, nil
+}
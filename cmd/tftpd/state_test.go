@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands redisState sends from a memoryState,
+// requiring a password
+func fakeRedis(t *testing.T, password string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	store := &memoryState{}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveFakeRedis(conn, store, password)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func serveFakeRedis(conn net.Conn, store *memoryState, password string) {
+	defer func() { _ = conn.Close() }()
+
+	ctx, r, authed := context.Background(), bufio.NewReader(conn), password == ""
+
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+
+		var args []string
+		for _, a := range reply.([]interface{}) {
+			args = append(args, a.(string))
+		}
+
+		var ttl time.Duration
+		if n := len(args); n > 2 && strings.EqualFold(args[n-2], "PX") {
+			ms, _ := strconv.Atoi(args[n-1])
+			ttl, args = time.Duration(ms)*time.Millisecond, args[:n-2]
+		}
+
+		var out string
+
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			out = "+OK\r\n"
+		case cmd == "GET":
+			if v, ok, _ := store.get(ctx, args[1]); ok {
+				out = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				out = "$-1\r\n"
+			}
+		case cmd == "SET" && len(args) == 4:
+			out = "$-1\r\n"
+			if ok, _ := store.setNX(ctx, args[1], args[2], ttl); ok {
+				out = "+OK\r\n"
+			}
+		case cmd == "SET":
+			_ = store.set(ctx, args[1], args[2], ttl)
+			out = "+OK\r\n"
+		case cmd == "DEL":
+			_ = store.del(ctx, args[1])
+			out = ":1\r\n"
+		case cmd == "EVAL" && args[1] == redisDelIf:
+			_ = store.delIf(ctx, args[3], args[4])
+			out = ":1\r\n"
+		case cmd == "EVAL" && args[1] == redisExpireIf:
+			ms, _ := strconv.Atoi(args[5])
+			out = ":0\r\n"
+			if ok, _ := store.expireIf(ctx, args[3], args[4], time.Duration(ms)*time.Millisecond); ok {
+				out = ":1\r\n"
+			}
+		case cmd == "HSET":
+			_ = store.hset(ctx, args[1], args[2], args[3])
+			out = ":1\r\n"
+		case cmd == "HGETALL":
+			hash, _ := store.hgetall(ctx, args[1])
+			out = fmt.Sprintf("*%d\r\n", 2*len(hash))
+			for field, value := range hash {
+				out += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+			}
+		default:
+			out = "-ERR unknown command\r\n"
+		}
+
+		if _, err = io.WriteString(conn, out); err != nil {
+			return
+		}
+	}
+}
+
+func TestSharedState(t *testing.T) {
+	addr := fakeRedis(t, "secret")
+
+	stores := map[string]func() stateStore{
+		"memory": func() stateStore { return &memoryState{} },
+		"redis": func() stateStore {
+			r, err := newRedisState("redis://:secret@" + addr + "/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return r
+		},
+	}
+
+	ctx := context.Background()
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			// two servers sharing a store, in memory by sharing it
+			store := newStore()
+			a := &sharedState{store: store, prefix: name + ":", instance: "a", claimTTL: 150 * time.Millisecond}
+			b := &sharedState{store: store, prefix: name + ":", instance: "b", claimTTL: 150 * time.Millisecond}
+
+			if ok, err := a.Claim(ctx, "10.0.0.1:2000"); !ok || err != nil {
+				t.Fatalf("a claimed %t, %v, want true", ok, err)
+			}
+
+			if ok, err := a.Claim(ctx, "10.0.0.1:2000"); !ok || err != nil {
+				t.Fatalf("a claimed its own session %t, %v, want true", ok, err)
+			}
+
+			// a refreshes its claim beyond the ttl
+			time.Sleep(400 * time.Millisecond)
+
+			if ok, err := b.Claim(ctx, "10.0.0.1:2000"); ok || err != nil {
+				t.Fatalf("b claimed a's session %t, %v, want false", ok, err)
+			}
+
+			if elsewhere, err := b.OwnedElsewhere(ctx, "10.0.0.1:2000"); !elsewhere || err != nil {
+				t.Errorf("b found a's session owned elsewhere %t, %v, want true", elsewhere, err)
+			}
+
+			if err := b.Release("10.0.0.1:2000"); err != nil {
+				t.Fatal(err)
+			}
+
+			if elsewhere, _ := b.OwnedElsewhere(ctx, "10.0.0.1:2000"); !elsewhere {
+				t.Error("b released a's session")
+			}
+
+			if err := a.Release("10.0.0.1:2000"); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := b.Claim(ctx, "10.0.0.1:2000"); !ok || err != nil {
+				t.Fatalf("b claimed a released session %t, %v, want true", ok, err)
+			}
+
+			// b dies, its claim no longer refreshed
+			b.mu.Lock()
+			close(b.claims["10.0.0.1:2000"])
+			delete(b.claims, "10.0.0.1:2000")
+			b.mu.Unlock()
+
+			time.Sleep(300 * time.Millisecond)
+
+			if elsewhere, _ := a.OwnedElsewhere(ctx, "10.0.0.1:2000"); elsewhere {
+				t.Error("b's claim didn't expire")
+			}
+
+			if ok, err := a.Claim(ctx, "10.0.0.1:2000"); !ok || err != nil {
+				t.Fatalf("a claimed the session of a dead server %t, %v, want true", ok, err)
+			}
+
+			// b releasing late leaves a's claim alone
+			if err := b.Release("10.0.0.1:2000"); err != nil {
+				t.Fatal(err)
+			}
+
+			if elsewhere, _ := b.OwnedElsewhere(ctx, "10.0.0.1:2000"); !elsewhere {
+				t.Error("b released the claim a took over")
+			}
+
+			if err := a.Release("10.0.0.1:2000"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.setMaintenance(ctx, true); err != nil {
+				t.Fatal(err)
+			}
+
+			if on, err := b.maintenance(ctx); !on || err != nil {
+				t.Errorf("b found maintenance mode %t, %v, want on", on, err)
+			}
+
+			if err := b.setMaintenance(ctx, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if on, _ := a.maintenance(ctx); on {
+				t.Error("a found maintenance mode on after b turned it off")
+			}
+
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"} {
+				if err := a.store.hset(ctx, a.prefix+"campaign:f", ip, "r-"+ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hash, err := b.store.hgetall(ctx, b.prefix+"campaign:f")
+			if err != nil || len(hash) != 2 || hash["10.0.0.2"] != "r-10.0.0.2" {
+				t.Errorf("got %v, %v, want the records of 2 clients", hash, err)
+			}
+		})
+	}
+}
+
+func TestRedisStateErrors(t *testing.T) {
+	ctx := context.Background()
+
+	r, err := newRedisState("redis://:wrong@" + fakeRedis(t, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = r.get(ctx, "k"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("got %v, want the server's WRONGPASS error", err)
+	}
+
+	for _, u := range []string{"http://redis:6379", "redis://redis:6379/db"} {
+		if _, err = newRedisState(u); err == nil {
+			t.Errorf("%s: got no error", u)
+		}
+	}
+
+	r, _ = newRedisState("redis://127.0.0.1:1")
+	if _, _, err = r.get(ctx, "k"); err == nil {
+		t.Error("got no error from a server that isn't there")
+	}
+}
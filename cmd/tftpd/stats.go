@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// transferStats counts finished transfers, read by the admin API and the
+// SNMP agent
+type transferStats struct {
+	bytes     uint64 // first for 64-bit atomic alignment on 32-bit platforms
+	completed uint64
+	failed    uint64
+	reaped    uint64
+}
+
+// transferCounts is a snapshot of transferStats
+type transferCounts struct {
+	Completed uint64 `json:"completed"`
+	Failed    uint64 `json:"failed"`
+	Reaped    uint64 `json:"reaped"` // failed for going idle
+	Bytes     uint64 `json:"bytes"`
+}
+
+// transfer counts a finished transfer
+func (s *transferStats) transfer(t tftp.Transfer) {
+	if t.Err != nil {
+		atomic.AddUint64(&s.failed, 1)
+
+		if errors.Is(t.Err, tftp.ErrIdle) {
+			atomic.AddUint64(&s.reaped, 1)
+		}
+	} else {
+		atomic.AddUint64(&s.completed, 1)
+	}
+
+	atomic.AddUint64(&s.bytes, uint64(t.Bytes))
+}
+
+func (s *transferStats) counts() transferCounts {
+	return transferCounts{
+		Completed: atomic.LoadUint64(&s.completed),
+		Failed:    atomic.LoadUint64(&s.failed),
+		Reaped:    atomic.LoadUint64(&s.reaped),
+		Bytes:     atomic.LoadUint64(&s.bytes),
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// statsdSink emits counter and timer metrics for every finished transfer
+// to a StatsD or DogStatsD endpoint
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	dogstatsd bool
+}
+
+func newStatsdSink(addr, prefix, tags string, dogstatsd bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &statsdSink{conn: conn, prefix: prefix, dogstatsd: dogstatsd}
+
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			s.tags = append(s.tags, tag)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *statsdSink) transfer(t tftp.Transfer) {
+	result := "ok"
+	if t.Err != nil {
+		result = "error"
+	}
+
+	// the client's family and, for downloads, how it acknowledged them,
+	// both from small fixed sets
+	family, acks := clientFamily(t), string(t.Acks)
+	if acks == "" {
+		acks = "none"
+	}
+
+	var lines []string
+
+	if s.dogstatsd {
+		tags := "|#" + strings.Join(append([]string{"result:" + result, "family:" + family, "acks:" + acks}, s.tags...), ",")
+
+		lines = []string{
+			s.metric("transfers", "1|c") + tags,
+			s.metric("transfer.bytes", fmt.Sprintf("%d|c", t.Bytes)) + tags,
+			s.metric("transfer.duration", fmt.Sprintf("%d|ms", t.Duration.Milliseconds())) + tags,
+		}
+	} else {
+		lines = []string{
+			s.metric("transfers."+result, "1|c"),
+			s.metric("transfer.bytes", fmt.Sprintf("%d|c", t.Bytes)),
+			s.metric("transfer.duration", fmt.Sprintf("%d|ms", t.Duration.Milliseconds())),
+			s.metric("transfers.family."+family, "1|c"),
+			s.metric("transfers.acks."+acks, "1|c"),
+		}
+	}
+
+	// transfers the server tore down for going idle
+	if errors.Is(t.Err, tftp.ErrIdle) {
+		tags := ""
+		if s.dogstatsd && len(s.tags) > 0 {
+			tags = "|#" + strings.Join(s.tags, ",")
+		}
+
+		lines = append(lines, s.metric("transfers.reaped", "1|c")+tags)
+	}
+
+	for _, o := range t.Options {
+		value, outcome := optionOutcome(o, t.Accepted)
+		name, bucket := optionMetric(o.Name), optionBucket(value)
+
+		if s.dogstatsd {
+			tags := []string{"option:" + name, "value:" + bucket, "outcome:" + outcome}
+			lines = append(lines, s.metric("options", "1|c")+"|#"+strings.Join(append(tags, s.tags...), ","))
+		} else {
+			lines = append(lines, s.metric("options."+name+"."+bucket+"."+outcome, "1|c"))
+		}
+	}
+
+	// a single datagram may carry several newline separated metrics
+	if _, err := s.conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		log.Printf("statsd: %v", err)
+	}
+}
+
+func (s *statsdSink) metric(name, value string) string {
+	return s.prefix + name + ":" + value
+}
+
+// optionOutcome returns the value an option the client requested settled
+// on and what became of it: "accepted" if acknowledged as asked for,
+// "rejected" if the server capped its value or refused an option it knows,
+// by policy or for the transfer, and "ignored" if it doesn't know it
+func optionOutcome(o tftp.Option, accepted []tftp.Option) (value, outcome string) {
+	for _, a := range accepted {
+		if !strings.EqualFold(a.Name, o.Name) {
+			continue
+		}
+
+		// a size answered for a download's tsize 0, or a multicast group
+		// for an empty multicast, is what the options ask for
+		asked, errAsked := strconv.ParseUint(o.Value, 10, 64)
+		got, errGot := strconv.ParseUint(a.Value, 10, 64)
+		if errAsked == nil && errGot == nil && got < asked {
+			return a.Value, "rejected"
+		}
+
+		return a.Value, "accepted"
+	}
+
+	if rfcOptions[strings.ToLower(o.Name)] {
+		return o.Value, "rejected"
+	}
+
+	return o.Value, "ignored"
+}
+
+// optionBucket groups an option value for metrics. Numbers are
+// rounded up to the next power of two ("le512", "le2048") to keep the number
+// of series bounded, anything else counts as "other".
+func optionBucket(value string) string {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "other"
+	}
+
+	if n == 0 {
+		return "0"
+	}
+
+	bound := uint64(1)
+	for bound < n && bound < 1<<62 {
+		bound <<= 1
+	}
+
+	return "le" + strconv.FormatUint(bound, 10)
+}
+
+// rfcOptions are the options defined by RFCs, the only ones counted under
+// their own name
+var rfcOptions = map[string]bool{
+	"blksize":    true, // RFC 2348
+	"timeout":    true, // RFC 2349
+	"tsize":      true, // RFC 2349
+	"multicast":  true, // RFC 2090
+	"windowsize": true, // RFC 7440
+}
+
+// optionMetric returns the lower case name of an option for metrics, or
+// "other" for options no RFC defines, so clients making up option names
+// can't create unbounded numbers of series
+func optionMetric(name string) string {
+	if name = strings.ToLower(name); rfcOptions[name] {
+		return name
+	}
+
+	return "other"
+}
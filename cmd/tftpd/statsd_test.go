@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestStatsdLines(t *testing.T) {
+	ok := tftp.Transfer{
+		Client:   "10.0.0.1:2000",
+		Filename: "undionly.kpxe",
+		Options:  []tftp.Option{{Name: "blksize", Value: "1432"}, {Name: "tsize", Value: "0"}, {Name: "windowsize", Value: "8"}},
+		Accepted: []tftp.Option{{Name: "blksize", Value: "1432"}, {Name: "tsize", Value: "2048"}},
+		Bytes:    2048,
+		Acks:     tftp.AckLockstep,
+		Duration: 1500 * time.Millisecond,
+	}
+
+	reaped := tftp.Transfer{
+		Client:   "10.0.0.2:2000",
+		Filename: "f",
+		Options:  []tftp.Option{{Name: "timeout", Value: "5"}},
+		Err:      fmt.Errorf("no ACK: %w", tftp.ErrIdle),
+	}
+
+	tests := []struct {
+		name      string
+		dogstatsd bool
+		transfer  tftp.Transfer
+		want      []string
+	}{
+		{
+			name:     "plain",
+			transfer: ok,
+			want: []string{
+				"tftp.transfers.ok:1|c",
+				"tftp.transfer.bytes:2048|c",
+				"tftp.transfer.duration:1500|ms",
+				"tftp.transfers.family.ipxe:1|c",
+				"tftp.transfers.acks.lockstep:1|c",
+				"tftp.options.blksize.le2048.accepted:1|c",
+				"tftp.options.tsize.le2048.accepted:1|c",
+				"tftp.options.windowsize.le8.rejected:1|c",
+			},
+		},
+		{
+			name:     "plain reaped",
+			transfer: reaped,
+			want: []string{
+				"tftp.transfers.error:1|c",
+				"tftp.transfer.bytes:0|c",
+				"tftp.transfer.duration:0|ms",
+				"tftp.transfers.family.u-boot:1|c",
+				"tftp.transfers.acks.none:1|c",
+				"tftp.transfers.reaped:1|c",
+				"tftp.options.timeout.le8.rejected:1|c",
+			},
+		},
+		{
+			name:      "dogstatsd",
+			dogstatsd: true,
+			transfer:  ok,
+			want: []string{
+				"tftp.transfers:1|c|#result:ok,family:ipxe,acks:lockstep,env:lab",
+				"tftp.transfer.bytes:2048|c|#result:ok,family:ipxe,acks:lockstep,env:lab",
+				"tftp.transfer.duration:1500|ms|#result:ok,family:ipxe,acks:lockstep,env:lab",
+				"tftp.options:1|c|#option:blksize,value:le2048,outcome:accepted,env:lab",
+				"tftp.options:1|c|#option:tsize,value:le2048,outcome:accepted,env:lab",
+				"tftp.options:1|c|#option:windowsize,value:le8,outcome:rejected,env:lab",
+			},
+		},
+		{
+			name:      "dogstatsd reaped",
+			dogstatsd: true,
+			transfer:  reaped,
+			want: []string{
+				"tftp.transfers:1|c|#result:error,family:u-boot,acks:none,env:lab",
+				"tftp.transfer.bytes:0|c|#result:error,family:u-boot,acks:none,env:lab",
+				"tftp.transfer.duration:0|ms|#result:error,family:u-boot,acks:none,env:lab",
+				"tftp.transfers.reaped:1|c|#env:lab",
+				"tftp.options:1|c|#option:timeout,value:le8,outcome:rejected,env:lab",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+
+			sink, err := newStatsdSink(conn.LocalAddr().String(), "tftp.", " env:lab, ", tt.dogstatsd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = sink.conn.Close() }()
+
+			sink.transfer(tt.transfer)
+
+			buf := make([]byte, 65536)
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every metric of a transfer in a single datagram
+			if got, want := string(buf[:n]), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestOptionOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		option   tftp.Option
+		accepted []tftp.Option
+		value    string
+		outcome  string
+	}{
+		{"acknowledged", tftp.Option{Name: "blksize", Value: "1428"}, []tftp.Option{{Name: "blksize", Value: "1428"}}, "1428", "accepted"},
+		{"name in another case", tftp.Option{Name: "BLKSIZE", Value: "1428"}, []tftp.Option{{Name: "blksize", Value: "1428"}}, "1428", "accepted"},
+		{"capped", tftp.Option{Name: "blksize", Value: "65464"}, []tftp.Option{{Name: "blksize", Value: "1024"}}, "1024", "rejected"},
+		{"window capped", tftp.Option{Name: "windowsize", Value: "512"}, []tftp.Option{{Name: "windowsize", Value: "64"}}, "64", "rejected"},
+		{"size answered", tftp.Option{Name: "tsize", Value: "0"}, []tftp.Option{{Name: "tsize", Value: "2048"}}, "2048", "accepted"},
+		{"group answered", tftp.Option{Name: "multicast"}, []tftp.Option{{Name: "multicast", Value: "239.0.0.1,1758,1"}}, "239.0.0.1,1758,1", "accepted"},
+		{"refused", tftp.Option{Name: "windowsize", Value: "8"}, nil, "8", "rejected"},
+		{"unknown", tftp.Option{Name: "rollover", Value: "0"}, nil, "0", "ignored"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, outcome := optionOutcome(tt.option, tt.accepted)
+			if value != tt.value || outcome != tt.outcome {
+				t.Errorf("got %q %s, want %q %s", value, outcome, tt.value, tt.outcome)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// tracer prints every packet the server sends or receives and optionally
+// records them to a pcap file that can be opened with Wireshark or tcpdump
+type tracer struct {
+	hexdump bool
+
+	mu   sync.Mutex
+	pcap io.WriteCloser
+}
+
+func newTracer(hexdump bool, pcapFile string) (*tracer, error) {
+	t := &tracer{hexdump: hexdump}
+
+	if pcapFile == "" {
+		return t, nil
+	}
+
+	f, err := os.Create(pcapFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// pcap global header: magic, version 2.4, GMT offset, timestamp accuracy,
+	// snapshot length and the link type (LINKTYPE_RAW, bare IP packets)
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], 101)
+
+	if _, err = f.Write(hdr); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	t.pcap = f
+
+	return t, nil
+}
+
+func (t *tracer) trace(dir tftp.TraceDir, local, remote net.Addr, p []byte) {
+	desc := "undecodable packet"
+	if pkt, err := tftp.ParsePacket(p); err == nil {
+		desc = pkt.String()
+	}
+
+	if t.hexdump {
+		log.Printf("[%s] %s %s\n%s", remote, dir, desc, strings.TrimRight(hex.Dump(p), "\n"))
+	} else {
+		log.Printf("[%s] %s %s", remote, dir, desc)
+	}
+
+	if t.pcap == nil {
+		return
+	}
+
+	src, dst := udpAddr(local), udpAddr(remote)
+	if dir == tftp.TraceIn {
+		src, dst = dst, src
+	}
+
+	t.writeRecord(ipPacket(src, dst, p))
+}
+
+func (t *tracer) writeRecord(pkt []byte) {
+	now := time.Now()
+
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := t.pcap.Write(rec); err != nil {
+		log.Printf("writing packet trace: %v", err)
+	}
+}
+
+func (t *tracer) Close() error {
+	if t.pcap == nil {
+		return nil
+	}
+
+	return t.pcap.Close()
+}
+
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u
+	}
+
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+// ipPacket wraps a UDP payload in the IP and UDP headers it would have had
+// on the wire so captures decode as regular TFTP traffic
+func ipPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45 // version 4, 5 word header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, 17, udp[4], udp[5])
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60 // version 6
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17 // UDP
+	ip[7] = 64 // hop limit
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, ip[8:40]...)
+	pseudo = append(pseudo, 0, 0, udp[4], udp[5], 0, 0, 0, 17)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+
+	return append(ip, udp...)
+}
+
+func udpChecksum(pseudo, udp []byte) uint16 {
+	sum := ^checksum(checksum(0, pseudo), udp)
+	if sum == 0 {
+		return 0xffff
+	}
+
+	return sum
+}
+
+// checksum folds b into the running ones' complement sum used by IP and UDP
+func checksum(initial uint16, b []byte) uint16 {
+	sum := uint32(initial)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+
+	return uint16(sum)
+}
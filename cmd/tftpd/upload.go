@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// Upload policies, deciding what happens to an existing file of the same
+// name as an upload
+const (
+	uploadOverwrite = "overwrite" // replace it
+	uploadCreate    = "create"    // refuse the upload
+	uploadRename    = "rename"    // keep it, storing the upload as <name>.1, <name>.2, ...
+)
+
+// uploadDir stores uploaded files below a directory, e.g. for network device
+// config backups. Files are written to a temporary name and only take their
+// place once the upload completed. Blocks of zeros, as found in disk and
+// flash images, are skipped rather than written, leaving holes on file
+// systems supporting sparse files.
+//
+// Names are confined to the directory like the files served, see
+// tftp.FSPath and tftp.LocalName, and a file is uploaded by one client at a
+// time, telling names apart by case only where the file system does. On
+// Windows a file being downloaded can't be replaced, failing the upload.
+// With versions set, the files stored are kept as versions too, and names
+// below the directory they're kept in are refused.
+type uploadDir struct {
+	dir      string
+	policy   string
+	versions *versionStore
+
+	mu        sync.Mutex
+	uploading map[string]bool // targets of the uploads in progress, by fileKey
+}
+
+func (d *uploadDir) upload(_ string, wrq tftp.WriteReq) (tftp.UploadFile, error) {
+	name := tftp.FSPath(wrq.Filename)
+	if name == "." || !tftp.LocalName(name) {
+		return nil, errors.New("invalid file name")
+	}
+
+	if first, _, _ := strings.Cut(name, "/"); d.versions != nil && first == versionsDir {
+		return nil, errors.New("invalid file name")
+	}
+
+	target := filepath.Join(d.dir, filepath.FromSlash(name))
+
+	if !d.lock(target) {
+		return nil, tftp.Errorf(tftp.ErrAccessViolation, "%s is being uploaded", wrq.Filename)
+	}
+
+	f, err := d.create(target)
+	if err != nil {
+		d.unlock(target)
+		return nil, err
+	}
+
+	return &uploadFile{file: f, target: target, policy: d.policy, versions: d.versions, unlock: func() { d.unlock(target) }}, nil
+}
+
+// create creates the temporary file an upload to target is written to,
+// refusing the upload if the policy doesn't let it replace target
+func (d *uploadDir) create(target string) (*os.File, error) {
+	if d.policy == uploadCreate {
+		if _, err := os.Lstat(target); err == nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(target), fs.ErrExist)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+}
+
+// lock reports whether target isn't being uploaded already, marking it as
+// being uploaded if so
+func (d *uploadDir) lock(target string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.uploading == nil {
+		d.uploading = make(map[string]bool)
+	}
+
+	key := fileKey(target)
+	if d.uploading[key] {
+		return false
+	}
+
+	d.uploading[key] = true
+
+	return true
+}
+
+func (d *uploadDir) unlock(target string) {
+	d.mu.Lock()
+	delete(d.uploading, fileKey(target))
+	d.mu.Unlock()
+}
+
+// caseInsensitive is set on hosts whose file systems usually ignore the case
+// of names, like NTFS and APFS, so names differing in case are the same file
+var caseInsensitive = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// fileKey returns the key identifying the file at path, the same for every
+// name of it the host's file system considers equal
+func fileKey(path string) string {
+	if caseInsensitive {
+		return strings.ToLower(path)
+	}
+
+	return path
+}
+
+// uploadFile is an upload in progress. The file isn't embedded, so copying
+// to it goes through Write rather than the file's ReadFrom.
+type uploadFile struct {
+	file     *os.File
+	target   string
+	policy   string
+	versions *versionStore
+	size     int64  // bytes written or skipped
+	unlock   func() // lets the next upload of the file in
+}
+
+// Write writes p, or seeks past it if it's all zeros
+func (f *uploadFile) Write(p []byte) (int, error) {
+	if !allZero(p) {
+		n, err := f.file.Write(p)
+		f.size += int64(n)
+
+		return n, err
+	}
+
+	if _, err := f.file.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+
+	f.size += int64(len(p))
+
+	return len(p), nil
+}
+
+// allZero reports whether p holds nothing but zero bytes
+func allZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *uploadFile) Finish(err error) error {
+	defer f.unlock()
+
+	// zeros skipped at the end leave the file short of its size
+	if err == nil {
+		err = f.file.Truncate(f.size)
+	}
+
+	if err == nil {
+		err = f.file.Sync()
+	}
+
+	if cErr := f.file.Close(); err == nil {
+		err = cErr
+	}
+
+	var stored string
+	if err == nil {
+		stored, err = f.store()
+	}
+
+	if err != nil {
+		_ = os.Remove(f.file.Name())
+		return err
+	}
+
+	// the upload is stored, so failing to keep a version doesn't fail it
+	if f.versions != nil {
+		name, err := filepath.Rel(f.versions.dir, stored)
+		if err == nil {
+			err = f.versions.add(filepath.ToSlash(name), stored)
+		}
+
+		if err != nil {
+			log.Printf("versions: %s: %v", stored, err)
+		}
+	}
+
+	return nil
+}
+
+// store moves the completed upload to its target according to the policy.
+// Hard links don't replace existing files, so the temporary file is linked
+// rather than renamed unless overwriting. It returns where the upload was
+// stored.
+func (f *uploadFile) store() (string, error) {
+	target := f.target
+
+	switch f.policy {
+	case uploadCreate:
+		if err := os.Link(f.file.Name(), target); err != nil {
+			return "", err
+		}
+	case uploadRename:
+		for i := 1; ; i++ {
+			err := os.Link(f.file.Name(), target)
+			if err == nil {
+				break
+			}
+
+			if !errors.Is(err, fs.ErrExist) {
+				return "", err
+			}
+
+			target = fmt.Sprintf("%s.%d", f.target, i)
+		}
+	default:
+		return target, os.Rename(f.file.Name(), target)
+	}
+
+	return target, os.Remove(f.file.Name())
+}
+
+// uploadPipe streams uploaded files to stdout, one at a time, or to the
+// stdin of a shell command run once per upload, which finds the name of the
+// file and the address of the client in TFTP_FILENAME and TFTP_CLIENT. An
+// upload that fails kills the command, so it's never mistaken for a
+// complete file; on stdout it's simply cut short. Uploads arriving while
+// another one is written to stdout are refused as busy.
+type uploadPipe struct {
+	command string // "-" for stdout
+
+	stdout sync.Mutex // held by the upload writing to stdout
+}
+
+func (p *uploadPipe) upload(clientAddr string, wrq tftp.WriteReq) (tftp.UploadFile, error) {
+	if p.command == "-" {
+		if !p.stdout.TryLock() {
+			return nil, tftp.Errorf(tftp.ErrUnknown, "busy")
+		}
+
+		return &stdoutUpload{unlock: p.stdout.Unlock}, nil
+	}
+
+	cmd := shell(p.command)
+	cmd.Env = append(os.Environ(), "TFTP_FILENAME="+wrq.Filename, "TFTP_CLIENT="+clientAddr)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("upload command: %w", err)
+	}
+
+	return &commandUpload{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+// shell returns the command running command with the system's shell
+func shell(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+type stdoutUpload struct {
+	unlock func()
+}
+
+func (u *stdoutUpload) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (u *stdoutUpload) Finish(error) error {
+	u.unlock()
+	return nil
+}
+
+type commandUpload struct {
+	io.WriteCloser // the command's stdin
+	cmd            *exec.Cmd
+}
+
+func (u *commandUpload) Finish(err error) error {
+	if err != nil {
+		_ = u.cmd.Process.Kill()
+	}
+
+	_ = u.Close()
+
+	if wErr := u.cmd.Wait(); err == nil && wErr != nil {
+		err = fmt.Errorf("upload command: %w", wErr)
+	}
+
+	return err
+}
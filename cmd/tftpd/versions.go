@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// versionsDir is the directory below an upload directory the versions of
+// its files are kept in
+const versionsDir = ".versions"
+
+// versionStore keeps the last versions of every file uploaded below a
+// directory, as hard links in .versions/<name>/<version>-<sha256>, numbered
+// from 1 in the order they were uploaded, so a rollout can pin a version by
+// requesting image.bin@3 or image.bin@sha256:<digest>, or go back to one.
+// An upload identical to the latest version adds none. Only uploads are
+// recorded, and files edited in place change their versions too.
+type versionStore struct {
+	dir  string
+	keep int
+
+	mu sync.Mutex // serializes adding and pruning versions
+}
+
+// fileVersion is a version of a file, as listed by the admin API
+type fileVersion struct {
+	Version int       `json:"version"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+
+	path string
+}
+
+// add records the file stored at target, named name below the directory,
+// as its latest version, then prunes the versions beyond the ones kept
+func (v *versionStore) add(name, target string) error {
+	digest, err := fileDigest(target)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	versions, err := v.list(name)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if n := len(versions); n > 0 {
+		if versions[n-1].SHA256 == digest {
+			return nil
+		}
+
+		next = versions[n-1].Version + 1
+	}
+
+	dir := v.path(name)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	if err = os.Link(target, filepath.Join(dir, fmt.Sprintf("%d-%s", next, digest))); err != nil {
+		return err
+	}
+
+	_, err = v.pruneLocked(name, v.keep)
+
+	return err
+}
+
+// path returns the directory the versions of name are kept in
+func (v *versionStore) path(name string) string {
+	return filepath.Join(v.dir, versionsDir, filepath.FromSlash(name))
+}
+
+// list returns the versions of name kept, oldest first
+func (v *versionStore) list(name string) ([]fileVersion, error) {
+	entries, err := os.ReadDir(v.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []fileVersion
+
+	for _, e := range entries {
+		n, digest, ok := strings.Cut(e.Name(), "-")
+		version, err := strconv.Atoi(n)
+		if !ok || err != nil || !e.Type().IsRegular() {
+			continue
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, fileVersion{
+			Version: version,
+			SHA256:  digest,
+			Size:    fi.Size(),
+			Time:    fi.ModTime(),
+			path:    filepath.Join(v.path(name), e.Name()),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, nil
+}
+
+// prune removes all but the latest keep versions of name, at least one,
+// returning the ones left
+func (v *versionStore) prune(name string, keep int) ([]fileVersion, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.pruneLocked(name, keep)
+}
+
+func (v *versionStore) pruneLocked(name string, keep int) ([]fileVersion, error) {
+	if keep < 1 {
+		keep = 1
+	}
+
+	versions, err := v.list(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(versions) > keep {
+		if err = os.Remove(versions[0].path); err != nil {
+			return nil, err
+		}
+
+		versions = versions[1:]
+	}
+
+	return versions, nil
+}
+
+// find returns the version of name given as a number or sha256:<digest>,
+// where the digest may be shortened to a unique prefix of 8 or more digits
+func (v *versionStore) find(name, spec string) (fileVersion, error) {
+	versions, err := v.list(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+
+	var found []fileVersion
+
+	if digest := strings.TrimPrefix(spec, "sha256:"); digest != spec {
+		for _, fv := range versions {
+			if len(digest) >= 8 && strings.HasPrefix(fv.SHA256, strings.ToLower(digest)) {
+				found = append(found, fv)
+			}
+		}
+	} else if n, err := strconv.Atoi(spec); err == nil {
+		for _, fv := range versions {
+			if fv.Version == n {
+				found = append(found, fv)
+			}
+		}
+	}
+
+	if len(found) != 1 {
+		return fileVersion{}, fmt.Errorf("%s@%s: %w", name, spec, fs.ErrNotExist)
+	}
+
+	return found[0], nil
+}
+
+// fileDigest returns the hex SHA-256 digest of the file at name
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// versionedFS serves the versions of a store by the names of their files
+// followed by @<version> or @sha256:<digest>, and the files of FS by any
+// other name, hiding the directory the versions are kept in
+type versionedFS struct {
+	fs.FS
+	versions *versionStore
+}
+
+func (v versionedFS) Open(name string) (fs.File, error) {
+	if first, _, _ := strings.Cut(name, "/"); first == versionsDir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	i := strings.LastIndexByte(name, '@')
+	if i < 0 || strings.Contains(name[i:], "/") || !fs.ValidPath(name[:i]) || !tftp.LocalName(name[:i]) {
+		return v.FS.Open(name)
+	}
+
+	fv, err := v.versions.find(name[:i], name[i+1:])
+	if err != nil {
+		// names with an @ of their own are files of FS
+		if f, fsErr := v.FS.Open(name); fsErr == nil {
+			return f, nil
+		}
+
+		return nil, err
+	}
+
+	return os.Open(fv.path)
+}
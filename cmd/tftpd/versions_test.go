@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+	versions := &versionStore{dir: dir, keep: 2}
+	uploads := &uploadDir{dir: dir, policy: uploadOverwrite, versions: versions}
+
+	upload := func(name, content string) {
+		t.Helper()
+
+		f, err := uploads.upload("", tftp.WriteReq{Filename: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = io.WriteString(f, content); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Finish(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, content := range []string{"one", "two", "two", "three"} {
+		upload("images/fw.bin", content)
+	}
+
+	fsys := versionedFS{FS: os.DirFS(dir), versions: versions}
+
+	read := func(name string) (string, error) {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return "", err
+		}
+
+		defer func() { _ = f.Close() }()
+
+		b, err := io.ReadAll(f)
+
+		return string(b), err
+	}
+
+	sum := sha256.Sum256([]byte("two"))
+	two := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		want string // "" for not found
+	}{
+		{name: "images/fw.bin", want: "three"},
+		{name: "images/fw.bin@3", want: "three"},
+		{name: "images/fw.bin@2", want: "two"},
+		{name: "images/fw.bin@sha256:" + two, want: "two"},
+		{name: "images/fw.bin@sha256:" + two[:8], want: "two"},
+		{name: "images/fw.bin@sha256:" + two[:7]}, // too short
+		{name: "images/fw.bin@1"},                 // pruned
+		{name: "images/other.bin@1"},
+		{name: ".versions/images/fw.bin/3-" + two},
+	}
+
+	for _, tt := range tests {
+		got, err := read(tt.name)
+
+		switch {
+		case tt.want == "" && !errors.Is(err, fs.ErrNotExist):
+			t.Errorf("%s: got %q, %v, want fs.ErrNotExist", tt.name, got, err)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	if _, err := uploads.upload("", tftp.WriteReq{Filename: ".versions/images/fw.bin/9-x"}); err == nil {
+		t.Error("uploaded below the versions directory")
+	}
+
+	admin := &adminAPI{versions: versions}
+
+	for _, tt := range []struct {
+		method, url string
+		status      int
+		versions    []int
+	}{
+		{method: http.MethodGet, url: "/versions/images/fw.bin", status: http.StatusOK, versions: []int{2, 3}},
+		{method: http.MethodDelete, url: "/versions/images/fw.bin?keep=0", status: http.StatusBadRequest},
+		{method: http.MethodDelete, url: "/versions/images/fw.bin?keep=1", status: http.StatusOK, versions: []int{3}},
+		{method: http.MethodGet, url: "/versions/images/other.bin", status: http.StatusNotFound},
+		{method: http.MethodGet, url: "/versions/../fw.bin", status: http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		admin.fileVersions(w, httptest.NewRequest(tt.method, tt.url, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.url, w.Code, tt.status)
+			continue
+		}
+
+		if tt.versions == nil {
+			continue
+		}
+
+		var got []fileVersion
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(tt.versions) {
+			t.Errorf("%s %s: got %d versions, want %v", tt.method, tt.url, len(got), tt.versions)
+			continue
+		}
+
+		for i, v := range got {
+			if v.Version != tt.versions[i] {
+				t.Errorf("%s %s: got version %d, want %d", tt.method, tt.url, v.Version, tt.versions[i])
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "images", "fw.bin")); err != nil {
+		t.Errorf("pruning removed the current file: %v", err)
+	}
+}
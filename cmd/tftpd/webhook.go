@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+// webhook posts a JSON notification to a URL for every finished transfer.
+// Notifications are queued and delivered one at a time in the background,
+// retried with exponential backoff on network errors, 429 and 5xx responses,
+// and dropped when the queue is full, like transfer events. When a secret is
+// set every attempt is sent with the Unix time in the X-TFTP-Timestamp
+// header, and "<timestamp>.<body>" is signed with HMAC-SHA256, the hex
+// digest sent in the X-TFTP-Signature header as "sha256=<digest>", so
+// receivers can refuse replays of old notifications.
+type webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+	queue   *sendQueue
+}
+
+func newWebhook(url string, secret []byte, retries, queue int, timeout time.Duration) *webhook {
+	return &webhook{
+		url:     url,
+		secret:  secret,
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		queue:   newSendQueue("webhook "+url, queue),
+	}
+}
+
+func (w *webhook) transfer(t tftp.Transfer) {
+	body, err := json.Marshal(newTransferEvent(t))
+	if err != nil {
+		log.Printf("webhook: %v", err)
+		return
+	}
+
+	w.queue.push("notification for "+t.Client, func() { w.deliver(body) })
+}
+
+func (w *webhook) deliver(body []byte) {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+
+		if attempt >= w.retries || !w.queue.sleep(backoff) {
+			log.Printf("webhook %s: giving up after %d attempt(s): %v", w.url, attempt+1, err)
+			return
+		}
+
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tftp-server")
+
+	if len(w.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-TFTP-Timestamp", timestamp)
+		req.Header.Set("X-TFTP-Signature", "sha256="+signWebhook(w.secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if resp.StatusCode >= 300 {
+		// the receiver rejected the event, retrying won't help
+		log.Printf("webhook %s: rejected with status %s", w.url, resp.Status)
+	}
+
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 digest of a notification's body
+// sent at timestamp
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stringList is a flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
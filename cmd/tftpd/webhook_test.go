@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josephwoodward/tftp-server/tftp"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+
+	delivered := make(chan delivery, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		delivered <- delivery{r.Header, body}
+	}))
+	defer srv.Close()
+
+	secret := []byte("s3cret")
+	hook := newWebhook(srv.URL, secret, 0, 1, time.Second)
+	hook.transfer(tftp.Transfer{Client: "10.0.0.1:2000", Filename: "f"})
+
+	var d delivery
+	select {
+	case d = <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification wasn't delivered")
+	}
+
+	timestamp := d.header.Get("X-TFTP-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("got timestamp %q, want the current Unix time", timestamp)
+	}
+
+	if got, want := d.header.Get("X-TFTP-Signature"), "sha256="+signWebhook(secret, timestamp, d.body); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+
+	// the signature covers the timestamp, so a replay can't claim a new one
+	if signWebhook(secret, strconv.FormatInt(sent+60, 10), d.body) == signWebhook(secret, timestamp, d.body) {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestWebhookFlush(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		count++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	hook := newWebhook(srv.URL, nil, 0, 10, time.Second)
+	for i := 0; i < 5; i++ {
+		hook.transfer(tftp.Transfer{Client: "10.0.0.1:2000"})
+	}
+
+	flush([]*sendQueue{hook.queue}, 5*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if count != 5 {
+		t.Errorf("delivered %d notifications before exiting, want 5", count)
+	}
+
+	// notifications of transfers ending after the flush are dropped
+	hook.transfer(tftp.Transfer{Client: "10.0.0.1:2000"})
+}
+
+func TestSendQueueFlushTimeout(t *testing.T) {
+	q := newSendQueue("test", 10)
+
+	ran := make(chan struct{}, 10)
+	for i := 0; i < 3; i++ {
+		q.push("item", func() {
+			ran <- struct{}{}
+
+			// a delivery retrying until the flush gives up
+			for q.sleep(10 * time.Millisecond) {
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	q.flush(ctx)
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("flush took %s, want it bounded by its context", d)
+	}
+
+	select {
+	case <-q.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue kept delivering after flushing gave up")
+	}
+
+	if len(ran) != 1 {
+		t.Errorf("ran %d deliveries, want the ones left skipped", len(ran))
+	}
+}
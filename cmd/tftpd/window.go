@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a weekly window of server local time an -allow rule applies
+// in, e.g. mon-fri 01:00-03:00. A window ending before it starts wraps past
+// midnight, the hours after it counting as part of the day it started.
+type timeWindow struct {
+	days     uint8 // bit n set for time.Weekday n
+	from, to int   // minutes after midnight, the same for the whole day
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// contains reports whether t is in the window
+func (w *timeWindow) contains(t time.Time) bool {
+	day, m := t.Weekday(), t.Hour()*60+t.Minute()
+
+	switch {
+	case w.from < w.to:
+		if m < w.from || m >= w.to {
+			return false
+		}
+	case w.from > w.to:
+		if m < w.to {
+			day = (day + 6) % 7 // the window started the day before
+		} else if m < w.from {
+			return false
+		}
+	}
+
+	return w.days&(1<<uint(day)) != 0
+}
+
+// parseDays parses days given as a comma separated list of days or ranges
+// of them, e.g. mon-fri or sat,sun, into the window's days
+func (w *timeWindow) parseDays(def string) error {
+	for _, spec := range strings.Split(strings.ToLower(def), ",") {
+		first, last, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, to := weekday(first), weekday(last)
+		if from < 0 || to < 0 {
+			return fmt.Errorf("%q: days are mon, tue, wed, thu, fri, sat and sun", def)
+		}
+
+		for d := from; ; d = (d + 1) % 7 {
+			w.days |= 1 << uint(d)
+
+			if d == to {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseHours parses hours given as HH:MM-HH:MM, e.g. 22:00-06:00
+func (w *timeWindow) parseHours(def string) error {
+	from, to, ok := strings.Cut(def, "-")
+
+	var err error
+	if ok {
+		if w.from, err = minutes(from, false); err == nil {
+			w.to, err = minutes(to, true)
+		}
+	}
+
+	if !ok || err != nil {
+		return fmt.Errorf("%q: hours are HH:MM-HH:MM", def)
+	}
+
+	return nil
+}
+
+func weekday(name string) int {
+	for i, d := range weekdays {
+		if name == d {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// minutes parses a time of day, 24:00 too if it ends a window
+func minutes(s string, end bool) (int, error) {
+	if end && s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -1,3 +1,5 @@
-module github.com/tftp-server
+module github.com/josephwoodward/tftp-server
 
 go 1.18
+
+require golang.org/x/sys v0.15.0
@@ -0,0 +1,488 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client downloads files from and uploads files to a TFTP server
+type Client struct {
+	Retries uint8
+	Timeout time.Duration
+
+	// BlockSize, if set, asks the server for blocks of this size with the
+	// blksize option (RFC 2348) instead of 512 bytes. Servers may lower it.
+	BlockSize int
+
+	// WindowSize, if above 1, asks the server to send, or take, that many
+	// blocks before waiting for an ACK with the windowsize option (RFC 7440).
+	// Servers may lower it.
+	WindowSize int
+
+	// MaxDuration, if set, ends a Get or Put still running after this long
+	// with ErrTransferTimeout, however often the server answers
+	MaxDuration time.Duration
+
+	// Compress asks the server to send files gzip compressed with the
+	// experimental xcompress option. Files are received uncompressed from
+	// servers that don't support it.
+	Compress bool
+
+	// Trace, if set, is called with every datagram the client sends or
+	// receives
+	Trace func(dir TraceDir, local, remote net.Addr, p []byte)
+
+	// OnFinish, if set, is called once a Get or Put ended, with Client
+	// holding the server's address, the blocks and bytes acknowledged and
+	// the parameters the transfer settled on
+	OnFinish func(t Transfer)
+}
+
+// Get downloads filename from the server listening on addr and writes its
+// contents to w, returning the number of bytes written. A transfer the
+// server aborts fails with an error wrapping an Error with the code it sent.
+func (c *Client) Get(addr, filename string, w io.Writer) (int64, error) {
+	t := c.begin(addr, filename, false)
+	t.Blocks, t.Bytes, t.Err = c.get(&t, w)
+	c.finish(t)
+
+	return t.Bytes, t.Err
+}
+
+// Put uploads the contents of r to the server listening on addr, storing
+// them as filename and returning the number of bytes sent. A transfer the
+// server aborts fails with an error wrapping an Error with the code it sent.
+func (c *Client) Put(addr, filename string, r io.Reader) (int64, error) {
+	t := c.begin(addr, filename, true)
+	t.Blocks, t.Bytes, t.Err = c.put(&t, r)
+	c.finish(t)
+
+	return t.Bytes, t.Err
+}
+
+// begin returns the record of a transfer with the RFC 1350 defaults, which
+// negotiated options change
+func (c *Client) begin(addr, filename string, upload bool) Transfer {
+	return Transfer{
+		Client:   addr,
+		Filename: filename,
+		Mode:     "octet",
+		Upload:   upload,
+		Params:   Params{BlockSize: BlockSize, WindowSize: 1, Timeout: c.timeout(), Size: -1},
+		Start:    time.Now(),
+	}
+}
+
+func (c *Client) finish(t Transfer) {
+	if c.OnFinish != nil {
+		t.Duration = time.Since(t.Start)
+		c.OnFinish(t)
+	}
+}
+
+// get downloads t.Filename to w, returning the number of blocks received and
+// bytes written
+func (c *Client) get(t *Transfer, w io.Writer) (uint64, int64, error) {
+	server, err := net.ResolveUDPAddr("udp", t.Client)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	rrq := ReadReq{Filename: t.Filename, Mode: t.Mode, Options: c.options()}
+	if c.Compress {
+		rrq.Options = append(rrq.Options, Option{Name: "xcompress", Value: "gzip"})
+	}
+
+	t.Options = rrq.Options
+
+	out, err := rrq.MarshalBinary()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := BlockSize
+	if c.BlockSize > size {
+		size = c.BlockSize
+	}
+
+	var (
+		peer     net.Addr
+		dataPkt  Data
+		errPkt   Err
+		oackPkt  OAck
+		block    uint16
+		blocks   uint64 // blocks received, not wrapping like block
+		inWindow int    // blocks received since the last ACK sent
+		nacked   bool   // the last block in order was ACKed again for a gap
+		waiting  bool   // out was sent already, or is only sent on timeout
+		written  int64
+		inflate  *inflater // decompresses the payloads if the server compresses them
+		dst      = w
+		buf      = make([]byte, 4+size)
+		deadline = c.deadline(t)
+	)
+
+	defer func() {
+		if inflate != nil {
+			inflate.abort()
+		}
+	}()
+
+	for {
+		n, err := c.exchange(conn, server, &peer, deadline, buf, waiting, out)
+		if err != nil {
+			return blocks, written, err
+		}
+
+		switch {
+		case dataPkt.UnmarshalBinary(buf[:n]) == nil:
+			if dataPkt.Block != block+1 {
+				// a duplicate or a gap in the window: ACK the last block in
+				// order again, once, for the server to resend the blocks
+				// following it
+				waiting, nacked, inWindow = nacked, true, 0
+				continue
+			}
+
+			block, blocks, nacked = block+1, blocks+1, false
+
+			m, err := io.Copy(dst, dataPkt.Payload)
+			if inflate == nil {
+				written += m
+			}
+
+			if err != nil {
+				return blocks, written, err
+			}
+
+			ack := Ack(block)
+			if out, err = ack.MarshalBinary(); err != nil {
+				return blocks, written, err
+			}
+
+			// the final block is shorter than the block size
+			if n < 4+t.Params.BlockSize {
+				if err = c.send(conn, out, peer); err != nil || inflate == nil {
+					return blocks, written, err
+				}
+
+				written, err = inflate.Close()
+
+				return blocks, written, err
+			}
+
+			// only the last block of a window is acknowledged, the ACK is
+			// sent on timeout otherwise, asking for the rest of the window
+			inWindow++
+			if waiting = inWindow < t.Params.WindowSize; !waiting {
+				inWindow = 0
+			}
+		case block == 0 && oackPkt.UnmarshalBinary(buf[:n]) == nil:
+			if err = c.accept(t, oackPkt); err != nil {
+				c.refuse(conn, peer, err)
+				return blocks, written, err
+			}
+
+			if t.Params.Compress && inflate == nil {
+				inflate = newInflater(w)
+				dst = inflate
+			}
+
+			// confirm the options with ACK 0
+			ack := Ack(0)
+			if out, err = ack.MarshalBinary(); err != nil {
+				return blocks, written, err
+			}
+
+			waiting = false
+		case errPkt.UnmarshalBinary(buf[:n]) == nil:
+			return blocks, written, serverError(errPkt)
+		default:
+			waiting = true
+		}
+	}
+}
+
+// put uploads the contents of r as t.Filename, returning the number of
+// blocks and bytes acknowledged
+func (c *Client) put(t *Transfer, r io.Reader) (uint64, int64, error) {
+	server, err := net.ResolveUDPAddr("udp", t.Client)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	wrq := WriteReq{Filename: t.Filename, Mode: t.Mode, Options: c.options()}
+	t.Options = wrq.Options
+
+	out, err := wrq.MarshalBinary()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		peer     net.Addr
+		ackPkt   Ack
+		oackPkt  OAck
+		errPkt   Err
+		dataPkt  = Data{Payload: r}
+		window   = [][]byte{out} // packets sent but not yet acknowledged, the request until answered
+		started  bool            // the server accepted the request
+		acked    uint16          // last block acknowledged
+		eof      bool            // the final block is in the window
+		sent     int64
+		blocks   uint64 // blocks acknowledged, not wrapping like acked
+		buf      = make([]byte, DatagramSize)
+		waiting  bool // the window was sent already, a stale reply came back
+		deadline = c.deadline(t)
+	)
+
+	for {
+		n, err := c.exchange(conn, server, &peer, deadline, buf, waiting, window...)
+		if err != nil {
+			return blocks, sent, err
+		}
+
+		switch {
+		case !started && oackPkt.UnmarshalBinary(buf[:n]) == nil:
+			if err = c.accept(t, oackPkt); err != nil {
+				c.refuse(conn, peer, err)
+				return blocks, sent, err
+			}
+
+			started, window = true, nil
+		case !started && ackPkt.UnmarshalBinary(buf[:n]) == nil && ackPkt == 0:
+			started, window = true, nil
+		case started && ackPkt.UnmarshalBinary(buf[:n]) == nil:
+			// block numbers wrap around, so count the blocks acknowledged
+			// relative to the last acknowledged one. A duplicate ACK doesn't
+			// resend the window, that's left to the timeout to avoid the
+			// Sorcerer's Apprentice Syndrome.
+			k := int(uint16(ackPkt) - acked)
+			if waiting = k < 1 || k > len(window); waiting {
+				continue
+			}
+
+			for _, data := range window[:k] {
+				sent += int64(len(data) - 4)
+			}
+
+			window, acked, blocks = window[k:], uint16(ackPkt), blocks+uint64(k)
+
+			if eof && len(window) == 0 {
+				return blocks, sent, nil
+			}
+		case errPkt.UnmarshalBinary(buf[:n]) == nil:
+			return blocks, sent, serverError(errPkt)
+		default:
+			waiting = true
+			continue
+		}
+
+		// fill the window, the final packet is shorter than a full block
+		dataPkt.Size = t.Params.BlockSize
+
+		for len(window) < t.Params.WindowSize && !eof {
+			data, err := dataPkt.MarshalBinary()
+			if err != nil {
+				return blocks, sent, err
+			}
+
+			window, eof = append(window, data), len(data) < 4+t.Params.BlockSize
+		}
+
+		waiting = false
+	}
+}
+
+// options returns the options a request asks for
+func (c *Client) options() []Option {
+	var options []Option
+
+	if c.BlockSize > 0 {
+		options = append(options, Option{Name: "blksize", Value: strconv.Itoa(c.BlockSize)})
+	}
+
+	if c.WindowSize > 1 {
+		options = append(options, Option{Name: "windowsize", Value: strconv.Itoa(c.WindowSize)})
+	}
+
+	return options
+}
+
+// accept sets t's parameters to the options the server acknowledged. Block
+// and window sizes above the ones asked for are refused, as RFC 2347 has
+// clients do with values they can't use.
+func (c *Client) accept(t *Transfer, oack OAck) error {
+	t.Accepted = append([]Option(nil), oack...)
+
+	for _, o := range oack {
+		n, err := strconv.Atoi(o.Value)
+
+		switch {
+		case strings.EqualFold(o.Name, "blksize"):
+			if err != nil || n < MinBlockSize || n > c.BlockSize {
+				return fmt.Errorf("server answered blksize %q, asked for %d", o.Value, c.BlockSize)
+			}
+
+			t.Params.BlockSize = n
+		case strings.EqualFold(o.Name, "windowsize"):
+			if err != nil || n < 1 || n > c.WindowSize {
+				return fmt.Errorf("server answered windowsize %q, asked for %d", o.Value, c.WindowSize)
+			}
+
+			t.Params.WindowSize = n
+		case strings.EqualFold(o.Name, "xcompress"):
+			t.Params.Compress = c.Compress && strings.EqualFold(o.Value, "gzip")
+		}
+	}
+
+	return nil
+}
+
+// refuse tells the server the options it acknowledged are refused
+func (c *Client) refuse(conn net.PacketConn, peer net.Addr, err error) {
+	if b, mErr := (Err{Error: ErrOptions, Message: err.Error()}).MarshalBinary(); mErr == nil {
+		_ = c.send(conn, b, peer)
+	}
+}
+
+// deadline returns the time t ends with ErrTransferTimeout, zero if never
+func (c *Client) deadline(t *Transfer) time.Time {
+	if c.MaxDuration <= 0 {
+		return time.Time{}
+	}
+
+	return t.Start.Add(c.MaxDuration)
+}
+
+// serverError is the error of a transfer the server aborted with errPkt
+func serverError(errPkt Err) error {
+	return fmt.Errorf("server error: %w (%s)", &Error{Code: errPkt.Error, Message: errPkt.Message}, errPkt.Error)
+}
+
+// exchange sends the packets out and waits for a reply, retransmitting them
+// on timeout. Packets are sent to the server until it replies from its
+// transfer ID (TID), which is then stored in peer; packets from any other
+// address are ignored. With sent set out already went out, so it's only sent
+// again on timeout. Past the deadline, unless zero, the transfer is aborted
+// with ErrTransferTimeout.
+func (c *Client) exchange(conn net.PacketConn, server *net.UDPAddr, peer *net.Addr, deadline time.Time, buf []byte, sent bool, out ...[]byte) (int, error) {
+	retries, timeout := c.Retries, c.timeout()
+	if retries == 0 {
+		retries = 10
+	}
+
+Retry:
+	for i := retries; i > 0; i-- {
+		to := *peer
+		if to == nil {
+			to = server
+		}
+
+		for _, p := range out {
+			if sent {
+				break
+			}
+
+			if err := c.send(conn, p, to); err != nil {
+				return 0, err
+			}
+		}
+
+		sent = false
+
+		wait := time.Now().Add(timeout)
+		if !deadline.IsZero() && deadline.Before(wait) {
+			wait = deadline
+		}
+
+		_ = conn.SetReadDeadline(wait)
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					if !deadline.IsZero() && !time.Now().Before(deadline) {
+						c.abort(conn, *peer)
+						return 0, ErrTransferTimeout
+					}
+
+					continue Retry
+				}
+
+				return 0, err
+			}
+
+			if *peer == nil {
+				if u, ok := from.(*net.UDPAddr); !ok || !u.IP.Equal(server.IP) {
+					continue
+				}
+
+				*peer = from
+			} else if from.String() != (*peer).String() {
+				continue
+			}
+
+			c.trace(TraceIn, conn.LocalAddr(), from, buf[:n])
+
+			return n, nil
+		}
+	}
+
+	return 0, ErrRetriesExhausted
+}
+
+// abort ends the transfer with the server's TID, if it answered already,
+// with an ERROR packet
+func (c *Client) abort(conn net.PacketConn, peer net.Addr) {
+	if peer == nil {
+		return
+	}
+
+	if b, err := (Err{Error: ErrUnknown, Message: "transfer timed out"}).MarshalBinary(); err == nil {
+		_ = c.send(conn, b, peer)
+	}
+}
+
+// timeout returns the time to wait for a reply, 10 seconds unless set
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 10 * time.Second
+	}
+
+	return c.Timeout
+}
+
+func (c *Client) send(conn net.PacketConn, p []byte, to net.Addr) error {
+	if _, err := conn.WriteTo(p, to); err != nil {
+		return err
+	}
+
+	c.trace(TraceOut, conn.LocalAddr(), to, p)
+
+	return nil
+}
+
+func (c *Client) trace(dir TraceDir, local, remote net.Addr, p []byte) {
+	if c.Trace != nil {
+		c.Trace(dir, local, remote, p)
+	}
+}
@@ -0,0 +1,52 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClientOptions(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 1000)
+
+	tests := []struct {
+		name       string
+		client     Client
+		blockSize  int
+		windowSize int
+	}{
+		{"plain", Client{}, BlockSize, 1},
+		{"blksize", Client{BlockSize: 1432}, 1432, 1},
+		{"windowsize", Client{WindowSize: 4}, BlockSize, 4},
+		{"lowered", Client{BlockSize: 4096, WindowSize: 32}, 2048, 8},
+	}
+
+	addr := testServer(t, &Server{Payload: payload, MaxBlockSize: 2048, MaxWindowSize: 8})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got bytes.Buffer
+				tr  Transfer
+			)
+
+			c := tt.client
+			c.OnFinish = func(done Transfer) { tr = done }
+
+			if _, err := c.Get(addr.String(), "f", &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), payload) {
+				t.Fatalf("got %d bytes, want the %d of the payload", got.Len(), len(payload))
+			}
+
+			if tr.Params.BlockSize != tt.blockSize || tr.Params.WindowSize != tt.windowSize {
+				t.Errorf("settled on blksize %d and windowsize %d, want %d and %d", tr.Params.BlockSize, tr.Params.WindowSize, tt.blockSize, tt.windowSize)
+			}
+
+			if want := uint64(len(payload)/tt.blockSize + 1); tr.Blocks != want {
+				t.Errorf("received %d blocks, want %d", tr.Blocks, want)
+			}
+		})
+	}
+}
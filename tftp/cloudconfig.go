@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"text/template"
+)
+
+// CloudConfig renders cloud-init user-data and Ignition configs per client
+// from Templates, for machines fetching them over TFTP early in boot where
+// HTTP isn't available yet. Besides their own Funcs, templates may call
+//
+//	{{json .Device.hostname}}  the value as JSON, also a valid YAML scalar
+//	{{base64 "..."}}           the string base64 encoded
+//	{{dataurl "..."}}          a data: URL of the string, for Ignition file contents
+//
+// and what they render is checked before it's served: Ignition configs,
+// requested as *.ign or *.json, must be valid JSON, and anything else is
+// cloud-init user-data, which must start with a header cloud-init knows,
+// like #cloud-config or #!. Use its Generate method as the server's
+// Generate:
+//
+//	s.Generate = (&tftp.CloudConfig{Templates: tftp.Templates{FS: os.DirFS("/srv/cloud"), Devices: inventory}}).Generate
+type CloudConfig struct {
+	Templates
+}
+
+// cloudInitHeaders start the kinds of user-data cloud-init handles
+var cloudInitHeaders = []string{
+	"#cloud-config",
+	"#!",
+	"#include",
+	"#cloud-boothook",
+	"#part-handler",
+	"#upstart-job",
+	"## template: jinja",
+	"Content-Type: multipart/",
+}
+
+// Generate renders the template of r's file and checks it, returning a nil
+// reader if there is none
+func (c *CloudConfig) Generate(r *Request) (io.Reader, int64, error) {
+	t := c.Templates
+	t.Funcs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"dataurl": func(s string) string {
+			return "data:," + url.PathEscape(s)
+		},
+	}
+
+	for name, fn := range c.Funcs {
+		t.Funcs[name] = fn
+	}
+
+	content, size, err := t.Generate(r)
+	if content == nil || err != nil {
+		return content, size, err
+	}
+
+	b, err := io.ReadAll(content)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	switch path.Ext(FSPath(r.Filename)) {
+	case ".ign", ".json":
+		if !json.Valid(b) {
+			return nil, -1, fmt.Errorf("%s: rendered Ignition config isn't valid JSON", r.Filename)
+		}
+	default:
+		if !hasCloudInitHeader(b) {
+			return nil, -1, fmt.Errorf("%s: rendered user-data doesn't start with a cloud-init header like #cloud-config", r.Filename)
+		}
+	}
+
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+func hasCloudInitHeader(b []byte) bool {
+	for _, h := range cloudInitHeaders {
+		if bytes.HasPrefix(b, []byte(h)) {
+			return true
+		}
+	}
+
+	return false
+}
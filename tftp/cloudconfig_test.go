@@ -0,0 +1,55 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCloudConfig(t *testing.T) {
+	devices, err := NewDeviceTable([]Device{{"ip": "127.0.0.1", "hostname": `node "1"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := testServer(t, &Server{
+		Payload: []byte{},
+		Generate: (&CloudConfig{Templates: Templates{
+			Devices: devices,
+			FS: fstest.MapFS{
+				"user-data.tmpl":  {Data: []byte("#cloud-config\nhostname: {{json .Device.hostname}}\n")},
+				"node.ign.tmpl":   {Data: []byte(`{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/hostname", "contents": {"source": {{json (dataurl .Device.hostname)}}}}]}}`)},
+				"broken.ign.tmpl": {Data: []byte(`{"ignition": {{.Device.hostname}}}`)},
+				"plain.tmpl":      {Data: []byte("hostname: {{.Device.hostname}}\n")},
+			},
+		}}).Generate,
+	})
+
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"user-data", "#cloud-config\nhostname: \"node \\\"1\\\"\"\n"},
+		{"node.ign", `{"ignition": {"version": "3.3.0"}, "storage": {"files": [{"path": "/etc/hostname", "contents": {"source": "data:,node%20%221%22"}}]}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if got := newTestClient(t).get(addr, rrq(tt.filename, "octet"), BlockSize); string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// configs that would break the machine's boot aren't served
+	for _, filename := range []string{"broken.ign", "plain"} {
+		t.Run(filename, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request(addr, rrq(filename, "octet"))
+
+			if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr)}) {
+				t.Errorf("got %q, want an ERROR", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package tftp
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// compressOption negotiates the experimental xcompress option, which has the
+// server send the file gzip compressed. Only gzip is supported, and only for
+// read requests to a server with Compress set. A tsize acknowledged
+// alongside it is the size of the file before compression.
+func compressOption(s *Server, sess *session, value string) (string, bool) {
+	if !s.Compress || sess.upload || !strings.EqualFold(value, "gzip") {
+		return "", false
+	}
+
+	sess.compress = true
+
+	return "gzip", true
+}
+
+// compress returns a reader of the contents of r compressed with gzip as
+// they are read, and a function stopping the compression
+func compress(r io.Reader) (io.Reader, func()) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gz := gzip.NewWriter(pw)
+
+		_, err := io.Copy(gz, r)
+		if err == nil {
+			err = gz.Close()
+		}
+
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, func() { _ = pr.Close() }
+}
+
+// inflater decompresses the gzip stream written to it into w as it arrives
+type inflater struct {
+	pw   *io.PipeWriter
+	done chan error
+	n    int64 // bytes written to w
+}
+
+func newInflater(w io.Writer) *inflater {
+	pr, pw := io.Pipe()
+	f := &inflater{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		gz, err := gzip.NewReader(pr)
+		if err == nil {
+			f.n, err = io.Copy(w, gz)
+		}
+
+		_ = pr.CloseWithError(err) // fail further writes if decompression stopped
+		f.done <- err
+	}()
+
+	return f
+}
+
+func (f *inflater) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+// Close waits for the stream to be decompressed, returning the number of
+// bytes written
+func (f *inflater) Close() (int64, error) {
+	_ = f.pw.Close()
+	err := <-f.done
+
+	return f.n, err
+}
+
+// abort stops decompressing a stream that won't be completed
+func (f *inflater) abort() {
+	_ = f.pw.CloseWithError(io.ErrUnexpectedEOF)
+}
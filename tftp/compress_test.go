@@ -0,0 +1,112 @@
+package tftp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 1000)
+
+	tests := []struct {
+		name    string
+		server  *Server
+		req     []byte
+		oack    string
+		gzipped bool
+	}{
+		{
+			name:    "compressed",
+			server:  &Server{Compress: true},
+			req:     rrq("f", "octet", "xcompress", "GZIP", "tsize", "0"),
+			oack:    "\x00\x06xcompress\x00gzip\x00tsize\x0013000\x00",
+			gzipped: true,
+		},
+		{
+			name:   "disabled",
+			server: &Server{},
+			req:    rrq("f", "octet", "xcompress", "gzip", "tsize", "0"),
+			oack:   "\x00\x06tsize\x0013000\x00",
+		},
+		{
+			name:   "unknown algorithm",
+			server: &Server{Compress: true},
+			req:    rrq("f", "octet", "xcompress", "zstd", "tsize", "0"),
+			oack:   "\x00\x06tsize\x0013000\x00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.server.Payload = payload
+			addr := testServer(t, tt.server)
+
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			if got := c.receive(); string(got) != tt.oack {
+				t.Fatalf("got %q, want OACK %q", got, tt.oack)
+			}
+
+			c.send([]byte{0, byte(OpAck), 0, 0})
+
+			var got []byte
+			for block := uint16(1); ; block++ {
+				p := c.receive()
+				got = append(got, p[4:]...)
+				c.send([]byte{0, byte(OpAck), byte(block >> 8), byte(block)})
+
+				if len(p)-4 < BlockSize {
+					break
+				}
+			}
+
+			if tt.gzipped {
+				gz, err := gzip.NewReader(bytes.NewReader(got))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(got) >= len(payload) {
+					t.Errorf("sent %d bytes compressed, no fewer than the %d of the payload", len(got), len(payload))
+				}
+
+				if got, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Errorf("got %d bytes, want the %d of the payload", len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestClientCompress(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 1000)
+
+	for _, compress := range []bool{true, false} {
+		addr := testServer(t, &Server{Payload: payload, Compress: compress})
+
+		var (
+			got bytes.Buffer
+			tr  Transfer
+		)
+
+		c := Client{Compress: true, OnFinish: func(done Transfer) { tr = done }}
+		if _, err := c.Get(addr.String(), "f", &got); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got.Bytes(), payload) {
+			t.Errorf("server compressing %v: got %d bytes, want %d", compress, got.Len(), len(payload))
+		}
+
+		if tr.Params.Compress != compress {
+			t.Errorf("server compressing %v: transfer compressed %v", compress, tr.Params.Compress)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package tftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"time"
+)
+
+// config holds the settings a Server runs with, its fields with the
+// defaults of those left unset filled in
+type config struct {
+	fs            fs.FS
+	retries       uint8
+	timeout       time.Duration
+	retry         RetryStrategy
+	maxAge        time.Duration
+	minTimeout    time.Duration
+	maxTimeout    time.Duration
+	minBlockSize  int
+	maxBlockSize  int
+	maxWindowSize int
+}
+
+func (c *config) setDefaults() error {
+	if c.retries == 0 {
+		c.retries = 10
+	}
+
+	if c.timeout == 0 {
+		c.timeout = 10 * time.Second
+	}
+
+	// a strategy left without an initial wait would spend every retry at
+	// once, so it waits the timeout instead
+	switch r := c.retry.(type) {
+	case nil:
+		c.retry = FixedRetry(c.timeout)
+	case FixedRetry:
+		if r <= 0 {
+			c.retry = FixedRetry(c.timeout)
+		}
+	case ExponentialRetry:
+		if r.Initial <= 0 {
+			r.Initial = c.timeout
+			c.retry = r
+		}
+	case *ExponentialRetry:
+		if r != nil && r.Initial <= 0 {
+			e := *r
+			e.Initial = c.timeout
+			c.retry = e
+		}
+	case AdaptiveRetry:
+		if r.Initial <= 0 {
+			r.Initial = c.timeout
+			c.retry = r
+		}
+	case *AdaptiveRetry:
+		if r != nil && r.Initial <= 0 {
+			a := *r
+			a.Initial = c.timeout
+			c.retry = a
+		}
+	}
+
+	switch {
+	case c.maxAge == 0:
+		c.maxAge = 24 * time.Hour
+	case c.maxAge < 0:
+		c.maxAge = 0
+	}
+
+	if c.minTimeout == 0 {
+		c.minTimeout = time.Second
+	}
+
+	if c.maxTimeout == 0 {
+		c.maxTimeout = 255 * time.Second
+	}
+
+	if c.minTimeout < 0 || c.minTimeout > c.maxTimeout {
+		return fmt.Errorf("timeout bounds must be positive, with the minimum of %s not above the maximum of %s", c.minTimeout, c.maxTimeout)
+	}
+
+	if c.minBlockSize == 0 {
+		c.minBlockSize = MinBlockSize
+	}
+
+	if c.maxBlockSize == 0 {
+		c.maxBlockSize = MaxBlockSize
+	}
+
+	if c.minBlockSize < MinBlockSize || c.maxBlockSize > MaxBlockSize || c.minBlockSize > c.maxBlockSize {
+		return fmt.Errorf("block size bounds must be within %d and %d bytes, with the minimum not above the maximum", MinBlockSize, MaxBlockSize)
+	}
+
+	if c.maxWindowSize == 0 {
+		c.maxWindowSize = maxWindowSize
+	}
+
+	if c.maxWindowSize < 0 {
+		return fmt.Errorf("window size bound %d can't be negative", c.maxWindowSize)
+	}
+
+	return nil
+}
+
+// ServerOption configures a Server created by NewServer
+type ServerOption func(*Server)
+
+// NewServer returns a Server configured by opts, e.g.
+//
+//	s := tftp.NewServer(tftp.WithRoot("/srv/tftp"), tftp.WithTimeout(2*time.Second))
+//
+// Settings without an option are set on the returned Server's fields before
+// it serves.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// WithRetries sets the number of times a packet is sent before a transfer is
+// abandoned
+func WithRetries(n uint8) ServerOption {
+	return func(s *Server) { s.Retries = n }
+}
+
+// WithTimeout sets the time waited for a reply before retransmitting a
+// packet
+func WithTimeout(d time.Duration) ServerOption {
+	return func(s *Server) { s.Timeout = d }
+}
+
+// WithRetryStrategy sets how long to wait for a reply before retransmitting
+// a packet
+func WithRetryStrategy(r RetryStrategy) ServerOption {
+	return func(s *Server) { s.Retry = r }
+}
+
+// WithLogger logs requests and transfers to l instead of the standard logger
+func WithLogger(l *log.Logger) ServerOption {
+	return func(s *Server) { s.Logger = l }
+}
+
+// WithRoot serves the files below dir by their requested name
+func WithRoot(dir string) ServerOption {
+	return func(s *Server) { s.Root = dir }
+}
+
+// WithFS serves the files of fsys by their requested name
+func WithFS(fsys fs.FS) ServerOption {
+	return func(s *Server) { s.FS = fsys }
+}
+
+// WithPayload serves p for every request
+func WithPayload(p []byte) ServerOption {
+	return func(s *Server) { s.Payload = p }
+}
+
+// WithHandler answers every read request with h
+func WithHandler(h Handler) ServerOption {
+	return func(s *Server) { s.Handler = h }
+}
+
+// WithGenerate computes the file served for a read request with f when it
+// arrives
+func WithGenerate(f func(r *Request) (io.Reader, int64, error)) ServerOption {
+	return func(s *Server) { s.Generate = f }
+}
+
+// WithTransport creates the socket of every transfer with t
+func WithTransport(t func(ctx context.Context, local, client net.Addr) (net.PacketConn, error)) ServerOption {
+	return func(s *Server) { s.Transport = t }
+}
+
+// logf logs to the server's Logger, or the standard logger if it has none
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+		return
+	}
+
+	log.Printf(format, args...)
+}
@@ -0,0 +1,381 @@
+package tftp
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device are the attributes of a device in an inventory, e.g. its role,
+// site or the image it boots, keyed by name
+type Device map[string]string
+
+// DeviceResolver looks up the device a client is in an inventory, by the MAC
+// address its request named, nil if none, or its IP address, for Templates
+// and a Resolver to make per-device decisions. It returns nil for devices it
+// doesn't know. The context is the request's, canceled once its transfer
+// ended.
+type DeviceResolver interface {
+	Device(ctx context.Context, mac net.HardwareAddr, ip net.IP) (Device, error)
+}
+
+// deviceMemoKey is the context key of the devices looked up for a request
+type deviceMemoKey struct{}
+
+// deviceMemo holds the devices looked up for a request by every
+// DeviceResolver, so Templates and a Resolver sharing one ask it once
+type deviceMemo struct {
+	mu      sync.Mutex
+	devices map[DeviceResolver]memoDevice
+}
+
+type memoDevice struct {
+	d   Device
+	err error
+}
+
+// withDeviceMemo returns a context remembering the devices looked up with it
+func withDeviceMemo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deviceMemoKey{}, &deviceMemo{devices: make(map[DeviceResolver]memoDevice)})
+}
+
+// lookupDevice returns the device a request for filename from clientAddr
+// comes from, asking d only once per request
+func lookupDevice(ctx context.Context, d DeviceResolver, clientAddr, filename string) (Device, error) {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host = clientAddr
+	}
+
+	memo, _ := ctx.Value(deviceMemoKey{}).(*deviceMemo)
+	if memo == nil || !reflect.TypeOf(d).Comparable() {
+		return d.Device(ctx, MACFromFilename(filename), net.ParseIP(host))
+	}
+
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	m, ok := memo.devices[d]
+	if !ok {
+		m.d, m.err = d.Device(ctx, MACFromFilename(filename), net.ParseIP(host))
+		memo.devices[d] = m
+	}
+
+	return m.d, m.err
+}
+
+// DeviceCache is a DeviceResolver remembering what another one answered
+// for TTL, including the devices it doesn't know, so a slow inventory API
+// is asked about each device once in a while rather than on every request.
+// Failed lookups aren't remembered.
+type DeviceCache struct {
+	Resolver   DeviceResolver
+	TTL        time.Duration
+	MaxEntries int // 4096 if 0
+
+	mu      sync.Mutex
+	entries map[string]cachedDevice
+}
+
+type cachedDevice struct {
+	d       Device
+	expires time.Time
+}
+
+// Device returns the device with the addresses remembered, or else asks the
+// Resolver about it
+func (c *DeviceCache) Device(ctx context.Context, mac net.HardwareAddr, ip net.IP) (Device, error) {
+	key := mac.String() + "|" + ip.String()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		return e.d, nil
+	}
+
+	d, err := c.Resolver.Device(ctx, mac, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	max := c.MaxEntries
+	if max <= 0 {
+		max = 4096
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[string]cachedDevice)
+	}
+
+	// make room by forgetting the expired entries, or else any
+	if len(c.entries) >= max {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		for k := range c.entries {
+			if len(c.entries) < max {
+				break
+			}
+
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedDevice{d: d, expires: time.Now().Add(c.TTL)}
+
+	return d, nil
+}
+
+// DeviceTable is a DeviceResolver of a fixed list of devices, found by MAC
+// address first, then by IP address
+type DeviceTable struct {
+	devices []Device
+	byMAC   map[string]Device
+	byIP    map[string]Device
+}
+
+// NewDeviceTable returns the table of devices, which are found by their mac
+// and ip attributes, one of which each of them needs
+func NewDeviceTable(devices []Device) (*DeviceTable, error) {
+	t := &DeviceTable{devices: devices, byMAC: make(map[string]Device), byIP: make(map[string]Device)}
+
+	for i, d := range devices {
+		if d["mac"] == "" && d["ip"] == "" {
+			return nil, fmt.Errorf("device %d has neither mac nor ip", i+1)
+		}
+
+		if d["mac"] != "" {
+			mac, err := net.ParseMAC(d["mac"])
+			if err != nil {
+				return nil, fmt.Errorf("device %d: %w", i+1, err)
+			}
+
+			t.byMAC[mac.String()] = d
+		}
+
+		if d["ip"] != "" {
+			ip := net.ParseIP(d["ip"])
+			if ip == nil {
+				return nil, fmt.Errorf("device %d: invalid IP address %q", i+1, d["ip"])
+			}
+
+			t.byIP[ip.String()] = d
+		}
+	}
+
+	return t, nil
+}
+
+// LoadDevices reads the table of devices from a .json file holding an array
+// of objects, or a .csv file whose header row names the attributes, e.g.
+//
+//	mac,ip,role,image
+//	00:50:56:01:02:03,,spine,images/spine.bin
+//	,10.1.0.20,leaf,images/leaf.bin
+func LoadDevices(name string) (*DeviceTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var devices []Device
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		devices, err = readDevicesJSON(f)
+	case ".csv":
+		devices, err = readDevicesCSV(f)
+	default:
+		return nil, fmt.Errorf("%s: devices are read from .json or .csv files", name)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return NewDeviceTable(devices)
+}
+
+func readDevicesJSON(r io.Reader) ([]Device, error) {
+	var objects []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&objects); err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, len(objects))
+	for i, o := range objects {
+		devices[i] = make(Device)
+		flatten(devices[i], "", o)
+	}
+
+	return devices, nil
+}
+
+func readDevicesCSV(r io.Reader) ([]Device, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	header, devices := records[0], make([]Device, 0, len(records)-1)
+
+	for _, record := range records[1:] {
+		d := make(Device)
+		for i, value := range record {
+			if value != "" {
+				d[strings.TrimSpace(header[i])] = value
+			}
+		}
+
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+// Device returns the device with the MAC address, or else the IP address
+func (t *DeviceTable) Device(_ context.Context, mac net.HardwareAddr, ip net.IP) (Device, error) {
+	if d, ok := t.byMAC[mac.String()]; ok && mac != nil {
+		return d, nil
+	}
+
+	if d, ok := t.byIP[ip.String()]; ok && ip != nil {
+		return d, nil
+	}
+
+	return nil, nil
+}
+
+// Devices returns every device of the table, in the order they were given
+func (t *DeviceTable) Devices() []Device {
+	return t.devices
+}
+
+// DeviceAPI is a DeviceResolver asking an HTTP inventory API, e.g. NetBox,
+// about every request's device. The API answers with a JSON object of the
+// device's attributes, or a list of devices in results as NetBox does, of
+// which the first is taken, and 404 Not Found or an empty list for devices
+// it doesn't know. Nested objects are flattened with dotted keys, e.g.
+// role.slug, and arrays left out. Wrap it in a DeviceCache so the API isn't
+// asked about every request.
+type DeviceAPI struct {
+	// URL of a device, with {mac} and {ip} replaced by its addresses, e.g.
+	// https://netbox.example.com/api/dcim/devices/?mac_address={mac}.
+	// Devices missing an address the URL needs aren't looked up.
+	URL string
+
+	// Header is sent with every request, e.g. an Authorization token
+	Header http.Header
+
+	// Client sends the requests, a client with a 10 second timeout if nil
+	Client *http.Client
+}
+
+// Device asks the API about the device with the addresses, giving up once
+// ctx is done
+func (a *DeviceAPI) Device(ctx context.Context, mac net.HardwareAddr, ip net.IP) (Device, error) {
+	if strings.Contains(a.URL, "{mac}") && mac == nil || strings.Contains(a.URL, "{ip}") && ip == nil {
+		return nil, nil
+	}
+
+	var macStr, ipStr string
+	if mac != nil {
+		macStr = mac.String()
+	}
+
+	if ip != nil {
+		ipStr = ip.String()
+	}
+
+	u := strings.NewReplacer("{mac}", url.QueryEscape(macStr), "{ip}", url.QueryEscape(ipStr)).Replace(a.URL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range a.Header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("inventory: %s", resp.Status)
+	}
+
+	var o map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, fmt.Errorf("inventory: %w", err)
+	}
+
+	if results, ok := o["results"].([]interface{}); ok {
+		if len(results) == 0 {
+			return nil, nil
+		}
+
+		if o, ok = results[0].(map[string]interface{}); !ok {
+			return nil, errors.New("inventory: results hold no objects")
+		}
+	}
+
+	d := make(Device)
+	flatten(d, "", o)
+
+	return d, nil
+}
+
+// flatten adds the values of o to d, nested objects with dotted keys
+func flatten(d Device, prefix string, o map[string]interface{}) {
+	for k, v := range o {
+		switch v := v.(type) {
+		case string:
+			d[prefix+k] = v
+		case float64:
+			d[prefix+k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			d[prefix+k] = strconv.FormatBool(v)
+		case map[string]interface{}:
+			flatten(d, prefix+k+".", v)
+		}
+	}
+}
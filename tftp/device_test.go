@@ -0,0 +1,200 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadDevices(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"inv.csv":  "mac,ip,role\n00-50-56-01-02-03,,spine\n,10.1.0.20,leaf\n",
+		"inv.json": `[{"mac": "00:50:56:01:02:03", "role": "spine"}, {"ip": "10.1.0.20", "role": "leaf", "rack": {"row": 4}}]`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			table, err := LoadDevices(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mac, _ := net.ParseMAC("00:50:56:01:02:03")
+
+			if d, _ := table.Device(context.Background(), mac, net.ParseIP("10.1.0.20")); d["role"] != "spine" {
+				t.Errorf("by MAC: got %v, want the spine", d)
+			}
+
+			if d, _ := table.Device(context.Background(), nil, net.ParseIP("10.1.0.20")); d["role"] != "leaf" {
+				t.Errorf("by IP: got %v, want the leaf", d)
+			}
+
+			if d, _ := table.Device(context.Background(), nil, net.ParseIP("10.1.0.21")); d != nil {
+				t.Errorf("unknown: got %v, want nil", d)
+			}
+		})
+	}
+}
+
+func TestDeviceAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("mac_address") {
+		case "00:50:56:01:02:03":
+			_, _ = w.Write([]byte(`{"count": 1, "results": [{"name": "sw1", "role": {"slug": "spine"}, "tags": [], "rack": null}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"count": 0, "results": []}`))
+		}
+	}))
+	defer srv.Close()
+
+	api := &DeviceAPI{URL: srv.URL + "/api/dcim/devices/?mac_address={mac}"}
+	mac, _ := net.ParseMAC("00:50:56:01:02:03")
+
+	d, err := api.Device(context.Background(), mac, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (Device{"name": "sw1", "role.slug": "spine"}); !reflect.DeepEqual(d, want) {
+		t.Errorf("got %v, want %v", d, want)
+	}
+
+	other, _ := net.ParseMAC("00:50:56:ff:ff:ff")
+	if d, err = api.Device(context.Background(), other, nil); err != nil || d != nil {
+		t.Errorf("unknown device: got %v, %v, want nil", d, err)
+	}
+
+	if d, err = api.Device(context.Background(), nil, net.ParseIP("10.1.0.20")); err != nil || d != nil {
+		t.Errorf("no MAC: got %v, %v, want nil without asking", d, err)
+	}
+}
+
+func TestResolveDevice(t *testing.T) {
+	table, err := NewDeviceTable([]Device{{"ip": "10.1.0.20", "role": "leaf", "image": "leaf.bin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Resolver{
+		Devices: table,
+		Rules: []ResolveRule{
+			{Device: Device{"role": "spine"}, Files: []string{"spine.bin"}},
+			{Device: Device{"role": "leaf"}, Files: []string{"images/{device.image}"}},
+		},
+	}
+
+	if got, want := r.Resolve(context.Background(), "10.1.0.20:2000", ReadReq{Filename: "boot.bin"}), []string{"images/leaf.bin", "boot.bin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := r.Resolve(context.Background(), "10.1.0.21:2000", ReadReq{Filename: "boot.bin"}), []string{"boot.bin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unknown device: got %q, want %q", got, want)
+	}
+}
+
+// countingDevices is a DeviceResolver of one device counting the lookups
+type countingDevices struct {
+	lookups int32
+	err     error
+}
+
+func (c *countingDevices) Device(ctx context.Context, mac net.HardwareAddr, ip net.IP) (Device, error) {
+	atomic.AddInt32(&c.lookups, 1)
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return Device{"role": "leaf", "image": "leaf.bin"}, nil
+}
+
+func TestDeviceCache(t *testing.T) {
+	inventory := &countingDevices{}
+	cache := &DeviceCache{Resolver: inventory, TTL: 100 * time.Millisecond, MaxEntries: 2}
+
+	lookup := func(ip string) Device {
+		t.Helper()
+
+		d, err := cache.Device(context.Background(), nil, net.ParseIP(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d
+	}
+
+	lookup("10.0.0.1")
+	if d := lookup("10.0.0.1"); d["role"] != "leaf" || atomic.LoadInt32(&inventory.lookups) != 1 {
+		t.Errorf("got %v after %d lookups, want the leaf remembered", d, inventory.lookups)
+	}
+
+	// a full cache forgets some device to remember another
+	lookup("10.0.0.2")
+	lookup("10.0.0.3")
+	if n := len(cache.entries); n != 2 {
+		t.Errorf("remembered %d devices, want at most 2", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	lookup("10.0.0.3")
+	if n := atomic.LoadInt32(&inventory.lookups); n != 4 {
+		t.Errorf("asked %d times, want an expired device asked about again", n)
+	}
+
+	inventory.err = errors.New("inventory down")
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Device(context.Background(), nil, net.ParseIP("10.0.0.4")); err == nil {
+			t.Error("lookup didn't fail")
+		}
+	}
+
+	if n := atomic.LoadInt32(&inventory.lookups); n != 6 {
+		t.Errorf("asked %d times, want failures not remembered", n)
+	}
+}
+
+func TestDeviceLookedUpOnce(t *testing.T) {
+	inventory := &countingDevices{}
+	templates := &Templates{FS: fstest.MapFS{"role.tmpl": {Data: []byte("{{.Device.role}}")}}, Devices: inventory}
+	resolver := &Resolver{
+		Devices: inventory,
+		Rules:   []ResolveRule{{Device: Device{"role": "leaf"}, Files: []string{"images/{device.image}"}}},
+	}
+
+	// the server gives every request a context of its own
+	ctx := withDeviceMemo(context.Background())
+
+	if got, want := resolver.Resolve(ctx, "10.1.0.20:2000", ReadReq{Filename: "role"}), []string{"images/leaf.bin", "role"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	r, _, err := templates.Generate(&Request{RemoteAddr: "10.1.0.20:2000", Filename: "role", ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := io.ReadAll(r); string(got) != "leaf" {
+		t.Errorf("rendered %q, want the role", got)
+	}
+
+	if n := atomic.LoadInt32(&inventory.lookups); n != 1 {
+		t.Errorf("looked up the device %d times for one request", n)
+	}
+}
@@ -0,0 +1,78 @@
+package tftp
+
+import (
+	"io/fs"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// DirFS returns the files below the directory dir, like os.DirFS, for
+// Server.FS. On Windows it also refuses the names that don't name a file
+// below dir, see LocalName. Requested names go through FSPath, so \ works as
+// a separator and a drive letter is taken as the root of dir.
+func DirFS(dir string) fs.FS {
+	return dirFS{os.DirFS(dir)}
+}
+
+type dirFS struct {
+	fs.FS
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	if !LocalName(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return d.FS.Open(name)
+}
+
+// LocalName reports whether the slash separated path name is safe to open
+// below a directory of the host. On Windows that rules out names with a :,
+// opening an alternate data stream of a file, and the names of devices like
+// NUL or COM1, which Windows opens whatever directory they are in.
+func LocalName(name string) bool {
+	return localName(name, runtime.GOOS == "windows")
+}
+
+func localName(name string, windows bool) bool {
+	if !windows {
+		return true
+	}
+
+	for _, elem := range strings.Split(name, "/") {
+		if strings.ContainsAny(elem, `:\`) || reservedName(elem) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reservedName reports whether elem is a Windows device name, which is
+// matched ignoring case, any extension and trailing spaces
+func reservedName(elem string) bool {
+	if i := strings.IndexByte(elem, '.'); i >= 0 {
+		elem = elem[:i]
+	}
+
+	elem = strings.ToUpper(strings.TrimRight(elem, " "))
+
+	switch elem {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+
+	return len(elem) == 4 && (strings.HasPrefix(elem, "COM") || strings.HasPrefix(elem, "LPT")) && elem[3] >= '1' && elem[3] <= '9'
+}
+
+// hasDrive reports whether name starts with a Windows drive, like C:\
+func hasDrive(name string) bool {
+	if len(name) < 3 || name[1] != ':' || name[2] != '\\' && name[2] != '/' {
+		return false
+	}
+
+	c := name[0] | 0x20 // lower case
+
+	return c >= 'a' && c <= 'z'
+}
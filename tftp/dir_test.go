@@ -0,0 +1,51 @@
+package tftp
+
+import "testing"
+
+func TestFSPath(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"pxelinux.0", "pxelinux.0"},
+		{"/boot/pxelinux.0", "boot/pxelinux.0"},
+		{`boot\efi\grubx64.efi`, "boot/efi/grubx64.efi"},
+		{`C:\boot\pxelinux.0`, "boot/pxelinux.0"},
+		{"c:/boot/pxelinux.0", "boot/pxelinux.0"},
+		{`D:\..\..\Windows\win.ini`, "Windows/win.ini"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"C:pxelinux.0", "C:pxelinux.0"},
+		{"1:/x", "1:/x"},
+		{"", "."},
+		{`\`, "."},
+	}
+
+	for _, tt := range tests {
+		if got := FSPath(tt.filename); got != tt.want {
+			t.Errorf("FSPath(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestLocalNameWindows(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"boot/pxelinux.0", true},
+		{"console.cfg", true},
+		{"com10", true},
+		{"NUL", false},
+		{"boot/nul.txt", false},
+		{"Con ", false},
+		{"com1.log", false},
+		{"LPT9", false},
+		{"C:pxelinux.0", false},
+		{"boot/file.txt:secret", false},
+	}
+
+	for _, tt := range tests {
+		if got := localName(tt.name, true); got != tt.want {
+			t.Errorf("localName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
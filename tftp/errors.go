@@ -0,0 +1,173 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"github.com/josephwoodward/tftp-server/tftp/wire"
+)
+
+// Error is an error carrying the ERROR packet a peer is sent about it.
+// Handlers and the server's hooks return one to choose the exact code and
+// message, and readers of content served may fail with one.
+type Error struct {
+	Code    ErrCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an Error with the given code and formatted message, e.g.
+// for a handler to refuse a request:
+//
+//	return tftp.Errorf(tftp.ErrAccessViolation, "device %s not registered", mac)
+func Errorf(code ErrCode, format string, args ...interface{}) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) packet() Err {
+	return Err{Error: e.Code, Message: e.Message}
+}
+
+// ErrorPacket translates err into the ERROR packet telling a peer about it:
+// an Error is sent as is, fs.ErrNotExist, fs.ErrPermission, fs.ErrExist and
+// running out of disk space get their own code, and any other error is
+// sent with code 0 and its text.
+func ErrorPacket(err error) Err {
+	return errorPacket(err, Err{Error: ErrUnknown, Message: err.Error()})
+}
+
+// errorPacket is ErrorPacket sending errors without a code of their own as
+// fallback
+func errorPacket(err error, fallback Err) Err {
+	var e *Error
+
+	switch {
+	case errors.As(err, &e):
+		return e.packet()
+	case errors.Is(err, fs.ErrNotExist):
+		return Err{Error: ErrNotFound, Message: "file not found"}
+	case errors.Is(err, fs.ErrPermission):
+		return Err{Error: ErrAccessViolation, Message: "access denied"}
+	case errors.Is(err, fs.ErrExist):
+		return Err{Error: ErrFileExists, Message: "file already exists"}
+	case errors.Is(err, syscall.ENOSPC):
+		return Err{Error: ErrDiskFull, Message: "disk full"}
+	default:
+		return fallback
+	}
+}
+
+// Errors transfers and decoding packets fail with, wrapped with more
+// context, e.g. in a PacketError or a TransferError, so they are checked
+// with errors.Is
+var (
+	ErrShortDatagram    = wire.ErrShortDatagram
+	ErrUnknownOpcode    = wire.ErrUnknownOpcode
+	ErrInvalidPacket    = wire.ErrInvalidPacket
+	ErrUnsupportedMode  = errors.New("unsupported transfer mode")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrDropped          = errors.New("request dropped")
+	ErrFileTooLarge     = errors.New("file too large")
+	ErrRetriesExhausted = errors.New("exhausted retries")
+	ErrTransferTimeout  = errors.New("transfer timed out")
+	ErrIdle             = errors.New("client idle")
+	ErrCanceled         = errors.New("transfer canceled")
+	ErrSessionExpired   = errors.New("session expired")
+	ErrAborted          = errors.New("aborted by the peer")
+)
+
+// PacketError is the error of a datagram that isn't a valid TFTP packet
+type PacketError = wire.PacketError
+
+// TransferError is the error a Transfer failed with, giving the request it
+// answered. Its text is the wrapped error's.
+type TransferError struct {
+	Client   string
+	Op       OpCode // OpRRQ or OpWRQ
+	Filename string
+	Err      error
+}
+
+func (e *TransferError) Error() string { return e.Err.Error() }
+func (e *TransferError) Unwrap() error { return e.Err }
+
+// peerError ends a transfer the peer aborted with an ERROR packet
+type peerError struct {
+	pkt Err
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("received error: %v", e.pkt.Message)
+}
+
+func (e *peerError) Unwrap() error { return ErrAborted }
+
+// rejectedError marks the error of a request the server refused
+type rejectedError struct {
+	msg    string
+	reason error // wrapped, if any
+}
+
+func (e *rejectedError) Error() string { return e.msg }
+func (e *rejectedError) Unwrap() error { return e.reason }
+
+// rejection returns the error of a request the server refused for the given
+// reason, which may be nil
+func rejection(reason error, format string, args ...interface{}) error {
+	return &rejectedError{msg: fmt.Sprintf(format, args...), reason: reason}
+}
+
+// FailReason tells why a transfer failed
+type FailReason int
+
+const (
+	FailError    FailReason = iota // a network, read or write error
+	FailRejected                   // the server refused the request with an ERROR packet
+	FailTimeout                    // the client stopped answering, or took too long
+	FailAborted                    // the client aborted with an ERROR packet
+	FailCanceled                   // the server's context was done, or Cancel or Close was called
+	FailIdle                       // the client sent nothing for the server's IdleTimeout
+)
+
+func (r FailReason) String() string {
+	switch r {
+	case FailRejected:
+		return "rejected"
+	case FailTimeout:
+		return "timeout"
+	case FailAborted:
+		return "aborted"
+	case FailCanceled:
+		return "canceled"
+	case FailIdle:
+		return "idle"
+	default:
+		return "error"
+	}
+}
+
+// failReason classifies the error a transfer failed with
+func failReason(err error) FailReason {
+	var rejected *rejectedError
+
+	switch {
+	case errors.As(err, &rejected):
+		return FailRejected
+	case errors.Is(err, ErrRetriesExhausted), errors.Is(err, ErrTransferTimeout), errors.Is(err, ErrSessionExpired):
+		return FailTimeout
+	case errors.Is(err, ErrIdle):
+		return FailIdle
+	case errors.Is(err, ErrAborted):
+		return FailAborted
+	case errors.Is(err, ErrCanceled), errors.Is(err, ErrServerClosed), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return FailCanceled
+	default:
+		return FailError
+	}
+}
@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"sync"
+	"time"
+)
+
+// EventKind tells what an Event reports
+type EventKind int
+
+const (
+	EventRequest    EventKind = iota // a read or write request was received
+	EventRetransmit                  // a packet was sent again after a timeout
+	EventComplete                    // a transfer completed
+	EventAbort                       // a transfer failed
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventRequest:
+		return "request"
+	case EventRetransmit:
+		return "retransmit"
+	case EventComplete:
+		return "complete"
+	case EventAbort:
+		return "abort"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened to a transfer, as delivered to the
+// channels returned by Server.Subscribe
+type Event struct {
+	Kind     EventKind
+	Time     time.Time
+	Client   string
+	Filename string // empty for EventRetransmit
+	Upload   bool
+	Block    uint16     // the block retransmitted, 0 for an OACK, for EventRetransmit
+	Transfer *Transfer  // the finished transfer, for EventComplete and EventAbort
+	Reason   FailReason // why the transfer failed, for EventAbort
+}
+
+// subscribers holds the channels of Server.Subscribe
+type subscribers struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving an Event for every request,
+// retransmission and finished transfer, and a function ending the
+// subscription, which closes the channel. Events are delivered without
+// blocking the transfers, so they are dropped while the channel's buffer of
+// the given size is full.
+func (s *Server) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	s.events.mu.Lock()
+	if s.events.subs == nil {
+		s.events.subs = make(map[chan Event]struct{})
+	}
+
+	s.events.subs[ch] = struct{}{}
+	s.events.mu.Unlock()
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			delete(s.events.subs, ch)
+			s.events.mu.Unlock()
+
+			close(ch)
+		})
+	}
+}
+
+// emit delivers e to every subscriber with room for it
+func (s *Server) emit(e Event) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	if len(s.events.subs) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+
+	for ch := range s.events.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
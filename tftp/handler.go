@@ -0,0 +1,136 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Handler answers read requests, deciding per request what the client gets
+type Handler interface {
+	ServeTFTP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeTFTP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// ErrHandlerFunc adapts a function returning an error to a Handler. An
+// error it returns ends the transfer with the ERROR packet ErrorPacket
+// translates it into, so one made by Errorf, or wrapping one, sends its code
+// and message, before the first Write or after some.
+type ErrHandlerFunc func(w ResponseWriter, r *Request) error
+
+func (f ErrHandlerFunc) ServeTFTP(w ResponseWriter, r *Request) {
+	if err := f(w, r); err != nil {
+		errPkt := ErrorPacket(err)
+		w.Error(errPkt.Error, errPkt.Message)
+	}
+}
+
+// Middleware wraps a Handler with behaviour of its own, e.g. logging,
+// authorization or rate limiting, calling the wrapped handler to serve
+// requests it lets through
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the middleware in order, so the first one sees a
+// request first:
+//
+//	s.Handler = tftp.Chain(mux, logging, ratelimit)
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	return h
+}
+
+// Request is a read request received by the server
+type Request struct {
+	RemoteAddr string // address of the client, host:port
+	Filename   string
+	Mode       string
+	Options    []Option // options sent with the request
+	Accepted   []Option // options acknowledged with an OACK, with their negotiated values
+	Params     Params   // parameters the transfer settled on
+
+	ctx  context.Context
+	sess *session // the negotiated session, once known
+}
+
+// Context returns the request's context, which is canceled once the
+// server's ServeContext context is done
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// ResponseWriter streams the file sent to the client. The transfer ends
+// once the handler returns.
+type ResponseWriter interface {
+	// Write appends to the file sent to the client, blocking until the
+	// client acknowledged the previous blocks. It fails once the transfer
+	// was abandoned.
+	io.Writer
+
+	// Error ends the transfer by sending the client an ERROR packet, it
+	// should not be called after Write
+	Error(code ErrCode, message string)
+}
+
+// errAbandoned fails the writes of handlers whose transfer was abandoned
+var errAbandoned = errors.New("transfer abandoned")
+
+// pipeWriter is the ResponseWriter handing a handler's writes to the sender
+type pipeWriter struct {
+	pw *io.PipeWriter
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *pipeWriter) Error(code ErrCode, message string) {
+	_ = w.pw.CloseWithError(&Error{Code: code, Message: message})
+}
+
+// serveHandler runs the handler for a request in the background, returning
+// the reader the file it writes is sent from and a function that stops the
+// handler once the transfer ended. The handler only starts once the reader
+// is first read from, after the options were negotiated, so it sees the
+// accepted ones.
+func serveHandler(h Handler, r *Request) (io.Reader, func()) {
+	pr, pw := io.Pipe()
+
+	start := func() {
+		if r.sess != nil {
+			r.Accepted, r.Params = r.sess.oack, r.sess.params()
+		}
+
+		go func() {
+			h.ServeTFTP(&pipeWriter{pw}, r)
+			_ = pw.Close()
+		}()
+	}
+
+	return &startingReader{r: pr, start: start}, func() { _ = pr.CloseWithError(errAbandoned) }
+}
+
+// startingReader calls start before it's first read from
+type startingReader struct {
+	r     io.Reader
+	once  sync.Once
+	start func()
+}
+
+func (r *startingReader) Read(p []byte) (int, error) {
+	r.once.Do(r.start)
+	return r.r.Read(p)
+}
@@ -0,0 +1,101 @@
+package tftp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, r *Request) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+
+				next.ServeTFTP(w, r)
+			})
+		}
+	}
+
+	// deny answers requests for secret files itself, without calling the
+	// handler it wraps
+	deny := func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if strings.HasPrefix(r.Filename, "secret") {
+				w.Error(ErrAccessViolation, "denied")
+				return
+			}
+
+			next.ServeTFTP(w, r)
+		})
+	}
+
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		mu.Lock()
+		order = append(order, "handler")
+		mu.Unlock()
+
+		_, _ = w.Write([]byte("served " + r.Filename))
+	})
+
+	addr := testServer(t, &Server{Handler: Chain(h, trace("first"), deny, trace("second"))})
+
+	c := newTestClient(t)
+	if got := c.get(addr, rrq("f", "octet"), BlockSize); string(got) != "served f" {
+		t.Errorf("got %q, want %q", got, "served f")
+	}
+
+	mu.Lock()
+	if got, want := strings.Join(order, ","), "first,second,handler"; got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+	order = nil
+	mu.Unlock()
+
+	c = newTestClient(t)
+	c.request(addr, rrq("secret", "octet"))
+
+	if got, want := c.receive(), []byte("\x00\x05\x00\x02denied\x00"); !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if got, want := strings.Join(order, ","), "first"; got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+}
+
+func TestErrHandlerFunc(t *testing.T) {
+	h := ErrHandlerFunc(func(w ResponseWriter, r *Request) error {
+		if r.Filename == "missing" {
+			return Errorf(ErrNotFound, "no %s here", r.Filename)
+		}
+
+		_, err := w.Write([]byte("ok"))
+		return err
+	})
+
+	addr := testServer(t, &Server{Handler: h})
+
+	c := newTestClient(t)
+	if got := c.get(addr, rrq("f", "octet"), BlockSize); string(got) != "ok" {
+		t.Errorf("got %q, want %q", got, "ok")
+	}
+
+	c = newTestClient(t)
+	c.request(addr, rrq("missing", "octet"))
+
+	if got, want := c.receive(), []byte("\x00\x05\x00\x01no missing here\x00"); !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
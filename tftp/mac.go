@@ -0,0 +1,36 @@
+package tftp
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// macPattern matches the MAC addresses found in the file names devices ask
+// for: octets separated by - or :, possibly led by an ARP hardware type as
+// PXELINUX sends, e.g. pxelinux.cfg/01-aa-bb-cc-dd-ee-ff, Cisco's dotted
+// aabb.ccdd.eeff, or 12 bare hex digits as IP phones ask for their
+// aabbccddeeff.cfg
+var macPattern = regexp.MustCompile(`(?i)(?:^|[^0-9a-f])((?:[0-9a-f]{2}[-:]){5,6}[0-9a-f]{2}|[0-9a-f]{4}\.[0-9a-f]{4}\.[0-9a-f]{4}|[0-9a-f]{12})(?:$|[^0-9a-f])`)
+
+// MACFromFilename returns the MAC address found in a requested file name,
+// e.g. aa:bb:cc:dd:ee:ff for pxelinux.cfg/01-aa-bb-cc-dd-ee-ff, or nil if
+// there is none
+func MACFromFilename(filename string) net.HardwareAddr {
+	m := macPattern.FindStringSubmatch(filename)
+	if m == nil {
+		return nil
+	}
+
+	digits := strings.NewReplacer("-", "", ":", "", ".", "").Replace(m[1])
+
+	// the last six octets are the address, after any hardware type
+	digits = digits[len(digits)-12:]
+
+	mac, err := net.ParseMAC(digits[0:2] + ":" + digits[2:4] + ":" + digits[4:6] + ":" + digits[6:8] + ":" + digits[8:10] + ":" + digits[10:12])
+	if err != nil {
+		return nil
+	}
+
+	return mac
+}
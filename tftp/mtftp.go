@@ -0,0 +1,302 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// ServeMTFTP answers the read requests that legacy PXE ROMs send using
+// Intel's multicast TFTP variant (PXE specification 2.1, appendix B) on
+// conn, a socket separate from the one passed to Serve. The DATA packets of
+// a transfer are sent to group, the multicast address and client port the
+// ROMs were configured with, so every client listening picks them up, and
+// any client may ACK them. They're sent from a port of the transfer's own,
+// created by Transport if set, even in single-port mode. Only one transfer
+// of a file runs at a time: requests for a file already being sent are
+// ignored, as clients listen until it ends and request the file again for
+// the blocks they missed. MTFTP has no options, so transfers use 512 byte
+// blocks. Transfers are otherwise served like unicast ones, bounded by
+// MaxTransfers, TransferTimeout and MaxSessionAge, listed by Sessions and
+// ended by Cancel and Close.
+func (s *Server) ServeMTFTP(conn net.PacketConn, group string) error {
+	return s.ServeMTFTPContext(context.Background(), conn, group)
+}
+
+// ServeMTFTPContext is like ServeMTFTP, but also stops once ctx is done,
+// returning its error. The transfers in progress are then abandoned right
+// away.
+func (s *Server) ServeMTFTPContext(ctx context.Context, conn net.PacketConn, group string) error {
+	if conn == nil {
+		return errors.New("nil connection")
+	}
+
+	if err := s.init(); err != nil {
+		return err
+	}
+
+	to, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return fmt.Errorf("mtftp group: %w", err)
+	}
+
+	if !to.IP.IsMulticast() || to.Port == 0 {
+		return fmt.Errorf("mtftp group %q is not a multicast address and port", group)
+	}
+
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+
+	defer s.untrack(conn)
+
+	ctx = context.WithValue(ctx, listenerKey{}, conn)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	for {
+		buf := make([]byte, DatagramSize)
+
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		s.trace(TraceIn, conn.LocalAddr(), addr, buf[:n])
+
+		var rrq ReadReq
+		if err = rrq.UnmarshalBinary(buf[:n]); err != nil {
+			s.logf("[%s] mtftp: bad request: %v", addr, err)
+			continue
+		}
+
+		if s.refused(ctx, addr.String()) {
+			continue
+		}
+
+		// one transfer per file serves every client asking for it, tracked
+		// like a client's transfer so Shutdown waits for it
+		key := "mtftp:" + strings.ToLower(rrq.Mode) + ":" + rrq.Filename
+		if !s.begin(key) {
+			continue
+		}
+
+		clientAddr := addr.String()
+
+		s.dispatch(ctx, key, clientAddr, func() {
+			defer s.end(key)
+
+			pprof.Do(ctx, transferLabels(clientAddr, rrq.Filename, OpRRQ), func(ctx context.Context) {
+				s.handleMTFTP(ctx, key, clientAddr, rrq, to)
+			})
+		})
+	}
+}
+
+func (s *Server) handleMTFTP(parent context.Context, key, clientAddr string, rrq ReadReq, group *net.UDPAddr) {
+	s.logf("[%s] mtftp: requested file: %s", clientAddr, rrq.Filename)
+	s.emit(Event{Kind: EventRequest, Client: clientAddr, Filename: rrq.Filename})
+
+	t := Transfer{
+		Client:   clientAddr,
+		Filename: rrq.Filename,
+		Mode:     rrq.Mode,
+		Options:  rrq.Options,
+		Start:    time.Now(),
+	}
+
+	ctx, cancel := s.transferContext(parent, key, t)
+	defer cancel()
+
+	if errPkt, reason := s.authorize(clientAddr, rrq.Filename, OpRRQ); errPkt != nil {
+		t.Err = rejection(reason, "unauthorized: %s", errPkt.Message)
+		if reason != ErrDropped {
+			s.reject(ctx, clientAddr, *errPkt)
+		}
+
+		s.finish(t)
+
+		return
+	}
+
+	netascii, errPkt := s.checkMode(rrq)
+	if errPkt != nil {
+		t.Err = rejection(ErrUnsupportedMode, "rejected %s mode: %s", rrq.Mode, errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	c, errPkt := s.open(ctx, clientAddr, rrq, netascii)
+	if errPkt != nil {
+		t.Err = rejection(nil, "%s", errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	defer c.close()
+
+	t.Variant = c.variant
+
+	// MTFTP has no options, sending plain RFC 1350 blocks to the group
+	t.Params = Params{BlockSize: BlockSize, WindowSize: 1, Timeout: s.cfg.timeout, Size: c.size, Multicast: true}
+	if c.req != nil {
+		c.req.Params = t.Params
+	}
+
+	if s.OnStart != nil {
+		s.OnStart(t)
+	}
+
+	t.Blocks, t.Bytes, t.Err = s.sendMTFTP(ctx, key, clientAddr, c, group)
+	t.Err = s.expired(parent, key, t.Err)
+	s.finish(t)
+}
+
+// sendMTFTP multicasts the content to the group in lockstep, moving on to
+// the next block as soon as any client acknowledges the current one
+func (s *Server) sendMTFTP(ctx context.Context, key, clientAddr string, c *content, group *net.UDPAddr) (uint64, int64, error) {
+	var local net.Addr
+	if listener, ok := ctx.Value(listenerKey{}).(net.PacketConn); ok {
+		local = listener.LocalAddr()
+	}
+
+	client, err := net.ResolveUDPAddr("udp", clientAddr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conn, err := s.listen(ctx, local, client)
+	if err != nil {
+		return 0, 0, fmt.Errorf("listen: %w", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	// the transfer ends once its context is done, unblocking the read
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	var (
+		ackPkt  Ack
+		errPkt  Err
+		dataPkt = Data{Payload: c.r}
+		buf     = make([]byte, DatagramSize)
+		sent    int64
+		blocks  uint64 // blocks acknowledged, unlike block numbers not wrapping
+	)
+
+NextPacket:
+	// a short block ends the transfer, which takes a final empty one if the
+	// content is a multiple of the block size
+	for eof := false; !eof; {
+		data, err := dataPkt.MarshalBinary()
+		if err != nil {
+			var resp *Error
+			if errors.As(err, &resp) {
+				s.reject(ctx, clientAddr, resp.packet())
+				return blocks, sent, rejection(resp, "handler error: %s", resp.Message)
+			}
+
+			// a transfer ended by the server stops its handler, whose pipe
+			// fails reads
+			if ctx.Err() != nil {
+				err = s.expired(context.Background(), key, ctx.Err())
+				s.reject(ctx, clientAddr, Err{Error: ErrUnknown, Message: err.Error()})
+
+				return blocks, sent, err
+			}
+
+			s.reject(ctx, clientAddr, errorPacket(err, Err{Error: ErrUnknown, Message: "could not read the file"}))
+			return blocks, sent, fmt.Errorf("preparing data packet: %w", err)
+		}
+
+		eof = len(data) < DatagramSize
+
+	Retry:
+		for i := s.cfg.retries; i > 0; i-- {
+			attempt := int(s.cfg.retries-i) + 1
+
+			if _, err = conn.WriteTo(data, group); err != nil {
+				if ctx.Err() != nil {
+					return blocks, sent, ctx.Err()
+				}
+
+				return blocks, sent, fmt.Errorf("write: %w", err)
+			}
+
+			s.trace(TraceOut, conn.LocalAddr(), group, data)
+
+			// many clients answer, so there's no round trip time to go by
+			_ = conn.SetReadDeadline(time.Now().Add(s.cfg.retry.Delay(attempt, 0)))
+
+			for {
+				r, from, err := conn.ReadFrom(buf)
+				if err != nil {
+					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+						continue Retry
+					}
+
+					if ctx.Err() != nil {
+						return blocks, sent, ctx.Err()
+					}
+
+					return blocks, sent, fmt.Errorf("waiting for ACK: %w", err)
+				}
+
+				s.trace(TraceIn, conn.LocalAddr(), from, buf[:r])
+
+				switch {
+				case ackPkt.UnmarshalBinary(buf[:r]) == nil:
+					if uint16(ackPkt) == dataPkt.Block {
+						sent, blocks = sent+int64(len(data)-4), blocks+1
+						continue NextPacket
+					}
+				case errPkt.UnmarshalBinary(buf[:r]) == nil:
+					// a client giving up doesn't stop the others listening
+					s.logf("[%s] mtftp: received error: %v", from, errPkt.Message)
+				default:
+					// any client may ACK, so one sending something else is
+					// told off without ending the transfer for the others
+					s.sendErrTo(conn, from, unexpectedPacket(buf[:r]))
+				}
+			}
+		}
+
+		return blocks, sent, ErrRetriesExhausted
+	}
+
+	return blocks, sent, nil
+}
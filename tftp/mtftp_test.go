@@ -0,0 +1,218 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+const mtftpGroup = "224.1.2.3:1759"
+
+// mtftpServer serves MTFTP with s on a loopback port, handing what's sent to
+// the group to the returned client, closing the server once the test ends
+func mtftpServer(t *testing.T, ctx context.Context, s *Server) (net.Addr, *testClient, chan error) {
+	t.Helper()
+
+	listeners := newTestClient(t)
+
+	s.Logger = log.New(io.Discard, "", 0)
+	s.Transport = func(ctx context.Context, local, client net.Addr) (net.PacketConn, error) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+
+		return &groupConn{PacketConn: conn, group: mtftpGroup, to: listeners.conn.LocalAddr()}, nil
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- s.ServeMTFTPContext(ctx, conn, mtftpGroup) }()
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = conn.Close()
+	})
+
+	return conn.LocalAddr(), listeners, served
+}
+
+func TestMTFTP(t *testing.T) {
+	payload := make([]byte, 2*BlockSize+1)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	finished := make(chan Transfer, 1)
+	addr, listeners, _ := mtftpServer(t, context.Background(), &Server{
+		Payload:  payload,
+		Timeout:  time.Minute,
+		OnFinish: func(tr Transfer) { finished <- tr },
+	})
+
+	a, b := newTestClient(t), newTestClient(t)
+	a.request(addr, rrq("pxeboot.0", "octet"))
+
+	// any client listening may ACK
+	var got []byte
+	for block, c := uint16(1), a; block <= 3; block++ {
+		p := listeners.receive()
+		if !bytes.HasPrefix(p, []byte{0, byte(OpData), 0, byte(block)}) {
+			t.Fatalf("group got %q, want DATA block %d", p, block)
+		}
+
+		got = append(got, p[4:]...)
+
+		c.peer = listeners.peer
+		c.send([]byte{0, byte(OpAck), 0, byte(block)})
+
+		if c == a {
+			c = b
+		} else {
+			c = a
+		}
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Errorf("group got %d bytes, want %d", len(got), len(payload))
+	}
+
+	if tr := <-finished; tr.Err != nil || tr.Blocks != 3 || !tr.Params.Multicast {
+		t.Errorf("transfer of %d blocks failed with %v", tr.Blocks, tr.Err)
+	}
+}
+
+func TestMTFTPEnded(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+		end    func(t *testing.T, s *Server, cancel context.CancelFunc)
+		want   error
+		served error // returned by ServeMTFTPContext, nil if it keeps serving
+	}{
+		{
+			name:   "canceled",
+			server: &Server{},
+			end: func(t *testing.T, s *Server, _ context.CancelFunc) {
+				sessions := s.Sessions()
+				if len(sessions) != 1 || !s.Cancel(sessions[0].ID) {
+					t.Fatalf("transfer can't be canceled, sessions are %v", sessions)
+				}
+			},
+			want: ErrCanceled,
+		},
+		{
+			name:   "closed",
+			server: &Server{},
+			end:    func(_ *testing.T, s *Server, _ context.CancelFunc) { _ = s.Close() },
+			want:   ErrServerClosed,
+			served: ErrServerClosed,
+		},
+		{
+			name:   "context done",
+			server: &Server{},
+			end:    func(_ *testing.T, _ *Server, cancel context.CancelFunc) { cancel() },
+			want:   context.Canceled,
+			served: context.Canceled,
+		},
+		{
+			name:   "transfer timeout",
+			server: &Server{TransferTimeout: 100 * time.Millisecond},
+			end:    func(*testing.T, *Server, context.CancelFunc) {},
+			want:   ErrTransferTimeout,
+		},
+		{
+			name:   "session age",
+			server: &Server{MaxSessionAge: 100 * time.Millisecond},
+			end:    func(*testing.T, *Server, context.CancelFunc) {},
+			want:   ErrSessionExpired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			finished := make(chan Transfer, 1)
+			tt.server.Payload, tt.server.Timeout = make([]byte, 10), time.Minute
+			tt.server.OnFinish = func(tr Transfer) { finished <- tr }
+
+			addr, listeners, served := mtftpServer(t, ctx, tt.server)
+
+			c := newTestClient(t)
+			c.request(addr, rrq("pxeboot.0", "octet"))
+			listeners.receive() // block 1, never acknowledged
+
+			tt.end(t, tt.server, cancel)
+
+			select {
+			case tr := <-finished:
+				if !errors.Is(tr.Err, tt.want) {
+					t.Errorf("transfer failed with %v, want %v", tr.Err, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("transfer didn't end")
+			}
+
+			if tt.served == nil {
+				return
+			}
+
+			select {
+			case err := <-served:
+				if !errors.Is(err, tt.served) {
+					t.Errorf("ServeMTFTPContext returned %v, want %v", err, tt.served)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ServeMTFTPContext didn't return")
+			}
+		})
+	}
+}
+
+func TestMTFTPMaxTransfers(t *testing.T) {
+	finished := make(chan Transfer, 2)
+	addr, listeners, _ := mtftpServer(t, context.Background(), &Server{
+		Payload:      make([]byte, 10),
+		Timeout:      time.Minute,
+		MaxTransfers: 1,
+		OnFinish:     func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("a", "octet"))
+	listeners.receive()
+
+	// a request for a second file is dropped while the first is sent,
+	// there being no Backlog
+	c.request(addr, rrq("b", "octet"))
+
+	_ = listeners.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := listeners.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+		t.Fatalf("second transfer started with %d bytes while the first runs", n)
+	}
+
+	c.peer = listeners.peer
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if tr := <-finished; tr.Err != nil {
+		t.Fatalf("first transfer failed: %v", tr.Err)
+	}
+
+	// the dropped request is retransmitted, now there's a free worker
+	c.request(addr, rrq("b", "octet"))
+
+	if p := listeners.receive(); !bytes.HasPrefix(p, []byte{0, byte(OpData), 0, 1}) {
+		t.Fatalf("got %q, want DATA block 1 of the second file", p)
+	}
+}
@@ -0,0 +1,447 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multicastGroups tracks the running multicast sessions (RFC 2090), one per
+// requested file. Every session sends to its own port of the group address.
+type multicastGroups struct {
+	base *net.UDPAddr
+
+	mu       sync.Mutex // guards sessions and the clients of each session
+	sessions map[string]*multicastSession
+}
+
+// multicastSession sends one file to the group, driven by the ACKs of the
+// master client. Once the master has every block the next client waiting
+// becomes master and is sent the blocks it's missing.
+type multicastSession struct {
+	group     *net.UDPAddr
+	conn      net.PacketConn // the server's transfer ID
+	content   io.ReaderAt
+	size      int64
+	blockSize int
+	timeout   time.Duration
+	oack      OAck // options negotiated by the first client
+
+	clients []*multicastClient // waiting to complete, the first is master
+}
+
+type multicastClient struct {
+	addr *net.UDPAddr
+	done chan multicastResult
+}
+
+type multicastResult struct {
+	blocks uint16
+	bytes  int64
+	err    error
+}
+
+func newMulticastGroups(addr string) (*multicastGroups, error) {
+	base, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("multicast address: %w", err)
+	}
+
+	if !base.IP.IsMulticast() || base.Port == 0 {
+		return nil, fmt.Errorf("multicast address %q is not a multicast group and port", addr)
+	}
+
+	return &multicastGroups{base: base, sessions: make(map[string]*multicastSession)}, nil
+}
+
+// multicastOption accepts the empty multicast option of read requests when
+// the server has a multicast address. The value acknowledged is filled in
+// once the client has joined a session.
+func multicastOption(s *Server, sess *session, value string) (string, bool) {
+	if s.multicast == nil || sess.upload || value != "" {
+		return "", false
+	}
+
+	sess.multicast = true
+
+	return "", true
+}
+
+// multicastValue is the value of the multicast option acknowledged to a
+// client, naming the group and whether the client is master
+func (ms *multicastSession) multicastValue(master bool) string {
+	mc := 0
+	if master {
+		mc = 1
+	}
+
+	return fmt.Sprintf("%s,%d,%d", ms.group.IP, ms.group.Port, mc)
+}
+
+// oackFor returns the OACK telling a client to join the session
+func (ms *multicastSession) oackFor(master bool) OAck {
+	oack := make(OAck, len(ms.oack))
+	for i, o := range ms.oack {
+		if strings.EqualFold(o.Name, "multicast") {
+			o.Value = ms.multicastValue(master)
+		}
+
+		oack[i] = o
+	}
+
+	return oack
+}
+
+// multicastKey names the session sending the file a read request asks for
+func multicastKey(rrq ReadReq) string {
+	return strings.ToLower(rrq.Mode) + ":" + rrq.Filename
+}
+
+// requeued reports whether clientAddr already waits in the session for key,
+// resending it the OACK as the retransmitted request means it was lost
+func (g *multicastGroups) requeued(key, clientAddr string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms, ok := g.sessions[key]
+	if !ok {
+		return false
+	}
+
+	for i, c := range ms.clients {
+		if c.addr.String() == clientAddr {
+			if data, err := ms.oackFor(i == 0).MarshalBinary(); err == nil {
+				_, _ = ms.conn.WriteTo(data, c.addr)
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendMulticast adds the client to the multicast session sending the file
+// named by key, starting the session with the contents of r if there is
+// none, and waits until the client has received every block
+func (s *Server) sendMulticast(ctx context.Context, clientAddr, key string, r io.Reader, sess *session) (uint64, int64, error) {
+	addr, err := net.ResolveUDPAddr("udp", clientAddr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	c := &multicastClient{addr: addr, done: make(chan multicastResult, 1)}
+	g := s.multicast
+
+	g.mu.Lock()
+
+	if ms, ok := g.sessions[key]; ok {
+		// join the running session, waiting for a turn as master
+		ms.clients = append(ms.clients, c)
+		if sc, ok := ms.conn.(*sharedConn); ok {
+			sc.join(clientAddr)
+		}
+
+		data, err := ms.oackFor(false).MarshalBinary()
+		g.mu.Unlock()
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if _, err = ms.conn.WriteTo(data, addr); err != nil {
+			return 0, 0, fmt.Errorf("write: %w", err)
+		}
+
+		s.trace(TraceOut, ms.conn.LocalAddr(), addr, data)
+
+		return s.waitMulticast(ctx, ms, c)
+	}
+
+	g.mu.Unlock()
+
+	// blocks are resent to every new master long after the request that
+	// started the session is gone, so the content is kept in memory
+	b, err := io.ReadAll(r)
+	if err != nil {
+		var resp *Error
+		if errors.As(err, &resp) {
+			s.reject(ctx, clientAddr, resp.packet())
+			return 0, 0, rejection(resp, "handler error: %s", resp.Message)
+		}
+
+		// a transfer ended by the server stops its handler, whose pipe
+		// fails reads
+		if ctx.Err() != nil {
+			err = s.expired(context.Background(), clientAddr, ctx.Err())
+			s.reject(ctx, clientAddr, Err{Error: ErrUnknown, Message: err.Error()})
+
+			return 0, 0, err
+		}
+
+		s.reject(ctx, clientAddr, errorPacket(err, Err{Error: ErrUnknown, Message: "could not read the file"}))
+
+		return 0, 0, fmt.Errorf("reading payload: %w", err)
+	}
+
+	content, size := bytes.NewReader(b), int64(len(b))
+
+	if size/int64(sess.blockSize) >= 1<<16-1 {
+		return 0, 0, errors.New("file has too many blocks for a multicast transfer")
+	}
+
+	conn, err := s.listenMulticast(ctx, clientAddr, addr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("listen: %w", err)
+	}
+
+	ms := &multicastSession{
+		conn:      conn,
+		content:   content,
+		size:      size,
+		blockSize: sess.blockSize,
+		timeout:   sess.timeout,
+		clients:   []*multicastClient{c},
+	}
+
+	// multicast transfers are sent in lockstep with the master client
+	for _, o := range sess.oack {
+		if !strings.EqualFold(o.Name, "windowsize") {
+			ms.oack = append(ms.oack, o)
+		}
+	}
+
+	g.mu.Lock()
+
+	if ms.group, err = g.allocate(); err != nil {
+		g.mu.Unlock()
+		_ = conn.Close()
+
+		return 0, 0, err
+	}
+
+	g.sessions[key] = ms
+	g.mu.Unlock()
+
+	s.logf("[%s] multicasting %s to %s", clientAddr, key, ms.group)
+
+	go s.runMulticast(key, ms)
+
+	return s.waitMulticast(ctx, ms, c)
+}
+
+// listenMulticast returns the transfer ID of a new session, the connection
+// the request was read from in single-port mode, or else a socket created
+// like a unicast transfer's. The session outlives the request starting it,
+// so the socket isn't tied to the request's context.
+func (s *Server) listenMulticast(ctx context.Context, clientAddr string, client net.Addr) (net.PacketConn, error) {
+	listener, _ := ctx.Value(listenerKey{}).(net.PacketConn)
+	if s.SinglePort && listener != nil {
+		return s.share(listener, clientAddr), nil
+	}
+
+	var local net.Addr
+	if listener != nil {
+		local = listener.LocalAddr()
+	}
+
+	return s.listen(context.WithValue(context.Background(), listenerKey{}, listener), local, client)
+}
+
+// waitMulticast waits until c has received every block, or leaves the
+// session once ctx is done
+func (s *Server) waitMulticast(ctx context.Context, ms *multicastSession, c *multicastClient) (uint64, int64, error) {
+	select {
+	case res := <-c.done:
+		return uint64(res.blocks), res.bytes, res.err
+	case <-ctx.Done():
+		s.multicast.mu.Lock()
+		ms.remove(c)
+		s.multicast.mu.Unlock()
+
+		return 0, 0, ctx.Err()
+	}
+}
+
+// allocate returns the first port of the group address no session uses. The
+// caller must hold g.mu.
+func (g *multicastGroups) allocate() (*net.UDPAddr, error) {
+	used := make(map[int]bool)
+	for _, ms := range g.sessions {
+		used[ms.group.Port] = true
+	}
+
+	for port := g.base.Port; port < 1<<16; port++ {
+		if !used[port] {
+			return &net.UDPAddr{IP: g.base.IP, Port: port}, nil
+		}
+	}
+
+	return nil, errors.New("no free multicast port")
+}
+
+// runMulticast serves the clients of a session one master at a time until
+// none are left
+func (s *Server) runMulticast(key string, ms *multicastSession) {
+	g := s.multicast
+
+	for {
+		g.mu.Lock()
+		if len(ms.clients) == 0 {
+			delete(g.sessions, key)
+			g.mu.Unlock()
+			_ = ms.conn.Close()
+
+			return
+		}
+
+		master := ms.clients[0]
+		g.mu.Unlock()
+
+		res := s.serveMaster(ms, master)
+
+		g.mu.Lock()
+		ms.remove(master)
+		g.mu.Unlock()
+
+		master.done <- res
+	}
+}
+
+// remove takes c out of the session's clients. The caller must hold the
+// groups' mutex.
+func (ms *multicastSession) remove(c *multicastClient) {
+	for i, other := range ms.clients {
+		if other == c {
+			ms.clients = append(ms.clients[:i], ms.clients[i+1:]...)
+			break
+		}
+	}
+
+	if sc, ok := ms.conn.(*sharedConn); ok {
+		sc.leave(c.addr.String())
+	}
+}
+
+// serveMaster makes c the master client and multicasts the blocks following
+// the last one it acknowledges until it has them all
+func (s *Server) serveMaster(ms *multicastSession, c *multicastClient) multicastResult {
+	final := uint16(ms.size/int64(ms.blockSize) + 1) // the final block is shorter than a full block
+	res := multicastResult{blocks: final, bytes: ms.size}
+
+	pkt, err := ms.oackFor(true).MarshalBinary()
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	var to net.Addr = c.addr
+
+	for {
+		acked, err := s.waitMulticastAck(ms, c, pkt, to)
+		if err != nil {
+			res.blocks, res.bytes = 0, 0
+			res.err = err
+
+			return res
+		}
+
+		if acked >= final {
+			return res
+		}
+
+		dataPkt := Data{
+			Block:   acked,
+			Payload: io.NewSectionReader(ms.content, int64(acked)*int64(ms.blockSize), int64(ms.blockSize)),
+			Size:    ms.blockSize,
+		}
+
+		if pkt, err = dataPkt.MarshalBinary(); err != nil {
+			res.err = fmt.Errorf("preparing data packet: %w", err)
+			return res
+		}
+
+		to = ms.group
+	}
+}
+
+// waitMulticastAck sends pkt to addr until the master client acknowledges a
+// block, returning its number. Other clients giving up with an ERROR packet
+// leave the session.
+func (s *Server) waitMulticastAck(ms *multicastSession, master *multicastClient, pkt []byte, to net.Addr) (uint16, error) {
+	var (
+		ackPkt Ack
+		errPkt Err
+		buf    = make([]byte, DatagramSize)
+	)
+
+	for i := s.cfg.retries; i > 0; i-- {
+		if _, err := ms.conn.WriteTo(pkt, to); err != nil {
+			return 0, fmt.Errorf("write: %w", err)
+		}
+
+		s.trace(TraceOut, ms.conn.LocalAddr(), to, pkt)
+
+		_ = ms.conn.SetReadDeadline(time.Now().Add(ms.timeout))
+
+		for {
+			n, from, err := ms.conn.ReadFrom(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					break
+				}
+
+				return 0, fmt.Errorf("waiting for ACK: %w", err)
+			}
+
+			s.trace(TraceIn, ms.conn.LocalAddr(), from, buf[:n])
+
+			fromMaster := from.String() == master.addr.String()
+
+			switch {
+			case ackPkt.UnmarshalBinary(buf[:n]) == nil:
+				if fromMaster {
+					return uint16(ackPkt), nil
+				}
+			case errPkt.UnmarshalBinary(buf[:n]) == nil:
+				if fromMaster {
+					return 0, &peerError{errPkt}
+				}
+
+				s.leaveMulticast(ms, from, errPkt)
+			default:
+				// only the master client's session ends, the others keep
+				// listening to the group
+				illegal := unexpectedPacket(buf[:n])
+				s.sendErrTo(ms.conn, from, illegal)
+
+				if fromMaster {
+					return 0, errors.New(illegal.Message)
+				}
+			}
+		}
+	}
+
+	return 0, ErrRetriesExhausted
+}
+
+// leaveMulticast removes a waiting client that gave up from the session
+func (s *Server) leaveMulticast(ms *multicastSession, addr net.Addr, errPkt Err) {
+	s.multicast.mu.Lock()
+	defer s.multicast.mu.Unlock()
+
+	for _, c := range ms.clients[1:] {
+		if c.addr.String() == addr.String() {
+			ms.remove(c)
+			c.done <- multicastResult{err: &peerError{errPkt}}
+
+			return
+		}
+	}
+}
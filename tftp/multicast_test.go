@@ -0,0 +1,136 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// groupConn delivers the packets sent to a multicast group to a socket of
+// the test instead, standing in for every client listening to the group
+type groupConn struct {
+	net.PacketConn
+	group string
+	to    net.Addr
+}
+
+func (c *groupConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if addr.String() == c.group {
+		addr = c.to
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestMulticast(t *testing.T) {
+	const group = "239.255.0.1:1758"
+
+	payload := make([]byte, 3*BlockSize+10)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, singlePort := range []bool{false, true} {
+		name := "own port"
+		if singlePort {
+			name = "single port"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			listeners := newTestClient(t) // receives what's sent to the group
+
+			finished := make(chan Transfer, 2)
+			s := &Server{
+				Payload:       payload,
+				MulticastAddr: group,
+				SinglePort:    singlePort,
+				Logger:        log.New(io.Discard, "", 0),
+				OnFinish:      func(tr Transfer) { finished <- tr },
+				Transport: func(ctx context.Context, local, client net.Addr) (net.PacketConn, error) {
+					conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+					if err != nil {
+						return nil, err
+					}
+
+					return &groupConn{PacketConn: conn, group: group, to: listeners.conn.LocalAddr()}, nil
+				},
+			}
+
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go func() { _ = s.Serve(&groupConn{PacketConn: conn, group: group, to: listeners.conn.LocalAddr()}) }()
+			t.Cleanup(func() { _ = s.Close() })
+
+			// receive gets the next block sent to the group
+			receive := func(block uint16) {
+				t.Helper()
+
+				start := int(block-1) * BlockSize
+				end := start + BlockSize
+				if end > len(payload) {
+					end = len(payload)
+				}
+
+				if got := listeners.receive(); !bytes.Equal(got, data(block, payload[start:end])) {
+					t.Fatalf("group got %q, want DATA block %d", got[:4], block)
+				}
+			}
+
+			a, b := newTestClient(t), newTestClient(t)
+
+			a.request(conn.LocalAddr(), rrq("f", "octet", "multicast", ""))
+			if got, want := a.receive(), []byte("\x00\x06multicast\x00239.255.0.1,1758,1\x00"); !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want OACK %q making the client master", got, want)
+			}
+
+			if singlePort != (a.peer.String() == conn.LocalAddr().String()) {
+				t.Fatalf("session sends from %s, listening on %s", a.peer, conn.LocalAddr())
+			}
+
+			a.send([]byte{0, byte(OpAck), 0, 0})
+			receive(1)
+
+			// a second client joins the session while it runs
+			b.request(conn.LocalAddr(), rrq("f", "octet", "multicast", ""))
+			if got, want := b.receive(), []byte("\x00\x06multicast\x00239.255.0.1,1758,0\x00"); !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want OACK %q", got, want)
+			}
+
+			for block := uint16(1); block <= 4; block++ {
+				a.send([]byte{0, byte(OpAck), 0, byte(block)})
+				if block < 4 {
+					receive(block + 1)
+				}
+			}
+
+			if tr := <-finished; tr.Client != a.conn.LocalAddr().String() || tr.Err != nil || tr.Bytes != int64(len(payload)) {
+				t.Fatalf("transfer of %s ended with %d bytes and %v, want the first client's complete", tr.Client, tr.Bytes, tr.Err)
+			}
+
+			// the second client, having missed block 1, becomes master
+			if got, want := b.receive(), []byte("\x00\x06multicast\x00239.255.0.1,1758,1\x00"); !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want OACK %q making the client master", got, want)
+			}
+
+			b.send([]byte{0, byte(OpAck), 0, 0})
+			receive(1)
+			b.send([]byte{0, byte(OpAck), 0, 4})
+
+			select {
+			case tr := <-finished:
+				if tr.Client != b.conn.LocalAddr().String() || tr.Err != nil {
+					t.Errorf("transfer of %s ended with %v, want the second client's complete", tr.Client, tr.Err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("second client's transfer didn't end")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ServeMux is a Handler dispatching read requests to the handler registered
+// for the pattern matching the requested file name, e.g. to serve boot
+// loaders from memory and configuration files from disk:
+//
+//	mux := tftp.NewServeMux()
+//	mux.Handle("*.efi", tftp.FileServer(bootloaders))
+//	mux.Handle("pxelinux.cfg/*", tftp.FileServer(os.DirFS("/srv/pxe")))
+//
+// Patterns are path.Match globs matched against the name as FSPath cleans
+// it, so * doesn't cross a /. A pattern without a / matches the last
+// element of the name instead, so *.efi also matches EFI/BOOT/bootx64.efi.
+// The longest pattern matching a name wins, and names no pattern matches
+// are answered with a file not found ERROR.
+type ServeMux struct {
+	mu      sync.RWMutex
+	entries []muxEntry
+}
+
+type muxEntry struct {
+	pattern string
+	h       Handler
+}
+
+// NewServeMux returns an empty ServeMux
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers h for the file names matching pattern. It panics if the
+// pattern is malformed or already registered.
+func (m *ServeMux) Handle(pattern string, h Handler) {
+	if h == nil {
+		panic("tftp: nil handler")
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic(fmt.Sprintf("tftp: malformed pattern %q: %v", pattern, err))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.entries {
+		if e.pattern == pattern {
+			panic(fmt.Sprintf("tftp: multiple registrations for %q", pattern))
+		}
+	}
+
+	m.entries = append(m.entries, muxEntry{pattern: pattern, h: h})
+}
+
+// HandleFunc registers f for the file names matching pattern
+func (m *ServeMux) HandleFunc(pattern string, f func(w ResponseWriter, r *Request)) {
+	m.Handle(pattern, HandlerFunc(f))
+}
+
+// Handler returns the handler serving r and the pattern it was registered
+// for, or nil if no pattern matches
+func (m *ServeMux) Handler(r *Request) (h Handler, pattern string) {
+	name := FSPath(r.Filename)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, e := range m.entries {
+		subject := name
+		if !strings.Contains(e.pattern, "/") {
+			subject = path.Base(name)
+		}
+
+		if ok, _ := path.Match(e.pattern, subject); ok && len(e.pattern) > len(pattern) {
+			h, pattern = e.h, e.pattern
+		}
+	}
+
+	return h, pattern
+}
+
+func (m *ServeMux) ServeTFTP(w ResponseWriter, r *Request) {
+	h, _ := m.Handler(r)
+	if h == nil {
+		w.Error(ErrNotFound, "file not found")
+		return
+	}
+
+	h.ServeTFTP(w, r)
+}
+
+// FileServer returns a Handler serving the files of fsys by their requested
+// name, like Server.FS does
+func FileServer(fsys fs.FS) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		f, errPkt := openFile(fsys, r.Filename)
+		if errPkt != nil {
+			w.Error(errPkt.Error, errPkt.Message)
+			return
+		}
+
+		defer func() { _ = f.Close() }()
+
+		if _, err := io.Copy(w, f); err != nil && err != errAbandoned {
+			errPkt := errorPacket(err, Err{Error: ErrUnknown, Message: "could not read the file"})
+			w.Error(errPkt.Error, errPkt.Message)
+		}
+	})
+}
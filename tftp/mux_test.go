@@ -0,0 +1,87 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+)
+
+func TestServeMux(t *testing.T) {
+	text := func(s string) HandlerFunc {
+		return func(w ResponseWriter, r *Request) { _, _ = w.Write([]byte(s)) }
+	}
+
+	mux := NewServeMux()
+	mux.Handle("*.efi", text("efi"))
+	mux.Handle("pxelinux.cfg/*", FileServer(fstest.MapFS{
+		"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff": {Data: []byte("per device")},
+		"pxelinux.cfg/dir/f":                {Data: []byte("nested")},
+	}))
+	mux.HandleFunc("pxelinux.cfg/default", text("default"))
+	mux.HandleFunc("grub/*.efi", text("grub"))
+
+	addr := testServer(t, &Server{Handler: mux})
+
+	tests := []struct {
+		filename string
+		want     string
+		code     ErrCode // of the ERROR answering the request, if any
+	}{
+		{filename: "bootx64.efi", want: "efi"},
+		{filename: "EFI/BOOT/bootx64.efi", want: "efi"},
+		{filename: `\EFI\BOOT\bootx64.efi`, want: "efi"},
+		{filename: "grub/grubx64.efi", want: "grub"},
+		{filename: "pxelinux.cfg/default", want: "default"},
+		{filename: "/pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", want: "per device"},
+		{filename: "pxelinux.cfg/../pxelinux.cfg/default", want: "default"},
+		{filename: "pxelinux.cfg/missing", code: ErrNotFound},
+		{filename: "pxelinux.cfg/dir/f", code: ErrNotFound},
+		{filename: "vmlinuz", code: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			c := newTestClient(t)
+
+			if tt.code != 0 {
+				c.request(addr, rrq(tt.filename, "octet"))
+
+				if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(tt.code)}) {
+					t.Errorf("got %q, want ERROR %d", got, tt.code)
+				}
+
+				return
+			}
+
+			if got := c.get(addr, rrq(tt.filename, "octet"), BlockSize); string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeMuxHandle(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(m *ServeMux)
+	}{
+		{"nil handler", func(m *ServeMux) { m.Handle("*", nil) }},
+		{"malformed pattern", func(m *ServeMux) { m.HandleFunc("[", func(ResponseWriter, *Request) {}) }},
+		{"registered twice", func(m *ServeMux) {
+			m.HandleFunc("*", func(ResponseWriter, *Request) {})
+			m.HandleFunc("*", func(ResponseWriter, *Request) {})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("didn't panic")
+				}
+			}()
+
+			tt.register(NewServeMux())
+		})
+	}
+}
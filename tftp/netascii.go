@@ -0,0 +1,126 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+)
+
+// netasciiReader converts what it reads to netascii (RFC 764) on the fly,
+// sending line feeds as CR LF and carriage returns as CR NUL. Files that
+// already end their lines with CR LF have them passed through unchanged, as
+// netasciiWriter stores them.
+type netasciiReader struct {
+	r       *bufio.Reader
+	next    byte // second byte of a translated pair
+	pending bool // next is yet to be read
+}
+
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+
+	for ; i < len(p); i++ {
+		if n.pending {
+			p[i], n.pending = n.next, false
+			continue
+		}
+
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = nil
+			}
+
+			return i, err
+		}
+
+		switch c {
+		case '\n':
+			p[i], n.next, n.pending = '\r', '\n', true
+		case '\r':
+			p[i], n.next, n.pending = '\r', 0, true
+
+			if next, err := n.r.Peek(1); err == nil && next[0] == '\n' {
+				_, _ = n.r.ReadByte()
+				n.next = '\n'
+			}
+		default:
+			p[i] = c
+		}
+	}
+
+	return i, nil
+}
+
+// nativeNewline is the line ending netascii uploads are stored with
+var nativeNewline = func() []byte {
+	if runtime.GOOS == "windows" {
+		return []byte("\r\n")
+	}
+
+	return []byte("\n")
+}()
+
+// netasciiWriter converts netascii written to it back to the host's line
+// endings on the fly, storing CR LF as nativeNewline and CR NUL as CR
+type netasciiWriter struct {
+	w   io.Writer
+	cr  bool   // the last byte written was a CR, its meaning depends on the next one
+	buf []byte // converted bytes, reused across writes
+}
+
+func newNetasciiWriter(w io.Writer) *netasciiWriter {
+	return &netasciiWriter{w: w}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := n.buf[:0]
+
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+
+			switch c {
+			case '\n':
+				out = append(out, nativeNewline...)
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r') // a bare CR isn't valid netascii, keep it as is
+			}
+		}
+
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+
+		out = append(out, c)
+	}
+
+	n.buf = out
+
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// flush writes a CR left over at the end of the upload
+func (n *netasciiWriter) flush() error {
+	if !n.cr {
+		return nil
+	}
+
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+
+	return err
+}
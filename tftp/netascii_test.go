@@ -0,0 +1,186 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNetasciiReader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"no line endings", "abc", "abc"},
+		{"line feeds", "a\nb\n", "a\r\nb\r\n"},
+		{"carriage returns", "a\rb\r", "a\r\x00b\r\x00"},
+		{"CR LF", "a\r\nb\r\n", "a\r\nb\r\n"},
+		{"CR CR LF", "a\r\r\n", "a\r\x00\r\n"},
+		{"LF CR", "a\n\rb", "a\r\n\r\x00b"},
+		{"blank lines", "\n\n", "\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// one byte at a time, so pairs are split across reads
+			got, err := io.ReadAll(iotest.OneByteReader(newNetasciiReader(bytes.NewReader([]byte(tt.in)))))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	nl := string(nativeNewline)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", ""},
+		{"CR LF", "a\r\nb\r\n", "a" + nl + "b" + nl},
+		{"CR NUL", "a\r\x00b", "a\rb"},
+		{"bare CR", "a\rb", "a\rb"},
+		{"trailing CR", "a\r", "a\r"},
+		{"bare LF", "a\nb", "a\nb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newNetasciiWriter(&buf)
+
+			// one byte at a time, so pairs are split across writes
+			for i := range tt.in {
+				if _, err := w.Write([]byte{tt.in[i]}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetasciiRoundTrip(t *testing.T) {
+	nl := string(nativeNewline)
+
+	tests := []string{
+		"",
+		"plain",
+		"one" + nl + "two" + nl,
+		"bare\rcarriage\rreturns",
+		"mixed\rx" + nl + nl + "\r",
+		"crlf\r\nlines\r\n", // stored with native line endings
+	}
+
+	for _, in := range tests {
+		var buf bytes.Buffer
+		w := newNetasciiWriter(&buf)
+
+		if _, err := io.Copy(w, newNetasciiReader(bytes.NewReader([]byte(in)))); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := strings.ReplaceAll(in, "\r\n", nl)
+		if got := buf.String(); got != want {
+			t.Errorf("%q came back as %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNetasciiDownload(t *testing.T) {
+	addr := testServer(t, &Server{Payload: []byte("one\ntwo\r\nthree\r")})
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"octet", "one\ntwo\r\nthree\r"},
+		{"netascii", "one\r\ntwo\r\nthree\r\x00"},
+		{"NetASCII", "one\r\ntwo\r\nthree\r\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c := newTestClient(t)
+
+			if got := c.get(addr, rrq("f", tt.mode), BlockSize); string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetasciiUpload(t *testing.T) {
+	nl := string(nativeNewline)
+
+	tests := []struct {
+		mode string
+		in   string
+		want string
+	}{
+		{"octet", "one\r\ntwo\r\x00", "one\r\ntwo\r\x00"},
+		{"netascii", "one\r\ntwo\r\x00", "one" + nl + "two\r"},
+		// the CR LF pair is split across blocks of 8 bytes
+		{"netascii", "1234567\r\n2\r\n", "1234567" + nl + "2" + nl},
+		{"NETASCII", "trailing\r", "trailing\r"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			f := newMemUpload()
+			addr := testServer(t, &Server{
+				Payload: []byte{},
+				Upload:  func(string, WriteReq) (UploadFile, error) { return f, nil },
+			})
+
+			c := newTestClient(t)
+			c.request(addr, wrq("f", tt.mode, "blksize", "8"))
+			c.receive() // OACK
+
+			block := uint16(1)
+			for rest := []byte(tt.in); ; block++ {
+				n := len(rest)
+				if n > 8 {
+					n = 8
+				}
+
+				c.send(data(block, rest[:n]))
+				c.expectAck(block)
+
+				if rest = rest[n:]; n < 8 {
+					break
+				}
+			}
+
+			if err := f.wait(t); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			if got := string(f.bytes()); got != tt.want {
+				t.Errorf("stored %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
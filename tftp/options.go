@@ -0,0 +1,373 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// session holds the parameters of a single transfer, which start out at the
+// RFC 1350 defaults and are changed by the options negotiated with the client
+type session struct {
+	blockSize  int           // payload bytes per DATA packet
+	timeout    time.Duration // time to wait for a reply before retransmitting
+	retry      RetryStrategy // decides the time to wait for each attempt
+	rtt        time.Duration // smoothed round trip time, 0 until measured
+	windowSize int           // DATA packets sent before waiting for an ACK
+	upload     bool          // true for write requests
+	size       int64         // bytes to be transferred, -1 if unknown
+	multicast  bool          // sent to a multicast group (RFC 2090)
+	compress   bool          // sent gzip compressed
+	offset     int64         // bytes of the content skipped
+	oack       OAck          // options accepted, acknowledged before the first DATA packet
+	acks       AckBehavior   // how the client acknowledged the blocks sent
+}
+
+// Params are the effective parameters of a transfer, negotiated with the
+// options the client sent or the server's defaults for the ones it didn't
+type Params struct {
+	BlockSize  int           // payload bytes per DATA packet
+	WindowSize int           // DATA packets sent before waiting for an ACK
+	Timeout    time.Duration // retransmission timeout, the first one for a RetryStrategy backing off
+	Size       int64         // bytes of the file, as served or announced with tsize, -1 if unknown
+	Offset     int64         // bytes of the file skipped with the offset option
+	Multicast  bool          // sent to a multicast group (RFC 2090)
+	Compress   bool          // sent gzip compressed
+}
+
+// params returns the parameters sess settled on
+func (sess *session) params() Params {
+	return Params{
+		BlockSize:  sess.blockSize,
+		WindowSize: sess.windowSize,
+		Timeout:    sess.timeout,
+		Size:       sess.size,
+		Offset:     sess.offset,
+		Multicast:  sess.multicast,
+		Compress:   sess.compress,
+	}
+}
+
+// optionFunc negotiates one requested option, adjusting sess and returning
+// the value to acknowledge, or false to ignore the option
+type optionFunc func(s *Server, sess *session, value string) (string, bool)
+
+// options are the RFC 2347 options understood by the server, keyed by their
+// lower case name. Requested options missing from it and from
+// Server.Options are ignored.
+var options = map[string]optionFunc{
+	"blksize":    blockSizeOption,
+	"timeout":    timeoutOption,
+	"tsize":      sizeOption,
+	"windowsize": windowSizeOption,
+	"multicast":  multicastOption,
+	"xcompress":  compressOption,
+	"offset":     offsetOption,
+}
+
+// OptionRequest is an option a client sent that the server doesn't
+// implement itself, along with the request it was sent with
+type OptionRequest struct {
+	RemoteAddr string
+	Filename   string
+	Mode       string
+	Upload     bool   // sent with a write request
+	Name       string // as sent by the client
+	Value      string
+}
+
+// OptionFunc negotiates a custom option registered in Server.Options,
+// returning the value acknowledged in the OACK, or false to ignore the
+// option. Returning an error rejects the request with an ERROR packet
+// (code 8, RFC 2347) carrying the error's text.
+type OptionFunc func(r OptionRequest) (value string, ok bool, err error)
+
+// OptionPolicy decides whether an option a client sent is negotiated,
+// returning false to ignore it. A positive max caps its numeric value:
+// larger block and window sizes are lowered to it, larger values of other
+// options get them ignored, since their value can't be changed in the OACK.
+type OptionPolicy func(r OptionRequest) (max int64, ok bool)
+
+// lowerable are the options whose value the server may lower in the OACK
+var lowerable = map[string]bool{"blksize": true, "windowsize": true}
+
+// negotiate returns the session for a request sending the given options,
+// transferring size bytes if known, or -1, or the ERROR packet rejecting the
+// request. Option names are case insensitive and only the first occurrence
+// of an option counts. Unknown options and options with malformed values are
+// left out of the OACK rather than failing the request, as RFC 2347 asks.
+func (s *Server) negotiate(req OptionRequest, requested []Option, size int64) (*session, *Err) {
+	sess := &session{blockSize: BlockSize, timeout: s.cfg.timeout, retry: s.cfg.retry, windowSize: 1, upload: req.Upload, size: size}
+	if s.Strict != nil && s.Strict(req.RemoteAddr) {
+		return sess, nil
+	}
+
+	seen := make(map[string]bool)
+
+	for _, o := range requested {
+		name := strings.ToLower(o.Name)
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+
+		if s.OptionPolicy != nil {
+			req.Name, req.Value = o.Name, o.Value
+
+			max, ok := s.OptionPolicy(req)
+			if !ok {
+				continue
+			}
+
+			if n, err := strconv.ParseInt(o.Value, 10, 64); max > 0 && err == nil && n > max {
+				if !lowerable[name] {
+					continue
+				}
+
+				o.Value = strconv.FormatInt(max, 10)
+			}
+		}
+
+		if fn, ok := options[name]; ok {
+			if value, ok := fn(s, sess, o.Value); ok {
+				sess.oack = append(sess.oack, Option{Name: o.Name, Value: value})
+			}
+
+			continue
+		}
+
+		fn, ok := s.Options[name]
+		if !ok {
+			continue
+		}
+
+		req.Name, req.Value = o.Name, o.Value
+
+		value, ok, err := fn(req)
+		if err != nil {
+			errPkt := errorPacket(err, Err{Error: ErrOptions, Message: err.Error()})
+			return nil, &errPkt
+		}
+
+		if ok {
+			sess.oack = append(sess.oack, Option{Name: o.Name, Value: value})
+		}
+	}
+
+	return sess, nil
+}
+
+// blockSizeOption negotiates the number of payload bytes per DATA packet
+// (RFC 2348). Sizes above the server's MaxBlockSize are lowered to it,
+// invalid sizes and sizes below its MinBlockSize are ignored.
+func blockSizeOption(s *Server, sess *session, value string) (string, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < s.cfg.minBlockSize {
+		return "", false
+	}
+
+	if n > s.cfg.maxBlockSize {
+		n = s.cfg.maxBlockSize
+	}
+
+	sess.blockSize = n
+
+	return strconv.Itoa(n), true
+}
+
+// timeoutOption negotiates the retransmission timeout in seconds (RFC 2349)
+// within the server's MinTimeout and MaxTimeout. The client expects
+// retransmissions after that time, so it replaces the server's RetryStrategy.
+func timeoutOption(s *Server, sess *session, value string) (string, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > 255 {
+		return "", false
+	}
+
+	timeout := time.Duration(n) * time.Second
+	if timeout < s.cfg.minTimeout || timeout > s.cfg.maxTimeout {
+		return "", false
+	}
+
+	sess.timeout, sess.retry = timeout, FixedRetry(timeout)
+
+	return strconv.Itoa(n), true
+}
+
+// sizeOption tells a client reading a file its size, and lets a client
+// writing one announce the size of the upload (RFC 2349). Read requests for
+// content of unknown size ignore the option.
+func sizeOption(_ *Server, sess *session, value string) (string, bool) {
+	if !sess.upload {
+		if sess.size < 0 {
+			return "", false
+		}
+
+		return strconv.FormatInt(sess.size, 10), true
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return "", false
+	}
+
+	sess.size = n
+
+	return value, true
+}
+
+// offsetOption negotiates the custom offset option of a server with Resume
+// set, skipping the given number of bytes of the content so a client can
+// complete an interrupted download. Offsets past the end of content of a
+// known size are ignored, in which case the client has to start over.
+func offsetOption(s *Server, sess *session, value string) (string, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if !s.Resume || sess.upload || err != nil || n < 0 || sess.size >= 0 && n > sess.size {
+		return "", false
+	}
+
+	sess.offset = n
+
+	return strconv.FormatInt(n, 10), true
+}
+
+// skip advances r past the first n bytes, seeking if it can
+func skip(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, n); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// maxWindowSize is the default bound of the negotiated window size, keeping
+// the number of packets a single lost datagram causes to be retransmitted
+// reasonable
+const maxWindowSize = 64
+
+// windowSizeOption negotiates the number of DATA packets sent before waiting
+// for an ACK (RFC 7440), lowering sizes above the server's MaxWindowSize.
+// For write requests it's the number of DATA packets received before the
+// server sends an ACK.
+func windowSizeOption(s *Server, sess *session, value string) (string, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > 65535 {
+		return "", false
+	}
+
+	if n > s.cfg.maxWindowSize {
+		n = s.cfg.maxWindowSize
+	}
+
+	sess.windowSize = n
+
+	return strconv.Itoa(n), true
+}
+
+// errOACKIgnored ends the negotiation with a client that retransmits its
+// request rather than acknowledging the OACK
+var errOACKIgnored = errors.New("client ignored the OACK")
+
+// plain turns sess into a plain RFC 1350 session without options, for
+// clients that don't understand the OACK, reporting false if the options
+// already changed the content sent, which the client then can't make sense
+// of
+func (sess *session) plain(s *Server) bool {
+	if sess.compress || sess.offset > 0 || sess.multicast {
+		return false
+	}
+
+	sess.blockSize, sess.timeout, sess.retry, sess.windowSize, sess.oack = BlockSize, s.cfg.timeout, s.cfg.retry, 1, nil
+
+	return true
+}
+
+// sendOACK sends the accepted options of a read request and waits for the
+// client to confirm them with ACK 0 before any DATA is sent:
+//
+//   - ACK 0 confirms the options, and the transfer starts with block 1
+//   - an ERROR refuses them (RFC 2347), ending the transfer
+//   - a timeout retransmits the OACK, up to the server's Retries
+//   - the request retransmitted instead means the client doesn't understand
+//     OACKs, returning errOACKIgnored so the transfer falls back to RFC 1350
+//   - any other packet is answered with an ERROR, ending the transfer
+//
+// ACKs of other blocks are ignored, waiting out the timeout.
+func (s *Server) sendOACK(conn net.Conn, sess *session) error {
+	data, err := sess.oack.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("preparing OACK: %w", err)
+	}
+
+	var (
+		ackPkt Ack
+		errPkt Err
+		buf    = make([]byte, DatagramSize)
+	)
+
+Retry:
+	for i := s.cfg.retries; i > 0; i-- {
+		if i < s.cfg.retries {
+			s.emit(Event{Kind: EventRetransmit, Client: conn.RemoteAddr().String()})
+		}
+
+		attempt := int(s.cfg.retries-i) + 1
+
+		if _, err = conn.Write(data); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), data)
+
+		sentAt := time.Now()
+		_ = conn.SetReadDeadline(sentAt.Add(sess.wait(attempt)))
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					if s.rerequested(conn.RemoteAddr().String()) {
+						return errOACKIgnored
+					}
+
+					continue Retry
+				}
+
+				return fmt.Errorf("waiting for ACK: %w", err)
+			}
+
+			s.trace(TraceIn, conn.LocalAddr(), conn.RemoteAddr(), buf[:n])
+
+			switch {
+			case ackPkt.UnmarshalBinary(buf[:n]) == nil:
+				if ackPkt == 0 {
+					if attempt == 1 {
+						sess.measured(time.Since(sentAt))
+					}
+
+					return nil
+				}
+			case errPkt.UnmarshalBinary(buf[:n]) == nil:
+				return &peerError{errPkt}
+			default:
+				illegal := unexpectedPacket(buf[:n])
+				s.sendErr(conn, illegal)
+
+				return errors.New(illegal.Message)
+			}
+		}
+	}
+
+	return ErrRetriesExhausted
+}
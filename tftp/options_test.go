@@ -0,0 +1,693 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestNegotiateClientBlobs(t *testing.T) {
+	s := &Server{Payload: make([]byte, 1000), MaxBlockSize: 1468}
+	addr := testServer(t, s)
+
+	tests := []struct {
+		name string
+		req  []byte
+		oack []byte // nil if the server answers with DATA block 1
+	}{
+		{
+			// iPXE's tftp_send_rrq
+			name: "iPXE",
+			req:  rrq("undionly.kpxe", "octet", "blksize", "1432", "tsize", "0"),
+			oack: []byte("\x00\x06blksize\x001432\x00tsize\x001000\x00"),
+		},
+		{
+			// iPXE asking to join a multicast session, not enabled here
+			name: "iPXE multicast",
+			req:  rrq("ipxe.efi", "octet", "blksize", "1432", "tsize", "0", "multicast", ""),
+			oack: []byte("\x00\x06blksize\x001432\x00tsize\x001000\x00"),
+		},
+		{
+			// U-Boot's TftpSend with CONFIG_TFTP_BLOCKSIZE 1468 and a
+			// window size of 1
+			name: "u-boot",
+			req:  rrq("zImage", "octet", "timeout", "5", "tsize", "0", "blksize", "1468", "windowsize", "1"),
+			oack: []byte("\x00\x06timeout\x005\x00tsize\x001000\x00blksize\x001468\x00windowsize\x001\x00"),
+		},
+		{
+			// U-Boot asking for more than the server allows
+			name: "u-boot large blksize",
+			req:  rrq("zImage", "octet", "timeout", "5", "tsize", "0", "blksize", "16352"),
+			oack: []byte("\x00\x06timeout\x005\x00tsize\x001000\x00blksize\x001468\x00"),
+		},
+		{
+			name: "unknown options",
+			req:  rrq("pxelinux.0", "octet", "x-vendor", "42", "tsize", "0", "rollover", "0"),
+			oack: []byte("\x00\x06tsize\x001000\x00"),
+		},
+		{
+			name: "only unknown options",
+			req:  rrq("pxelinux.0", "octet", "x-vendor", "42"),
+		},
+		{
+			name: "duplicate options",
+			req:  rrq("pxelinux.0", "octet", "blksize", "1024", "blksize", "512", "BLKSIZE", "8"),
+			oack: []byte("\x00\x06blksize\x001024\x00"),
+		},
+		{
+			name: "mixed case",
+			req:  rrq("pxelinux.0", "OCTET", "BlkSize", "1024", "TSIZE", "0"),
+			oack: []byte("\x00\x06BlkSize\x001024\x00TSIZE\x001000\x00"),
+		},
+		{
+			name: "malformed values",
+			req:  rrq("pxelinux.0", "octet", "blksize", "big", "timeout", "0", "windowsize", "-1", "tsize", "0"),
+			oack: []byte("\x00\x06tsize\x001000\x00"),
+		},
+		{
+			name: "trailing option without value",
+			req:  append(rrq("pxelinux.0", "octet", "blksize", "1024"), "tsize\x00"...),
+			oack: []byte("\x00\x06blksize\x001024\x00"),
+		},
+		{
+			name: "long request",
+			req:  rrq(strings.Repeat("d/", 300)+"f", "octet", "tsize", "0"),
+			oack: []byte("\x00\x06tsize\x001000\x00"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			got := c.receive()
+			defer c.abort()
+
+			if tt.oack == nil {
+				if !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 1}) {
+					t.Fatalf("got %q, want DATA block 1", got)
+				}
+
+				return
+			}
+
+			if !bytes.Equal(got, tt.oack) {
+				t.Errorf("got %q, want OACK %q", got, tt.oack)
+			}
+		})
+	}
+}
+
+func TestOptionPolicy(t *testing.T) {
+	s := &Server{
+		Payload: make([]byte, 1000),
+		OptionPolicy: func(r OptionRequest) (int64, bool) {
+			switch strings.ToLower(r.Name) {
+			case "windowsize":
+				return 0, false
+			case "blksize":
+				return 1024, !strings.HasPrefix(r.Filename, "plain/")
+			case "timeout":
+				return 3, true
+			}
+
+			return 0, true
+		},
+	}
+	addr := testServer(t, s)
+
+	tests := []struct {
+		name string
+		req  []byte
+		oack []byte // nil if the server answers with DATA block 1
+	}{
+		{
+			name: "refused",
+			req:  rrq("f", "octet", "windowsize", "8", "tsize", "0"),
+			oack: []byte("\x00\x06tsize\x001000\x00"),
+		},
+		{
+			name: "capped",
+			req:  rrq("f", "octet", "blksize", "1432", "tsize", "0"),
+			oack: []byte("\x00\x06blksize\x001024\x00tsize\x001000\x00"),
+		},
+		{
+			name: "below the cap",
+			req:  rrq("f", "octet", "BLKSIZE", "512"),
+			oack: []byte("\x00\x06BLKSIZE\x00512\x00"),
+		},
+		{
+			name: "over the cap of an option not lowered",
+			req:  rrq("f", "octet", "timeout", "5", "blksize", "600"),
+			oack: []byte("\x00\x06blksize\x00600\x00"),
+		},
+		{
+			name: "per file",
+			req:  rrq("plain/f", "octet", "blksize", "1432", "windowsize", "4"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			got := c.receive()
+			defer c.abort()
+
+			if tt.oack == nil {
+				if !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 1}) {
+					t.Fatalf("got %q, want DATA block 1", got)
+				}
+
+				return
+			}
+
+			if !bytes.Equal(got, tt.oack) {
+				t.Errorf("got %q, want OACK %q", got, tt.oack)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	s := &Server{
+		Payload:  []byte("payload"),
+		OnFinish: func(tr Transfer) { finished <- tr },
+		Options: map[string]OptionFunc{
+			"x-vendor": func(r OptionRequest) (string, bool, error) {
+				if r.Value == "bad" {
+					return "", false, errors.New("x-vendor bad is not supported")
+				}
+
+				return strings.ToUpper(r.Value), r.Value != "ignored", nil
+			},
+			"blksize": func(OptionRequest) (string, bool, error) { return "1", true, nil },
+		},
+	}
+	addr := testServer(t, s)
+
+	tests := []struct {
+		name    string
+		req     []byte
+		answer  []byte // the packet the OACK is answered with, if any
+		want    []byte // prefix of the server's first packet
+		content []byte // received after the OACK, if acknowledged
+		err     error  // of the transfer
+	}{
+		{
+			name:    "custom option",
+			req:     rrq("f", "octet", "X-Vendor", "on", "blksize", "1024"),
+			want:    []byte("\x00\x06X-Vendor\x00ON\x00blksize\x001024\x00"),
+			answer:  []byte{0, byte(OpAck), 0, 0},
+			content: []byte("payload"),
+		},
+		{
+			name:    "custom option ignored",
+			req:     rrq("f", "octet", "x-vendor", "ignored", "tsize", "0"),
+			want:    []byte("\x00\x06tsize\x007\x00"),
+			answer:  []byte{0, byte(OpAck), 0, 0},
+			content: []byte("payload"),
+		},
+		{
+			name: "custom option refused",
+			req:  rrq("f", "octet", "x-vendor", "bad"),
+			want: []byte("\x00\x05\x00\x08x-vendor bad is not supported\x00"),
+			err:  errors.New("rejected options: x-vendor bad is not supported"),
+		},
+		{
+			name:   "OACK refused by the client",
+			req:    rrq("f", "octet", "tsize", "0"),
+			want:   []byte("\x00\x06tsize\x007\x00"),
+			answer: []byte("\x00\x05\x00\x08no thanks\x00"),
+			err:    ErrAborted,
+		},
+		{
+			name:   "OACK answered with DATA",
+			req:    rrq("f", "octet", "tsize", "0"),
+			want:   []byte("\x00\x06tsize\x007\x00"),
+			answer: data(1, nil),
+			err:    errors.New("unexpected DATA"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			if got := c.receive(); !bytes.HasPrefix(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+
+			if tt.answer != nil {
+				c.send(tt.answer)
+			}
+
+			if tt.content != nil {
+				if got := c.receive(); !bytes.Equal(got, data(1, tt.content)) {
+					t.Fatalf("got %q, want DATA block 1 of %q", got, tt.content)
+				}
+
+				c.send([]byte{0, byte(OpAck), 0, 1})
+			}
+
+			var tr Transfer
+			select {
+			case tr = <-finished:
+			case <-time.After(5 * time.Second):
+				t.Fatal("transfer didn't end")
+			}
+
+			switch {
+			case tt.err == nil && tr.Err != nil:
+				t.Errorf("transfer failed: %v", tr.Err)
+			case tt.err != nil && tr.Err == nil:
+				t.Errorf("transfer completed, want %v", tt.err)
+			case tt.err != nil && !errors.Is(tr.Err, tt.err) && !strings.Contains(tr.Err.Error(), tt.err.Error()):
+				t.Errorf("transfer failed with %v, want %v", tr.Err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNegotiateStrict(t *testing.T) {
+	addr := testServer(t, &Server{
+		Payload: []byte("payload"),
+		Strict:  func(clientAddr string) bool { return true },
+	})
+
+	c := newTestClient(t)
+	if got := c.get(addr, rrq("f", "octet", "blksize", "8", "tsize", "0"), BlockSize); !bytes.Equal(got, []byte("payload")) {
+		t.Errorf("got %q, want the payload in a single RFC 1350 block", got)
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	payload := make([]byte, 5000)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name    string
+		server  *Server
+		blksize string
+		want    int // the block size the file is sent in
+	}{
+		{name: "small", server: &Server{}, blksize: "8", want: 8},
+		{name: "larger than the default", server: &Server{}, blksize: "1432", want: 1432},
+		{name: "larger than the file", server: &Server{}, blksize: "8192", want: 8192},
+		{name: "lowered to the maximum", server: &Server{MaxBlockSize: 1024}, blksize: "1432", want: 1024},
+		{name: "below the minimum", server: &Server{MinBlockSize: 512}, blksize: "64", want: BlockSize},
+		{name: "invalid", server: &Server{}, blksize: "7", want: BlockSize},
+		{name: "too large", server: &Server{}, blksize: "65465", want: MaxBlockSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			tt.server.Payload, tt.server.OnFinish = payload, func(tr Transfer) { finished <- tr }
+			addr := testServer(t, tt.server)
+
+			c := newTestClient(t)
+			if got := c.get(addr, rrq("f", "octet", "blksize", tt.blksize), tt.want); !bytes.Equal(got, payload) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+			}
+
+			if tr := <-finished; tr.Err != nil || tr.Params.BlockSize != tt.want {
+				t.Errorf("transfer in blocks of %d failed with %v, want blocks of %d", tr.Params.BlockSize, tr.Err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutOption(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:    []byte("payload"),
+		Timeout:    time.Minute,
+		MaxTimeout: 2 * time.Second,
+		OnFinish:   func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet", "timeout", "3", "tsize", "0"))
+
+	if got, want := c.receive(), []byte("\x00\x06tsize\x007\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want OACK %q without the timeout beyond MaxTimeout", got, want)
+	}
+
+	c.abort()
+	<-finished
+
+	c = newTestClient(t)
+	c.request(addr, rrq("f", "octet", "timeout", "1"))
+
+	if got, want := c.receive(), []byte("\x00\x06timeout\x001\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want OACK %q", got, want)
+	}
+
+	// the OACK is retransmitted after the negotiated second, not the
+	// server's minute
+	start := time.Now()
+	if got, want := c.receive(), []byte("\x00\x06timeout\x001\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want the OACK again", got)
+	}
+
+	if waited := time.Since(start); waited < 900*time.Millisecond || waited > 3*time.Second {
+		t.Errorf("OACK retransmitted after %v, want a second", waited)
+	}
+
+	c.send([]byte{0, byte(OpAck), 0, 0})
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if tr := <-finished; tr.Err != nil || tr.Params.Timeout != time.Second {
+		t.Errorf("transfer with a timeout of %v failed with %v, want a second", tr.Params.Timeout, tr.Err)
+	}
+}
+
+func TestSizeOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+		req    []byte
+		oack   []byte // nil if the server answers with DATA block 1
+	}{
+		{
+			name:   "payload",
+			server: &Server{Payload: make([]byte, 1234)},
+			req:    rrq("f", "octet", "tsize", "0"),
+			oack:   []byte("\x00\x06tsize\x001234\x00"),
+		},
+		{
+			name:   "file",
+			server: &Server{FS: fstest.MapFS{"boot/f": {Data: make([]byte, 99999)}}},
+			req:    rrq("boot/f", "octet", "tsize", "0"),
+			oack:   []byte("\x00\x06tsize\x0099999\x00"),
+		},
+		{
+			name:   "value sent by the client ignored",
+			server: &Server{Payload: make([]byte, 10)},
+			req:    rrq("f", "octet", "tsize", "4096"),
+			oack:   []byte("\x00\x06tsize\x0010\x00"),
+		},
+		{
+			name: "generated",
+			server: &Server{Generate: func(*Request) (io.Reader, int64, error) {
+				return strings.NewReader("generated"), 9, nil
+			}},
+			req:  rrq("f", "octet", "tsize", "0"),
+			oack: []byte("\x00\x06tsize\x009\x00"),
+		},
+		{
+			name: "generated of unknown size",
+			server: &Server{Generate: func(*Request) (io.Reader, int64, error) {
+				return strings.NewReader("generated"), -1, nil
+			}},
+			req: rrq("f", "octet", "tsize", "0"),
+		},
+		{
+			name:   "handler",
+			server: &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) { _, _ = w.Write([]byte("x")) })},
+			req:    rrq("f", "octet", "tsize", "0", "blksize", "1024"),
+			oack:   []byte("\x00\x06blksize\x001024\x00"),
+		},
+		{
+			name:   "netascii",
+			server: &Server{Payload: []byte("a\nb\n")},
+			req:    rrq("f", "netascii", "tsize", "0"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := testServer(t, tt.server)
+
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			got := c.receive()
+			defer c.abort()
+
+			if tt.oack == nil {
+				if !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 1}) {
+					t.Fatalf("got %q, want DATA block 1", got)
+				}
+
+				return
+			}
+
+			if !bytes.Equal(got, tt.oack) {
+				t.Errorf("got %q, want OACK %q", got, tt.oack)
+			}
+		})
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	payload := make([]byte, 10*BlockSize+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// block returns the content of DATA block n
+	block := func(n uint16) []byte {
+		start := int(n-1) * BlockSize
+		end := start + BlockSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		return data(n, payload[start:end])
+	}
+
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:       payload,
+		Timeout:       time.Second,
+		MaxWindowSize: 4,
+		OnFinish:      func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet", "windowsize", "8"))
+
+	if got, want := c.receive(), []byte("\x00\x06windowsize\x004\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want OACK %q lowered to MaxWindowSize", got, want)
+	}
+
+	c.send([]byte{0, byte(OpAck), 0, 0})
+
+	steps := []struct {
+		blocks []uint16 // sent by the server
+		ack    uint16   // sent by the client
+	}{
+		{[]uint16{1, 2, 3, 4}, 4},
+		{[]uint16{5, 6, 7, 8}, 6},   // as if 7 was lost
+		{[]uint16{7, 8, 9, 10}, 10}, // the window restarts after the ACK
+		{[]uint16{11}, 11},
+	}
+
+	for _, step := range steps {
+		for _, n := range step.blocks {
+			if got := c.receive(); !bytes.Equal(got, block(n)) {
+				t.Fatalf("got %q, want DATA block %d", got[:4], n)
+			}
+		}
+
+		c.send([]byte{0, byte(OpAck), byte(step.ack >> 8), byte(step.ack)})
+	}
+
+	tr := <-finished
+	if tr.Err != nil || tr.Blocks != 11 || tr.Bytes != int64(len(payload)) || tr.Params.WindowSize != 4 {
+		t.Errorf("transfer of %d blocks and %d bytes in windows of %d failed with %v, want 11 blocks, %d bytes and 4", tr.Blocks, tr.Bytes, tr.Params.WindowSize, tr.Err, len(payload))
+	}
+}
+
+func TestWindowSizeTimeout(t *testing.T) {
+	addr := testServer(t, &Server{Payload: make([]byte, 3*BlockSize), Timeout: 500 * time.Millisecond})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet", "windowsize", "2"))
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 0})
+
+	// no ACK at all resends the whole window
+	for _, n := range []uint16{1, 2, 1, 2} {
+		if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, byte(n)}) {
+			t.Fatalf("got %q, want DATA block %d", got[:4], n)
+		}
+	}
+
+	c.abort()
+}
+
+func TestOffsetOption(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	tests := []struct {
+		name   string
+		server *Server
+		offset string
+		oack   string // empty if the option is ignored
+		want   []byte
+	}{
+		{
+			name:   "resumed",
+			server: &Server{Resume: true, Payload: payload},
+			offset: "1000",
+			oack:   "\x00\x06offset\x001000\x00",
+			want:   payload[1000:],
+		},
+		{
+			name: "resumed without seeking",
+			server: &Server{Resume: true, Generate: func(*Request) (io.Reader, int64, error) {
+				return io.MultiReader(bytes.NewReader(payload)), int64(len(payload)), nil
+			}},
+			offset: "2999",
+			oack:   "\x00\x06offset\x002999\x00",
+			want:   payload[2999:],
+		},
+		{
+			name:   "at the end",
+			server: &Server{Resume: true, Payload: payload},
+			offset: "3000",
+			oack:   "\x00\x06offset\x003000\x00",
+			want:   []byte{},
+		},
+		{
+			name:   "past the end",
+			server: &Server{Resume: true, Payload: payload},
+			offset: "3001",
+			want:   payload,
+		},
+		{
+			name:   "negative",
+			server: &Server{Resume: true, Payload: payload},
+			offset: "-1",
+			want:   payload,
+		},
+		{
+			name:   "disabled",
+			server: &Server{Payload: payload},
+			offset: "1000",
+			want:   payload,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			tt.server.OnFinish = func(tr Transfer) { finished <- tr }
+			addr := testServer(t, tt.server)
+
+			c := newTestClient(t)
+			c.request(addr, rrq("f", "octet", "offset", tt.offset))
+
+			if tt.oack != "" {
+				if got := c.receive(); string(got) != tt.oack {
+					t.Fatalf("got %q, want OACK %q", got, tt.oack)
+				}
+
+				c.send([]byte{0, byte(OpAck), 0, 0})
+			}
+
+			var got []byte
+			for block := uint16(1); ; block++ {
+				p := c.receive()
+				if !bytes.HasPrefix(p, []byte{0, byte(OpData), 0, byte(block)}) {
+					t.Fatalf("got %q, want DATA block %d", p, block)
+				}
+
+				got = append(got, p[4:]...)
+				c.send([]byte{0, byte(OpAck), 0, byte(block)})
+
+				if len(p)-4 < BlockSize {
+					break
+				}
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want the last %d of the payload", len(got), len(tt.want))
+			}
+
+			if tr := <-finished; tr.Err != nil || tr.Params.Offset != int64(len(payload)-len(tt.want)) {
+				t.Errorf("transfer from offset %d failed with %v", tr.Params.Offset, tr.Err)
+			}
+		})
+	}
+}
+
+func TestOACKIgnored(t *testing.T) {
+	payload := make([]byte, 600)
+
+	tests := []struct {
+		name  string
+		req   []byte
+		plain bool // whether the transfer falls back to RFC 1350
+	}{
+		{"fallback", rrq("f", "octet", "blksize", "1024", "tsize", "0"), true},
+		{"content already changed", rrq("f", "octet", "offset", "100"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			addr := testServer(t, &Server{
+				Payload:  payload,
+				Resume:   true,
+				Timeout:  300 * time.Millisecond,
+				OnFinish: func(tr Transfer) { finished <- tr },
+			})
+
+			// a client not understanding the OACK retransmits its request,
+			// and ACKs of blocks other than 0 don't confirm it
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpOACK)}) {
+				t.Fatalf("got %q, want an OACK", got)
+			}
+
+			c.send([]byte{0, byte(OpAck), 0, 1})
+			c.request(addr, tt.req)
+
+			if !tt.plain {
+				if tr := <-finished; !errors.Is(tr.Err, errOACKIgnored) {
+					t.Errorf("transfer failed with %v, want the OACK ignored", tr.Err)
+				}
+
+				return
+			}
+
+			for _, want := range []uint16{1, 2} {
+				p := c.receive()
+				if !bytes.HasPrefix(p, []byte{0, byte(OpData), 0, byte(want)}) {
+					t.Fatalf("got %q, want DATA block %d", p, want)
+				}
+
+				if want == 1 && len(p) != 4+BlockSize {
+					t.Fatalf("DATA block 1 carries %d bytes, want the default %d", len(p)-4, BlockSize)
+				}
+
+				c.send([]byte{0, byte(OpAck), 0, byte(want)})
+			}
+
+			tr := <-finished
+			if tr.Err != nil || tr.Accepted != nil || tr.Params.BlockSize != BlockSize {
+				t.Errorf("transfer with options %v and blocks of %d failed with %v, want none and %d", tr.Accepted, tr.Params.BlockSize, tr.Err, BlockSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package tftp
+
+import "context"
+
+// dispatch runs the transfer of clientAddr's request, registered by key, in
+// a goroutine of its own, or with MaxTransfers set, on one of at most that
+// many workers, queueing it for the next free worker if they're all busy. A
+// request overflowing the Backlog is dropped, or answered with a server busy
+// ERROR if RejectBusy is set, and the transfer ended.
+func (s *Server) dispatch(ctx context.Context, key, clientAddr string, transfer func()) {
+	if s.MaxTransfers <= 0 {
+		go transfer()
+		return
+	}
+
+	s.mu.Lock()
+
+	switch {
+	case s.workers < s.MaxTransfers:
+		s.workers++
+		s.mu.Unlock()
+
+		go s.work(transfer)
+
+		return
+	case len(s.backlog) < s.Backlog:
+		s.backlog = append(s.backlog, transfer)
+		s.mu.Unlock()
+
+		return
+	}
+
+	s.mu.Unlock()
+	s.end(key)
+
+	if !s.RejectBusy {
+		s.logf("[%s] dropping request, %d transfers running and %d waiting", clientAddr, s.MaxTransfers, s.Backlog)
+		return
+	}
+
+	s.logf("[%s] rejecting request, %d transfers running and %d waiting", clientAddr, s.MaxTransfers, s.Backlog)
+	s.reject(ctx, clientAddr, Err{Error: ErrUnknown, Message: "server busy"})
+}
+
+// work runs transfer, then the queued ones, until the backlog is empty
+func (s *Server) work(transfer func()) {
+	for transfer != nil {
+		transfer()
+
+		s.mu.Lock()
+
+		transfer = nil
+		if len(s.backlog) > 0 {
+			transfer = s.backlog[0]
+			s.backlog[0] = nil
+			s.backlog = s.backlog[1:]
+		} else {
+			s.workers--
+		}
+
+		s.mu.Unlock()
+	}
+}
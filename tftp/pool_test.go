@@ -0,0 +1,75 @@
+package tftp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMaxTransfers(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		name := "drop"
+		if reject {
+			name = "reject busy"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			started, release := make(chan string, 3), make(chan struct{})
+			addr := testServer(t, &Server{
+				MaxTransfers: 1,
+				Backlog:      1,
+				RejectBusy:   reject,
+				Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+					started <- r.Filename
+					<-release
+					_, _ = w.Write([]byte(r.Filename))
+				}),
+			})
+
+			running, queued, overflowing := newTestClient(t), newTestClient(t), newTestClient(t)
+
+			running.request(addr, rrq("running", "octet"))
+			if got := <-started; got != "running" {
+				t.Fatalf("started %s, want the first request", got)
+			}
+
+			queued.request(addr, rrq("queued", "octet"))
+			overflowing.request(addr, rrq("overflowing", "octet"))
+
+			if reject {
+				if got := overflowing.receive(); !bytes.Equal(got, []byte("\x00\x05\x00\x00server busy\x00")) {
+					t.Errorf("got %q, want a server busy ERROR", got)
+				}
+			} else {
+				_ = overflowing.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				if n, _, err := overflowing.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+					t.Errorf("answered an overflowing request with %d bytes", n)
+				}
+			}
+
+			// the queued request waits for the running transfer to end
+			select {
+			case name := <-started:
+				t.Fatalf("started %s while a transfer was running", name)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			for i, c := range []*testClient{running, queued} {
+				if i > 0 {
+					if got := <-started; got != "queued" {
+						t.Fatalf("started %s, want the queued request", got)
+					}
+				}
+
+				release <- struct{}{}
+
+				filename := []string{"running", "queued"}[i]
+				if got, want := c.receive(), append([]byte{0, byte(OpData), 0, 1}, filename...); !bytes.Equal(got, want) {
+					t.Errorf("got %q, want %q", got, want)
+				}
+
+				c.send([]byte{0, byte(OpAck), 0, 1})
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package tftp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// reap ends the transfers older than the server's MaxSessionAge and those
+// whose client sent nothing for IdleTimeout, checking several times per
+// limit until no transfer is left. Only transfers with a transfer ID are
+// watched for being idle, as clients waiting in a multicast session only
+// listen.
+func (s *Server) reap() {
+	interval := time.Minute
+	for _, limit := range []time.Duration{s.IdleTimeout, s.cfg.maxAge} {
+		if limit > 0 && limit/4 < interval {
+			interval = limit / 4
+		}
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for now := range tick.C {
+		s.mu.Lock()
+
+		if len(s.active) == 0 {
+			s.reaping = false
+			s.mu.Unlock()
+
+			return
+		}
+
+		for clientAddr, t := range s.active {
+			if t.ended != nil || t.cancel == nil {
+				continue
+			}
+
+			seen := atomic.LoadInt64(&t.seen)
+
+			switch {
+			case s.cfg.maxAge > 0 && now.Sub(t.info.Start) >= s.cfg.maxAge:
+				s.logf("[%s] aborting transfer older than %v", clientAddr, s.cfg.maxAge)
+				t.ended = fmt.Errorf("%w after %v", ErrSessionExpired, s.cfg.maxAge)
+			case s.IdleTimeout > 0 && seen != 0 && now.Sub(time.Unix(0, seen)) >= s.IdleTimeout:
+				s.logf("[%s] reaping transfer idle for %v", clientAddr, s.IdleTimeout)
+				t.ended = fmt.Errorf("%w for %v", ErrIdle, s.IdleTimeout)
+			default:
+				continue
+			}
+
+			t.cancel()
+		}
+
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// receiveErr reads packets until an ERROR, failing the test if none arrives
+func (c *testClient) receiveErr() []byte {
+	c.t.Helper()
+
+	for {
+		if pkt := c.receive(); bytes.HasPrefix(pkt, []byte{0, byte(OpErr)}) {
+			return pkt
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	failed := make(chan FailReason, 1)
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:     bytes.Repeat([]byte("x"), 4*BlockSize),
+		Retries:     100,
+		Timeout:     50 * time.Millisecond,
+		IdleTimeout: 300 * time.Millisecond,
+		OnFinish:    func(tr Transfer) { finished <- tr },
+		OnFail:      func(_ Transfer, reason FailReason) { failed <- reason },
+	})
+
+	start := time.Now()
+
+	// the client stops answering after the first block, while the server
+	// has retransmissions to spare for seconds
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if got := c.receiveErr(); !bytes.Contains(got, []byte(ErrIdle.Error())) {
+		t.Errorf("got %q, want an ERROR telling the client it was idle", got)
+	}
+
+	select {
+	case tr := <-finished:
+		if !errors.Is(tr.Err, ErrIdle) {
+			t.Errorf("transfer failed with %v, want ErrIdle", tr.Err)
+		}
+
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("reaped after %s, want about the idle timeout", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle transfer wasn't reaped")
+	}
+
+	if reason := <-failed; reason != FailIdle {
+		t.Errorf("failed for %s, want %s", reason, FailIdle)
+	}
+}
+
+func TestMaxSessionAge(t *testing.T) {
+	handlerDone := make(chan error, 1)
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		MaxSessionAge: 300 * time.Millisecond,
+		OnFinish:      func(tr Transfer) { finished <- tr },
+
+		// a stuck handler, which only ever writes the first block
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_, _ = w.Write(make([]byte, BlockSize))
+
+			<-r.Context().Done()
+			handlerDone <- r.Context().Err()
+		}),
+	})
+
+	// the client answers everything, so the transfer is never idle
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if got := c.receiveErr(); !bytes.Contains(got, []byte(ErrSessionExpired.Error())) {
+		t.Errorf("got %q, want an ERROR telling the client the session expired", got)
+	}
+
+	select {
+	case tr := <-finished:
+		if !errors.Is(tr.Err, ErrSessionExpired) {
+			t.Errorf("transfer failed with %v, want ErrSessionExpired", tr.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer outlived MaxSessionAge")
+	}
+
+	select {
+	case err := <-handlerDone:
+		if err == nil {
+			t.Error("handler's context wasn't canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept running")
+	}
+}
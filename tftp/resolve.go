@@ -0,0 +1,138 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+)
+
+// Resolver picks the files served to PXE clients by their identity, e.g. so
+// different hardware classes boot different images from one server. Use
+// its Resolve method as the server's Resolve:
+//
+//	s.Resolve = (&tftp.Resolver{Rules: []tftp.ResolveRule{
+//		{MAC: "00:50:56", Pattern: "pxelinux.cfg/*", Files: []string{"pxelinux.cfg/vmware"}},
+//		{Subnet: lab, Files: []string{"lab/{name}"}},
+//	}}).Resolve
+type Resolver struct {
+	Rules []ResolveRule
+
+	// Devices, if set, looks up the client's device for the rules with
+	// Device conditions and the {device.<attribute>} of their Files. A
+	// failed lookup counts as an unknown device.
+	Devices DeviceResolver
+}
+
+// ResolveRule gives the files tried in place of the requests it matches.
+// Every condition set must hold for a request to match.
+type ResolveRule struct {
+	// Pattern is a path.Match glob of the requested names, matched against
+	// the last element of the name if it has no /, like the patterns of a
+	// ServeMux
+	Pattern string
+
+	// MAC is a prefix of the MAC address found in the requested name by
+	// MACFromFilename, e.g. a vendor's OUI 00:50:56, in any case and with :
+	// or - separators
+	MAC string
+
+	// Subnet is the subnet of the client's IP address
+	Subnet *net.IPNet
+
+	// Device are attributes the client's device, found by
+	// Resolver.Devices, must have, e.g. role spine
+	Device Device
+
+	// Files are tried in order, with {name} replaced by the requested name
+	// and {device.<attribute>} by the attribute of the client's device
+	Files []string
+}
+
+// matches reports whether the rule applies to a request for filename from
+// clientAddr, whose device is dev
+func (r *ResolveRule) matches(clientAddr, filename string, dev Device) bool {
+	for k, v := range r.Device {
+		if dev[k] != v {
+			return false
+		}
+	}
+
+	if r.Pattern != "" {
+		name := FSPath(filename)
+		if !strings.Contains(r.Pattern, "/") {
+			name = path.Base(name)
+		}
+
+		if ok, _ := path.Match(r.Pattern, name); !ok {
+			return false
+		}
+	}
+
+	if r.MAC != "" {
+		mac := MACFromFilename(filename)
+		prefix := strings.ToLower(strings.ReplaceAll(r.MAC, "-", ":"))
+
+		if mac == nil || !strings.HasPrefix(mac.String(), prefix) {
+			return false
+		}
+	}
+
+	if r.Subnet != nil {
+		host, _, err := net.SplitHostPort(clientAddr)
+		if err != nil || !r.Subnet.Contains(net.ParseIP(host)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Resolve returns the fallback chain of a request: the files of every
+// matching rule, in the order of the rules, then the requested file
+func (r *Resolver) Resolve(ctx context.Context, clientAddr string, rrq ReadReq) []string {
+	var names []string
+
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	var dev Device
+	if r.Devices != nil {
+		dev, _ = lookupDevice(ctx, r.Devices, clientAddr, rrq.Filename)
+	}
+
+	for i := range r.Rules {
+		if rule := &r.Rules[i]; rule.matches(clientAddr, rrq.Filename, dev) {
+			for _, f := range rule.Files {
+				add(expandDevice(strings.ReplaceAll(f, "{name}", FSPath(rrq.Filename)), dev))
+			}
+		}
+	}
+
+	add(rrq.Filename)
+
+	return names
+}
+
+// expandDevice replaces the {device.<attribute>} in name with the attributes
+// of dev, empty if it doesn't have them
+func expandDevice(name string, dev Device) string {
+	for {
+		i := strings.Index(name, "{device.")
+		if i < 0 {
+			return name
+		}
+
+		j := strings.IndexByte(name[i:], '}')
+		if j < 0 {
+			return name
+		}
+
+		name = name[:i] + dev[name[i+len("{device."):i+j]] + name[i+j+1:]
+	}
+}
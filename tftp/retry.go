@@ -0,0 +1,99 @@
+package tftp
+
+import "time"
+
+// RetryStrategy decides how long to wait for a reply to a packet before
+// retransmitting it
+type RetryStrategy interface {
+	// Delay returns the time to wait after sending a packet for the
+	// attempt'th time, counting from 1, given the round trip time measured
+	// so far in the transfer, or 0 before any was measured
+	Delay(attempt int, rtt time.Duration) time.Duration
+}
+
+// FixedRetry waits the same time after every attempt. A Server's Timeout
+// is waited if it's 0.
+type FixedRetry time.Duration
+
+func (d FixedRetry) Delay(attempt int, rtt time.Duration) time.Duration {
+	return time.Duration(d)
+}
+
+// ExponentialRetry waits Initial after the first attempt, multiplying the
+// wait by Factor, or 2 if unset, for every retransmission up to Max. A
+// Server uses its Timeout as the Initial wait if it's unset, so the zero
+// value backs off from there without bound.
+type ExponentialRetry struct {
+	Initial time.Duration
+	Max     time.Duration // no limit if 0
+	Factor  float64
+}
+
+func (e ExponentialRetry) Delay(attempt int, rtt time.Duration) time.Duration {
+	factor := e.Factor
+	if factor <= 1 {
+		factor = 2
+	}
+
+	d := float64(e.Initial)
+	for i := 1; i < attempt; i++ {
+		d *= factor
+
+		if e.Max > 0 && d >= float64(e.Max) {
+			return e.Max
+		}
+	}
+
+	return time.Duration(d)
+}
+
+// AdaptiveRetry follows the round trip time measured in the transfer,
+// waiting twice as long as it takes the client to answer, doubled for every
+// retransmission, so fast clients recover quickly from a lost packet
+// without slow ones being sent duplicates. Initial is waited until the
+// round trip time is known, and waits are kept within Min and Max. A
+// Server uses its Timeout as the Initial wait if it's unset.
+type AdaptiveRetry struct {
+	Initial time.Duration
+	Min     time.Duration
+	Max     time.Duration // no limit if 0
+}
+
+func (a AdaptiveRetry) Delay(attempt int, rtt time.Duration) time.Duration {
+	d := a.Initial
+	if rtt > 0 {
+		d = 2 * rtt
+	}
+
+	if d < a.Min {
+		d = a.Min
+	}
+
+	for i := 1; i < attempt && (a.Max == 0 || d < a.Max); i++ {
+		d *= 2
+	}
+
+	if a.Max > 0 && d > a.Max {
+		d = a.Max
+	}
+
+	return d
+}
+
+// wait returns the time to wait for a reply to a packet sent for the
+// attempt'th time
+func (sess *session) wait(attempt int) time.Duration {
+	return sess.retry.Delay(attempt, sess.rtt)
+}
+
+// measured adds the round trip time of a packet answered on its first
+// attempt to the smoothed one of the session (RFC 6298). Replies to
+// retransmitted packets aren't measured, as they may answer any of them.
+func (sess *session) measured(rtt time.Duration) {
+	if sess.rtt == 0 {
+		sess.rtt = rtt
+		return
+	}
+
+	sess.rtt += (rtt - sess.rtt) / 8
+}
@@ -0,0 +1,102 @@
+package tftp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	const ms = time.Millisecond
+
+	tests := []struct {
+		name    string
+		retry   RetryStrategy
+		rtt     time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{"fixed", FixedRetry(100 * ms), 0, 3, 100 * ms},
+		{"exponential first", ExponentialRetry{Initial: 100 * ms}, 0, 1, 100 * ms},
+		{"exponential third", ExponentialRetry{Initial: 100 * ms}, 0, 3, 400 * ms},
+		{"exponential factor", ExponentialRetry{Initial: 100 * ms, Factor: 3}, 0, 3, 900 * ms},
+		{"exponential capped", ExponentialRetry{Initial: 100 * ms, Max: 250 * ms}, 0, 3, 250 * ms},
+		{"adaptive before rtt", AdaptiveRetry{Initial: 100 * ms}, 0, 1, 100 * ms},
+		{"adaptive rtt", AdaptiveRetry{Initial: 100 * ms}, 5 * ms, 1, 10 * ms},
+		{"adaptive backoff", AdaptiveRetry{Initial: 100 * ms}, 5 * ms, 3, 40 * ms},
+		{"adaptive min", AdaptiveRetry{Initial: 100 * ms, Min: 30 * ms}, 5 * ms, 1, 30 * ms},
+		{"adaptive max", AdaptiveRetry{Initial: 100 * ms, Max: 150 * ms}, 0, 3, 150 * ms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retry.Delay(tt.attempt, tt.rtt); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryZeroValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry RetryStrategy
+	}{
+		{"unset", nil},
+		{"fixed", FixedRetry(0)},
+		{"exponential", ExponentialRetry{}},
+		{"exponential pointer", &ExponentialRetry{Max: time.Minute}},
+		{"adaptive", AdaptiveRetry{}},
+		{"adaptive pointer", &AdaptiveRetry{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config{timeout: 3 * time.Second, retry: tt.retry}
+			if err := c.setDefaults(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := c.retry.Delay(1, 0); got != 3*time.Second {
+				t.Errorf("first wait %s, want the timeout", got)
+			}
+		})
+	}
+}
+
+func TestRetransmitBackoff(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:  []byte("x"),
+		Retries:  3,
+		Retry:    ExponentialRetry{Initial: 50 * time.Millisecond},
+		OnFinish: func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+
+	// DATA block 1 is sent once per attempt, never acknowledged
+	var at []time.Time
+	for i := 0; i < 3; i++ {
+		c.receive()
+		at = append(at, time.Now())
+	}
+
+	if d := at[1].Sub(at[0]); d < 40*time.Millisecond {
+		t.Errorf("first retransmission after %s, want about 50ms", d)
+	}
+
+	if d := at[2].Sub(at[1]); d < 80*time.Millisecond {
+		t.Errorf("second retransmission after %s, want about 100ms", d)
+	}
+
+	select {
+	case tr := <-finished:
+		if !errors.Is(tr.Err, ErrRetriesExhausted) {
+			t.Errorf("transfer failed with %v, want ErrRetriesExhausted", tr.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer wasn't abandoned")
+	}
+}
@@ -0,0 +1,133 @@
+package tftp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecretProvider looks up the secrets Templates insert with
+// {{secret "name"}} at render time, e.g. the bootstrap token of a generated
+// config, so they're never written below a served directory. The context
+// is the request's, canceled once its transfer ended.
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// errNoSecret is returned for secrets a provider doesn't have
+var errNoSecret = errors.New("no such secret")
+
+// EnvSecrets are the secrets held in environment variables named Prefix
+// followed by the upper case name, with - and . as _, e.g. TFTP_SECRET_JOIN_TOKEN
+// for join-token with the prefix TFTP_SECRET_
+type EnvSecrets struct {
+	Prefix string
+}
+
+func (e EnvSecrets) Secret(_ context.Context, name string) (string, error) {
+	key := e.Prefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return "", fmt.Errorf("secret %s: %w", name, errNoSecret)
+	}
+
+	return v, nil
+}
+
+// FileSecrets are the secrets held in the files below Dir, one per file
+// named like the secret, e.g. a Kubernetes secret volume. A trailing newline
+// isn't part of the secret.
+type FileSecrets struct {
+	Dir string
+}
+
+func (f FileSecrets) Secret(_ context.Context, name string) (string, error) {
+	if !fs.ValidPath(name) || !LocalName(name) {
+		return "", fmt.Errorf("secret %s: invalid name", name)
+	}
+
+	b, err := os.ReadFile(filepath.Join(f.Dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("secret %s: %w", name, errNoSecret)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+}
+
+// VaultSecrets are the secrets held in a HashiCorp Vault KV version 2
+// secrets engine, named by their path and the key of the value, e.g.
+// bootstrap/k8s#token, the key defaulting to value
+type VaultSecrets struct {
+	// URL of the secrets engine, e.g. https://vault.example.com:8200/v1/secret
+	URL   string
+	Token string
+
+	// Client sends the requests, a client with a 10 second timeout if nil
+	Client *http.Client
+}
+
+func (v *VaultSecrets) Secret(ctx context.Context, name string) (string, error) {
+	secretPath, key, ok := strings.Cut(name, "#")
+	if !ok {
+		key = "value"
+	}
+
+	if !fs.ValidPath(secretPath) {
+		return "", fmt.Errorf("secret %s: invalid name", name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(v.URL, "/")+"/data/"+secretPath, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("secret %s: %w", name, errNoSecret)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault: %s", resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+
+	s, ok := body.Data.Data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s: %w", name, errNoSecret)
+	}
+
+	return s, nil
+}
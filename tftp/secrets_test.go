@@ -0,0 +1,93 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSecrets(t *testing.T) {
+	t.Setenv("TFTP_SECRET_JOIN_TOKEN", "from env")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "join-token"), []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "t0ken" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path != "/v1/secret/data/bootstrap" {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"data": {"data": {"value": "from vault", "join-token": "token from vault"}, "metadata": {"version": 3}}}`))
+	}))
+	defer vault.Close()
+
+	tests := []struct {
+		name     string
+		provider SecretProvider
+		secret   string
+		want     string
+	}{
+		{"env", EnvSecrets{Prefix: "TFTP_SECRET_"}, "join-token", "from env"},
+		{"file", FileSecrets{Dir: dir}, "join-token", "from file"},
+		{"vault", &VaultSecrets{URL: vault.URL + "/v1/secret", Token: "t0ken"}, "bootstrap", "from vault"},
+		{"vault key", &VaultSecrets{URL: vault.URL + "/v1/secret/", Token: "t0ken"}, "bootstrap#join-token", "token from vault"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.provider.Secret(context.Background(), tt.secret)
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+
+			if _, err = tt.provider.Secret(context.Background(), "missing"); !errors.Is(err, errNoSecret) {
+				t.Errorf("missing secret: got %v, want errNoSecret", err)
+			}
+		})
+	}
+
+	if _, err := (FileSecrets{Dir: dir}).Secret(context.Background(), "../escape"); err == nil {
+		t.Error("read a secret outside the directory")
+	}
+
+	if _, err := (&VaultSecrets{URL: vault.URL + "/v1/secret", Token: "wrong"}).Secret(context.Background(), "bootstrap"); err == nil || errors.Is(err, errNoSecret) {
+		t.Errorf("got %v for a refused token, want the status", err)
+	}
+}
+
+func TestTemplateSecret(t *testing.T) {
+	t.Setenv("TFTP_SECRET_TOKEN", "s3cret")
+
+	fsys := fstest.MapFS{"join.sh.tmpl": {Data: []byte(`kubeadm join --token {{secret "token"}}`)}}
+
+	r, _, err := (&Templates{FS: fsys, Secrets: EnvSecrets{Prefix: "TFTP_SECRET_"}}).Generate(&Request{RemoteAddr: "10.0.0.1:2000", Filename: "join.sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := io.ReadAll(r); string(got) != "kubeadm join --token s3cret" {
+		t.Errorf("rendered %q", got)
+	}
+
+	// a missing secret, or provider, fails the request rather than
+	// rendering a config without it
+	for _, secrets := range []SecretProvider{EnvSecrets{Prefix: "MISSING_"}, nil} {
+		if _, _, err = (&Templates{FS: fsys, Secrets: secrets}).Generate(&Request{RemoteAddr: "10.0.0.1:2000", Filename: "join.sh"}); err == nil {
+			t.Errorf("rendered without the secret from %v", secrets)
+		}
+	}
+}
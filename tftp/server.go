@@ -2,130 +2,1224 @@ package tftp
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
+	"path"
+	"runtime/pprof"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Server answers TFTP requests. It's configured through its fields, either
+// set directly or by NewServer's options, which mustn't change once it
+// serves. Fields left at their zero value use the defaults documented on
+// them, which are resolved when serving starts without changing the fields.
 type Server struct {
 	Payload []byte
+
+	// Retries is the number of times a packet is sent before the transfer
+	// is abandoned, 10 if unset
 	Retries uint8
+
+	// Timeout is the time waited for a reply before retransmitting a
+	// packet, 10 seconds if unset
 	Timeout time.Duration
+
+	// Retry decides how long to wait for a reply before retransmitting a
+	// packet, given the round trip time measured in the transfer. It
+	// defaults to FixedRetry(Timeout), and is replaced by a fixed timeout
+	// for clients asking for one with the timeout option. Strategies whose
+	// initial wait is left at 0 wait Timeout instead.
+	Retry RetryStrategy
+
+	// MinTimeout and MaxTimeout bound the retransmission timeout clients may
+	// ask for with the timeout option (RFC 2349). The server can't answer
+	// with a different value than asked for, so requests outside the bounds
+	// are ignored and the session keeps Timeout. They default to the 1 to
+	// 255 seconds the option allows; Serve fails if MinTimeout is negative
+	// or above MaxTimeout.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// MinBlockSize and MaxBlockSize bound the block size clients may ask for
+	// with the blksize option (RFC 2348). Larger sizes are lowered to
+	// MaxBlockSize, which the OACK reports, while smaller ones are ignored
+	// as the server may not raise them. They default to the package's
+	// MinBlockSize and MaxBlockSize.
+	MinBlockSize int
+	MaxBlockSize int
+
+	// MaxWindowSize bounds the window size clients may ask for with the
+	// windowsize option (RFC 7440), larger sizes are lowered to it. It
+	// defaults to 64, Serve fails if it's negative.
+	MaxWindowSize int
+
+	// MaxUploadSize, if set, rejects uploads larger than this many bytes,
+	// either up front when the client announces the size with the tsize
+	// option (RFC 2349) or once that many bytes have been received
+	MaxUploadSize int64
+
+	// TransferTimeout, if set, bounds the time a transfer may take from the
+	// request to its final packet, ending it with an ERROR packet however
+	// often the client answers, e.g. one ACK per timeout
+	TransferTimeout time.Duration
+
+	// MaxSessionAge caps how long any transfer may live, however it's
+	// going, after which the reaper ends it with an ERROR packet and
+	// ErrSessionExpired, so no session outlives a stuck client or handler
+	// for weeks. It's 24 hours if unset, and negative for no cap.
+	MaxSessionAge time.Duration
+
+	// IdleTimeout, if set, ends transfers whose client sent nothing for this
+	// long, even if retransmissions are still due, releasing their socket,
+	// file and goroutine. Transfers failing this way end with ErrIdle.
+	IdleTimeout time.Duration
+
+	// MaxTransfers, if set, bounds the number of transfers served at once,
+	// so a storm of requests can't start unlimited goroutines. Requests
+	// arriving while that many run wait in a queue of up to Backlog
+	// requests, served in order as transfers end, and the ones overflowing
+	// it are dropped, as the client will retransmit them, or refused if
+	// RejectBusy is set. An MTFTP transfer counts as one, however many
+	// clients listen, while multicast sessions are not bounded.
+	MaxTransfers int
+	Backlog      int
+
+	// RejectBusy answers requests overflowing the Backlog with a server busy
+	// ERROR, telling clients to try another server, instead of dropping them
+	RejectBusy bool
+
+	// Compress enables the experimental xcompress option, with which
+	// clients like Client with Compress set have files sent gzip compressed
+	Compress bool
+
+	// Resume enables the custom offset option, with which clients skip the
+	// given number of bytes of a file to complete an interrupted download
+	Resume bool
+
+	// Strict, if set, reports whether a client is served as by a plain
+	// RFC 1350 server, ignoring every option it sends so it never sees an
+	// OACK, for old clients confused by them
+	Strict func(clientAddr string) bool
+
+	// Options, if set, negotiates custom options, e.g. vendor extensions,
+	// keyed by their lower case name. Options the server implements itself,
+	// like blksize, can't be replaced.
+	Options map[string]OptionFunc
+
+	// OptionPolicy, if set, decides whether each option a client sends is
+	// negotiated at all, and caps its value, e.g. to refuse windowsize for
+	// buggy boot ROMs or keep blksize at 1024 for some clients
+	OptionPolicy OptionPolicy
+
+	// MulticastAddr, if set, enables the multicast option (RFC 2090) with
+	// this group address and port, e.g. 239.255.0.1:1758. Clients asking for
+	// the same file share a session sending it to the group, using the next
+	// free port for every other file. Sessions send from a port of their
+	// own created like a unicast transfer's, or the listening one in
+	// single-port mode. Files sent to a group are held in memory, and every
+	// client receives the content the first one was served.
+	MulticastAddr string
+
+	// Handler, if set, answers every read request, taking precedence over
+	// PayloadFor, FS, Root and Payload
+	Handler Handler
+
+	// Generate, if set, computes the file served for a read request when it
+	// arrives, e.g. a kickstart file per device, rather than reading it from
+	// disk. It returns the content with its exact size, which clients asking
+	// with the tsize option are told, or -1 if unknown. Readers that are
+	// io.Closers are closed once the transfer ends. A nil reader serves the
+	// request with Handler, PayloadFor, FS, Root or Payload instead, and an
+	// error refuses it with the ERROR packet ErrorPacket translates it into,
+	// or a generic one. The request's Accepted options and Params aren't
+	// negotiated yet, as they depend on the size.
+	Generate func(r *Request) (content io.Reader, size int64, err error)
+
+	// FS, if set, serves its files by their requested name instead of
+	// Payload, e.g. an embed.FS or fstest.MapFS
+	FS fs.FS
+
+	// Root, if set and FS is not, serves the files below this directory
+	// like FS would
+	Root string
+
+	// Resolve, if set, returns the names of the files of FS or Root tried in
+	// turn for a read request, e.g. a Resolver's picking them by the
+	// client's MAC address or subnet, serving the first that exists. The
+	// requested name is only tried if it's among them, unless none are
+	// returned. The context is the request's, canceled once its transfer
+	// ended.
+	Resolve func(ctx context.Context, clientAddr string, rrq ReadReq) []string
+
+	// Fallback, if set, is the file of FS or Root served for read requests
+	// of files it doesn't have, instead of a file not found ERROR, e.g. the
+	// default PXELINUX configuration. It applies to every name; a Resolver
+	// rule trying {name}, then the fallback, limits it to some.
+	Fallback string
+
+	// Snapshot, if set, copies every file of FS or Root before sending it,
+	// so a file overwritten in place mid-transfer is still served whole as
+	// it was when requested, instead of a torn mix of old and new bytes.
+	// Files replaced by renaming another over them are served whole either
+	// way, from the one opened. Every transfer copies its file, to memory
+	// up to 1 MiB and to a temporary file beyond, released once it ended.
+	// Files that keep changing while they're copied are refused.
+	Snapshot bool
+
+	// Trace, if set, is called with every datagram the server sends or
+	// receives, which is useful when debugging misbehaving clients
+	Trace func(dir TraceDir, local, remote net.Addr, p []byte)
+
+	// OnStart, if set, is called once for every accepted read request before
+	// the first packet is sent
+	OnStart func(Transfer)
+
+	// OnFinish, if set, is called once for every transfer after it has either
+	// completed or been abandoned
+	OnFinish func(Transfer)
+
+	// OnComplete, if set, is called once for every transfer that completed,
+	// after OnFinish
+	OnComplete func(Transfer)
+
+	// OnFail, if set, is called once for every transfer that failed, with
+	// the reason why, after OnFinish
+	OnFail func(t Transfer, reason FailReason)
+
+	// ModePolicy, if set, decides how requests in a mode other than octet
+	// are answered, returning nil to serve the payload unchanged or the ERROR
+	// packet rejecting the request. If unset, netascii requests are served
+	// with their line endings converted on the fly and any other mode is
+	// rejected. Write requests are decided alike, passed as a ReadReq of
+	// their file name, mode and options, and stored unchanged if served.
+	ModePolicy func(rrq ReadReq) *Err
+
+	// AnyMode serves requests in modes other than octet and netascii, e.g.
+	// the obsolete mail mode or vendor specific ones, the payload unchanged
+	// instead of rejecting them. It has no effect if ModePolicy is set.
+	AnyMode bool
+
+	// Authorize, if set, is consulted before any transfer starts with the
+	// request's opcode, OpRRQ or OpWRQ. Returning an error refuses the
+	// request with an access violation ERROR carrying the error's text, or
+	// drops it without an answer if the error wraps ErrDropped, so scanners
+	// can't tell a server is listening.
+	Authorize func(clientAddr, filename string, op OpCode) error
+
+	// Upload, if set, enables write requests, returning where the file a
+	// client uploads is written to. Returning an error rejects the request.
+	Upload func(clientAddr string, wrq WriteReq) (UploadFile, error)
+
+	// PayloadFor, if set, chooses the payload served for a request instead
+	// of Payload, e.g. to roll a new build out to some clients first. The
+	// returned variant labels the choice in the Transfer. A nil payload
+	// serves the request from FS, Root or Payload as if PayloadFor was unset.
+	PayloadFor func(clientAddr string, rrq ReadReq) (payload []byte, variant string)
+
+	// Transport, if set, creates the socket of every transfer's own port
+	// (its transfer ID) instead of listening on an ephemeral UDP port, e.g.
+	// to run transfers over a userspace network stack or a test fake, or to
+	// pick the local address. local is the address of the connection the
+	// request was read from, nil if unknown, and client the client's.
+	Transport func(ctx context.Context, local, client net.Addr) (net.PacketConn, error)
+
+	// SinglePort, if set, exchanges the packets of every transfer over the
+	// connection its request was read from instead of a port of its own,
+	// telling transfers apart by the client's address, for firewalls and
+	// NATs dropping replies from other ports than the one asked.
+	// Transport is then unused.
+	SinglePort bool
+
+	// Owners, if set, tells apart the servers answering the same address in
+	// single-port mode, e.g. instances behind a virtual IP: a request is
+	// only served once its client's session is claimed, and the packets of
+	// sessions another server owns are dropped rather than answered with an
+	// ERROR, so a load balancer or failover moving a client's packets to
+	// another server doesn't abort its transfer. The client retransmits
+	// until its packets reach the owner again.
+	Owners SessionOwners
+
+	// Logger, if set, logs the requests and transfers instead of the
+	// standard logger
+	Logger *log.Logger
+
+	cfg       config // the fields above with defaults filled in
+	events    subscribers
+	multicast *multicastGroups
+	strays    chan struct{} // bounds the Owners lookups of stray packets
+	initOnce  sync.Once
+	initErr   error
+
+	mu        sync.Mutex                  // guards the fields below
+	active    map[string]*activeTransfer  // transfers in progress by client
+	listeners map[net.PacketConn]struct{} // connections requests are read from
+	closing   bool                        // Shutdown or Close was called
+	closed    bool                        // Close was called
+	idle      chan struct{}               // closed once no transfer is left after Shutdown
+	reaping   bool                        // the idle reaper runs
+	nextID    uint64                      // ID of the last transfer begun
+	routes    map[string]*sharedConn      // transfers sharing a listener in single-port mode, by client
+	workers   int                         // transfers running with MaxTransfers set
+	backlog   []func()                    // transfers waiting for a worker
 }
 
-func (s *Server) ListenAndServer(addr string) error {
+// Transfer summarises a single finished transfer
+type Transfer struct {
+	Client   string
+	Filename string
+	Mode     string
+	Upload   bool        // true if the client wrote the file rather than read it
+	Variant  string      // payload variant chosen by PayloadFor, or file chosen by Resolve, if any
+	Options  []Option    // options sent with the request
+	Accepted []Option    // options acknowledged with an OACK, with their negotiated values
+	Params   Params      // parameters the transfer settled on, zero if it was refused before
+	Blocks   uint64      // number of blocks acknowledged
+	Bytes    int64       // number of payload bytes acknowledged
+	Acks     AckBehavior // how the client acknowledged the blocks of a unicast download
+	Start    time.Time
+	Duration time.Duration
+	Err      error // nil if the transfer completed successfully
+}
+
+// AckBehavior is how the client of a download acknowledged its blocks,
+// telling apart implementations and the networks losing their packets
+type AckBehavior string
+
+const (
+	AckLockstep  AckBehavior = "lockstep"  // each block on its own
+	AckWindowed  AckBehavior = "windowed"  // several blocks at once, with windowsize
+	AckDuplicate AckBehavior = "duplicate" // blocks acknowledged before again
+)
+
+// ackBehavior returns the AckBehavior of a download of blocks, none if no
+// block was acknowledged
+func ackBehavior(blocks uint64, windowed, duplicated bool) AckBehavior {
+	switch {
+	case duplicated:
+		return AckDuplicate
+	case windowed:
+		return AckWindowed
+	case blocks > 0:
+		return AckLockstep
+	default:
+		return ""
+	}
+}
+
+// ListenAndServe listens on the UDP address addr and answers its requests
+// until it fails or Shutdown or Close is called
+func (s *Server) ListenAndServe(addr string) error {
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return err
 	}
 
 	defer func() { _ = conn.Close() }()
-	log.Printf("Listening on %s ...\n", conn.LocalAddr())
+	s.logf("Listening on %s ...\n", conn.LocalAddr())
 
 	return s.Serve(conn)
 }
 
+// ListenAndServer is the former name of ListenAndServe.
+//
+// Deprecated: use ListenAndServe.
+func (s *Server) ListenAndServer(addr string) error {
+	return s.ListenAndServe(addr)
+}
+
+// ListenAndServeAll listens on every address, e.g. one per interface or
+// VLAN that a wildcard address can't cover, and answers the requests of all
+// of them until one fails or Shutdown or Close is called, returning the
+// first error
+func (s *Server) ListenAndServeAll(addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no listen address")
+	}
+
+	conns := make([]net.PacketConn, 0, len(addrs))
+
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+
+			return err
+		}
+
+		conns = append(conns, conn)
+		s.logf("Listening on %s ...\n", conn.LocalAddr())
+	}
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.PacketConn) { errs <- s.Serve(conn) }(conn)
+	}
+
+	// the first error stops the others, which then fail for their closed conn
+	err := <-errs
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	for range conns[1:] {
+		<-errs
+	}
+
+	return err
+}
+
+// Serve answers the requests read from conn until it fails or Shutdown or
+// Close is called. It may be called concurrently with several connections,
+// which share the server's configuration and transfers.
 func (s *Server) Serve(conn net.PacketConn) error {
+	return s.ServeContext(context.Background(), conn)
+}
+
+// ServeContext is like Serve, but also stops once ctx is done, returning its
+// error. The transfers in progress are then abandoned right away, and
+// handlers see their Request's context canceled.
+func (s *Server) ServeContext(ctx context.Context, conn net.PacketConn) error {
 	if conn == nil {
 		return errors.New("nil connection")
 	}
 
-	if s.Payload == nil {
-		return errors.New("payload is required")
+	if err := s.init(); err != nil {
+		return err
 	}
 
-	if s.Retries == 0 {
-		s.Retries = 10
+	if !s.track(conn) {
+		return ErrServerClosed
 	}
 
-	if s.Timeout == 0 {
-		s.Timeout = 10 * time.Second
-	}
+	defer s.untrack(conn)
 
-	var rrq ReadReq
+	// transfers learn the connection their request was read from
+	ctx = context.WithValue(ctx, listenerKey{}, conn)
 
-	for {
-		buf := make([]byte, DatagramSize)
+	// unblock the read below once ctx is done, leaving the caller's conn open
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
 
-		_, addr, err := conn.ReadFrom(buf)
+	// requests are read whole, even beyond the 512 bytes RFC 2347 allows,
+	// so the options of clients sending long file names aren't cut off.
+	// Parsing copies what it keeps, so the buffer is reused.
+	buf := make([]byte, 1<<16)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
 			return err
 		}
 
-		if err = rrq.UnmarshalBinary(buf); err != nil {
-			log.Printf("[%s] bad request: %v", addr, err)
+		// in single-port mode, the transfer traces the packets it's handed
+		if s.route(addr, buf[:n]) {
+			continue
+		}
+
+		s.trace(TraceIn, conn.LocalAddr(), addr, buf[:n])
+
+		pkt, err := ParsePacket(buf[:n])
+		if err != nil {
+			s.logf("[%s] bad request: %v", addr, err)
+			s.reject(ctx, addr.String(), Err{Error: ErrIllegalOp, Message: "malformed request: " + err.Error()})
+
 			continue
 		}
 
-		go s.handle(addr.String(), rrq)
+		switch req := pkt.(type) {
+		case *ReadReq:
+			if s.refused(ctx, addr.String()) {
+				continue
+			}
+
+			if !s.begin(addr.String()) {
+				s.duplicate(addr.String(), *req)
+				continue
+			}
+
+			clientAddr, rrq := addr.String(), *req
+
+			s.dispatch(ctx, clientAddr, clientAddr, func() {
+				defer s.end(clientAddr)
+
+				if !s.claim(ctx, clientAddr) {
+					return
+				}
+
+				defer s.release(clientAddr)
+
+				pprof.Do(ctx, transferLabels(clientAddr, rrq.Filename, OpRRQ), func(ctx context.Context) {
+					s.handle(ctx, clientAddr, rrq)
+				})
+			})
+		case *WriteReq:
+			if s.refused(ctx, addr.String()) {
+				continue
+			}
+
+			if !s.begin(addr.String()) {
+				s.logf("[%s] ignoring retransmitted request for %s", addr, req.Filename)
+				continue
+			}
+
+			clientAddr, wrq := addr.String(), *req
+
+			s.dispatch(ctx, clientAddr, clientAddr, func() {
+				defer s.end(clientAddr)
+
+				if !s.claim(ctx, clientAddr) {
+					return
+				}
+
+				defer s.release(clientAddr)
+
+				pprof.Do(ctx, transferLabels(clientAddr, wrq.Filename, OpWRQ), func(ctx context.Context) {
+					s.handleWrite(ctx, clientAddr, wrq)
+				})
+			})
+		case *Err:
+			// never answer an ERROR, which could start an endless exchange
+			s.logf("[%s] bad request: unexpected %s", addr, req)
+		default:
+			s.stray(ctx, addr.String(), req)
+		}
+	}
+}
+
+// transferLabels are the pprof labels of the goroutines serving a transfer,
+// which attribute them to its client and file in CPU profiles and goroutine
+// dumps. Goroutines a transfer starts, e.g. a handler's, inherit them.
+func transferLabels(clientAddr, filename string, op OpCode) pprof.LabelSet {
+	return pprof.Labels("tftp.client", clientAddr, "tftp.file", filename, "tftp.op", op.String())
+}
+
+// init validates the configuration and resolves its defaults once, whether
+// Serve or ServeMTFTP is called first
+func (s *Server) init() error {
+	s.initOnce.Do(func() { s.initErr = s.setDefaults() })
+	return s.initErr
+}
+
+func (s *Server) setDefaults() (err error) {
+	s.cfg = config{
+		fs:            s.FS,
+		retries:       s.Retries,
+		timeout:       s.Timeout,
+		retry:         s.Retry,
+		maxAge:        s.MaxSessionAge,
+		minTimeout:    s.MinTimeout,
+		maxTimeout:    s.MaxTimeout,
+		minBlockSize:  s.MinBlockSize,
+		maxBlockSize:  s.MaxBlockSize,
+		maxWindowSize: s.MaxWindowSize,
+	}
+
+	if s.cfg.fs == nil && s.Root != "" {
+		s.cfg.fs = DirFS(s.Root)
+	}
+
+	if s.Payload == nil && s.PayloadFor == nil && s.cfg.fs == nil && s.Handler == nil && s.Generate == nil {
+		return errors.New("payload, FS, root, handler or generator is required")
+	}
+
+	if err = s.cfg.setDefaults(); err != nil {
+		return err
+	}
+
+	if s.MulticastAddr != "" {
+		if s.multicast, err = newMulticastGroups(s.MulticastAddr); err != nil {
+			return err
+		}
+	}
+
+	if s.Owners != nil {
+		s.strays = make(chan struct{}, maxStrayLookups)
+	}
+
+	return nil
+}
+
+// begin marks a transfer for clientAddr as in progress, reporting false if
+// one already is. Clients retransmit their request when the first reply is
+// slow to arrive, which mustn't start a second transfer.
+func (s *Server) begin(clientAddr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[clientAddr]; ok {
+		return false
+	}
+
+	if s.active == nil {
+		s.active = make(map[string]*activeTransfer)
+	}
+
+	s.nextID++
+	s.active[clientAddr] = &activeTransfer{id: s.nextID, rerequested: make(chan struct{}, 1)}
+
+	if (s.IdleTimeout > 0 || s.cfg.maxAge > 0) && !s.reaping {
+		s.reaping = true
+		go s.reap()
+	}
+
+	return true
+}
+
+// end marks the transfer for clientAddr as finished
+func (s *Server) end(clientAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.active, clientAddr)
+
+	if len(s.active) == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// rerequested reports whether clientAddr retransmitted its request since the
+// last call
+func (s *Server) rerequested(clientAddr string) bool {
+	s.mu.Lock()
+	t := s.active[clientAddr]
+	s.mu.Unlock()
+
+	if t == nil {
+		return false
+	}
+
+	select {
+	case <-t.rerequested:
+		return true
+	default:
+		return false
+	}
+}
+
+// duplicate answers a read request retransmitted while the client's transfer
+// is in progress. Unicast transfers retransmit their first packet on their
+// own, but a client waiting in a multicast session is only sent its OACK
+// once, so it's sent again. A client retransmitting its request while the
+// server waits for the OACK to be acknowledged doesn't understand it, which
+// the transfer is told about.
+func (s *Server) duplicate(clientAddr string, rrq ReadReq) {
+	if s.multicast != nil && s.multicast.requeued(multicastKey(rrq), clientAddr) {
+		return
+	}
+
+	s.mu.Lock()
+	if t := s.active[clientAddr]; t != nil {
+		select {
+		case t.rerequested <- struct{}{}:
+		default:
+		}
+	}
+	s.mu.Unlock()
+
+	s.logf("[%s] ignoring retransmitted request for %s", clientAddr, rrq.Filename)
+}
+
+func (s *Server) handle(parent context.Context, clientAddr string, rrq ReadReq) {
+	s.logf("[%s] requested file: %s", clientAddr, rrq.Filename)
+	s.emit(Event{Kind: EventRequest, Client: clientAddr, Filename: rrq.Filename})
+
+	t := Transfer{
+		Client:   clientAddr,
+		Filename: rrq.Filename,
+		Mode:     rrq.Mode,
+		Options:  rrq.Options,
+		Start:    time.Now(),
+	}
+
+	ctx, cancel := s.transferContext(parent, clientAddr, t)
+	defer cancel()
+
+	if errPkt, reason := s.authorize(clientAddr, rrq.Filename, OpRRQ); errPkt != nil {
+		t.Err = rejection(reason, "unauthorized: %s", errPkt.Message)
+		if reason != ErrDropped {
+			s.reject(ctx, clientAddr, *errPkt)
+		}
+
+		s.finish(t)
+
+		return
+	}
+
+	netascii, errPkt := s.checkMode(rrq)
+	if errPkt != nil {
+		t.Err = rejection(ErrUnsupportedMode, "rejected %s mode: %s", rrq.Mode, errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	c, errPkt := s.open(ctx, clientAddr, rrq, netascii)
+	if errPkt != nil {
+		t.Err = rejection(nil, "%s", errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	defer c.close()
+
+	r, size := c.r, c.size
+	t.Variant = c.variant
+
+	sess, errPkt := s.negotiate(OptionRequest{RemoteAddr: clientAddr, Filename: rrq.Filename, Mode: rrq.Mode}, rrq.Options, size)
+	if errPkt != nil {
+		t.Err = rejection(nil, "rejected options: %s", errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	t.Accepted, t.Params = sess.oack, sess.params()
+
+	if c.req != nil {
+		c.req.sess = sess
+	}
+
+	if sess.offset > 0 {
+		if err := skip(r, sess.offset); err != nil {
+			t.Err = fmt.Errorf("skipping to offset %d: %w", sess.offset, err)
+			s.reject(ctx, clientAddr, Err{Error: ErrUnknown, Message: "could not skip to the offset"})
+			s.finish(t)
+
+			return
+		}
+	}
+
+	if sess.compress {
+		var stop func()
+		r, stop = compress(r)
+		defer stop()
+	}
+
+	if s.OnStart != nil {
+		s.OnStart(t)
+	}
+
+	if sess.multicast {
+		t.Blocks, t.Bytes, t.Err = s.sendMulticast(ctx, clientAddr, multicastKey(rrq), r, sess)
+	} else {
+		t.Blocks, t.Bytes, t.Err = s.send(ctx, clientAddr, r, sess)
+		t.Accepted, t.Params = sess.oack, sess.params() // none if the client fell back to RFC 1350
+		t.Acks = sess.acks
+	}
+
+	t.Err = s.expired(parent, clientAddr, t.Err)
+	s.finish(t)
+}
+
+// authorize asks the Authorize hook whether the request may be served,
+// returning the ERROR packet refusing it if not and the reason, ErrDropped if
+// the ERROR isn't sent
+func (s *Server) authorize(clientAddr, filename string, op OpCode) (*Err, error) {
+	if s.Authorize == nil {
+		return nil, nil
+	}
+
+	if err := s.Authorize(clientAddr, filename, op); err != nil {
+		errPkt := errorPacket(err, Err{Error: ErrAccessViolation, Message: err.Error()})
+		if errors.Is(err, ErrDropped) {
+			return &errPkt, ErrDropped
+		}
+
+		return &errPkt, ErrUnauthorized
+	}
+
+	return nil, nil
+}
+
+// checkMode decides whether a read request's mode is served, and whether
+// its line endings are converted to netascii
+func (s *Server) checkMode(rrq ReadReq) (netascii bool, errPkt *Err) {
+	netascii = s.ModePolicy == nil && strings.EqualFold(rrq.Mode, "netascii")
+
+	if !strings.EqualFold(rrq.Mode, "octet") && !netascii {
+		policy := s.ModePolicy
+		if policy == nil {
+			if s.AnyMode {
+				return false, nil
+			}
+
+			policy = unsupportedMode
+		}
+
+		return false, policy(rrq)
+	}
+
+	return netascii, nil
+}
+
+// content is what a read request is answered with
+type content struct {
+	r       io.Reader
+	size    int64    // -1 if unknown
+	variant string   // chosen by PayloadFor, or the file chosen by Resolve
+	req     *Request // passed to the Handler, if any
+	close   func()
+}
+
+// open returns the content served for a read request by Generate,
+// Handler, PayloadFor, FS or Payload, converted to netascii if asked to
+func (s *Server) open(ctx context.Context, clientAddr string, rrq ReadReq, netascii bool) (*content, *Err) {
+	c := &content{size: -1, close: func() {}} // the size is unknown for handlers
+
+	// Generate and Resolve share the devices looked up for the request
+	ctx = withDeviceMemo(ctx)
+	req := &Request{RemoteAddr: clientAddr, Filename: rrq.Filename, Mode: rrq.Mode, Options: rrq.Options, ctx: ctx}
+
+	var generated io.Reader
+	if s.Generate != nil {
+		r, size, err := s.Generate(req)
+		if err != nil {
+			s.logf("[%s] generating %s: %v", clientAddr, rrq.Filename, err)
+			errPkt := errorPacket(err, Err{Error: ErrUnknown, Message: "could not generate the file"})
+
+			return nil, &errPkt
+		}
+
+		if generated = r; size >= 0 {
+			c.size = size
+		}
+	}
+
+	var payload []byte
+	if s.PayloadFor != nil && s.Handler == nil && generated == nil {
+		payload, c.variant = s.PayloadFor(clientAddr, rrq)
+	}
+
+	switch {
+	case generated != nil:
+		c.r = generated
+
+		if closer, ok := generated.(io.Closer); ok {
+			c.close = func() { _ = closer.Close() }
+		}
+	case s.Handler != nil:
+		c.req = req
+		c.r, c.close = serveHandler(s.Handler, c.req)
+
+		// a handler that neither writes nor returns mustn't keep the
+		// transfer reading from it once its context is done
+		stop, done := c.close, make(chan struct{})
+		c.close = func() {
+			close(done)
+			stop()
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				stop()
+			case <-done:
+			}
+		}()
+	case payload != nil:
+		c.r, c.size = bytes.NewReader(payload), int64(len(payload))
+	case s.cfg.fs != nil:
+		f, name, errPkt := s.resolve(ctx, clientAddr, rrq)
+		if errPkt != nil {
+			return nil, errPkt
+		}
+
+		if name != rrq.Filename {
+			s.logf("[%s] serving %s for %s", clientAddr, name, rrq.Filename)
+			c.variant = name
+		}
+
+		c.r, c.close = f, func() { _ = f.Close() }
+
+		if fi, err := f.Stat(); err == nil {
+			c.size = fi.Size()
+		}
+
+		if s.Snapshot {
+			r, size, release, err := snapshot(f)
+			_ = f.Close()
+
+			if err != nil {
+				s.logf("[%s] copying %s: %v", clientAddr, name, err)
+				errPkt := errorPacket(err, Err{Error: ErrUnknown, Message: "could not read the file"})
+
+				return nil, &errPkt
+			}
+
+			c.r, c.size, c.close = r, size, release
+		}
+	default:
+		c.r, c.size = bytes.NewReader(s.Payload), int64(len(s.Payload))
+	}
+
+	if netascii {
+		// the size grows by every line ending converted, which isn't known
+		// without reading the whole file first
+		c.r, c.size = newNetasciiReader(c.r), -1
+	}
+
+	return c, nil
+}
+
+// finish logs the outcome of a transfer and passes it to OnFinish
+func (s *Server) finish(t Transfer) {
+	t.Duration = time.Since(t.Start)
+
+	switch {
+	case t.Err != nil:
+		s.logf("[%s] %v", t.Client, t.Err)
+	case t.Upload:
+		s.logf("[%s] received %d blocks", t.Client, t.Blocks)
+	default:
+		s.logf("[%s] sent %d blocks", t.Client, t.Blocks)
+	}
+
+	if t.Err != nil {
+		op := OpRRQ
+		if t.Upload {
+			op = OpWRQ
+		}
+
+		t.Err = &TransferError{Client: t.Client, Op: op, Filename: t.Filename, Err: t.Err}
+	}
+
+	if s.OnFinish != nil {
+		s.OnFinish(t)
+	}
+
+	if t.Err == nil {
+		s.emit(Event{Kind: EventComplete, Client: t.Client, Filename: t.Filename, Upload: t.Upload, Transfer: &t})
+	} else {
+		s.emit(Event{Kind: EventAbort, Client: t.Client, Filename: t.Filename, Upload: t.Upload, Transfer: &t, Reason: failReason(t.Err)})
+	}
+
+	switch {
+	case t.Err == nil && s.OnComplete != nil:
+		s.OnComplete(t)
+	case t.Err != nil && s.OnFail != nil:
+		s.OnFail(t, failReason(t.Err))
+	}
+}
+
+// reject answers a request with an ERROR packet from a new transfer ID
+func (s *Server) reject(ctx context.Context, clientAddr string, errPkt Err) {
+	// the ERROR is sent even if the transfer's context is done, from where
+	// the request was read
+	conn, err := s.dial(context.WithValue(context.Background(), listenerKey{}, ctx.Value(listenerKey{})), clientAddr)
+	if err != nil {
+		s.logf("[%s] dial: %v", clientAddr, err)
+		return
 	}
+
+	defer func() { _ = conn.Close() }()
+
+	s.sendErr(conn, errPkt)
 }
 
-func (s *Server) handle(clientAddr string, rrq ReadReq) {
-	log.Printf("[%s] requested file: %s", clientAddr, rrq.Filename)
+// sendErr sends an ERROR packet to the peer conn is connected to
+func (s *Server) sendErr(conn net.Conn, errPkt Err) {
+	data, err := errPkt.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	if _, err = conn.Write(data); err == nil {
+		s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), data)
+	}
+}
 
-	conn, err := net.Dial("udp", clientAddr)
+// sendErrTo sends an ERROR packet to addr from the transfer ID conn
+func (s *Server) sendErrTo(conn net.PacketConn, addr net.Addr, errPkt Err) {
+	data, err := errPkt.MarshalBinary()
 	if err != nil {
-		log.Printf("[%s] dial: %v", clientAddr, err)
 		return
 	}
 
+	if _, err = conn.WriteTo(data, addr); err == nil {
+		s.trace(TraceOut, conn.LocalAddr(), addr, data)
+	}
+}
+
+// unexpectedPacket returns the ERROR packet answering a packet that isn't
+// part of the exchange in progress, which ends it (RFC 1350 section 7)
+func unexpectedPacket(p []byte) Err {
+	what := "malformed packet"
+	if len(p) >= 2 {
+		what = OpCode(binary.BigEndian.Uint16(p)).String()
+	}
+
+	return Err{Error: ErrIllegalOp, Message: "unexpected " + what}
+}
+
+// OctetOnly is a ModePolicy rejecting every request that isn't in octet
+// mode, including netascii ones. Like every rejection of a mode it answers
+// with an ERROR packet of code 0, as RFC 1350 has no code for it.
+func OctetOnly(rrq ReadReq) *Err {
+	return &Err{Error: ErrUnknown, Message: fmt.Sprintf("transfer mode %q is not supported, use octet", rrq.Mode)}
+}
+
+// unsupportedMode rejects requests in modes other than octet and netascii
+// when no ModePolicy is set
+func unsupportedMode(rrq ReadReq) *Err {
+	return &Err{Error: ErrUnknown, Message: fmt.Sprintf("transfer mode %q is not supported, use octet or netascii", rrq.Mode)}
+}
+
+// NetasciiAsOctet is a ModePolicy serving netascii requests as octet, which
+// is harmless for clients that only ever ask for text files already using
+// CRLF line endings, and rejecting any other mode
+func NetasciiAsOctet(rrq ReadReq) *Err {
+	if strings.EqualFold(rrq.Mode, "netascii") {
+		return nil
+	}
+
+	return OctetOnly(rrq)
+}
+
+// openFile opens the regular file named by a request from fsys
+func openFile(fsys fs.FS, filename string) (fs.File, *Err) {
+	f, err := fsys.Open(FSPath(filename))
+	if err == nil {
+		var fi fs.FileInfo
+		if fi, err = f.Stat(); err == nil && !fi.Mode().IsRegular() {
+			err = fs.ErrNotExist // directories and devices aren't served
+		}
+
+		if err != nil {
+			_ = f.Close()
+		}
+	}
+
+	if err != nil {
+		errPkt := ErrorPacket(err)
+		return nil, &errPkt
+	}
+
+	return f, nil
+}
+
+// resolve opens the first file of the fallback chain of a request that
+// exists in the server's FS, or the Fallback file, returning the name it was
+// found by
+func (s *Server) resolve(ctx context.Context, clientAddr string, rrq ReadReq) (fs.File, string, *Err) {
+	var names []string
+	if s.Resolve != nil {
+		names = s.Resolve(ctx, clientAddr, rrq)
+	}
+
+	if len(names) == 0 {
+		names = []string{rrq.Filename}
+	}
+
+	var errPkt *Err
+
+	for _, name := range names {
+		var f fs.File
+		if f, errPkt = openFile(s.cfg.fs, name); errPkt == nil {
+			return f, name, nil
+		}
+
+		if errPkt.Error != ErrNotFound {
+			return nil, "", errPkt
+		}
+	}
+
+	if s.Fallback != "" {
+		if f, fbErr := openFile(s.cfg.fs, s.Fallback); fbErr == nil {
+			return f, s.Fallback, nil
+		}
+
+		s.logf("[%s] fallback file %s not found", clientAddr, s.Fallback)
+	}
+
+	return nil, "", errPkt
+}
+
+// FSPath converts a requested file name into the path of the file in an
+// fs.FS. Names are always relative to the root of the FS, with \ accepted
+// as a separator, a Windows drive like C:\ taken as the root and .. unable
+// to climb out of it.
+func FSPath(filename string) string {
+	if hasDrive(filename) {
+		filename = filename[2:]
+	}
+
+	name := path.Clean("/" + strings.ReplaceAll(filename, `\`, "/"))
+	if name == "/" {
+		return "."
+	}
+
+	return name[1:]
+}
+
+// send transfers the contents of r to the client, returning the number of
+// blocks and payload bytes the client acknowledged. Accepted options are
+// acknowledged before the first DATA packet. Up to the negotiated window
+// size of DATA packets are sent before waiting for an ACK (RFC 7440), which
+// acknowledges every block up to the one it names.
+func (s *Server) send(ctx context.Context, clientAddr string, r io.Reader, sess *session) (uint64, int64, error) {
+	conn, err := s.dial(ctx, clientAddr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dial: %w", err)
+	}
+
 	defer func() { _ = conn.Close() }()
 
+	if len(sess.oack) > 0 {
+		err = s.sendOACK(conn, sess)
+		if errors.Is(err, errOACKIgnored) && sess.plain(s) {
+			s.logf("[%s] client ignores the OACK, falling back to RFC 1350", clientAddr)
+		} else if err != nil {
+			return 0, 0, err
+		}
+	}
+
 	var (
 		ackPkt  Ack
 		errPkt  Err
-		dataPkt = Data{Payload: bytes.NewReader(s.Payload)}
+		dataPkt = Data{Payload: r, Size: sess.blockSize}
 		buf     = make([]byte, DatagramSize)
+		window  [][]byte // packets sent but not yet acknowledged
+		acked   uint16   // last block acknowledged
+		blocks  uint64   // blocks acknowledged, not wrapping like acked
+		sent    int64
+		eof     bool
+
+		windowed, duplicated bool // ACKs seen of several blocks, of blocks acknowledged before
 	)
 
-NextPacket:
-	// continue looping whilst data packet is equal to DatagramSize (516 bytes)
-	for n := DatagramSize; n == DatagramSize; {
-		data, err := dataPkt.MarshalBinary()
-		if err != nil {
-			log.Printf("[%s] preparing data packet: %v", clientAddr, err)
-			return
-		}
+	defer func() { sess.acks = ackBehavior(blocks, windowed, duplicated) }()
 
-	Retry:
-		for i := s.Retries; i > 0; i-- {
-			n, err = conn.Write(data) // send the data packet
+NextWindow:
+	for {
+		// fill the window, the final packet is shorter than a full block:
+		// content that's a multiple of the block size ends with an empty
+		// one, and an empty file is sent as just that empty block 1
+		for len(window) < sess.windowSize && !eof {
+			data, err := dataPkt.MarshalBinary()
 			if err != nil {
-				log.Printf("[%s] write: %v", clientAddr, err)
-				return
+				var resp *Error
+				if errors.As(err, &resp) {
+					// the handler answered with an ERROR packet
+					s.sendErr(conn, resp.packet())
+					return blocks, sent, rejection(resp, "handler error: %s", resp.Message)
+				}
+
+				// a transfer ended by the server stops its handler, whose
+				// pipe fails reads, and the conn tells the client why
+				if ctx.Err() != nil {
+					return blocks, sent, ctx.Err()
+				}
+
+				s.sendErr(conn, errorPacket(err, Err{Error: ErrUnknown, Message: "could not read the file"}))
+				return blocks, sent, fmt.Errorf("preparing data packet: %w", err)
 			}
 
-			// Wait for ACK packet
-			_ = conn.SetReadDeadline(time.Now().Add(s.Timeout))
+			window = append(window, data)
+			eof = len(data) < 4+sess.blockSize
+		}
+
+		if len(window) == 0 {
+			return blocks, sent, nil
+		}
+
+	Retry:
+		for i := s.cfg.retries; i > 0; i-- {
+			attempt := int(s.cfg.retries-i) + 1
+			if attempt > 1 {
+				s.emit(Event{Kind: EventRetransmit, Client: clientAddr, Block: acked + 1})
+			}
 
-			if _, err = conn.Read(buf); err != nil {
-				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-					continue Retry
+			for _, data := range window {
+				if _, err = conn.Write(data); err != nil {
+					return blocks, sent, fmt.Errorf("write: %w", err)
 				}
 
-				log.Printf("[%s] waiting for ACK: %v", clientAddr, err)
-				return
+				s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), data)
 			}
 
-			switch {
-			case ackPkt.UnmarshalBinary(buf) == nil:
-				if uint16(ackPkt) == dataPkt.Block {
-					// received ACK; send next packet
-					continue NextPacket
+			// Wait for ACK packet. Duplicate ACKs are ignored rather than
+			// answered, as retransmitting on them makes every following
+			// block go out twice (the Sorcerer's Apprentice Syndrome of
+			// RFC 1123 section 4.2.3.1), so the window is only resent once
+			// the timeout expires.
+			sentAt := time.Now()
+			_ = conn.SetReadDeadline(sentAt.Add(sess.wait(attempt)))
+
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+						continue Retry
+					}
+
+					return blocks, sent, fmt.Errorf("waiting for ACK: %w", err)
+				}
+
+				s.trace(TraceIn, conn.LocalAddr(), conn.RemoteAddr(), buf[:n])
+
+				switch {
+				case ackPkt.UnmarshalBinary(buf[:n]) == nil:
+					// block numbers wrap around, so count the blocks acknowledged
+					// relative to the last acknowledged one
+					if k := int(uint16(ackPkt) - acked); k >= 1 && k <= len(window) {
+						for _, data := range window[:k] {
+							sent += int64(len(data) - 4)
+						}
+
+						if attempt == 1 {
+							sess.measured(time.Since(sentAt))
+						}
+
+						windowed = windowed || k > 1
+						window, acked, blocks = window[k:], uint16(ackPkt), blocks+uint64(k)
+						conn.progressed(blocks, sent)
+						continue NextWindow
+					} else if k < 1 {
+						duplicated = true
+					}
+				case errPkt.UnmarshalBinary(buf[:n]) == nil:
+					return blocks, sent, &peerError{errPkt}
+				default:
+					illegal := unexpectedPacket(buf[:n])
+					s.sendErr(conn, illegal)
+
+					return blocks, sent, errors.New(illegal.Message)
 				}
-			case errPkt.UnmarshalBinary(buf) == nil:
-				log.Printf("[%s] received error: %v", clientAddr, errPkt.Message)
-				return
-			default:
-				log.Printf("[%s] bad packet", clientAddr)
 			}
 		}
 
-		log.Printf("[%s] exhausted retries", clientAddr)
-		return
+		return blocks, sent, ErrRetriesExhausted
 	}
-
-	log.Printf("[%s] sent %d blocks", clientAddr, dataPkt.Block)
 }
@@ -0,0 +1,644 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves s on a loopback port, closing it once the test ends
+func testServer(t *testing.T, s *Server) net.Addr {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Logger == nil {
+		s.Logger = log.New(io.Discard, "", 0)
+	}
+
+	go func() { _ = s.Serve(conn) }()
+
+	t.Cleanup(func() { _ = s.Close() })
+
+	return conn.LocalAddr()
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.PacketConn
+	peer net.Addr // the transfer ID, once the server answered
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) request(server net.Addr, p []byte) {
+	c.t.Helper()
+
+	if _, err := c.conn.WriteTo(p, server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) send(p []byte) {
+	c.t.Helper()
+
+	if _, err := c.conn.WriteTo(p, c.peer); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() []byte {
+	c.t.Helper()
+
+	buf := make([]byte, 1<<16)
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, addr, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.peer = addr
+
+	return buf[:n]
+}
+
+func (c *testClient) abort() {
+	c.t.Helper()
+
+	b, _ := Err{Error: ErrUnknown, Message: "test done"}.MarshalBinary()
+	c.send(b)
+}
+
+// get downloads a file of blocks of blockSize with the request req,
+// acknowledging an OACK if the server answers with one, and returns its
+// content
+func (c *testClient) get(server net.Addr, req []byte, blockSize int) []byte {
+	c.t.Helper()
+
+	c.request(server, req)
+
+	var content []byte
+
+	for block := uint16(1); ; block++ {
+		p := c.receive()
+		if block == 1 && bytes.HasPrefix(p, []byte{0, byte(OpOACK)}) {
+			c.send([]byte{0, byte(OpAck), 0, 0})
+			p = c.receive()
+		}
+
+		if len(p) < 4 || !bytes.Equal(p[:4], []byte{0, byte(OpData), byte(block >> 8), byte(block)}) {
+			c.t.Fatalf("got %q, want DATA block %d", p, block)
+		}
+
+		content = append(content, p[4:]...)
+		c.send([]byte{0, byte(OpAck), byte(block >> 8), byte(block)})
+
+		if len(p)-4 < blockSize {
+			return content
+		}
+	}
+}
+
+func rrq(fields ...string) []byte {
+	return append([]byte{0, byte(OpRRQ)}, strings.Join(fields, "\x00")+"\x00"...)
+}
+
+func TestSendBlockBoundaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		blksize   int // negotiated, 0 for none
+		wantSizes []int
+	}{
+		{"empty", 0, 0, []int{0}},
+		{"empty negotiated", 0, 1024, []int{0}},
+		{"one block", BlockSize, 0, []int{BlockSize, 0}},
+		{"three blocks", 3 * BlockSize, 0, []int{BlockSize, BlockSize, BlockSize, 0}},
+		{"one block negotiated", 1024, 1024, []int{1024, 0}},
+		{"two blocks negotiated", 2 * 1428, 1428, []int{1428, 1428, 0}},
+		{"short last block", BlockSize + 1, 0, []int{BlockSize, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, tt.size)
+			finished := make(chan Transfer, 1)
+			addr := testServer(t, &Server{Payload: payload, OnFinish: func(tr Transfer) { finished <- tr }})
+
+			c := newTestClient(t)
+
+			if tt.blksize == 0 {
+				c.request(addr, rrq("f", "octet"))
+			} else {
+				c.request(addr, rrq("f", "octet", "blksize", strconv.Itoa(tt.blksize)))
+
+				if got, want := c.receive(), []byte("\x00\x06blksize\x00"+strconv.Itoa(tt.blksize)+"\x00"); !bytes.Equal(got, want) {
+					t.Fatalf("got %q, want OACK %q", got, want)
+				}
+
+				c.send([]byte{0, byte(OpAck), 0, 0})
+			}
+
+			for i, want := range tt.wantSizes {
+				block := uint16(i + 1)
+
+				got := c.receive()
+				if len(got) < 4 || OpCode(binary.BigEndian.Uint16(got)) != OpData || binary.BigEndian.Uint16(got[2:]) != block {
+					t.Fatalf("got %q, want DATA block %d", got, block)
+				}
+
+				if len(got)-4 != want {
+					t.Fatalf("DATA block %d carries %d bytes, want %d", block, len(got)-4, want)
+				}
+
+				ack := Ack(block)
+				b, _ := ack.MarshalBinary()
+				c.send(b)
+			}
+
+			select {
+			case tr := <-finished:
+				if tr.Err != nil {
+					t.Fatalf("transfer failed: %v", tr.Err)
+				}
+
+				if tr.Blocks != uint64(len(tt.wantSizes)) || tr.Bytes != int64(tt.size) {
+					t.Errorf("transfer of %d blocks and %d bytes, want %d and %d", tr.Blocks, tr.Bytes, len(tt.wantSizes), tt.size)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("transfer didn't complete on the final ACK")
+			}
+		})
+	}
+}
+
+func TestAuthorizeDrop(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:  make([]byte, 10),
+		OnFinish: func(tr Transfer) { finished <- tr },
+		Authorize: func(_, filename string, _ OpCode) error {
+			if filename == "drop" {
+				return fmt.Errorf("scanner: %w", ErrDropped)
+			}
+
+			return errors.New("denied")
+		},
+	})
+
+	c := newTestClient(t)
+	c.request(addr, rrq("deny", "octet"))
+
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(ErrAccessViolation)}) {
+		t.Fatalf("got %q, want an access violation ERROR", got)
+	}
+
+	<-finished
+
+	c.request(addr, rrq("drop", "octet"))
+
+	select {
+	case tr := <-finished:
+		if !errors.Is(tr.Err, ErrDropped) {
+			t.Errorf("transfer failed with %v, want ErrDropped", tr.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped request wasn't reported")
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+	if n, _, err := c.conn.ReadFrom(make([]byte, 1024)); err == nil {
+		t.Errorf("dropped request was answered with %d bytes", n)
+	}
+}
+
+func TestIllegalOp(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    []byte // the request starting the transfer
+		packet []byte // sent once the server answered it
+	}{
+		{"request during a download", rrq("f", "octet"), wrq("f", "octet")},
+		{"DATA during a download", rrq("f", "octet"), data(1, []byte("x"))},
+		{"malformed packet during a download", rrq("f", "octet"), []byte{0}},
+		{"ACK during an upload", wrq("f", "octet"), []byte{0, byte(OpAck), 0, 1}},
+		{"OACK during an upload", wrq("f", "octet"), []byte("\x00\x06blksize\x001024\x00")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			addr := testServer(t, &Server{
+				Payload:  make([]byte, 2*BlockSize),
+				Upload:   func(string, WriteReq) (UploadFile, error) { return newMemUpload(), nil },
+				OnFinish: func(tr Transfer) { finished <- tr },
+			})
+
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+			c.receive()
+			c.send(tt.packet)
+
+			if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(ErrIllegalOp)}) {
+				t.Fatalf("got %q, want an illegal operation ERROR", got)
+			}
+
+			if tr := <-finished; tr.Err == nil || !strings.Contains(tr.Err.Error(), "unexpected") {
+				t.Errorf("transfer ended with %v, want an unexpected packet", tr.Err)
+			}
+		})
+	}
+}
+
+func TestIllegalRequest(t *testing.T) {
+	addr := testServer(t, &Server{Payload: []byte{}})
+
+	tests := []struct {
+		name   string
+		packet []byte
+		answer bool
+	}{
+		{"ACK", []byte{0, byte(OpAck), 0, 1}, true},
+		{"DATA", data(1, nil), true},
+		{"unknown opcode", []byte{0, 42, 0, 0}, true},
+		{"malformed request", []byte{0, byte(OpRRQ), 'f'}, true},
+		{"ERROR", []byte("\x00\x05\x00\x00bye\x00"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			c.request(addr, tt.packet)
+
+			if !tt.answer {
+				_ = c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+
+				if n, _, err := c.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+					t.Errorf("answered with %d bytes", n)
+				}
+
+				return
+			}
+
+			if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(ErrIllegalOp)}) {
+				t.Errorf("got %q, want an illegal operation ERROR", got)
+			}
+		})
+	}
+}
+
+func TestUnknownTransferID(t *testing.T) {
+	for _, upload := range []bool{false, true} {
+		name := "download"
+		if upload {
+			name = "upload"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			f := newMemUpload()
+			addr := testServer(t, &Server{
+				Payload:  []byte("payload"),
+				Upload:   func(string, WriteReq) (UploadFile, error) { return f, nil },
+				OnFinish: func(tr Transfer) { finished <- tr },
+			})
+
+			c, intruder := newTestClient(t), newTestClient(t)
+
+			if upload {
+				c.request(addr, wrq("f", "octet"))
+				c.expectAck(0)
+			} else {
+				c.request(addr, rrq("f", "octet"))
+				c.receive()
+			}
+
+			// packets from another port are answered without disturbing the
+			// transfer, except ERRORs, which are never answered
+			intruder.peer = c.peer
+			for _, p := range [][]byte{{0, byte(OpAck), 0, 1}, data(1, []byte("spoofed")), []byte("\x00\x05\x00\x00bye\x00")} {
+				intruder.send(p)
+			}
+
+			for i := 0; i < 2; i++ {
+				if got := intruder.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(ErrUnknownID)}) {
+					t.Fatalf("got %q, want an unknown transfer ID ERROR", got)
+				}
+			}
+
+			_ = intruder.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if n, _, err := intruder.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+				t.Errorf("ERROR answered with %d bytes", n)
+			}
+
+			if upload {
+				c.send(data(1, []byte("genuine")))
+				c.expectAck(1)
+			} else {
+				c.send([]byte{0, byte(OpAck), 0, 1})
+			}
+
+			if tr := <-finished; tr.Err != nil || tr.Blocks != 1 {
+				t.Errorf("transfer of %d blocks failed with %v", tr.Blocks, tr.Err)
+			}
+
+			if upload {
+				if got := string(f.bytes()); got != "genuine" {
+					t.Errorf("stored %q, want the client's", got)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateAck(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	addr := testServer(t, &Server{
+		Payload:  make([]byte, 2*BlockSize),
+		Timeout:  time.Second,
+		OnFinish: func(tr Transfer) { finished <- tr },
+	})
+
+	// expectNothing fails the test if a packet arrives within d
+	expectNothing := func(c *testClient, d time.Duration) {
+		t.Helper()
+
+		_ = c.conn.SetReadDeadline(time.Now().Add(d))
+		if n, _, err := c.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+			t.Fatalf("got a packet of %d bytes, want none before the timeout", n)
+		}
+	}
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 1}) {
+		t.Fatalf("got %q, want DATA block 1", got)
+	}
+
+	// an ACK duplicated on the way, e.g. by a client retransmitting it after
+	// a delayed DATA, sends the next block once, not twice
+	c.send([]byte{0, byte(OpAck), 0, 1})
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 2}) {
+		t.Fatalf("got %q, want DATA block 2", got)
+	}
+
+	expectNothing(c, 300*time.Millisecond)
+
+	// stale ACKs are ignored, the block being resent on the timeout only
+	c.send([]byte{0, byte(OpAck), 0, 0})
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 2}) {
+		t.Fatalf("got %q, want DATA block 2 again", got)
+	}
+
+	c.send([]byte{0, byte(OpAck), 0, 2})
+
+	if got := c.receive(); !bytes.Equal(got, data(3, nil)) {
+		t.Fatalf("got %q, want the empty DATA block 3", got)
+	}
+
+	c.send([]byte{0, byte(OpAck), 0, 3})
+
+	if tr := <-finished; tr.Err != nil || tr.Blocks != 3 {
+		t.Errorf("transfer of %d blocks failed with %v", tr.Blocks, tr.Err)
+	}
+}
+
+func TestDuplicateRequest(t *testing.T) {
+	var started int32
+
+	finished := make(chan Transfer, 2)
+	addr := testServer(t, &Server{
+		Payload:  []byte("payload"),
+		Timeout:  5 * time.Second,
+		OnStart:  func(Transfer) { atomic.AddInt32(&started, 1) },
+		OnFinish: func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+
+	// a client retransmitting its request before the first DATA arrived
+	for i := 0; i < 3; i++ {
+		c.request(addr, rrq("f", "octet"))
+	}
+
+	if got := c.receive(); !bytes.Equal(got, data(1, []byte("payload"))) {
+		t.Fatalf("got %q, want DATA block 1", got)
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, from, err := c.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+		t.Fatalf("got %d more bytes from %s, want a single transfer", n, from)
+	}
+
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	if tr := <-finished; tr.Err != nil {
+		t.Fatalf("transfer failed: %v", tr.Err)
+	}
+
+	// once the transfer ended, the client may ask again
+	if got := c.get(addr, rrq("f", "octet"), BlockSize); string(got) != "payload" {
+		t.Fatalf("got %q, want the payload again", got)
+	}
+
+	<-finished
+
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("started %d transfers, want 2", n)
+	}
+}
+
+// logLines is a log output handing over the lines logged, dropping them if
+// they're not received in time
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+	}
+
+	return len(p), nil
+}
+
+func TestListenAndServeAll(t *testing.T) {
+	lines := make(logLines, 100)
+	s := &Server{Payload: []byte("served"), Logger: log.New(lines, "", 0)}
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServeAll([]string{"127.0.0.1:0", "127.0.0.1:0"}) }()
+
+	var addrs []string
+	for len(addrs) < 2 {
+		select {
+		case line := <-lines:
+			var addr string
+			if _, err := fmt.Sscanf(line, "Listening on %s ...", &addr); err == nil {
+				addrs = append(addrs, addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("listening on %v, want 2 addresses", addrs)
+		}
+	}
+
+	if addrs[0] == addrs[1] {
+		t.Fatalf("listening on %s twice", addrs[0])
+	}
+
+	for _, addr := range addrs {
+		server, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := newTestClient(t).get(server, rrq("f", "octet"), BlockSize); string(got) != "served" {
+			t.Errorf("%s served %q, want %q", addr, got, "served")
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	returned(t, served, ErrServerClosed)
+
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Errorf("%s wasn't closed: %v", addr, err)
+			continue
+		}
+
+		_ = conn.Close()
+	}
+}
+
+func TestListenAndServeAllFails(t *testing.T) {
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = taken.Close() }()
+
+	s := &Server{Payload: []byte{}, Logger: log.New(io.Discard, "", 0)}
+
+	if err := s.ListenAndServeAll(nil); err == nil {
+		t.Error("served no address")
+	}
+
+	if err := s.ListenAndServeAll([]string{"127.0.0.1:0", taken.LocalAddr().String()}); err == nil {
+		t.Error("served an address in use")
+	}
+}
+
+func TestServeRejectsBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"negative window size", &Server{MaxWindowSize: -1}},
+		{"negative minimum timeout", &Server{MinTimeout: -time.Second}},
+		{"minimum timeout above the maximum", &Server{MinTimeout: 10 * time.Second, MaxTimeout: 5 * time.Second}},
+		{"minimum timeout above the default maximum", &Server{MinTimeout: time.Hour}},
+		{"minimum block size above the maximum", &Server{MinBlockSize: 1024, MaxBlockSize: 512}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+
+			tt.server.Payload = []byte("x")
+
+			if err := tt.server.Serve(conn); err == nil {
+				t.Error("served with invalid bounds")
+			}
+		})
+	}
+}
+
+func TestAckBehavior(t *testing.T) {
+	ack := func(block uint16) []byte { return []byte{0, byte(OpAck), byte(block >> 8), byte(block)} }
+
+	// the client receives a number of DATA packets, then sends ACKs
+	type step struct {
+		receive int
+		acks    []uint16
+	}
+
+	tests := []struct {
+		name    string
+		options []string
+		steps   []step
+		want    AckBehavior
+	}{
+		{name: "lockstep", steps: []step{{1, []uint16{1}}, {1, []uint16{2}}, {1, []uint16{3}}}, want: AckLockstep},
+		{name: "duplicate", steps: []step{{1, []uint16{1, 1}}, {1, []uint16{2}}, {1, []uint16{3}}}, want: AckDuplicate},
+		{name: "windowed", options: []string{"windowsize", "4"}, steps: []step{{3, []uint16{3}}}, want: AckWindowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished := make(chan Transfer, 1)
+			addr := testServer(t, &Server{Payload: make([]byte, 20), OnFinish: func(tr Transfer) { finished <- tr }})
+
+			c := newTestClient(t)
+			c.request(addr, rrq(append([]string{"f", "octet", "blksize", "8"}, tt.options...)...))
+			c.receive() // OACK
+			c.send(ack(0))
+
+			for _, st := range tt.steps {
+				for i := 0; i < st.receive; i++ {
+					c.receive()
+				}
+
+				for _, block := range st.acks {
+					c.send(ack(block))
+				}
+			}
+
+			select {
+			case tr := <-finished:
+				if tr.Err != nil || tr.Acks != tt.want {
+					t.Errorf("got %q, %v, want %q", tr.Acks, tr.Err, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("transfer didn't finish")
+			}
+		})
+	}
+}
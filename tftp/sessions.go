@@ -0,0 +1,167 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// activeTransfer is a transfer in progress, registered by the address of
+// its client
+type activeTransfer struct {
+	seen  int64  // unix nanoseconds the client was last heard from, 0 before the transfer ID exists; first for 64-bit atomic alignment on 32-bit platforms
+	bytes int64  // payload bytes acknowledged so far
+	done  uint64 // blocks acknowledged so far
+
+	id          uint64
+	info        Transfer           // the request, set once the transfer started
+	rerequested chan struct{}      // signalled when the client retransmits its request
+	cancel      context.CancelFunc // ends the transfer, nil until it started
+	ended       error              // why the server ended the transfer, if it did
+}
+
+// heard records that the client sent a packet to the transfer ID
+func (t *activeTransfer) heard() {
+	atomic.StoreInt64(&t.seen, time.Now().UnixNano())
+}
+
+// progressed records the blocks and payload bytes acknowledged so far
+func (t *activeTransfer) progressed(blocks uint64, bytes int64) {
+	atomic.StoreUint64(&t.done, blocks)
+	atomic.StoreInt64(&t.bytes, bytes)
+}
+
+// Session is a snapshot of a transfer in progress, as listed by
+// Server.Sessions
+type Session struct {
+	ID       uint64 // unique for the lifetime of the Server
+	Client   string
+	Filename string
+	Mode     string
+	Upload   bool
+	Blocks   uint64 // acknowledged so far
+	Bytes    int64
+	Start    time.Time
+}
+
+// Sessions returns the transfers in progress, oldest first
+func (s *Server) Sessions() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]Session, 0, len(s.active))
+
+	for _, t := range s.active {
+		if t.cancel == nil {
+			continue
+		}
+
+		sessions = append(sessions, Session{
+			ID:       t.id,
+			Client:   t.info.Client,
+			Filename: t.info.Filename,
+			Mode:     t.info.Mode,
+			Upload:   t.info.Upload,
+			Blocks:   atomic.LoadUint64(&t.done),
+			Bytes:    atomic.LoadInt64(&t.bytes),
+			Start:    t.info.Start,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	return sessions
+}
+
+// Cancel ends the transfer in progress with the given ID, sending its
+// client an ERROR packet, reporting false if there is none. The transfer
+// fails with ErrCanceled.
+func (s *Server) Cancel(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for clientAddr, t := range s.active {
+		if t.id != id || t.cancel == nil {
+			continue
+		}
+
+		if t.ended == nil {
+			s.logf("[%s] canceling transfer of %s", clientAddr, t.info.Filename)
+
+			t.ended = ErrCanceled
+			t.cancel()
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// transferContext registers the transfer t started under parent by key,
+// the client's address but for MTFTP transfers, returning its context,
+// which is done once the transfer has run for TransferTimeout or it is
+// ended by Cancel, Close or the reaper
+func (s *Server) transferContext(parent context.Context, key string, t Transfer) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if s.TransferTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, s.TransferTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	s.mu.Lock()
+	if a := s.active[key]; a != nil {
+		a.info, a.cancel = t, cancel
+
+		// a transfer leaving the Backlog after Close ends right away
+		if s.closed && a.ended == nil {
+			a.ended = ErrServerClosed
+			cancel()
+		}
+	}
+	s.mu.Unlock()
+
+	return ctx, cancel
+}
+
+// expired replaces the error of the transfer registered by key ended by
+// TransferTimeout, Cancel, Close or the reaper, rather than by its parent
+// context, with ErrTransferTimeout, ErrCanceled, ErrServerClosed,
+// ErrSessionExpired or ErrIdle
+func (s *Server) expired(parent context.Context, key string, err error) error {
+	if parent.Err() != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	var ended error
+	if t := s.active[key]; t != nil {
+		ended = t.ended
+	}
+	s.mu.Unlock()
+
+	switch {
+	case ended != nil && errors.Is(err, context.Canceled):
+		return ended
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w after %v", ErrTransferTimeout, s.TransferTimeout)
+	default:
+		return err
+	}
+}
+
+// endedBy returns why the server ended t, nil if it didn't
+func (s *Server) endedBy(t *activeTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return t.ended
+}
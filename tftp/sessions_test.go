@@ -0,0 +1,79 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	s := &Server{
+		OnFinish: func(tr Transfer) { finished <- tr },
+
+		// a slow handler, stuck after the first block until canceled
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_, _ = w.Write(make([]byte, BlockSize))
+			<-r.Context().Done()
+		}),
+	}
+	addr := testServer(t, s)
+
+	c := newTestClient(t)
+	c.request(addr, rrq("boot.img", "octet"))
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 1})
+
+	var sessions []Session
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if sessions = s.Sessions(); len(sessions) == 1 && sessions[0].Blocks == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got sessions %+v, want one with a block acknowledged", sessions)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := sessions[0]
+	if got.Client != c.conn.LocalAddr().String() || got.Filename != "boot.img" || got.Mode != "octet" || got.Upload || got.Bytes != BlockSize || got.Start.IsZero() {
+		t.Errorf("got session %+v", got)
+	}
+
+	if s.Cancel(got.ID + 1) {
+		t.Error("canceled a session that doesn't exist")
+	}
+
+	if !s.Cancel(got.ID) {
+		t.Fatal("didn't cancel the session")
+	}
+
+	if pkt := c.receiveErr(); !bytes.Contains(pkt, []byte(ErrCanceled.Error())) {
+		t.Errorf("got %q, want an ERROR telling the client it was canceled", pkt)
+	}
+
+	select {
+	case tr := <-finished:
+		if !errors.Is(tr.Err, ErrCanceled) {
+			t.Errorf("transfer failed with %v, want ErrCanceled", tr.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer wasn't canceled")
+	}
+
+	// the transfer is unregistered right after it reported finishing
+	for deadline := time.Now().Add(5 * time.Second); len(s.Sessions()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got sessions %+v after the transfer ended", s.Sessions())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s.Cancel(got.ID) {
+		t.Error("canceled a session that ended")
+	}
+}
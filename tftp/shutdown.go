@@ -0,0 +1,132 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrServerClosed is returned by Serve, ListenAndServe and ServeMTFTP once
+// Shutdown or Close was called, and is the error of the transfers Close
+// ends
+var ErrServerClosed = errors.New("tftp: server closed")
+
+// Shutdown stops the server gracefully, answering new requests with an
+// ERROR packet while waiting for the transfers in progress to end, then
+// closing the connections requests are read from, which makes Serve return
+// ErrServerClosed. If ctx is done before the transfers end, the
+// connections are closed anyway and ctx's error is returned; the transfers
+// carry on until they end by themselves.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+
+	idle := s.idle
+	if idle == nil {
+		idle = make(chan struct{})
+		if len(s.active) == 0 {
+			close(idle)
+		} else {
+			s.idle = idle
+		}
+	}
+	s.mu.Unlock()
+
+	var err error
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.listeners {
+		if cErr := conn.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+
+	return err
+}
+
+// Close stops the server right away, closing the connections requests are
+// read from, which makes Serve return ErrServerClosed, and ending the
+// transfers in progress or waiting in the Backlog with an ERROR packet. Use
+// Shutdown to let the transfers complete.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closing, s.closed = true, true
+
+	for clientAddr, t := range s.active {
+		if t.ended == nil && t.cancel != nil {
+			s.logf("[%s] closing transfer of %s", clientAddr, t.info.Filename)
+
+			t.ended = ErrServerClosed
+			t.cancel()
+		}
+	}
+
+	var err error
+
+	for conn := range s.listeners {
+		if cErr := conn.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+
+	return err
+}
+
+var _ io.Closer = (*Server)(nil)
+
+// shuttingDown reports whether Shutdown or Close was called
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// refused rejects a request arriving after Shutdown was called, reporting
+// whether it did
+func (s *Server) refused(ctx context.Context, clientAddr string) bool {
+	if !s.shuttingDown() {
+		return false
+	}
+
+	s.reject(ctx, clientAddr, Err{Error: ErrUnknown, Message: "server is shutting down"})
+
+	return true
+}
+
+// track registers a connection requests are read from to be closed by
+// Shutdown, reporting false if the server is shut down already
+func (s *Server) track(conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]struct{})
+	}
+
+	s.listeners[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, conn)
+}
@@ -0,0 +1,204 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve serves s on a loopback port under ctx like testServer, also
+// returning what ServeContext returns
+func serve(t *testing.T, ctx context.Context, s *Server) (net.Addr, chan error) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Logger = log.New(io.Discard, "", 0)
+
+	served := make(chan error, 1)
+	go func() { served <- s.ServeContext(ctx, conn) }()
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = conn.Close()
+	})
+
+	return conn.LocalAddr(), served
+}
+
+// returned waits for ServeContext to return, failing the test unless it
+// returns want
+func returned(t *testing.T, served chan error, want error) {
+	t.Helper()
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, want) {
+			t.Errorf("serving ended with %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serving didn't end")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	s := &Server{Payload: make([]byte, BlockSize+1), OnFinish: func(tr Transfer) { finished <- tr }}
+	addr, served := serve(t, context.Background(), s)
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+	c.receive()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// requests arriving meanwhile are refused
+	late := newTestClient(t)
+	for {
+		late.request(addr, rrq("f", "octet"))
+		if got := late.receive(); bytes.HasPrefix(got, []byte{0, byte(OpErr)}) {
+			if !bytes.Contains(got, []byte("shutting down")) {
+				t.Fatalf("got %q, want a shutting down ERROR", got)
+			}
+
+			break
+		}
+
+		// the request beat Shutdown
+		late.abort()
+		<-finished
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a transfer in progress", err)
+	default:
+	}
+
+	// the transfer in progress completes
+	c.send([]byte{0, byte(OpAck), 0, 1})
+	c.receive()
+	c.send([]byte{0, byte(OpAck), 0, 2})
+
+	if tr := <-finished; tr.Err != nil {
+		t.Errorf("transfer failed: %v", tr.Err)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+
+	returned(t, served, ErrServerClosed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := &Server{Payload: make([]byte, BlockSize+1)}
+	addr, served := serve(t, context.Background(), s)
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+	c.receive()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want the context's deadline exceeded", err)
+	}
+
+	returned(t, served, ErrServerClosed)
+
+	// the transfer carries on regardless
+	c.send([]byte{0, byte(OpAck), 0, 1})
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpData), 0, 2}) {
+		t.Errorf("got %q, want DATA block 2", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	for _, upload := range []bool{false, true} {
+		finished := make(chan Transfer, 1)
+		s := &Server{
+			Payload:  make([]byte, BlockSize+1),
+			Upload:   func(string, WriteReq) (UploadFile, error) { return newMemUpload(), nil },
+			OnFinish: func(tr Transfer) { finished <- tr },
+		}
+		addr, served := serve(t, context.Background(), s)
+
+		c := newTestClient(t)
+		if upload {
+			c.request(addr, wrq("f", "octet"))
+		} else {
+			c.request(addr, rrq("f", "octet"))
+		}
+
+		c.receive()
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr)}) {
+			t.Errorf("upload %v: got %q, want an ERROR ending the transfer", upload, got)
+		}
+
+		if tr := <-finished; !errors.Is(tr.Err, ErrServerClosed) {
+			t.Errorf("upload %v: transfer failed with %v, want ErrServerClosed", upload, tr.Err)
+		}
+
+		returned(t, served, ErrServerClosed)
+
+		if err := s.Serve(newTestClient(t).conn); !errors.Is(err, ErrServerClosed) {
+			t.Errorf("serving a closed server returned %v", err)
+		}
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	finished := make(chan Transfer, 1)
+	handled := make(chan error, 1)
+
+	s := &Server{
+		OnFinish: func(tr Transfer) { finished <- tr },
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			_, _ = w.Write(make([]byte, BlockSize))
+
+			<-r.Context().Done()
+			handled <- r.Context().Err()
+		}),
+	}
+	addr, served := serve(t, ctx, s)
+
+	c := newTestClient(t)
+	c.request(addr, rrq("f", "octet"))
+	c.receive()
+
+	cancel()
+
+	returned(t, served, context.Canceled)
+
+	if tr := <-finished; !errors.Is(tr.Err, context.Canceled) {
+		t.Errorf("transfer failed with %v, want the context canceled", tr.Err)
+	}
+
+	select {
+	case err := <-handled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("handler's context ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler's context wasn't canceled")
+	}
+}
@@ -0,0 +1,266 @@
+package tftp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// sharedConn is the transfer ID of a session in single-port mode, sharing
+// the socket requests are read from: packets are sent from it, and the ones
+// its clients send to it are handed over by Serve. A unicast transfer has a
+// single client, a multicast session every client waiting in it.
+type sharedConn struct {
+	listener net.PacketConn
+	s        *Server
+	keys     []string // the addresses of the clients, guarded by s.mu
+	inbox    chan routedPacket
+
+	mu       sync.Mutex // guards deadline
+	deadline time.Time
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// routedPacket is a packet Serve read for a transfer in single-port mode
+type routedPacket struct {
+	p    []byte
+	from net.Addr
+}
+
+// share returns the transfer ID for exchanging packets with clientAddr over
+// listener, replacing any other the client had
+func (s *Server) share(listener net.PacketConn, clientAddr string) *sharedConn {
+	c := &sharedConn{
+		listener: listener,
+		s:        s,
+		inbox:    make(chan routedPacket, 16),
+		closed:   make(chan struct{}),
+	}
+
+	c.join(clientAddr)
+
+	return c
+}
+
+// join hands the packets of clientAddr to the conn too, replacing any other
+// transfer ID the client had
+func (c *sharedConn) join(clientAddr string) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if c.s.routes == nil {
+		c.s.routes = make(map[string]*sharedConn)
+	}
+
+	c.s.routes[clientAddr] = c
+	c.keys = append(c.keys, clientAddr)
+}
+
+// leave stops the packets of clientAddr being handed to the conn
+func (c *sharedConn) leave(clientAddr string) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if c.s.routes[clientAddr] == c {
+		delete(c.s.routes, clientAddr)
+	}
+
+	for i, key := range c.keys {
+		if key == clientAddr {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// route hands a packet other than a request that Serve read from clientAddr
+// to the client's transfer in single-port mode, reporting false if there is
+// none. Packets are dropped, as by a socket, when the transfer lags behind.
+func (s *Server) route(clientAddr net.Addr, p []byte) bool {
+	if !s.SinglePort || len(p) < 2 {
+		return false
+	}
+
+	if op := OpCode(binary.BigEndian.Uint16(p)); op == OpRRQ || op == OpWRQ {
+		return false
+	}
+
+	s.mu.Lock()
+	c := s.routes[clientAddr.String()]
+	s.mu.Unlock()
+
+	if c == nil {
+		return false
+	}
+
+	select {
+	case c.inbox <- routedPacket{p: append([]byte(nil), p...), from: clientAddr}:
+	default:
+	}
+
+	return true
+}
+
+func (c *sharedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	select {
+	case pkt := <-c.inbox:
+		return copy(p, pkt.p), pkt.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *sharedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+		return c.listener.WriteTo(p, addr)
+	}
+}
+
+// Close stops the clients' packets being handed to the conn, leaving the
+// listener open
+func (c *sharedConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+
+		c.s.mu.Lock()
+		for _, key := range c.keys {
+			if c.s.routes[key] == c {
+				delete(c.s.routes, key)
+			}
+		}
+		c.s.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (c *sharedConn) LocalAddr() net.Addr {
+	return c.listener.LocalAddr()
+}
+
+func (c *sharedConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *sharedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+
+	return nil
+}
+
+// SetWriteDeadline does nothing, as the listener's deadlines are Serve's
+func (c *sharedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// SessionOwners records which of the servers sharing an address in
+// single-port mode owns the session of a client, see Server.Owners
+type SessionOwners interface {
+	// Claim records the server as the owner of clientAddr's session,
+	// reporting false if another server owns it
+	Claim(ctx context.Context, clientAddr string) (bool, error)
+
+	// Release gives up the session of clientAddr once its transfer ended
+	Release(clientAddr string) error
+
+	// OwnedElsewhere reports whether another server owns the session of
+	// clientAddr
+	OwnedElsewhere(ctx context.Context, clientAddr string) (bool, error)
+}
+
+// claim reports whether the server may serve the request of clientAddr,
+// serving it if the owners can't be asked rather than serving no one
+func (s *Server) claim(ctx context.Context, clientAddr string) bool {
+	if !s.SinglePort || s.Owners == nil {
+		return true
+	}
+
+	ok, err := s.Owners.Claim(ctx, clientAddr)
+	if err != nil {
+		s.logf("[%s] claiming the session: %v", clientAddr, err)
+		return true
+	}
+
+	if !ok {
+		s.logf("[%s] ignoring request served by another server", clientAddr)
+	}
+
+	return ok
+}
+
+func (s *Server) release(clientAddr string) {
+	if !s.SinglePort || s.Owners == nil {
+		return
+	}
+
+	if err := s.Owners.Release(clientAddr); err != nil {
+		s.logf("[%s] releasing the session: %v", clientAddr, err)
+	}
+}
+
+// maxStrayLookups is the number of stray packets the owners are asked about
+// at once, so a flood of them can't pile up lookups
+const maxStrayLookups = 16
+
+// stray answers a packet other than a request that belongs to no transfer
+// with an ERROR, unless another server owns the client's session. Asking
+// the owners is left to a goroutine, so it doesn't hold up Serve, and
+// packets arriving while maxStrayLookups are asked about are dropped
+// unanswered, as a client whose transfer is still running retransmits.
+func (s *Server) stray(ctx context.Context, clientAddr string, pkt Packet) {
+	if !s.SinglePort || s.Owners == nil {
+		s.logf("[%s] bad request: unexpected %s", clientAddr, pkt)
+		s.reject(ctx, clientAddr, Err{Error: ErrIllegalOp, Message: "expected a read or write request"})
+
+		return
+	}
+
+	select {
+	case s.strays <- struct{}{}:
+	default:
+		s.logf("[%s] dropping %s, too many stray packets", clientAddr, pkt)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.strays }()
+
+		if elsewhere, err := s.Owners.OwnedElsewhere(ctx, clientAddr); err == nil && elsewhere {
+			s.logf("[%s] dropping %s of a session served by another server", clientAddr, pkt)
+			return
+		}
+
+		s.logf("[%s] bad request: unexpected %s", clientAddr, pkt)
+		s.reject(ctx, clientAddr, Err{Error: ErrIllegalOp, Message: "expected a read or write request"})
+	}()
+}
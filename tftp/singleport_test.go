@@ -0,0 +1,213 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSinglePort(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 3*BlockSize/10+5)
+
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload:    payload,
+		SinglePort: true,
+		Upload:     func(string, WriteReq) (UploadFile, error) { return f, nil },
+	})
+
+	// two downloads and an upload, interleaved over the listening socket
+	readers := []*testClient{newTestClient(t), newTestClient(t)}
+	for _, c := range readers {
+		c.request(addr, rrq("f", "octet"))
+	}
+
+	writer := newTestClient(t)
+	writer.request(addr, wrq("f", "octet"))
+	writer.expectAck(0)
+
+	contents := make([][]byte, len(readers))
+
+	for block, done := uint16(1), false; !done; block++ {
+		for i, c := range readers {
+			p := c.receive()
+			if c.peer.String() != addr.String() {
+				t.Fatalf("block %d sent from %s, want %s", block, c.peer, addr)
+			}
+
+			if !bytes.HasPrefix(p, []byte{0, byte(OpData), byte(block >> 8), byte(block)}) {
+				t.Fatalf("got %q, want DATA block %d", p, block)
+			}
+
+			contents[i] = append(contents[i], p[4:]...)
+			c.send([]byte{0, byte(OpAck), byte(block >> 8), byte(block)})
+
+			done = len(p)-4 < BlockSize
+		}
+
+		if !done {
+			writer.send(data(block, make([]byte, BlockSize)))
+		} else {
+			writer.send(data(block, []byte("end")))
+		}
+
+		writer.expectAck(block)
+		if writer.peer.String() != addr.String() {
+			t.Fatalf("ACK %d sent from %s, want %s", block, writer.peer, addr)
+		}
+	}
+
+	for i, content := range contents {
+		if !bytes.Equal(content, payload) {
+			t.Errorf("client %d received %d bytes, want %d", i, len(content), len(payload))
+		}
+	}
+
+	if err := f.wait(t); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if got, want := len(f.bytes()), 3*BlockSize+len("end"); got != want {
+		t.Errorf("stored %d bytes, want %d", got, want)
+	}
+}
+
+// memOwners is the SessionOwners of the servers sharing it, told apart by
+// their name
+type memOwners struct {
+	mu     *sync.Mutex
+	owners map[string]string // by client address
+	name   string
+}
+
+func (o memOwners) Claim(_ context.Context, clientAddr string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if owner, ok := o.owners[clientAddr]; ok && owner != o.name {
+		return false, nil
+	}
+
+	o.owners[clientAddr] = o.name
+
+	return true, nil
+}
+
+func (o memOwners) Release(clientAddr string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.owners[clientAddr] == o.name {
+		delete(o.owners, clientAddr)
+	}
+
+	return nil
+}
+
+func (o memOwners) OwnedElsewhere(_ context.Context, clientAddr string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	owner, ok := o.owners[clientAddr]
+
+	return ok && owner != o.name, nil
+}
+
+func (o memOwners) owned() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.owners)
+}
+
+func TestSinglePortOwners(t *testing.T) {
+	shared := memOwners{mu: &sync.Mutex{}, owners: make(map[string]string)}
+
+	a, b := shared, shared
+	a.name, b.name = "a", "b"
+
+	addrA := testServer(t, &Server{Payload: []byte("hello"), SinglePort: true, Owners: a})
+	addrB := testServer(t, &Server{Payload: []byte("hello"), SinglePort: true, Owners: b})
+
+	silent := func(c *testClient, server net.Addr) {
+		t.Helper()
+
+		_ = c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if n, from, err := c.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+			t.Fatalf("%s answered with %d bytes from %s", server, n, from)
+		}
+	}
+
+	ack := []byte{0, byte(OpAck), 0, 1}
+
+	c := newTestClient(t)
+	c.request(addrA, rrq("f", "octet"))
+
+	if p := c.receive(); !bytes.Equal(p, data(1, []byte("hello"))) {
+		t.Fatalf("got %q, want DATA block 1", p)
+	}
+
+	// the request retransmitted and the ACK moved to b, as by a failover
+	c.request(addrB, rrq("f", "octet"))
+	c.request(addrB, ack)
+	silent(c, addrB)
+
+	c.send(ack)
+
+	for deadline := time.Now().Add(5 * time.Second); shared.owned() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the session wasn't released")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// once released, b answers stray packets again
+	c.request(addrB, ack)
+	if p := c.receive(); !bytes.HasPrefix(p, []byte{0, byte(OpErr), 0, byte(ErrIllegalOp)}) {
+		t.Fatalf("got %q, want an illegal operation ERROR", p)
+	}
+}
+
+// slowOwners owns no session, answering OwnedElsewhere once released
+type slowOwners struct {
+	asked   chan struct{}
+	release chan struct{}
+}
+
+func (o slowOwners) Claim(context.Context, string) (bool, error) { return true, nil }
+func (o slowOwners) Release(string) error                        { return nil }
+
+func (o slowOwners) OwnedElsewhere(context.Context, string) (bool, error) {
+	o.asked <- struct{}{}
+	<-o.release
+
+	return false, nil
+}
+
+func TestSinglePortStrayFlood(t *testing.T) {
+	owners := slowOwners{asked: make(chan struct{}, 100), release: make(chan struct{})}
+	addr := testServer(t, &Server{Payload: []byte("hello"), SinglePort: true, Owners: owners})
+
+	c := newTestClient(t)
+	for i := 0; i < 3*maxStrayLookups; i++ {
+		c.request(addr, []byte{0, byte(OpAck), 0, 1})
+	}
+
+	// the requests still get through
+	other := newTestClient(t)
+	other.request(addr, rrq("f", "octet"))
+
+	if p := other.receive(); !bytes.Equal(p, data(1, []byte("hello"))) {
+		t.Fatalf("got %q, want DATA block 1", p)
+	}
+
+	close(owners.release)
+
+	if n := len(owners.asked); n > maxStrayLookups {
+		t.Errorf("asked the owners about %d stray packets at once, want at most %d", n, maxStrayLookups)
+	}
+}
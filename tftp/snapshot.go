@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+)
+
+const (
+	// snapshotMemory is the size up to which snapshots are held in memory
+	snapshotMemory = 1 << 20
+
+	// snapshotAttempts is how often a file changing while it's copied is
+	// copied again before the request is refused
+	snapshotAttempts = 3
+)
+
+// errModified refuses requests of files that kept changing while copied
+var errModified = Errorf(ErrUnknown, "file is being modified, try again later")
+
+// snapshot copies f, so the transfer serves the file as it was even if it's
+// overwritten in place meanwhile, returning the copy, its size and the
+// function releasing it. Small files are copied to memory, larger ones to a
+// temporary file. A file found to change while copied is copied again if
+// it can be read from the start again, up to snapshotAttempts times.
+func snapshot(f fs.File) (io.Reader, int64, func(), error) {
+	for attempt := 1; ; attempt++ {
+		before, err := f.Stat()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		r, size, release, err := copyFile(f, before.Size())
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		after, err := f.Stat()
+		if err == nil && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) && size == before.Size() {
+			return r, size, release, nil
+		}
+
+		release()
+
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		seeker, ok := f.(io.Seeker)
+		if !ok || attempt == snapshotAttempts {
+			return nil, 0, nil, errModified
+		}
+
+		if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+}
+
+// copyFile copies f, of the given size when opened, to memory or a
+// temporary file
+func copyFile(f fs.File, size int64) (io.Reader, int64, func(), error) {
+	if size <= snapshotMemory {
+		var b bytes.Buffer
+		if _, err := b.ReadFrom(f); err != nil {
+			return nil, 0, nil, err
+		}
+
+		return bytes.NewReader(b.Bytes()), int64(b.Len()), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "tftp-snapshot-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	// the copy is unlinked right away where open files may be, so it's
+	// gone even if the server isn't stopped cleanly
+	_ = os.Remove(tmp.Name())
+
+	release := func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}
+
+	n, err := io.Copy(tmp, f)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+
+	return tmp, n, release, nil
+}
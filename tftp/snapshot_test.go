@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		blksize int
+	}{
+		{name: "in memory", size: 3*BlockSize + 10, blksize: BlockSize},
+		{name: "temporary file", size: snapshotMemory + 10, blksize: MaxBlockSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := filepath.Join(dir, "image.bin")
+
+			old, replacement := bytes.Repeat([]byte("o"), tt.size), bytes.Repeat([]byte("n"), tt.size)
+			if err := os.WriteFile(name, old, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			addr := testServer(t, &Server{Root: dir, Snapshot: true})
+
+			c := newTestClient(t)
+			c.request(addr, rrq("image.bin", "octet", "blksize", strconv.Itoa(tt.blksize)))
+			c.receive() // OACK
+
+			var content []byte
+
+			for block := uint16(0); ; block++ {
+				c.send([]byte{0, byte(OpAck), byte(block >> 8), byte(block)})
+
+				p := c.receive()
+				if !bytes.HasPrefix(p, []byte{0, byte(OpData)}) {
+					t.Fatalf("got %q, want DATA block %d", p, block+1)
+				}
+
+				// the file is overwritten in place once the transfer started
+				if block == 0 {
+					if err := os.WriteFile(name, replacement, 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if content = append(content, p[4:]...); len(p)-4 < tt.blksize {
+					c.send([]byte{0, byte(OpAck), byte((block + 1) >> 8), byte(block + 1)})
+					break
+				}
+			}
+
+			if !bytes.Equal(content, old) {
+				t.Errorf("served a torn file of %d bytes, %d of them new", len(content), bytes.Count(content, []byte("n")))
+			}
+		})
+	}
+}
+
+// changingFile is a file whose modification time changes on every Stat
+type changingFile struct {
+	fs.File
+	stats int
+}
+
+func (f *changingFile) Stat() (fs.FileInfo, error) {
+	f.stats++
+	return changingInfo{mod: time.Unix(int64(f.stats), 0)}, nil
+}
+
+func (f *changingFile) Read(p []byte) (int, error) {
+	return copy(p, "data"), io.EOF
+}
+
+type changingInfo struct {
+	fs.FileInfo
+	mod time.Time
+}
+
+func (i changingInfo) Size() int64        { return 4 }
+func (i changingInfo) ModTime() time.Time { return i.mod }
+
+func TestSnapshotModified(t *testing.T) {
+	if _, _, _, err := snapshot(&changingFile{}); !errors.Is(err, errModified) {
+		t.Errorf("got %v, want errModified", err)
+	}
+}
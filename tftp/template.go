@@ -0,0 +1,117 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"text/template"
+)
+
+// TemplateData are the variables of a request a template is rendered with,
+// e.g. {{.IP}} or {{.MAC}}
+type TemplateData struct {
+	IP   string // the client's IP address
+	Port int    // the client's port
+	Path string // the requested file name
+	MAC  string // found in Path by MACFromFilename, e.g. aa:bb:cc:dd:ee:ff, empty if none
+
+	// Device are the attributes of the client's device found by
+	// Templates.Devices, e.g. {{.Device.role}}, nil if unknown
+	Device Device
+}
+
+// Templates renders Go text templates with the variables of the request
+// before serving them, e.g. to generate the configuration file of every
+// switch from one template. A request for switch.cfg renders the template
+// switch.cfg.tmpl of FS, and is passed on as if there were no templates if
+// FS has none by that name. Use its Generate method as the server's
+// Generate:
+//
+//	s.Generate = (&tftp.Templates{FS: os.DirFS("/srv/templates")}).Generate
+//
+// Templates are parsed for every request, so edits apply right away.
+type Templates struct {
+	FS     fs.FS
+	Suffix string           // appended to the requested name, .tmpl if empty
+	Funcs  template.FuncMap // functions templates may call, besides the built-in ones
+
+	// Devices, if set, looks up the attributes of the client's device
+	// templates are rendered with
+	Devices DeviceResolver
+
+	// Secrets, if set, looks up the secrets templates insert with
+	// {{secret "name"}}, failing the request if one is missing
+	Secrets SecretProvider
+}
+
+// Generate renders the template of r's file, returning a nil reader if there
+// is none
+func (t *Templates) Generate(r *Request) (io.Reader, int64, error) {
+	suffix := t.Suffix
+	if suffix == "" {
+		suffix = ".tmpl"
+	}
+
+	name := FSPath(r.Filename) + suffix
+
+	text, err := fs.ReadFile(t.FS, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, -1, nil
+	}
+
+	if err != nil {
+		return nil, -1, err
+	}
+
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			if t.Secrets == nil {
+				return "", errors.New("no secrets provider")
+			}
+
+			return t.Secrets.Secret(r.Context(), name)
+		},
+	}
+
+	for name, fn := range t.Funcs {
+		funcs[name] = fn
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Parse(string(text))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	data := templateData(r)
+	if t.Devices != nil {
+		if data.Device, err = lookupDevice(r.Context(), t.Devices, r.RemoteAddr, r.Filename); err != nil {
+			return nil, -1, err
+		}
+	}
+
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, data); err != nil {
+		return nil, -1, err
+	}
+
+	return &b, int64(b.Len()), nil
+}
+
+// templateData returns the variables r is rendered with
+func templateData(r *Request) TemplateData {
+	data := TemplateData{IP: r.RemoteAddr, Path: r.Filename}
+
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		data.IP = host
+		data.Port, _ = strconv.Atoi(port)
+	}
+
+	if mac := MACFromFilename(r.Filename); mac != nil {
+		data.MAC = mac.String()
+	}
+
+	return data
+}
@@ -0,0 +1,197 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// peerConn is the transfer ID (TID) of a session, a socket of its own
+// exchanging packets with a single client. Packets arriving from any other
+// address are answered with an unknown transfer ID ERROR and skipped, as
+// RFC 1350 section 4 asks, so they can neither disturb nor spoof the
+// session.
+type peerConn struct {
+	net.PacketConn
+	peer *net.UDPAddr
+	s    *Server
+	t    *activeTransfer // the transfer the conn belongs to, if any
+
+	ctx    context.Context // closes the conn once done
+	closed chan struct{}
+	done   chan struct{} // closed once the ctx watcher is
+	once   sync.Once
+}
+
+// listenerKey is the context key of the connection a transfer's request
+// was read from
+type listenerKey struct{}
+
+// dial returns a new transfer ID for exchanging packets with clientAddr,
+// created by the server's Transport or sharing the connection the request
+// was read from in single-port mode, which fails reads and writes with
+// ctx's error once it's done
+func (s *Server) dial(ctx context.Context, clientAddr string) (*peerConn, error) {
+	peer, err := net.ResolveUDPAddr("udp", clientAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		conn  net.PacketConn
+		local net.Addr
+	)
+
+	listener, _ := ctx.Value(listenerKey{}).(net.PacketConn)
+	if listener != nil {
+		local = listener.LocalAddr()
+	}
+
+	if s.SinglePort && listener != nil {
+		conn = s.share(listener, clientAddr)
+	} else {
+		conn, err = s.listen(ctx, local, peer)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &peerConn{PacketConn: conn, peer: peer, s: s, ctx: ctx, closed: make(chan struct{}), done: make(chan struct{})}
+
+	s.mu.Lock()
+	if c.t = s.active[clientAddr]; c.t != nil {
+		c.t.heard()
+	}
+	s.mu.Unlock()
+
+	go func() {
+		defer close(c.done)
+
+		select {
+		case <-ctx.Done():
+			c.tellEnded(conn)
+			_ = conn.Close()
+		case <-c.closed:
+			// the transfer may have failed on its context being done
+			// before this noticed, still owing the client its ERROR
+			if ctx.Err() != nil {
+				c.tellEnded(conn)
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// listen returns a socket of a transfer's own for exchanging packets with
+// client, created by the server's Transport or listenUDP
+func (s *Server) listen(ctx context.Context, local, client net.Addr) (net.PacketConn, error) {
+	if s.Transport != nil {
+		return s.Transport(ctx, local, client)
+	}
+
+	return listenUDP(ctx, local, client)
+}
+
+// listenUDP is the default Transport, listening on an ephemeral port of the
+// IP address the request was read from, unless that's a wildcard or a
+// multicast group, so clients of a server listening on several interfaces
+// hear from the one they asked
+func listenUDP(ctx context.Context, local, client net.Addr) (net.PacketConn, error) {
+	address := ":0"
+	if addr, ok := local.(*net.UDPAddr); ok && !addr.IP.IsUnspecified() && !addr.IP.IsMulticast() {
+		address = net.JoinHostPort(addr.IP.String(), "0")
+	}
+
+	var lc net.ListenConfig
+
+	return lc.ListenPacket(ctx, "udp", address)
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(p)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return n, c.ctx.Err()
+			}
+
+			return n, err
+		}
+
+		if c.fromPeer(from) {
+			if c.t != nil {
+				c.t.heard()
+			}
+
+			return n, nil
+		}
+
+		c.s.trace(TraceIn, c.LocalAddr(), from, p[:n])
+
+		// an ERROR isn't answered, which could start an endless exchange
+		var errPkt Err
+		if errPkt.UnmarshalBinary(p[:n]) != nil {
+			c.s.sendErrTo(c.PacketConn, from, Err{Error: ErrUnknownID, Message: "unknown transfer ID"})
+		}
+	}
+}
+
+// progressed records the blocks and payload bytes the client acknowledged
+// so far for Server.Sessions
+func (c *peerConn) progressed(blocks uint64, bytes int64) {
+	if c.t != nil {
+		c.t.progressed(blocks, bytes)
+	}
+}
+
+// fromPeer reports whether a packet from addr was sent by the client.
+// Transports other than UDP sockets may report addresses of other types.
+func (c *peerConn) fromPeer(addr net.Addr) bool {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.Equal(c.peer.IP) && u.Port == c.peer.Port
+	}
+
+	return addr.String() == c.peer.String()
+}
+
+func (c *peerConn) Write(p []byte) (int, error) {
+	n, err := c.WriteTo(p, c.peer)
+	if err != nil && c.ctx.Err() != nil {
+		return n, c.ctx.Err()
+	}
+
+	return n, err
+}
+
+// detach stops the conn being closed once its context is done, leaving it
+// to the caller to close
+func (c *peerConn) detach() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	<-c.done
+
+	return c.PacketConn.Close()
+}
+
+// tellEnded sends the client waiting for a transfer that ran out of time or
+// was ended by the server an ERROR telling why
+func (c *peerConn) tellEnded(conn net.PacketConn) {
+	switch {
+	case errors.Is(c.ctx.Err(), context.DeadlineExceeded):
+		c.s.sendErrTo(conn, c.peer, Err{Error: ErrUnknown, Message: "transfer timed out"})
+	case c.t != nil:
+		if ended := c.s.endedBy(c.t); ended != nil {
+			c.s.sendErrTo(conn, c.peer, Err{Error: ErrUnknown, Message: ended.Error()})
+		}
+	}
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
@@ -0,0 +1,25 @@
+package tftp
+
+import "net"
+
+// TraceDir is the direction of a traced datagram
+type TraceDir uint8
+
+const (
+	TraceIn  TraceDir = iota // datagram received from the remote peer
+	TraceOut                 // datagram sent to the remote peer
+)
+
+func (d TraceDir) String() string {
+	if d == TraceOut {
+		return "send"
+	}
+
+	return "recv"
+}
+
+func (s *Server) trace(dir TraceDir, local, remote net.Addr, p []byte) {
+	if s.Trace != nil {
+		s.Trace(dir, local, remote, p)
+	}
+}
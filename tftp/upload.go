@@ -0,0 +1,307 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// UploadFile is the destination of an uploaded file
+type UploadFile interface {
+	io.Writer
+
+	// Finish is called once the transfer ended, with nil if every block was
+	// received or the error that ended it, in which case the partial file
+	// should be discarded
+	Finish(err error) error
+}
+
+func (s *Server) handleWrite(parent context.Context, clientAddr string, wrq WriteReq) {
+	s.logf("[%s] uploading file: %s", clientAddr, wrq.Filename)
+	s.emit(Event{Kind: EventRequest, Client: clientAddr, Filename: wrq.Filename, Upload: true})
+
+	t := Transfer{
+		Client:   clientAddr,
+		Filename: wrq.Filename,
+		Mode:     wrq.Mode,
+		Options:  wrq.Options,
+		Upload:   true,
+		Start:    time.Now(),
+	}
+
+	ctx, cancel := s.transferContext(parent, clientAddr, t)
+	defer cancel()
+
+	// uploads are held to the same modes as downloads
+	netascii, modeErr := s.checkMode(ReadReq{Filename: wrq.Filename, Mode: wrq.Mode, Options: wrq.Options})
+
+	var (
+		errPkt *Err
+		reason error
+	)
+
+	switch {
+	case s.Upload == nil:
+		errPkt = &Err{Error: ErrAccessViolation, Message: "uploads are disabled"}
+	case modeErr != nil:
+		errPkt, reason = modeErr, ErrUnsupportedMode
+	default:
+		errPkt, reason = s.authorize(clientAddr, wrq.Filename, OpWRQ)
+	}
+
+	if errPkt != nil {
+		t.Err = rejection(reason, "rejected upload: %s", errPkt.Message)
+		if reason != ErrDropped {
+			s.reject(ctx, clientAddr, *errPkt)
+		}
+
+		s.finish(t)
+
+		return
+	}
+
+	sess, errPkt := s.negotiate(OptionRequest{RemoteAddr: clientAddr, Filename: wrq.Filename, Mode: wrq.Mode, Upload: true}, wrq.Options, -1)
+	if errPkt != nil {
+		t.Err = rejection(nil, "rejected options: %s", errPkt.Message)
+		s.reject(ctx, clientAddr, *errPkt)
+		s.finish(t)
+
+		return
+	}
+
+	t.Accepted, t.Params = sess.oack, sess.params()
+
+	if s.MaxUploadSize > 0 && sess.size > s.MaxUploadSize {
+		t.Err = rejection(ErrFileTooLarge, "rejected upload: announced size %d exceeds %d bytes", sess.size, s.MaxUploadSize)
+		s.reject(ctx, clientAddr, Err{Error: ErrDiskFull, Message: "file too large"})
+		s.finish(t)
+
+		return
+	}
+
+	f, err := s.Upload(clientAddr, wrq)
+	if err != nil {
+		t.Err = rejection(err, "rejected upload: %v", err)
+		s.reject(ctx, clientAddr, errorPacket(err, Err{Error: ErrAccessViolation, Message: err.Error()}))
+		s.finish(t)
+
+		return
+	}
+
+	if s.OnStart != nil {
+		s.OnStart(t)
+	}
+
+	if netascii {
+		w := newNetasciiWriter(f)
+		t.Blocks, t.Bytes, t.Err = s.receive(ctx, clientAddr, w, sess)
+
+		if err = w.flush(); err != nil && t.Err == nil {
+			t.Err = fmt.Errorf("storing upload: %w", err)
+		}
+	} else {
+		t.Blocks, t.Bytes, t.Err = s.receive(ctx, clientAddr, f, sess)
+	}
+
+	t.Err = s.expired(parent, clientAddr, t.Err)
+
+	if err = f.Finish(t.Err); err != nil && t.Err == nil {
+		t.Err = fmt.Errorf("storing upload: %w", err)
+	}
+
+	s.finish(t)
+}
+
+// receive acknowledges the write request and writes the DATA packets the
+// client sends to w, returning the number of blocks and payload bytes
+// received. Accepted options are acknowledged with an OACK in place of ACK 0.
+func (s *Server) receive(ctx context.Context, clientAddr string, w io.Writer, sess *session) (uint64, int64, error) {
+	conn, err := s.dial(ctx, clientAddr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dial: %w", err)
+	}
+
+	dallying := false
+	defer func() {
+		if !dallying {
+			_ = conn.Close()
+		}
+	}()
+
+	var (
+		ackPkt   Ack // block 0 acknowledges the write request
+		dataPkt  Data
+		errPkt   Err
+		buf      = make([]byte, 4+sess.blockSize)
+		received int64
+		blocks   uint64 // blocks stored, unlike ackPkt not wrapping past 65535
+		sinceAck int    // blocks stored since the last ACK, up to the window size
+	)
+
+NextPacket:
+	for {
+		ack, err := ackPkt.MarshalBinary()
+		if blocks == 0 && len(sess.oack) > 0 {
+			ack, err = sess.oack.MarshalBinary()
+		}
+
+		if err != nil {
+			return blocks, received, err
+		}
+
+	Retry:
+		for i := s.cfg.retries; i > 0; i-- {
+			attempt := int(s.cfg.retries-i) + 1
+			if attempt > 1 {
+				s.emit(Event{Kind: EventRetransmit, Client: clientAddr, Upload: true, Block: uint16(ackPkt)})
+			}
+
+			// within a window only its last block is acknowledged (RFC 7440),
+			// the ACK of the last one stored repeated once the wait times out
+			inWindow := attempt == 1 && sinceAck > 0 && sinceAck < sess.windowSize
+			if !inWindow {
+				if _, err = conn.Write(ack); err != nil {
+					return blocks, received, fmt.Errorf("write: %w", err)
+				}
+
+				s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), ack)
+				sinceAck = 0
+			}
+
+			// Wait for the next DATA packet
+			sentAt := time.Now()
+			_ = conn.SetReadDeadline(sentAt.Add(sess.wait(attempt)))
+
+			n, err := s.readData(conn, buf, ack, ackPkt, sess.windowSize > 1)
+			if err != nil {
+				if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+					continue Retry
+				}
+
+				return blocks, received, fmt.Errorf("waiting for DATA: %w", err)
+			}
+
+			switch {
+			case dataPkt.UnmarshalBinary(buf[:n]) == nil:
+				if attempt == 1 && !inWindow {
+					sess.measured(time.Since(sentAt))
+				}
+
+				if s.MaxUploadSize > 0 && received+int64(n-4) > s.MaxUploadSize {
+					s.sendErr(conn, Err{Error: ErrDiskFull, Message: "file too large"})
+					return blocks, received, fmt.Errorf("upload exceeds %d bytes: %w", s.MaxUploadSize, ErrFileTooLarge)
+				}
+
+				m, err := io.Copy(w, dataPkt.Payload)
+				received += m
+
+				if err != nil {
+					s.sendErr(conn, errorPacket(err, Err{Error: ErrDiskFull, Message: "could not store the file"}))
+					return blocks, received, fmt.Errorf("storing block %d: %w", dataPkt.Block, err)
+				}
+
+				ackPkt, blocks, sinceAck = Ack(dataPkt.Block), blocks+1, sinceAck+1
+				conn.progressed(blocks, received)
+
+				// the final block is shorter than the block size
+				if n < len(buf) {
+					ack, err = ackPkt.MarshalBinary()
+					if err == nil {
+						_, err = conn.Write(ack)
+						s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), ack)
+					}
+
+					if err == nil {
+						// the dally outlives the transfer's context, which is
+						// canceled as soon as handleWrite returns
+						dallying = true
+						conn.detach()
+						go s.dally(conn, buf[:n], ack, sess.timeout)
+					}
+
+					return blocks, received, err
+				}
+
+				continue NextPacket
+			case errPkt.UnmarshalBinary(buf[:n]) == nil:
+				return blocks, received, &peerError{errPkt}
+			default:
+				illegal := unexpectedPacket(buf[:n])
+				s.sendErr(conn, illegal)
+
+				return blocks, received, errors.New(illegal.Message)
+			}
+		}
+
+		return blocks, received, ErrRetriesExhausted
+	}
+}
+
+// readData reads the next packet of an upload into buf, skipping DATA
+// packets of other blocks than the one after last. Those are retransmitted
+// by a client that didn't get the ACK of last, which is repeated without
+// counting as a retry since the client is still there. In a windowed upload
+// they're dropped instead, as they're also the rest of a window after a lost
+// block, which the ACK repeated once the wait times out has the client send
+// again.
+func (s *Server) readData(conn net.Conn, buf, ack []byte, last Ack, windowed bool) (int, error) {
+	var dataPkt Data
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		s.trace(TraceIn, conn.LocalAddr(), conn.RemoteAddr(), buf[:n])
+
+		if dataPkt.UnmarshalBinary(buf[:n]) != nil || dataPkt.Block == uint16(last)+1 {
+			return n, nil
+		}
+
+		if windowed {
+			continue
+		}
+
+		if _, err = conn.Write(ack); err != nil {
+			return 0, err
+		}
+
+		s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), ack)
+	}
+}
+
+// dally lingers for a timeout after the final ACK of an upload, repeating it
+// whenever the client retransmits the final DATA packet because the ACK was
+// lost (RFC 1350 section 6), then closes conn
+func (s *Server) dally(conn net.Conn, final, ack []byte, timeout time.Duration) {
+	defer func() { _ = conn.Close() }()
+
+	final = append([]byte(nil), final...)
+	buf := make([]byte, len(final)+1)
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		s.trace(TraceIn, conn.LocalAddr(), conn.RemoteAddr(), buf[:n])
+
+		if !bytes.Equal(buf[:n], final) {
+			continue
+		}
+
+		if _, err = conn.Write(ack); err != nil {
+			return
+		}
+
+		s.trace(TraceOut, conn.LocalAddr(), conn.RemoteAddr(), ack)
+	}
+}
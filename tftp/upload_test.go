@@ -0,0 +1,410 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func wrq(fields ...string) []byte {
+	return append([]byte{0, byte(OpWRQ)}, strings.Join(fields, "\x00")+"\x00"...)
+}
+
+func data(block uint16, p []byte) []byte {
+	return append([]byte{0, byte(OpData), byte(block >> 8), byte(block)}, p...)
+}
+
+// memUpload is an UploadFile kept in memory
+type memUpload struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	finished chan error
+}
+
+func newMemUpload() *memUpload {
+	return &memUpload{finished: make(chan error, 1)}
+}
+
+func (u *memUpload) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.buf.Write(p)
+}
+
+func (u *memUpload) Finish(err error) error {
+	u.finished <- err
+	return nil
+}
+
+func (u *memUpload) bytes() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]byte(nil), u.buf.Bytes()...)
+}
+
+func (u *memUpload) wait(t *testing.T) error {
+	t.Helper()
+
+	select {
+	case err := <-u.finished:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload didn't finish")
+		return nil
+	}
+}
+
+// expectAck fails the test unless the next packet received is an ACK of block
+func (c *testClient) expectAck(block uint16) {
+	c.t.Helper()
+
+	if got, want := c.receive(), []byte{0, byte(OpAck), byte(block >> 8), byte(block)}; !bytes.Equal(got, want) {
+		c.t.Fatalf("got %q, want ACK %d", got, block)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		mode    string
+		blksize int // negotiated, 0 for none
+	}{
+		{name: "empty", size: 0, mode: "octet"},
+		{name: "short", size: 100, mode: "octet"},
+		{name: "one block", size: BlockSize, mode: "octet"},
+		{name: "several blocks", size: 3*BlockSize + 7, mode: "octet"},
+		{name: "negotiated", size: 3000, mode: "octet", blksize: 1024},
+		{name: "upper case mode", size: 10, mode: "OCTET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMemUpload()
+			addr := testServer(t, &Server{
+				Payload: []byte{},
+				Upload:  func(string, WriteReq) (UploadFile, error) { return f, nil },
+			})
+
+			payload := make([]byte, tt.size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+
+			blockSize := BlockSize
+
+			c := newTestClient(t)
+			if tt.blksize == 0 {
+				c.request(addr, wrq("f", tt.mode))
+				c.expectAck(0)
+			} else {
+				blockSize = tt.blksize
+				c.request(addr, wrq("f", tt.mode, "blksize", strconv.Itoa(tt.blksize)))
+
+				if got, want := c.receive(), []byte("\x00\x06blksize\x00"+strconv.Itoa(tt.blksize)+"\x00"); !bytes.Equal(got, want) {
+					t.Fatalf("got %q, want OACK %q", got, want)
+				}
+			}
+
+			for block, rest := uint16(1), payload; ; block++ {
+				n := len(rest)
+				if n > blockSize {
+					n = blockSize
+				}
+
+				c.send(data(block, rest[:n]))
+				c.expectAck(block)
+
+				if rest = rest[n:]; n < blockSize {
+					break
+				}
+			}
+
+			if err := f.wait(t); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+
+			if got := f.bytes(); !bytes.Equal(got, payload) {
+				t.Errorf("stored %d bytes, want %d", len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+		req    []byte
+		code   ErrCode
+	}{
+		{
+			name:   "disabled",
+			server: &Server{Payload: []byte{}},
+			req:    wrq("f", "octet"),
+			code:   ErrAccessViolation,
+		},
+		{
+			name:   "unsupported mode",
+			server: &Server{Payload: []byte{}, Upload: func(string, WriteReq) (UploadFile, error) { return newMemUpload(), nil }},
+			req:    wrq("f", "mail"),
+			code:   ErrUnknown,
+		},
+		{
+			name:   "mode refused by the policy",
+			server: &Server{Payload: []byte{}, ModePolicy: OctetOnly, Upload: func(string, WriteReq) (UploadFile, error) { return newMemUpload(), nil }},
+			req:    wrq("f", "netascii"),
+			code:   ErrUnknown,
+		},
+		{
+			name:   "refused by the hook",
+			server: &Server{Payload: []byte{}, Upload: func(string, WriteReq) (UploadFile, error) { return nil, errors.New("no") }},
+			req:    wrq("f", "octet"),
+			code:   ErrAccessViolation,
+		},
+		{
+			name:   "announced size too large",
+			server: &Server{Payload: []byte{}, MaxUploadSize: 100, Upload: func(string, WriteReq) (UploadFile, error) { return newMemUpload(), nil }},
+			req:    wrq("f", "octet", "tsize", "101"),
+			code:   ErrDiskFull,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := testServer(t, tt.server)
+
+			c := newTestClient(t)
+			c.request(addr, tt.req)
+
+			if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(tt.code)}) {
+				t.Fatalf("got %q, want ERROR %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestUploadDuplicateData(t *testing.T) {
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload: []byte{},
+		Retries: 2,
+		Upload:  func(string, WriteReq) (UploadFile, error) { return f, nil },
+	})
+
+	first, second := bytes.Repeat([]byte{1}, BlockSize), []byte("end")
+
+	c := newTestClient(t)
+	c.request(addr, wrq("f", "octet"))
+	c.expectAck(0)
+
+	c.send(data(1, first))
+	c.expectAck(1)
+
+	// more duplicates than retries, as from a client whose ACKs are lost
+	for i := 0; i < 5; i++ {
+		c.send(data(1, first))
+		c.expectAck(1)
+	}
+
+	c.send(data(2, second))
+	c.expectAck(2)
+
+	if err := f.wait(t); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if got, want := f.bytes(), append(first, second...); !bytes.Equal(got, want) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestUploadWindowed(t *testing.T) {
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload: []byte{},
+		Timeout: 200 * time.Millisecond,
+		Upload:  func(string, WriteReq) (UploadFile, error) { return f, nil },
+	})
+
+	var want []byte
+	block := func(n uint16) []byte {
+		p := bytes.Repeat([]byte{byte(n)}, BlockSize)
+		if n == 9 {
+			p = []byte("end")
+		}
+
+		return p
+	}
+
+	for n := uint16(1); n <= 9; n++ {
+		want = append(want, block(n)...)
+	}
+
+	c := newTestClient(t)
+	c.request(addr, wrq("f", "octet", "windowsize", "4"))
+
+	if got, want := c.receive(), []byte("\x00\x06windowsize\x004\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want OACK %q", got, want)
+	}
+
+	// only the last block of a window is acknowledged
+	for n := uint16(1); n <= 4; n++ {
+		c.send(data(n, block(n)))
+	}
+
+	c.expectAck(4)
+
+	// block 5 is lost, the rest of the window is dropped and block 4
+	// acknowledged again once the server gives up waiting
+	for n := uint16(6); n <= 8; n++ {
+		c.send(data(n, block(n)))
+	}
+
+	c.expectAck(4)
+
+	for n := uint16(5); n <= 8; n++ {
+		c.send(data(n, block(n)))
+	}
+
+	c.expectAck(8)
+
+	// the final block ends the window early
+	c.send(data(9, block(9)))
+	c.expectAck(9)
+
+	if err := f.wait(t); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if got := f.bytes(); !bytes.Equal(got, want) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(want))
+	}
+
+	// the client's windowed uploads
+	put := newMemUpload()
+	addr = testServer(t, &Server{
+		Payload: []byte{},
+		Upload:  func(string, WriteReq) (UploadFile, error) { return put, nil },
+	})
+
+	var tr Transfer
+	client := Client{WindowSize: 8, OnFinish: func(done Transfer) { tr = done }}
+
+	if _, err := client.Put(addr.String(), "f", bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := put.wait(t); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if got := put.bytes(); !bytes.Equal(got, want) || tr.Params.WindowSize != 8 {
+		t.Errorf("stored %d bytes with windowsize %d, want %d with 8", len(got), tr.Params.WindowSize, len(want))
+	}
+}
+
+func TestUploadMaxSize(t *testing.T) {
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload:       []byte{},
+		MaxUploadSize: BlockSize + 10,
+		Upload:        func(string, WriteReq) (UploadFile, error) { return f, nil },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, wrq("f", "octet"))
+	c.expectAck(0)
+
+	c.send(data(1, make([]byte, BlockSize)))
+	c.expectAck(1)
+
+	c.send(data(2, make([]byte, BlockSize)))
+
+	if got := c.receive(); !bytes.HasPrefix(got, []byte{0, byte(OpErr), 0, byte(ErrDiskFull)}) {
+		t.Fatalf("got %q, want a disk full ERROR", got)
+	}
+
+	if err := f.wait(t); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("upload failed with %v, want ErrFileTooLarge", err)
+	}
+
+	if got := len(f.bytes()); got != BlockSize {
+		t.Errorf("stored %d bytes, want only the %d of the first block", got, BlockSize)
+	}
+}
+
+func TestUploadBlockWrap(t *testing.T) {
+	finished := make(chan Transfer, 1)
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload:  []byte{},
+		Upload:   func(string, WriteReq) (UploadFile, error) { return f, nil },
+		OnFinish: func(tr Transfer) { finished <- tr },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, wrq("f", "octet", "blksize", "8"))
+	c.receive() // OACK
+
+	const blocks = 1<<16 + 2
+
+	p := make([]byte, 8)
+	for i := 1; i <= blocks; i++ {
+		block := uint16(i)
+		if i == blocks {
+			p = p[:1]
+		}
+
+		c.send(data(block, p))
+		c.expectAck(block)
+	}
+
+	tr := <-finished
+	if tr.Err != nil || tr.Blocks != blocks {
+		t.Errorf("transfer of %d blocks failed with %v, want %d blocks", tr.Blocks, tr.Err, blocks)
+	}
+}
+
+func TestUploadDally(t *testing.T) {
+	f := newMemUpload()
+	addr := testServer(t, &Server{
+		Payload: []byte{},
+		Timeout: 300 * time.Millisecond,
+		Upload:  func(string, WriteReq) (UploadFile, error) { return f, nil },
+	})
+
+	c := newTestClient(t)
+	c.request(addr, wrq("f", "octet"))
+	c.expectAck(0)
+
+	final := data(1, []byte("final"))
+	c.send(final)
+	c.expectAck(1)
+
+	if err := f.wait(t); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	// the final ACK was lost, so the client retransmits the final DATA,
+	// repeatedly if need be
+	for i := 0; i < 2; i++ {
+		c.send(final)
+		c.expectAck(1)
+	}
+
+	// once the dally is over, nothing is answered
+	time.Sleep(400 * time.Millisecond)
+	c.send(final)
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := c.conn.ReadFrom(make([]byte, DatagramSize)); err == nil {
+		t.Errorf("answered with %d bytes after the dally", n)
+	}
+}
@@ -0,0 +1,602 @@
+// Package wire encodes and decodes TFTP packets: the requests of RFC 1350
+// with the options of RFC 2347, DATA, ACK, ERROR and OACK. It's the codec
+// of the tftp package's server and client, and has no dependency on them,
+// so sniffers, fuzzers and other clients can use it on its own.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	DatagramSize = 516 // Maximum supported datagram size
+	BlockSize    = DatagramSize - 4
+
+	MinBlockSize = 8     // smallest block size a client may negotiate (RFC 2348)
+	MaxBlockSize = 65464 // largest block size a client may negotiate (RFC 2348)
+)
+
+type OpCode uint16
+
+// opcode  operation
+// 1     Read request (RRQ)
+// 2     Write request (WRQ)
+// 3     Data (DATA)
+// 4     Acknowledgment (ACK)
+// 5     Error (ERROR)
+// 6     Option acknowledgment (OACK)
+const (
+	OpRRQ OpCode = iota + 1
+	OpWRQ
+	OpData
+	OpAck
+	OpErr
+	OpOACK
+)
+
+func (c OpCode) String() string {
+	switch c {
+	case OpRRQ:
+		return "RRQ"
+	case OpWRQ:
+		return "WRQ"
+	case OpData:
+		return "DATA"
+	case OpAck:
+		return "ACK"
+	case OpErr:
+		return "ERROR"
+	case OpOACK:
+		return "OACK"
+	default:
+		return fmt.Sprintf("opcode %d", uint16(c))
+	}
+}
+
+//const OpData uint16 = 3
+
+type ErrCode uint16
+
+const (
+	ErrUnknown ErrCode = iota
+	ErrNotFound
+	ErrAccessViolation
+	ErrDiskFull
+	ErrIllegalOp
+	ErrUnknownID
+	ErrFileExists
+	ErrNoUser
+	ErrOptions // a party refused the negotiated options (RFC 2347)
+)
+
+func (c ErrCode) String() string {
+	switch c {
+	case ErrUnknown:
+		return "not defined"
+	case ErrNotFound:
+		return "file not found"
+	case ErrAccessViolation:
+		return "access violation"
+	case ErrDiskFull:
+		return "disk full"
+	case ErrIllegalOp:
+		return "illegal operation"
+	case ErrUnknownID:
+		return "unknown transfer ID"
+	case ErrFileExists:
+		return "file already exists"
+	case ErrNoUser:
+		return "no such user"
+	case ErrOptions:
+		return "option negotiation failed"
+	default:
+		return fmt.Sprintf("error code %d", uint16(c))
+	}
+}
+
+// Packet is a TFTP packet, which a pointer to any of the packet types is
+type Packet interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(p []byte) error
+	String() string
+}
+
+// Errors decoding packets fail with, wrapped in a PacketError
+var (
+	ErrShortDatagram = errors.New("datagram too short")
+	ErrUnknownOpcode = errors.New("unknown opcode")
+	ErrInvalidPacket = errors.New("malformed packet")
+)
+
+// PacketError is the error of a datagram that isn't a valid TFTP packet
+type PacketError struct {
+	Op  OpCode // the opcode of the packet, 0 if it's too short to have one
+	Err error  // ErrShortDatagram, ErrUnknownOpcode or ErrInvalidPacket
+}
+
+func (e *PacketError) Error() string {
+	switch {
+	case e.Op == 0:
+		return e.Err.Error()
+	case e.Err == ErrUnknownOpcode:
+		return fmt.Sprintf("unknown opcode %d", uint16(e.Op))
+	default:
+		return fmt.Sprintf("%v (%s)", e.Err, e.Op)
+	}
+}
+
+func (e *PacketError) Unwrap() error { return e.Err }
+
+func invalidPacket(op OpCode) error {
+	return &PacketError{Op: op, Err: ErrInvalidPacket}
+}
+
+// ParsePacket decodes a datagram into a *ReadReq, *WriteReq, *Data, *Ack, *Err
+// or *OAck depending on its opcode
+func ParsePacket(p []byte) (Packet, error) {
+	if len(p) < 2 {
+		return nil, &PacketError{Err: ErrShortDatagram}
+	}
+
+	var pkt Packet
+
+	switch code := OpCode(binary.BigEndian.Uint16(p)); code {
+	case OpRRQ:
+		pkt = new(ReadReq)
+	case OpWRQ:
+		pkt = new(WriteReq)
+	case OpData:
+		pkt = new(Data)
+	case OpAck:
+		pkt = new(Ack)
+	case OpErr:
+		pkt = new(Err)
+	case OpOACK:
+		pkt = new(OAck)
+	default:
+		return nil, &PacketError{Op: code, Err: ErrUnknownOpcode}
+	}
+
+	if err := pkt.UnmarshalBinary(p); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
+
+// ReadReq acts as the initial read request packet (RRQ) informing the server which file it would like to read
+// 2 bytes     string    1 byte     string   1 byte
+// ------------------------------------------------
+// | Opcode |  Filename  |   0  |    Mode    |   0  |
+// ------------------------------------------------
+type ReadReq struct {
+	Filename string
+	Mode     string
+	Options  []Option // RFC 2347 options following the mode, in the order sent
+}
+
+// Option is a name and value pair appended to a request (RFC 2347)
+// 2 bytes     string    1 byte     string   1 byte   string   1 byte   string   1 byte
+// ------------------------------------------------------------------------------------
+// | Opcode |  Filename  |   0  |    Mode    |   0  |  opt1  |   0  |  value1  |   0  | ...
+// ------------------------------------------------------------------------------------
+type Option struct {
+	Name  string
+	Value string
+}
+
+func (q *ReadReq) MarshalBinary() ([]byte, error) {
+	return marshalRequest(OpRRQ, q.Filename, q.Mode, q.Options)
+}
+
+func (q *ReadReq) UnmarshalBinary(p []byte) (err error) {
+	q.Filename, q.Mode, q.Options, err = unmarshalRequest(OpRRQ, p)
+	return err
+}
+
+// WriteReq acts as the initial write request packet (WRQ) informing the server which file it would like to write,
+// it shares the layout of the read request
+// 2 bytes     string    1 byte     string   1 byte
+// ------------------------------------------------
+// | Opcode |  Filename  |   0  |    Mode    |   0  |
+// ------------------------------------------------
+type WriteReq struct {
+	Filename string
+	Mode     string
+	Options  []Option
+}
+
+func (q *WriteReq) MarshalBinary() ([]byte, error) {
+	return marshalRequest(OpWRQ, q.Filename, q.Mode, q.Options)
+}
+
+func (q *WriteReq) UnmarshalBinary(p []byte) (err error) {
+	q.Filename, q.Mode, q.Options, err = unmarshalRequest(OpWRQ, p)
+	return err
+}
+
+func (q *WriteReq) String() string {
+	return fmt.Sprintf("WRQ filename=%q mode=%s", q.Filename, q.Mode) + optionsString(q.Options)
+}
+
+// marshalRequest encodes a RRQ or WRQ packet, defaulting to octet mode
+func marshalRequest(op OpCode, filename, mode string, options []Option) ([]byte, error) {
+	if mode == "" {
+		mode = "octet"
+	}
+
+	// capacity: operation code + filename + 0 byte + mode + 0 byte
+	// https://datatracker.ietf.org/doc/html/rfc1350#section-5
+	capacity := 2 + len(filename) + 1 + len(mode) + 1
+
+	b := new(bytes.Buffer)
+	b.Grow(capacity)
+
+	// Write Opcode
+	if err := binary.Write(b, binary.BigEndian, op); err != nil {
+		return nil, err
+	}
+
+	// Write Filename
+	if _, err := b.WriteString(filename); err != nil {
+		return nil, err
+	}
+
+	// Write null byte
+	if err := b.WriteByte(0); err != nil {
+		return nil, err
+	}
+
+	// Write Mode
+	if _, err := b.WriteString(mode); err != nil {
+		return nil, err
+	}
+
+	// Write another null byte
+	if err := b.WriteByte(0); err != nil {
+		return nil, err
+	}
+
+	// Write each option name and value, both null terminated
+	for _, o := range options {
+		b.WriteString(o.Name)
+		b.WriteByte(0)
+		b.WriteString(o.Value)
+		b.WriteByte(0)
+	}
+
+	return b.Bytes(), nil
+}
+
+// unmarshalRequest decodes the filename, mode and options of a RRQ or WRQ packet
+func unmarshalRequest(op OpCode, p []byte) (filename, mode string, options []Option, err error) {
+	r := bytes.NewBuffer(p)
+	invalid := invalidPacket(op)
+
+	var code OpCode
+
+	// Read the OpCode
+	if err = binary.Read(r, binary.BigEndian, &code); err != nil {
+		return "", "", nil, &PacketError{Op: op, Err: ErrShortDatagram}
+	}
+
+	if code != op {
+		return "", "", nil, invalid
+	}
+
+	// Read the filename including the packet null byte delimiter
+	if filename, err = r.ReadString(0); err != nil {
+		return "", "", nil, invalid
+	}
+
+	// Remove the null byte from the end of the filename
+	if filename = strings.TrimRight(filename, "\x00"); len(filename) == 0 {
+		return "", "", nil, invalid
+	}
+
+	// Get the mode including null byte delimiter again
+	if mode, err = r.ReadString(0); err != nil {
+		return "", "", nil, invalid
+	}
+
+	// Remove null byte delimiter again
+	if mode = strings.TrimRight(mode, "\x00"); len(mode) == 0 {
+		return "", "", nil, invalid
+	}
+
+	// Read option name and value pairs, ignoring a trailing incomplete pair
+	for r.Len() > 0 {
+		name, err := r.ReadString(0)
+		if name = strings.TrimRight(name, "\x00"); err != nil || name == "" {
+			break
+		}
+
+		value, err := r.ReadString(0)
+		if err != nil {
+			break
+		}
+
+		options = append(options, Option{Name: name, Value: strings.TrimRight(value, "\x00")})
+	}
+
+	return filename, mode, options, nil
+}
+
+func (q *ReadReq) String() string {
+	return fmt.Sprintf("RRQ filename=%q mode=%s", q.Filename, q.Mode) + optionsString(q.Options)
+}
+
+func optionsString(options []Option) string {
+	var b strings.Builder
+	for _, o := range options {
+		fmt.Fprintf(&b, " %s=%s", o.Name, o.Value)
+	}
+
+	return b.String()
+}
+
+// Data acts as the data packet that will transfer the files payload
+// 2 bytes     2 bytes      n bytes
+// ----------------------------------
+// | Opcode |   Block #  |   Data     |
+// ----------------------------------
+//
+// MarshalBinary encodes the block after Block, advancing it, with the next
+// Size bytes read from Payload, so the same Data encodes a whole stream.
+type Data struct {
+	// Block enables UDP reliability by incrementing on each packet sent,
+	// the client discriminate between new packets and duplicates, sending an ack including the block number to
+	// confirm delivery
+	Block   uint16
+	Payload io.Reader
+	Size    int // payload bytes per block, BlockSize if zero
+}
+
+func (d *Data) MarshalBinary() ([]byte, error) {
+	size := d.Size
+	if size == 0 {
+		size = BlockSize
+	}
+
+	b := new(bytes.Buffer)
+	b.Grow(4 + size)
+
+	d.Block++
+
+	if err := binary.Write(b, binary.BigEndian, uint16(OpData)); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(b, binary.BigEndian, d.Block); err != nil { // write block number to packet
+		return nil, err
+	}
+
+	// Every packet will be the full block size (512 bytes unless negotiated) expect for the last one,
+	// which is how the client knows it's reached the end of the stream
+	_, err := io.CopyN(b, d.Payload, int64(size))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (d *Data) UnmarshalBinary(p []byte) error {
+	// Sanity check the payload data
+	if l := len(p); l < 4 || l > 4+MaxBlockSize {
+		return invalidPacket(OpData)
+	}
+
+	var opcode OpCode
+	// Read opcode from packet
+	err := binary.Read(bytes.NewReader(p[:2]), binary.BigEndian, &opcode)
+	if err != nil || opcode != OpData {
+		return invalidPacket(OpData)
+	}
+
+	// Read block number
+	err = binary.Read(bytes.NewReader(p[2:4]), binary.BigEndian, &d.Block)
+	if err != nil {
+		return invalidPacket(OpData)
+	}
+
+	// Read byte slice to get the end to get data
+	d.Payload = bytes.NewBuffer(p[4:])
+
+	return nil
+}
+
+func (d *Data) String() string {
+	if l, ok := d.Payload.(interface{ Len() int }); ok {
+		return fmt.Sprintf("DATA block=%d size=%d", d.Block, l.Len())
+	}
+
+	return fmt.Sprintf("DATA block=%d", d.Block)
+}
+
+// Ack responds to the server with a block number to inform the server
+// which packet it just received
+// 2 bytes     2 bytes
+// ---------------------
+// | Opcode |   Block #  |
+// ---------------------
+type Ack uint16
+
+func (a *Ack) MarshalBinary() ([]byte, error) {
+	capacity := 2 + 2 // operation code + block number
+
+	b := new(bytes.Buffer)
+	b.Grow(capacity)
+
+	err := binary.Write(b, binary.BigEndian, OpAck) // Write ack op code to buffer
+	if err != nil {
+		return nil, err
+	}
+
+	err = binary.Write(b, binary.BigEndian, a) // Now write block number
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (a *Ack) UnmarshalBinary(p []byte) error {
+	var code OpCode
+
+	r := bytes.NewReader(p)
+
+	if err := binary.Read(r, binary.BigEndian, &code); err != nil {
+		return &PacketError{Op: OpAck, Err: ErrShortDatagram}
+	}
+
+	if code != OpAck {
+		return invalidPacket(OpAck)
+	}
+
+	if err := binary.Read(r, binary.BigEndian, a); err != nil {
+		return &PacketError{Op: OpAck, Err: ErrShortDatagram}
+	}
+
+	return nil
+}
+
+func (a *Ack) String() string {
+	return fmt.Sprintf("ACK block=%d", uint16(*a))
+}
+
+// Err packet
+// 2 bytes     2 bytes       string    1 byte
+// -----------------------------------------
+// | Opcode |  ErrorCode |   ErrMsg   |   0  |
+// -----------------------------------------
+type Err struct {
+	Error   ErrCode
+	Message string
+}
+
+func (e Err) MarshalBinary() ([]byte, error) {
+	capacity := 2 + 2 + len(e.Message) + 1
+
+	b := new(bytes.Buffer)
+	b.Grow(capacity)
+
+	err := binary.Write(b, binary.BigEndian, OpErr) // Write OpErr op code to buffer
+	if err != nil {
+		return nil, err
+	}
+
+	// Now write error code
+	if err = binary.Write(b, binary.BigEndian, e.Error); err != nil {
+		return nil, err
+	}
+
+	_, err = b.WriteString(e.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.WriteByte(0); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func (e *Err) UnmarshalBinary(p []byte) error {
+	r := bytes.NewBuffer(p)
+
+	var code OpCode
+
+	if err := binary.Read(r, binary.BigEndian, &code); err != nil { // read op code
+		return &PacketError{Op: OpErr, Err: ErrShortDatagram}
+	}
+
+	if code != OpErr {
+		return invalidPacket(OpErr)
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &e.Error); err != nil {
+		return &PacketError{Op: OpErr, Err: ErrShortDatagram}
+	}
+
+	var err error
+	e.Message, err = r.ReadString(0)
+	e.Message = strings.TrimRight(e.Message, "\x00") // remove the 0-byte
+
+	if err != nil {
+		return invalidPacket(OpErr)
+	}
+
+	return nil
+}
+
+func (e *Err) String() string {
+	return fmt.Sprintf("ERROR code=%d (%s) message=%q", uint16(e.Error), e.Error, e.Message)
+}
+
+// OAck acknowledges the options of a request the server accepted, each with
+// the value it settled on (RFC 2347). Options missing from it were ignored.
+// 2 bytes    string   1 byte   string   1 byte
+// ----------------------------------------------
+// | Opcode |  opt1  |   0  |  value1  |   0  | ...
+// ----------------------------------------------
+type OAck []Option
+
+func (o OAck) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+
+	if err := binary.Write(b, binary.BigEndian, OpOACK); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range o {
+		b.WriteString(opt.Name)
+		b.WriteByte(0)
+		b.WriteString(opt.Value)
+		b.WriteByte(0)
+	}
+
+	return b.Bytes(), nil
+}
+
+func (o *OAck) UnmarshalBinary(p []byte) error {
+	r := bytes.NewBuffer(p)
+
+	var code OpCode
+
+	if err := binary.Read(r, binary.BigEndian, &code); err != nil {
+		return &PacketError{Op: OpOACK, Err: ErrShortDatagram}
+	}
+
+	if code != OpOACK {
+		return invalidPacket(OpOACK)
+	}
+
+	*o = (*o)[:0]
+
+	for r.Len() > 0 {
+		name, err := r.ReadString(0)
+		if err != nil {
+			return invalidPacket(OpOACK)
+		}
+
+		value, err := r.ReadString(0)
+		if err != nil {
+			return invalidPacket(OpOACK)
+		}
+
+		*o = append(*o, Option{Name: strings.TrimRight(name, "\x00"), Value: strings.TrimRight(value, "\x00")})
+	}
+
+	return nil
+}
+
+func (o *OAck) String() string {
+	return "OACK" + optionsString(*o)
+}
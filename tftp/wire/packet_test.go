@@ -0,0 +1,218 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func ack(n uint16) *Ack {
+	a := Ack(n)
+	return &a
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  Packet
+	}{
+		{"RRQ", &ReadReq{Filename: "pxelinux.0", Mode: "octet"}},
+		{"RRQ netascii", &ReadReq{Filename: "boot/grub.cfg", Mode: "netascii"}},
+		{"RRQ options", &ReadReq{Filename: "undionly.kpxe", Mode: "octet", Options: []Option{{"blksize", "1428"}, {"tsize", "0"}, {"windowsize", "8"}}}},
+		{"RRQ empty option value", &ReadReq{Filename: "f", Mode: "octet", Options: []Option{{"x-vendor", ""}}}},
+		{"WRQ", &WriteReq{Filename: "backup/sw1.cfg", Mode: "octet"}},
+		{"WRQ options", &WriteReq{Filename: "sw1.cfg", Mode: "octet", Options: []Option{{"tsize", "2048"}, {"timeout", "3"}}}},
+		{"ACK 0", ack(0)},
+		{"ACK", ack(513)},
+		{"ACK max", ack(65535)},
+		{"ERROR", &Err{Error: ErrNotFound, Message: "file not found"}},
+		{"ERROR empty message", &Err{Error: ErrUnknown}},
+		{"ERROR options", &Err{Error: ErrOptions, Message: "blksize refused"}},
+		{"OACK", &OAck{{"blksize", "1428"}, {"tsize", "1048576"}}},
+		{"OACK empty", new(OAck)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.pkt.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+
+			got, err := ParsePacket(b)
+			if err != nil {
+				t.Fatalf("ParsePacket(%q): %v", b, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.pkt) {
+				t.Errorf("ParsePacket(%q) = %v, want %v", b, got, tt.pkt)
+			}
+
+			again, err := got.MarshalBinary()
+			if err != nil || !bytes.Equal(again, b) {
+				t.Errorf("MarshalBinary of the parsed packet = %q, %v, want %q", again, err, b)
+			}
+		})
+	}
+}
+
+func TestRequestDefaultsToOctet(t *testing.T) {
+	b, err := (&ReadReq{Filename: "f"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte("\x00\x01f\x00octet\x00"); !bytes.Equal(b, want) {
+		t.Errorf("MarshalBinary = %q, want %q", b, want)
+	}
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload int // bytes available to the packet
+		size    int // block size, BlockSize if zero
+		want    int // payload bytes sent
+	}{
+		{"empty", 0, 0, 0},
+		{"short", 100, 0, 100},
+		{"full", BlockSize, 0, BlockSize},
+		{"oversized", BlockSize + 1, 0, BlockSize},
+		{"negotiated full", 1428, 1428, 1428},
+		{"negotiated oversized", 3000, 1428, 1428},
+		{"largest", MaxBlockSize, MaxBlockSize, MaxBlockSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{0xa5}, tt.payload)
+			d := &Data{Block: 41, Payload: bytes.NewReader(payload), Size: tt.size}
+
+			b, err := d.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+
+			if len(b) != 4+tt.want {
+				t.Fatalf("MarshalBinary returned %d bytes, want %d", len(b), 4+tt.want)
+			}
+
+			got, err := ParsePacket(b)
+			if err != nil {
+				t.Fatalf("ParsePacket: %v", err)
+			}
+
+			data, ok := got.(*Data)
+			if !ok {
+				t.Fatalf("ParsePacket = %T, want *Data", got)
+			}
+
+			if data.Block != 42 {
+				t.Errorf("block %d, want 42", data.Block)
+			}
+
+			if p, _ := io.ReadAll(data.Payload); !bytes.Equal(p, payload[:tt.want]) {
+				t.Errorf("payload of %d bytes, want %d", len(p), tt.want)
+			}
+		})
+	}
+}
+
+func TestDataBlockWraps(t *testing.T) {
+	d := &Data{Block: 65535, Payload: bytes.NewReader(nil)}
+
+	b, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Block != 0 || !bytes.Equal(b, []byte{0, 3, 0, 0}) {
+		t.Errorf("block %d, packet %v, want block 0", d.Block, b)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		op   OpCode
+		err  error
+	}{
+		{"empty", nil, 0, ErrShortDatagram},
+		{"one byte", []byte{0}, 0, ErrShortDatagram},
+		{"unknown opcode", []byte{0, 7, 0, 1}, 7, ErrUnknownOpcode},
+		{"opcode 0", []byte{0, 0}, 0, ErrUnknownOpcode},
+		{"RRQ without filename", []byte("\x00\x01"), OpRRQ, ErrInvalidPacket},
+		{"RRQ filename without NUL", []byte("\x00\x01file"), OpRRQ, ErrInvalidPacket},
+		{"RRQ empty filename", []byte("\x00\x01\x00octet\x00"), OpRRQ, ErrInvalidPacket},
+		{"RRQ without mode", []byte("\x00\x01file\x00"), OpRRQ, ErrInvalidPacket},
+		{"RRQ mode without NUL", []byte("\x00\x01file\x00octet"), OpRRQ, ErrInvalidPacket},
+		{"RRQ empty mode", []byte("\x00\x01file\x00\x00"), OpRRQ, ErrInvalidPacket},
+		{"WRQ mode without NUL", []byte("\x00\x02file\x00octet"), OpWRQ, ErrInvalidPacket},
+		{"DATA truncated", []byte{0, 3, 0}, OpData, ErrInvalidPacket},
+		{"DATA oversized", append([]byte{0, 3, 0, 1}, make([]byte, MaxBlockSize+1)...), OpData, ErrInvalidPacket},
+		{"ACK truncated", []byte{0, 4, 0}, OpAck, ErrShortDatagram},
+		{"ERROR truncated", []byte{0, 5, 0}, OpErr, ErrShortDatagram},
+		{"ERROR message without NUL", []byte("\x00\x05\x00\x01gone"), OpErr, ErrInvalidPacket},
+		{"OACK name without NUL", []byte("\x00\x06blksize"), OpOACK, ErrInvalidPacket},
+		{"OACK odd option count", []byte("\x00\x06blksize\x001428\x00tsize\x00"), OpOACK, ErrInvalidPacket},
+		{"OACK value without NUL", []byte("\x00\x06blksize\x001428"), OpOACK, ErrInvalidPacket},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := ParsePacket(tt.p)
+			if err == nil {
+				t.Fatalf("ParsePacket(%q) = %v, want an error", tt.p, pkt)
+			}
+
+			var pe *PacketError
+			if !errors.As(err, &pe) {
+				t.Fatalf("ParsePacket(%q) error %v is not a *PacketError", tt.p, err)
+			}
+
+			if pe.Op != tt.op || !errors.Is(err, tt.err) {
+				t.Errorf("ParsePacket(%q) = %v (op %d), want %v (op %d)", tt.p, err, pe.Op, tt.err, tt.op)
+			}
+		})
+	}
+}
+
+func TestRequestOddOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		p    string
+		want []Option
+	}{
+		{"trailing name", "\x00\x01f\x00octet\x00blksize\x00", nil},
+		{"trailing name without NUL", "\x00\x01f\x00octet\x00blksize", nil},
+		{"pair then trailing name", "\x00\x01f\x00octet\x00tsize\x000\x00blksize\x00", []Option{{"tsize", "0"}}},
+		{"value without NUL", "\x00\x01f\x00octet\x00tsize\x000", nil},
+		{"empty name ends options", "\x00\x01f\x00octet\x00\x00tsize\x000\x00", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rrq ReadReq
+			if err := rrq.UnmarshalBinary([]byte(tt.p)); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+
+			if rrq.Filename != "f" || rrq.Mode != "octet" || !reflect.DeepEqual(rrq.Options, tt.want) {
+				t.Errorf("UnmarshalBinary = %+v, want options %v", rrq, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalWrongOpcode(t *testing.T) {
+	b, _ := ack(1).MarshalBinary()
+
+	for _, pkt := range []Packet{new(ReadReq), new(WriteReq), new(Data), new(Err), new(OAck)} {
+		if err := pkt.UnmarshalBinary(b); !errors.Is(err, ErrInvalidPacket) {
+			t.Errorf("%T.UnmarshalBinary(ACK) = %v, want ErrInvalidPacket", pkt, err)
+		}
+	}
+}